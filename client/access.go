@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// AccessTokenHeader carries the access token a server issues after a
+	// payment; sending it back pays for later requests to the same routes
+	AccessTokenHeader     = "PAYMENT-ACCESS-TOKEN"
+	AccessRemainingHeader = "PAYMENT-ACCESS-REMAINING"
+	AccessStatusHeader    = "PAYMENT-ACCESS-STATUS"
+)
+
+// accessToken is a stored token and the route group it was issued for
+type accessToken struct {
+	value   string
+	group   string
+	expires time.Time
+}
+
+// accessTokenTransport stores the access tokens servers issue and replays
+// them, so one payment covers the requests the token is valid for. Tokens
+// are kept per server and route group; a path is tied to a group once a
+// token was issued or accepted on it. Paths not seen yet get the latest token
+// from the server, which is simply ignored if it is for another group.
+type accessTokenTransport struct {
+	base http.RoundTripper
+
+	mu     sync.Mutex
+	tokens map[string]accessToken // origin + group
+	paths  map[string]string      // origin + path → group
+	latest map[string]string      // origin → group
+}
+
+// newAccessTokenTransport wraps base with access token handling
+//
+// Args:
+//
+//	base: transport requests are sent with
+//
+// Returns:
+//
+//	*accessTokenTransport
+func newAccessTokenTransport(base http.RoundTripper) *accessTokenTransport {
+	return &accessTokenTransport{
+		base:   base,
+		tokens: make(map[string]accessToken),
+		paths:  make(map[string]string),
+		latest: make(map[string]string),
+	}
+}
+
+func (t *accessTokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	origin := req.URL.Scheme + "://" + req.URL.Host
+	path := origin + req.URL.Path
+
+	sent, ok := t.lookup(origin, path)
+	if ok && req.Header.Get(AccessTokenHeader) == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set(AccessTokenHeader, sent.value)
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case resp.Header.Get(AccessTokenHeader) != "":
+		token, ok := parseAccessToken(resp.Header.Get(AccessTokenHeader))
+		if ok {
+			t.tokens[origin+"\n"+token.group] = token
+			t.paths[path] = token.group
+			t.latest[origin] = token.group
+		}
+	case !ok:
+		// No token was sent
+	case resp.Header.Get(AccessStatusHeader) != "":
+		// Rejected: used up, expired or for another group. Forget the token
+		// only if this path belongs to its group.
+		if t.paths[path] == sent.group {
+			delete(t.tokens, origin+"\n"+sent.group)
+			delete(t.paths, path)
+		}
+	default:
+		t.paths[path] = sent.group
+		if resp.Header.Get(AccessRemainingHeader) == "0" {
+			delete(t.tokens, origin+"\n"+sent.group)
+		}
+	}
+	return resp, nil
+}
+
+// lookup finds the token to send to path
+func (t *accessTokenTransport) lookup(origin string, path string) (accessToken, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	group, ok := t.paths[path]
+	if !ok {
+		group = t.latest[origin]
+	}
+	token, ok := t.tokens[origin+"\n"+group]
+	if ok && time.Now().After(token.expires) {
+		delete(t.tokens, origin+"\n"+group)
+		return accessToken{}, false
+	}
+	return token, ok
+}
+
+// parseAccessToken reads the group and expiry of a token. The signature is
+// the server's to check.
+func parseAccessToken(value string) (accessToken, bool) {
+	var claims struct {
+		Group string `json:"grp"`
+		jwt.RegisteredClaims
+	}
+	if _, _, err := jwt.NewParser().ParseUnverified(value, &claims); err != nil || claims.ExpiresAt == nil {
+		return accessToken{}, false
+	}
+	return accessToken{value: value, group: claims.Group, expires: claims.ExpiresAt.Time}, true
+}
@@ -31,6 +31,13 @@ func createBuilderPatternClient(evmPrivateKey, svmPrivateKey string) (*x402.X402
 	// Register EVM scheme for all EVM networks
 	client.Register("eip155:*", evm.NewExactEvmScheme(evmSigner))
 
+	// Register the upto scheme so metered routes can be paid too
+	uptoScheme, err := NewUptoEvmScheme(evmPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	client.Register("eip155:*", uptoScheme)
+
 	// You can also register specific networks for fine-grained control
 	// For example, use a different signer for Ethereum mainnet:
 	// ethereumSigner := evmsigners.NewClientSignerFromPrivateKey(ethereumKey)
@@ -5,12 +5,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	x402 "github.com/coinbase/x402/go"
 	"github.com/joho/godotenv"
+	"go_code/x402/logging"
 )
 
 /**
@@ -22,16 +25,33 @@ import (
  *
  * - builder-pattern: Basic builder pattern with Register()
  * - mechanism-helper-registration: Using mechanism helpers for clean registration
+ * - native-payments: Pay in ETH / SOL instead of USDC
  *
  * Usage:
  *   go run . builder-pattern
  *   go run . mechanism-helper-registration
+ *   go run . native-payments
+ *
+ * Set REQUEST_COUNT to repeat the request; routes that issue access tokens
+ * are paid once and the token is replayed for the following requests.
  */
 
 func main() {
 	// Load .env file if it exists
-	if err := godotenv.Load(); err != nil {
-		fmt.Println("No .env file found, using environment variables")
+	envErr := godotenv.Load()
+	// Redact secrets from everything printed from here on
+	installErr := logging.Install()
+	defer logging.Close()
+	if _, err := logging.Setup("client"); err != nil {
+		fmt.Println(err)
+		logging.Exit(1)
+	}
+	if installErr != nil {
+		slog.Warn("output is not redacted", "error", installErr)
+	}
+	logging.WarnSecretsInSource()
+	if envErr != nil {
+		slog.Info("no .env file found, using environment variables")
 	}
 
 	pattern := "mechanism-helper-registration"
@@ -39,13 +59,12 @@ func main() {
 		pattern = os.Args[1]
 	}
 
-	fmt.Printf("\nRunning example: %s\n\n", pattern)
+	slog.Info("running example", "pattern", pattern)
 
 	// Get configuration
 	evmPrivateKey := os.Getenv("EVM_PRIVATE_KEY")
 	if evmPrivateKey == "" {
-		fmt.Println("❌ EVM_PRIVATE_KEY environment variable is required")
-		os.Exit(1)
+		logging.Fatal("EVM_PRIVATE_KEY environment variable is required")
 	}
 
 	svmPrivateKey := os.Getenv("SVM_PRIVATE_KEY")
@@ -64,29 +83,37 @@ func main() {
 		client, err = createBuilderPatternClient(evmPrivateKey, svmPrivateKey)
 	case "mechanism-helper-registration":
 		client, err = createMechanismHelperRegistrationClient(evmPrivateKey, svmPrivateKey)
+	case "native-payments":
+		client, err = createNativePaymentsClient(evmPrivateKey, svmPrivateKey)
 	default:
-		fmt.Printf("❌ Unknown pattern: %s\n", pattern)
-		fmt.Println("Available patterns: builder-pattern, mechanism-helper-registration")
-		os.Exit(1)
+		logging.Fatal("unknown pattern", "pattern", pattern,
+			"available", "builder-pattern, mechanism-helper-registration, native-payments")
 	}
 
 	if err != nil {
-		fmt.Printf("❌ Failed to create client: %v\n", err)
-		os.Exit(1)
+		logging.Fatal("failed to create client", "error", err)
 	}
 
-	// Make the request
-	if err := makeRequest(client, url); err != nil {
-		fmt.Printf("❌ Request failed: %v\n", err)
-		os.Exit(1)
+	// Repeat the request to see access tokens replayed instead of paying again
+	count := 1
+	if value := os.Getenv("REQUEST_COUNT"); value != "" {
+		if count, err = strconv.Atoi(value); err != nil || count < 1 {
+			logging.Fatal("invalid REQUEST_COUNT", "value", value)
+		}
 	}
-}
 
-// makeRequest performs an HTTP GET request with payment handling
-func makeRequest(client *x402.X402Client, url string) error {
+	// Make the requests
 	httpClient := wrapHTTPClient(client)
+	for i := 0; i < count; i++ {
+		if err := makeRequest(httpClient, url); err != nil {
+			logging.Fatal("request failed", "error", err)
+		}
+	}
+}
 
-	fmt.Printf("Making request to: %s\n\n", url)
+// makeRequest performs an HTTP GET request with payment handling
+func makeRequest(httpClient *http.Client, url string) error {
+	slog.Info("making request", "url", url)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
@@ -108,68 +135,27 @@ func makeRequest(client *x402.X402Client, url string) error {
 		return fmt.Errorf("failed to read response body: %w", err)
 	}
 
-	fmt.Printf("Response Status: %d %s\n", resp.StatusCode, resp.Status)
-	fmt.Printf("Response Body Length: %d bytes\n", len(bodyBytes))
-
-	// Check if response body is empty
-	if len(bodyBytes) == 0 {
-		fmt.Println("⚠️  Response body is empty")
-		// Extract payment response from headers if present
-		paymentHeader := resp.Header.Get("PAYMENT-RESPONSE")
-		if paymentHeader == "" {
-			paymentHeader = resp.Header.Get("X-PAYMENT-RESPONSE")
-		}
-
-		if paymentHeader != "" {
-			fmt.Println("\n💰 Payment Details:")
-			settleResp, err := extractPaymentResponse(resp.Header)
-			if err == nil {
-				fmt.Printf("  Transaction: %s\n", settleResp.Transaction)
-				fmt.Printf("  Network: %s\n", settleResp.Network)
-				fmt.Printf("  Payer: %s\n", settleResp.Payer)
-			} else {
-				fmt.Printf("  Payment Header: %s\n", paymentHeader[:min(100, len(paymentHeader))])
-			}
-		}
-		return nil
-	}
-
-	// Try to decode response body as JSON
-	var responseData interface{}
-	if err := json.Unmarshal(bodyBytes, &responseData); err != nil {
-		// If JSON decoding fails, print raw response
-		fmt.Printf("⚠️  Failed to decode as JSON, showing raw response:\n")
-		fmt.Printf("  %s\n", string(bodyBytes))
-		return fmt.Errorf("failed to decode response as JSON: %w", err)
+	// The server's request ID finds the request in its logs and the facilitator's
+	slog.Info("response", "status", resp.StatusCode, "bytes", len(bodyBytes),
+		"request_id", resp.Header.Get(logging.RequestIDHeader))
+	if resp.Header.Get(AccessTokenHeader) != "" {
+		slog.Info("access token issued, later requests will use it")
+	} else if remaining := resp.Header.Get(AccessRemainingHeader); remaining != "" {
+		slog.Info("paid with access token", "remaining", remaining)
 	}
 
-	fmt.Println("✅ Response body:")
-	prettyJSON, _ := json.MarshalIndent(responseData, "  ", "  ")
-	fmt.Printf("  %s\n", string(prettyJSON))
+	logPaymentResponse(resp.Header)
 
-	// Extract payment response from headers if present
-	paymentHeader := resp.Header.Get("PAYMENT-RESPONSE")
-	if paymentHeader == "" {
-		paymentHeader = resp.Header.Get("X-PAYMENT-RESPONSE")
+	if len(bodyBytes) == 0 {
+		slog.Warn("response body is empty")
+		return nil
 	}
 
-	if paymentHeader != "" {
-		fmt.Println("\n💰 Payment Details:")
-		settleResp, err := extractPaymentResponse(resp.Header)
-		if err == nil {
-			fmt.Printf("  Transaction: %s\n", settleResp.Transaction)
-			fmt.Printf("  Network: %s\n", settleResp.Network)
-			fmt.Printf("  Payer: %s\n", settleResp.Payer)
-		}
+	if !json.Valid(bodyBytes) {
+		slog.Warn("response is not JSON", "body", string(bodyBytes))
+		return fmt.Errorf("failed to decode response as JSON")
 	}
+	slog.Info("response body", "body", string(bodyBytes))
 
 	return nil
 }
-
-// min returns the minimum of two integers
-func min(a, b int) int {
-	if a < b {
-		return a
-	}
-	return b
-}
@@ -32,6 +32,13 @@ func createMechanismHelperRegistrationClient(evmPrivateKey, svmPrivateKey string
 	// This registers:
 	// - eip155:* (all EVM networks in v2)
 	client.Register("eip155:*", evm.NewExactEvmScheme(evmSigner))
+
+	// Register the upto scheme so metered routes can be paid too
+	uptoScheme, err := NewUptoEvmScheme(evmPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	client.Register("eip155:*", uptoScheme)
 	//v1 networks
 	client.Register("base-sepolia", evm.NewExactEvmScheme(evmSigner))
 	client.Register("base", evm.NewExactEvmScheme(evmSigner))
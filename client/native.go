@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/coinbase/x402/go/types"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	ethtypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+	solana "github.com/gagliardetto/solana-go"
+	"github.com/gagliardetto/solana-go/programs/system"
+	"github.com/gagliardetto/solana-go/rpc"
+)
+
+// SchemeNative pays in the network's native asset (ETH, SOL) instead of a token
+const SchemeNative = "native"
+
+// Default RPC endpoints by CAIP-2 network. EVM_RPC_URL and SVM_RPC_URL override them.
+var defaultNativeRPCs = map[string]string{
+	"eip155:8453":  "https://mainnet.base.org",
+	"eip155:84532": "https://sepolia.base.org",
+	"solana:5eykt4UsFv8P8NJdTREpY1vzqKqZKvdp": "https://api.mainnet-beta.solana.com",
+	"solana:EtWTRABZaYq6iMfeYKouRu166VU2xqa1": "https://api.devnet.solana.com",
+}
+
+// nativeRPCURL returns the RPC endpoint for a network
+func nativeRPCURL(network string, override string) (string, error) {
+	if url := os.Getenv(override); url != "" {
+		return url, nil
+	}
+	if url, ok := defaultNativeRPCs[network]; ok {
+		return url, nil
+	}
+	return "", fmt.Errorf("no RPC endpoint for %s, set %s", network, override)
+}
+
+// evmClients dials and caches one RPC client per EVM network
+type evmClients struct {
+	mu      sync.Mutex
+	clients map[string]*ethclient.Client
+}
+
+// get returns a connected client for network
+func (p *evmClients) get(network string) (*ethclient.Client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if client, ok := p.clients[network]; ok {
+		return client, nil
+	}
+	url, err := nativeRPCURL(network, "EVM_RPC_URL")
+	if err != nil {
+		return nil, err
+	}
+	client, err := ethclient.Dial(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to RPC: %w", err)
+	}
+	if p.clients == nil {
+		p.clients = make(map[string]*ethclient.Client)
+	}
+	p.clients[network] = client
+	return client, nil
+}
+
+// ============================================================================
+// EVM
+// ============================================================================
+
+// NativeEvmScheme pays native requirements with a signed ETH transfer. The
+// transaction is handed to the facilitator unbroadcast; the payer pays gas.
+type NativeEvmScheme struct {
+	privateKey *ecdsa.PrivateKey
+	address    common.Address
+	clients    evmClients
+}
+
+// NewNativeEvmScheme creates the client side of the native scheme on EVM
+//
+// Args:
+//
+//	privateKeyHex: Private key in hex format (with or without 0x prefix)
+//
+// Returns:
+//
+//	*NativeEvmScheme or error
+func NewNativeEvmScheme(privateKeyHex string) (*NativeEvmScheme, error) {
+	privateKey, err := crypto.HexToECDSA(strings.TrimPrefix(privateKeyHex, "0x"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	return &NativeEvmScheme{
+		privateKey: privateKey,
+		address:    crypto.PubkeyToAddress(privateKey.PublicKey),
+	}, nil
+}
+
+func (s *NativeEvmScheme) Scheme() string {
+	return SchemeNative
+}
+
+// CreatePaymentPayload signs a transfer of the required amount to payTo
+func (s *NativeEvmScheme) CreatePaymentPayload(ctx context.Context, requirements types.PaymentRequirements) (types.PaymentPayload, error) {
+	client, err := s.clients.get(requirements.Network)
+	if err != nil {
+		return types.PaymentPayload{}, err
+	}
+
+	if !common.IsHexAddress(requirements.PayTo) {
+		return types.PaymentPayload{}, fmt.Errorf("invalid payTo address %q", requirements.PayTo)
+	}
+	payTo := common.HexToAddress(requirements.PayTo)
+	amount, ok := new(big.Int).SetString(requirements.Amount, 10)
+	if !ok || amount.Sign() <= 0 {
+		return types.PaymentPayload{}, fmt.Errorf("invalid amount %q", requirements.Amount)
+	}
+
+	chainID, err := client.ChainID(ctx)
+	if err != nil {
+		return types.PaymentPayload{}, fmt.Errorf("failed to get chain ID: %w", err)
+	}
+	if "eip155:"+chainID.String() != requirements.Network {
+		return types.PaymentPayload{}, fmt.Errorf("RPC is on chain %s, requirements are for %s", chainID, requirements.Network)
+	}
+	nonce, err := client.PendingNonceAt(ctx, s.address)
+	if err != nil {
+		return types.PaymentPayload{}, fmt.Errorf("failed to get nonce: %w", err)
+	}
+	head, err := client.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return types.PaymentPayload{}, fmt.Errorf("failed to get latest block: %w", err)
+	}
+	tip, err := client.SuggestGasTipCap(ctx)
+	if err != nil {
+		return types.PaymentPayload{}, fmt.Errorf("failed to get gas tip: %w", err)
+	}
+	gas, err := client.EstimateGas(ctx, ethereum.CallMsg{From: s.address, To: &payTo, Value: amount})
+	if err != nil {
+		return types.PaymentPayload{}, fmt.Errorf("failed to estimate gas: %w", err)
+	}
+
+	// Leave room for the base fee to double before the facilitator broadcasts
+	feeCap := new(big.Int).Add(new(big.Int).Mul(head.BaseFee, big.NewInt(2)), tip)
+
+	tx, err := ethtypes.SignNewTx(s.privateKey, ethtypes.LatestSignerForChainID(chainID), &ethtypes.DynamicFeeTx{
+		ChainID:   chainID,
+		Nonce:     nonce,
+		GasTipCap: tip,
+		GasFeeCap: feeCap,
+		Gas:       gas,
+		To:        &payTo,
+		Value:     amount,
+	})
+	if err != nil {
+		return types.PaymentPayload{}, fmt.Errorf("failed to sign transaction: %w", err)
+	}
+	raw, err := tx.MarshalBinary()
+	if err != nil {
+		return types.PaymentPayload{}, err
+	}
+
+	return types.PaymentPayload{
+		X402Version: 2,
+		Payload: map[string]interface{}{
+			"transaction": hexutil.Encode(raw),
+		},
+	}, nil
+}
+
+// ============================================================================
+// SVM (Solana)
+// ============================================================================
+
+// NativeSvmScheme pays native requirements with a SOL transfer signed by the
+// payer, leaving the fee payer signature to the facilitator
+type NativeSvmScheme struct {
+	privateKey solana.PrivateKey
+}
+
+// NewNativeSvmScheme creates the client side of the native scheme on Solana
+//
+// Args:
+//
+//	privateKeyBase58: Private key in base58 format
+//
+// Returns:
+//
+//	*NativeSvmScheme or error
+func NewNativeSvmScheme(privateKeyBase58 string) (*NativeSvmScheme, error) {
+	privateKey, err := solana.PrivateKeyFromBase58(privateKeyBase58)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Solana private key: %w", err)
+	}
+	return &NativeSvmScheme{privateKey: privateKey}, nil
+}
+
+func (s *NativeSvmScheme) Scheme() string {
+	return SchemeNative
+}
+
+// CreatePaymentPayload builds and partially signs a transfer of the required
+// lamports to payTo with the facilitator's fee payer
+func (s *NativeSvmScheme) CreatePaymentPayload(ctx context.Context, requirements types.PaymentRequirements) (types.PaymentPayload, error) {
+	payTo, err := solana.PublicKeyFromBase58(requirements.PayTo)
+	if err != nil {
+		return types.PaymentPayload{}, fmt.Errorf("invalid payTo address %q: %w", requirements.PayTo, err)
+	}
+	feePayerValue, _ := requirements.Extra["feePayer"].(string)
+	feePayer, err := solana.PublicKeyFromBase58(feePayerValue)
+	if err != nil {
+		return types.PaymentPayload{}, fmt.Errorf("requirements carry no valid feePayer")
+	}
+	lamports, ok := new(big.Int).SetString(requirements.Amount, 10)
+	if !ok || lamports.Sign() <= 0 || !lamports.IsUint64() {
+		return types.PaymentPayload{}, fmt.Errorf("invalid amount %q", requirements.Amount)
+	}
+
+	url, err := nativeRPCURL(requirements.Network, "SVM_RPC_URL")
+	if err != nil {
+		return types.PaymentPayload{}, err
+	}
+	blockhash, err := rpc.New(url).GetLatestBlockhash(ctx, rpc.CommitmentFinalized)
+	if err != nil {
+		return types.PaymentPayload{}, fmt.Errorf("failed to get blockhash: %w", err)
+	}
+
+	tx, err := solana.NewTransaction(
+		[]solana.Instruction{
+			system.NewTransferInstruction(lamports.Uint64(), s.privateKey.PublicKey(), payTo).Build(),
+		},
+		blockhash.Value.Blockhash,
+		solana.TransactionPayer(feePayer),
+	)
+	if err != nil {
+		return types.PaymentPayload{}, fmt.Errorf("failed to build transaction: %w", err)
+	}
+
+	_, err = tx.PartialSign(func(key solana.PublicKey) *solana.PrivateKey {
+		if key.Equals(s.privateKey.PublicKey()) {
+			return &s.privateKey
+		}
+		return nil
+	})
+	if err != nil {
+		return types.PaymentPayload{}, fmt.Errorf("failed to sign transaction: %w", err)
+	}
+
+	encoded, err := tx.ToBase64()
+	if err != nil {
+		return types.PaymentPayload{}, err
+	}
+
+	return types.PaymentPayload{
+		X402Version: 2,
+		Payload: map[string]interface{}{
+			"transaction": encoded,
+		},
+	}, nil
+}
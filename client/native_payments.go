@@ -0,0 +1,39 @@
+package main
+
+import (
+	x402 "github.com/coinbase/x402/go"
+)
+
+/**
+ * Native Payments Client
+ *
+ * This demonstrates paying in the network's native asset instead of USDC,
+ * for agents that only hold ETH on Base or SOL. The server quotes its "$"
+ * prices in wei or lamports using a price oracle.
+ *
+ * On EVM the client signs a plain ETH transfer and pays its own gas. On
+ * Solana it signs a SOL transfer and the facilitator pays the fee.
+ */
+
+func createNativePaymentsClient(evmPrivateKey, svmPrivateKey string) (*x402.X402Client, error) {
+	evmScheme, err := NewNativeEvmScheme(evmPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	client := x402.Newx402Client()
+
+	// Pay native requirements on all EVM networks with ETH
+	client.Register("eip155:*", evmScheme)
+
+	// Register SOL payments if key is provided
+	if svmPrivateKey != "" {
+		svmScheme, err := NewNativeSvmScheme(svmPrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		client.Register("solana:*", svmScheme)
+	}
+
+	return client, nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/coinbase/x402/go/types"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+)
+
+// SchemeUpto authorizes a maximum price; the server settles what the request
+// actually cost
+const SchemeUpto = "upto"
+
+// defaultPermitValidity is used when requirements carry no maxTimeoutSeconds
+const defaultPermitValidity = 5 * time.Minute
+
+// Domain of the permit witness the facilitator checks next to an EIP-2612
+// permit, with the facilitator (the spender) as verifying contract
+const (
+	permitWitnessDomainName    = "x402 Permit Witness"
+	permitWitnessDomainVersion = "1"
+)
+
+var erc20NoncesParsed = func() abi.ABI {
+	parsed, err := abi.JSON(strings.NewReader(`[{"inputs":[{"name":"owner","type":"address"}],"name":"nonces","outputs":[{"name":"","type":"uint256"}],"stateMutability":"view","type":"function"}]`))
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}()
+
+// UptoEvmScheme pays upto requirements with an EIP-2612 permit for the
+// maximum amount, naming the facilitator as spender. The facilitator submits
+// the permit and transfers only what the server reports as used; the payer
+// needs no ETH. A second signature, the permit witness, binds the permit to
+// the requirements' payTo so nobody else can redirect it.
+type UptoEvmScheme struct {
+	privateKey *ecdsa.PrivateKey
+	address    common.Address
+	clients    evmClients
+}
+
+// NewUptoEvmScheme creates the client side of the upto scheme on EVM
+//
+// Args:
+//
+//	privateKeyHex: Private key in hex format (with or without 0x prefix)
+//
+// Returns:
+//
+//	*UptoEvmScheme or error
+func NewUptoEvmScheme(privateKeyHex string) (*UptoEvmScheme, error) {
+	privateKey, err := crypto.HexToECDSA(strings.TrimPrefix(privateKeyHex, "0x"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	return &UptoEvmScheme{
+		privateKey: privateKey,
+		address:    crypto.PubkeyToAddress(privateKey.PublicKey),
+	}, nil
+}
+
+func (s *UptoEvmScheme) Scheme() string {
+	return SchemeUpto
+}
+
+// CreatePaymentPayload signs a permit for the maximum amount
+func (s *UptoEvmScheme) CreatePaymentPayload(ctx context.Context, requirements types.PaymentRequirements) (types.PaymentPayload, error) {
+	spender, _ := requirements.Extra["spender"].(string)
+	if !common.IsHexAddress(spender) {
+		return types.PaymentPayload{}, fmt.Errorf("requirements carry no valid spender")
+	}
+	if !common.IsHexAddress(requirements.Asset) {
+		return types.PaymentPayload{}, fmt.Errorf("invalid asset address %q", requirements.Asset)
+	}
+	if !common.IsHexAddress(requirements.PayTo) {
+		return types.PaymentPayload{}, fmt.Errorf("invalid payTo address %q", requirements.PayTo)
+	}
+	token := common.HexToAddress(requirements.Asset)
+	value, ok := new(big.Int).SetString(requirements.Amount, 10)
+	if !ok || value.Sign() <= 0 {
+		return types.PaymentPayload{}, fmt.Errorf("invalid amount %q", requirements.Amount)
+	}
+	name, _ := requirements.Extra["name"].(string)
+	version, _ := requirements.Extra["version"].(string)
+
+	client, err := s.clients.get(requirements.Network)
+	if err != nil {
+		return types.PaymentPayload{}, err
+	}
+	chainID, err := client.ChainID(ctx)
+	if err != nil {
+		return types.PaymentPayload{}, fmt.Errorf("failed to get chain ID: %w", err)
+	}
+
+	data, err := erc20NoncesParsed.Pack("nonces", s.address)
+	if err != nil {
+		return types.PaymentPayload{}, err
+	}
+	result, err := client.CallContract(ctx, ethereum.CallMsg{To: &token, Data: data}, nil)
+	if err != nil {
+		return types.PaymentPayload{}, fmt.Errorf("failed to read permit nonce: %w", err)
+	}
+	unpacked, err := erc20NoncesParsed.Unpack("nonces", result)
+	if err != nil {
+		return types.PaymentPayload{}, fmt.Errorf("token does not support EIP-2612: %w", err)
+	}
+	nonce := unpacked[0].(*big.Int)
+
+	validity := defaultPermitValidity
+	if requirements.MaxTimeoutSeconds > 0 {
+		validity = time.Duration(requirements.MaxTimeoutSeconds) * time.Second
+	}
+	deadline := big.NewInt(time.Now().Add(validity).Unix())
+
+	message := apitypes.TypedDataMessage{
+		"owner":    s.address.Hex(),
+		"spender":  common.HexToAddress(spender).Hex(),
+		"value":    value.String(),
+		"nonce":    nonce.String(),
+		"deadline": deadline.String(),
+	}
+	digest, _, err := apitypes.TypedDataAndHash(apitypes.TypedData{
+		Types: apitypes.Types{
+			"EIP712Domain": {
+				{Name: "name", Type: "string"},
+				{Name: "version", Type: "string"},
+				{Name: "chainId", Type: "uint256"},
+				{Name: "verifyingContract", Type: "address"},
+			},
+			"Permit": {
+				{Name: "owner", Type: "address"},
+				{Name: "spender", Type: "address"},
+				{Name: "value", Type: "uint256"},
+				{Name: "nonce", Type: "uint256"},
+				{Name: "deadline", Type: "uint256"},
+			},
+		},
+		PrimaryType: "Permit",
+		Domain: apitypes.TypedDataDomain{
+			Name:              name,
+			Version:           version,
+			ChainId:           (*math.HexOrDecimal256)(chainID),
+			VerifyingContract: token.Hex(),
+		},
+		Message: message,
+	})
+	if err != nil {
+		return types.PaymentPayload{}, fmt.Errorf("failed to hash permit: %w", err)
+	}
+
+	signature, err := crypto.Sign(digest, s.privateKey)
+	if err != nil {
+		return types.PaymentPayload{}, fmt.Errorf("failed to sign permit: %w", err)
+	}
+	signature[64] += 27
+
+	witnessDigest, _, err := apitypes.TypedDataAndHash(apitypes.TypedData{
+		Types: apitypes.Types{
+			"EIP712Domain": {
+				{Name: "name", Type: "string"},
+				{Name: "version", Type: "string"},
+				{Name: "chainId", Type: "uint256"},
+				{Name: "verifyingContract", Type: "address"},
+			},
+			"PermitWitness": {
+				{Name: "token", Type: "address"},
+				{Name: "owner", Type: "address"},
+				{Name: "nonce", Type: "uint256"},
+				{Name: "deadline", Type: "uint256"},
+				{Name: "payTo", Type: "address"},
+			},
+		},
+		PrimaryType: "PermitWitness",
+		Domain: apitypes.TypedDataDomain{
+			Name:              permitWitnessDomainName,
+			Version:           permitWitnessDomainVersion,
+			ChainId:           (*math.HexOrDecimal256)(chainID),
+			VerifyingContract: common.HexToAddress(spender).Hex(),
+		},
+		Message: apitypes.TypedDataMessage{
+			"token":    token.Hex(),
+			"owner":    s.address.Hex(),
+			"nonce":    nonce.String(),
+			"deadline": deadline.String(),
+			"payTo":    common.HexToAddress(requirements.PayTo).Hex(),
+		},
+	})
+	if err != nil {
+		return types.PaymentPayload{}, fmt.Errorf("failed to hash permit witness: %w", err)
+	}
+
+	witnessSignature, err := crypto.Sign(witnessDigest, s.privateKey)
+	if err != nil {
+		return types.PaymentPayload{}, fmt.Errorf("failed to sign permit witness: %w", err)
+	}
+	witnessSignature[64] += 27
+
+	return types.PaymentPayload{
+		X402Version: 2,
+		Payload: map[string]interface{}{
+			"signature":        hexutil.Encode(signature),
+			"witnessSignature": hexutil.Encode(witnessSignature),
+			"permit":           map[string]interface{}(message),
+		},
+	}, nil
+}
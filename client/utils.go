@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/base64"
 	"encoding/json"
+	"log/slog"
 	"net/http"
 
 	x402 "github.com/coinbase/x402/go"
@@ -14,8 +15,10 @@ func wrapHTTPClient(x402Client *x402.X402Client) *http.Client {
 	// Create x402 HTTP client wrapper
 	httpClient := x402http.Newx402HTTPClient(x402Client)
 
-	// Wrap standard HTTP client with payment handling
-	return x402http.WrapHTTPClientWithPayment(http.DefaultClient, httpClient)
+	// Wrap an HTTP client that replays access tokens with payment handling,
+	// so requests covered by a token are not paid again
+	tokenClient := &http.Client{Transport: newAccessTokenTransport(http.DefaultTransport)}
+	return x402http.WrapHTTPClientWithPayment(tokenClient, httpClient)
 }
 
 // extractPaymentResponse extracts settlement details from response headers
@@ -45,3 +48,17 @@ func extractPaymentResponse(headers http.Header) (*x402.SettleResponse, error) {
 
 	return &settleResp, nil
 }
+
+// logPaymentResponse logs the settlement the server reported in the
+// PAYMENT-RESPONSE (v2) or X-PAYMENT-RESPONSE (v1) header, if any
+func logPaymentResponse(headers http.Header) {
+	settleResp, err := extractPaymentResponse(headers)
+	if err != nil {
+		slog.Warn("unreadable payment response header", "error", err)
+		return
+	}
+	if settleResp == nil {
+		return
+	}
+	slog.Info("payment settled", "tx", settleResp.Transaction, "network", settleResp.Network, "payer", settleResp.Payer)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// Admin Endpoints
+// ============================================================================
+
+// requireAdminToken returns middleware that only lets requests through that
+// carry token as a bearer token, compared in constant time. An empty token
+// disables the endpoints it guards.
+func requireAdminToken(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Admin API is disabled, set ADMIN_API_TOKEN"})
+			return
+		}
+		presented, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid admin token"})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRequireAdminToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	request := func(token string, header string) int {
+		r := gin.New()
+		r.POST("/deferred/flush", requireAdminToken(token), func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+		req := httptest.NewRequest(http.MethodPost, "/deferred/flush", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		header string
+		want   int
+	}{
+		{"valid token", "admin-secret", "Bearer admin-secret", http.StatusOK},
+		{"wrong token", "admin-secret", "Bearer guess", http.StatusUnauthorized},
+		{"no header", "admin-secret", "", http.StatusUnauthorized},
+		{"not a bearer token", "admin-secret", "admin-secret", http.StatusUnauthorized},
+		{"disabled", "", "Bearer ", http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		if got := request(tt.token, tt.header); got != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strconv"
+	"sync"
+)
+
+const (
+	// DefaultBatchParallelism bounds how many items of a batch are processed at once
+	DefaultBatchParallelism = 8
+
+	// MaxBatchSize is the largest number of items accepted in one batch request
+	MaxBatchSize = 100
+)
+
+// paymentRequest is a payload/requirements pair as accepted by /verify and /settle
+type paymentRequest struct {
+	PaymentPayload      json.RawMessage `json:"paymentPayload"`
+	PaymentRequirements json.RawMessage `json:"paymentRequirements"`
+}
+
+// batchRequest is the body of POST /verify/batch and POST /settle/batch
+type batchRequest struct {
+	Items []paymentRequest `json:"items"`
+}
+
+// batchItemResult is the outcome of one batch item. Result holds the same
+// JSON /verify or /settle would have returned for the item on success.
+type batchItemResult struct {
+	Index   int         `json:"index"`
+	Success bool        `json:"success"`
+	Result  interface{} `json:"result,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// batchResponse is returned by the batch endpoints, one result per item in
+// request order
+type batchResponse struct {
+	Results []batchItemResult `json:"results"`
+}
+
+// batchParallelism reads BATCH_PARALLELISM, falling back to the default
+func batchParallelism() int {
+	if value := os.Getenv("BATCH_PARALLELISM"); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			return n
+		}
+	}
+	return DefaultBatchParallelism
+}
+
+// runBatch processes items concurrently with at most parallelism in flight
+// and returns their results in request order
+//
+// Args:
+//
+//	ctx: request context shared by all items
+//	items: payload/requirements pairs
+//	parallelism: maximum number of items processed at once
+//	process: verifies or settles a single item
+//
+// Returns:
+//
+//	one batchItemResult per item
+func runBatch(
+	ctx context.Context,
+	items []paymentRequest,
+	parallelism int,
+	process func(ctx context.Context, item paymentRequest) (interface{}, error),
+) []batchItemResult {
+	results := make([]batchItemResult, len(items))
+	sem := make(chan struct{}, parallelism)
+
+	var wg sync.WaitGroup
+	for i, item := range items {
+		wg.Add(1)
+		go func(i int, item paymentRequest) {
+			defer wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				results[i] = batchItemResult{Index: i, Error: ctx.Err().Error()}
+				return
+			}
+
+			result, err := process(ctx, item)
+			if err != nil {
+				results[i] = batchItemResult{Index: i, Error: err.Error()}
+				return
+			}
+			results[i] = batchItemResult{Index: i, Success: true, Result: result}
+		}(i, item)
+	}
+	wg.Wait()
+
+	return results
+}
@@ -0,0 +1,866 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	x402 "github.com/coinbase/x402/go"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"go_code/x402/logging"
+)
+
+const (
+	DefaultDeferredQueueFile   = "deferred_settlements.json"
+	DefaultDeferredReportsFile = "deferred_batches.json"
+	DefaultDeferredInterval    = 5 * time.Minute
+	DefaultDeferredMaxBatch    = 50
+
+	// Multicall3 is deployed at the same address on every EVM chain it supports
+	Multicall3Address = "0xcA11bde05977b3631167028862bE2a173976CA11"
+
+	// deferredDeadlineMargin is how long before an authorization's validBefore
+	// its batch must be submitted
+	deferredDeadlineMargin = 2 * time.Minute
+
+	// deferredTick is how often the scheduler checks whether a batch is due
+	deferredTick = 15 * time.Second
+
+	// maxBatchReports is how many batch reports are kept
+	maxBatchReports = 100
+)
+
+const multicall3ABI = `[{"inputs":[{"components":[{"name":"target","type":"address"},{"name":"allowFailure","type":"bool"},{"name":"callData","type":"bytes"}],"name":"calls","type":"tuple[]"}],"name":"aggregate3","outputs":[{"components":[{"name":"success","type":"bool"},{"name":"returnData","type":"bytes"}],"name":"returnData","type":"tuple[]"}],"stateMutability":"payable","type":"function"}]`
+
+// eip3009ABI covers both transferWithAuthorization overloads: (v, r, s) for EOA
+// signatures and (bytes signature) for contract wallets. go-ethereum names
+// the second overload "transferWithAuthorization0".
+const eip3009ABI = `[
+{"inputs":[{"name":"from","type":"address"},{"name":"to","type":"address"},{"name":"value","type":"uint256"},{"name":"validAfter","type":"uint256"},{"name":"validBefore","type":"uint256"},{"name":"nonce","type":"bytes32"},{"name":"v","type":"uint8"},{"name":"r","type":"bytes32"},{"name":"s","type":"bytes32"}],"name":"transferWithAuthorization","outputs":[],"stateMutability":"nonpayable","type":"function"},
+{"inputs":[{"name":"from","type":"address"},{"name":"to","type":"address"},{"name":"value","type":"uint256"},{"name":"validAfter","type":"uint256"},{"name":"validBefore","type":"uint256"},{"name":"nonce","type":"bytes32"},{"name":"signature","type":"bytes"}],"name":"transferWithAuthorization","outputs":[],"stateMutability":"nonpayable","type":"function"},
+{"inputs":[{"name":"authorizer","type":"address"},{"name":"nonce","type":"bytes32"}],"name":"authorizationState","outputs":[{"name":"","type":"bool"}],"stateMutability":"view","type":"function"}
+]`
+
+var (
+	multicall3Parsed = mustParseABI(multicall3ABI)
+	eip3009Parsed    = mustParseABI(eip3009ABI)
+
+	// authorizationUsedTopic is keccak256("AuthorizationUsed(address,bytes32)")
+	authorizationUsedTopic = crypto.Keccak256Hash([]byte("AuthorizationUsed(address,bytes32)"))
+)
+
+// multicallCall is one call of a Multicall3 aggregate3 batch
+type multicallCall struct {
+	Target       common.Address
+	AllowFailure bool
+	CallData     []byte
+}
+
+// multicallResult is the outcome of one aggregate3 call
+type multicallResult struct {
+	Success    bool
+	ReturnData []byte
+}
+
+// ============================================================================
+// Deferred Authorization Queue
+// ============================================================================
+
+// deferredAuthorization is a verified EIP-3009 authorization waiting to be
+// settled in a batch
+type deferredAuthorization struct {
+	ID          string    `json:"id"`
+	Network     string    `json:"network"`
+	Asset       string    `json:"asset"`
+	From        string    `json:"from"`
+	To          string    `json:"to"`
+	Value       string    `json:"value"`
+	ValidAfter  string    `json:"validAfter"`
+	ValidBefore string    `json:"validBefore"`
+	Nonce       string    `json:"nonce"`
+	Signature   string    `json:"signature"`
+	QueuedAt    time.Time `json:"queuedAt"`
+	SubmittedTx string    `json:"submittedTx,omitempty"`
+	RequestID   string    `json:"requestId,omitempty"`
+}
+
+// deadline returns the time after which the authorization can no longer be used
+func (a deferredAuthorization) deadline() time.Time {
+	validBefore, ok := new(big.Int).SetString(a.ValidBefore, 10)
+	if !ok || !validBefore.IsInt64() {
+		return time.Time{}
+	}
+	return time.Unix(validBefore.Int64(), 0)
+}
+
+// key identifies the authorization on chain; a token accepts each
+// (authorizer, nonce) pair only once
+func (a deferredAuthorization) key() string {
+	return strings.ToLower(a.Asset + ":" + a.From + ":" + a.Nonce)
+}
+
+// deferredQueue is the persistent queue of authorizations awaiting settlement
+type deferredQueue struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]deferredAuthorization
+}
+
+// newDeferredQueue opens the queue at path, loading entries left by a previous run
+func newDeferredQueue(path string) (*deferredQueue, error) {
+	queue := &deferredQueue{
+		path:    path,
+		entries: make(map[string]deferredAuthorization),
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return queue, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read deferred queue: %w", err)
+	}
+	if len(data) == 0 {
+		return queue, nil
+	}
+
+	var entries []deferredAuthorization
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse deferred queue: %w", err)
+	}
+	for _, entry := range entries {
+		queue.entries[entry.ID] = entry
+	}
+
+	return queue, nil
+}
+
+var (
+	errAuthorizationQueued = errors.New("authorization already queued")
+	errQueuedOverBalance   = errors.New("queued payments would exceed the payer's balance")
+)
+
+// Add queues an authorization unless the same one is already queued or the
+// payer's queued payments of the asset, including this one, would exceed
+// balance. Queued authorizations are not yet on chain, so the balance check
+// done by verification does not account for them.
+func (q *deferredQueue) Add(entry deferredAuthorization, balance *big.Int) error {
+	value, ok := new(big.Int).SetString(entry.Value, 10)
+	if !ok {
+		return fmt.Errorf("invalid authorization value %q", entry.Value)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	total := new(big.Int).Set(value)
+	for _, existing := range q.entries {
+		if existing.key() == entry.key() {
+			return errAuthorizationQueued
+		}
+		if strings.EqualFold(existing.Asset, entry.Asset) && strings.EqualFold(existing.From, entry.From) {
+			if queued, ok := new(big.Int).SetString(existing.Value, 10); ok {
+				total.Add(total, queued)
+			}
+		}
+	}
+	if total.Cmp(balance) > 0 {
+		return errQueuedOverBalance
+	}
+
+	q.entries[entry.ID] = entry
+	return q.saveLocked()
+}
+
+// Update replaces queued entries with the given versions
+func (q *deferredQueue) Update(entries ...deferredAuthorization) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, entry := range entries {
+		if _, ok := q.entries[entry.ID]; ok {
+			q.entries[entry.ID] = entry
+		}
+	}
+	if err := q.saveLocked(); err != nil {
+		slog.Warn("failed to persist deferred queue", "error", err)
+	}
+}
+
+// Remove drops entries whose outcome is final
+func (q *deferredQueue) Remove(ids ...string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, id := range ids {
+		delete(q.entries, id)
+	}
+	if err := q.saveLocked(); err != nil {
+		slog.Warn("failed to persist deferred queue", "error", err)
+	}
+}
+
+// List returns the queued entries, earliest deadline first
+func (q *deferredQueue) List() []deferredAuthorization {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.sortedLocked()
+}
+
+// saveLocked persists the queue. Callers must hold q.mu.
+func (q *deferredQueue) saveLocked() error {
+	return writeJSONFile(q.path, q.sortedLocked())
+}
+
+// sortedLocked returns the entries ordered by deadline. Callers must hold q.mu.
+func (q *deferredQueue) sortedLocked() []deferredAuthorization {
+	entries := make([]deferredAuthorization, 0, len(q.entries))
+	for _, entry := range q.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].deadline().Before(entries[j].deadline())
+	})
+	return entries
+}
+
+// ============================================================================
+// Deferred Settler
+// ============================================================================
+
+// deferredSettleResponse is returned by /settle for payments that were
+// verified and queued instead of settled right away
+type deferredSettleResponse struct {
+	x402.SettleResponse
+	Queued   bool      `json:"queued"`
+	QueueID  string    `json:"queueId"`
+	SettleBy time.Time `json:"settleBy"`
+}
+
+// batchItemFailure explains why a queued authorization was not settled
+type batchItemFailure struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason"`
+}
+
+// batchReport summarizes one settlement batch
+type batchReport struct {
+	BatchID     string             `json:"batchId"`
+	Network     string             `json:"network"`
+	Transaction string             `json:"transaction,omitempty"`
+	Items       int                `json:"items"`
+	Settled     []string           `json:"settled"`
+	Failed      []batchItemFailure `json:"failed"`
+	Requeued    []string           `json:"requeued,omitempty"`
+	GasUsed     uint64             `json:"gasUsed,omitempty"`
+	Fee         string             `json:"fee,omitempty"`
+	StartedAt   time.Time          `json:"startedAt"`
+	FinishedAt  time.Time          `json:"finishedAt"`
+	Error       string             `json:"error,omitempty"`
+}
+
+// deferredSettler verifies EIP-3009 payments immediately but settles them
+// later, many at a time, through a single Multicall3 transaction
+type deferredSettler struct {
+	facilitator paymentProcessor
+	signer      *facilitatorEvmSigner
+	queue       *deferredQueue
+	webhook     *settlementWebhook
+	onSettled   func(ctx context.Context, result *x402.SettleResponse)
+	interval    time.Duration
+	maxBatch    int
+
+	reportsPath string
+	reportsMu   sync.Mutex
+	reports     []batchReport
+
+	// flushMu ensures only one batch is in flight at a time
+	flushMu sync.Mutex
+}
+
+// newDeferredSettler opens the persistent queue and batch report log
+//
+// Args:
+//
+//	facilitator: facilitator used to verify payments before queueing
+//	signer: EVM signer that submits the batches
+//	queuePath: JSON file holding queued authorizations
+//	reportsPath: JSON file holding recent batch reports
+//	interval: longest time an authorization waits before its batch is sent
+//	maxBatch: maximum number of authorizations per batch transaction
+//
+// Returns:
+//
+//	*deferredSettler or error
+func newDeferredSettler(
+	facilitator paymentProcessor,
+	signer *facilitatorEvmSigner,
+	queuePath string,
+	reportsPath string,
+	interval time.Duration,
+	maxBatch int,
+) (*deferredSettler, error) {
+	queue, err := newDeferredQueue(queuePath)
+	if err != nil {
+		return nil, err
+	}
+
+	reports, err := loadBatchReports(reportsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &deferredSettler{
+		facilitator: facilitator,
+		signer:      signer,
+		queue:       queue,
+		interval:    interval,
+		maxBatch:    maxBatch,
+		reportsPath: reportsPath,
+		reports:     reports,
+	}, nil
+}
+
+// loadBatchReports reads previously written batch reports, if any
+func loadBatchReports(path string) ([]batchReport, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) || len(data) == 0 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read batch reports: %w", err)
+	}
+
+	var reports []batchReport
+	if err := json.Unmarshal(data, &reports); err != nil {
+		return nil, fmt.Errorf("failed to parse batch reports: %w", err)
+	}
+	return reports, nil
+}
+
+// exactEvmPayload is the part of an exact EVM payment payload needed to
+// replay the authorization through transferWithAuthorization
+type exactEvmPayload struct {
+	Payload struct {
+		Signature     string `json:"signature"`
+		Authorization struct {
+			From        string `json:"from"`
+			To          string `json:"to"`
+			Value       string `json:"value"`
+			ValidAfter  string `json:"validAfter"`
+			ValidBefore string `json:"validBefore"`
+			Nonce       string `json:"nonce"`
+		} `json:"authorization"`
+	} `json:"payload"`
+}
+
+// Settle verifies the payment and queues it for batch settlement. It returns
+// ok=false when the payment is not an EIP-3009 authorization on the signer's
+// network, its signature is EIP-6492 wrapped (the wallet must be deployed
+// first), its deadline is too close to defer, or the payer's balance does not
+// cover it on top of their already queued payments; the caller then settles
+// it immediately.
+//
+// Args:
+//
+//	ctx: request context
+//	payload: raw payment payload
+//	requirements: raw payment requirements
+//
+// Returns:
+//
+//	response, whether the payment was deferred, and any verification error
+func (d *deferredSettler) Settle(
+	ctx context.Context,
+	payload json.RawMessage,
+	requirements json.RawMessage,
+) (*deferredSettleResponse, bool, error) {
+	fields, err := parseRequirementsFields(requirements)
+	if err != nil || fields.Scheme != "exact" || fields.Network != d.signer.network() {
+		return nil, false, nil
+	}
+
+	var evmPayload exactEvmPayload
+	if err := json.Unmarshal(payload, &evmPayload); err != nil {
+		return nil, false, nil
+	}
+	auth := evmPayload.Payload.Authorization
+	if evmPayload.Payload.Signature == "" || auth.From == "" || auth.Nonce == "" {
+		return nil, false, nil
+	}
+
+	// Counterfactual wallets are deployed by the settlement transaction
+	// itself, which a batched transferWithAuthorization call cannot do
+	signature, err := hexutil.Decode(evmPayload.Payload.Signature)
+	if err != nil {
+		return nil, false, nil
+	}
+	if _, wrapped, _ := parseERC6492Signature(signature); wrapped {
+		return nil, false, nil
+	}
+
+	entry := deferredAuthorization{
+		ID:          newRandomID(),
+		Network:     fields.Network,
+		Asset:       fields.Asset,
+		From:        auth.From,
+		To:          auth.To,
+		Value:       auth.Value,
+		ValidAfter:  auth.ValidAfter,
+		ValidBefore: auth.ValidBefore,
+		Nonce:       auth.Nonce,
+		Signature:   evmPayload.Payload.Signature,
+		QueuedAt:    time.Now().UTC(),
+		RequestID:   logging.RequestID(ctx),
+	}
+
+	// Authorizations expiring before the next scheduled batch are settled now
+	settleBy := entry.deadline().Add(-deferredDeadlineMargin)
+	if time.Until(settleBy) < deferredTick*2 {
+		return nil, false, nil
+	}
+
+	result, err := d.facilitator.Verify(ctx, payload, requirements)
+	if err != nil {
+		return nil, true, err
+	}
+
+	balance, err := d.signer.GetBalance(ctx, entry.From, entry.Asset)
+	if err != nil {
+		slog.WarnContext(ctx, "failed to read payer balance, settling immediately",
+			"payer", result.Payer, "error", err)
+		return nil, false, nil
+	}
+
+	if err := d.queue.Add(entry, balance); err != nil {
+		if !errors.Is(err, errAuthorizationQueued) {
+			slog.InfoContext(ctx, "payment not queued, settling immediately",
+				"payer", result.Payer, "reason", err)
+			return nil, false, nil
+		}
+		return nil, true, &x402.SettleError{
+			Reason:  "duplicate_authorization",
+			Payer:   result.Payer,
+			Network: x402.Network(fields.Network),
+			Err:     err,
+		}
+	}
+	slog.InfoContext(ctx, "payment queued for batch settlement",
+		"id", entry.ID, "payer", result.Payer, "settle_by", settleBy.Format(time.RFC3339))
+
+	return &deferredSettleResponse{
+		SettleResponse: x402.SettleResponse{
+			Success: true,
+			Payer:   result.Payer,
+			Network: x402.Network(fields.Network),
+		},
+		Queued:   true,
+		QueueID:  entry.ID,
+		SettleBy: settleBy,
+	}, true, nil
+}
+
+// Run flushes the queue whenever a batch is due, until ctx is cancelled.
+// A batch is due when the queue is full, its oldest entry has waited for the
+// batch interval, or an entry is approaching its validBefore deadline.
+func (d *deferredSettler) Run(ctx context.Context) {
+	ticker := time.NewTicker(deferredTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if d.batchDue(time.Now()) {
+			d.Flush(ctx)
+		}
+	}
+}
+
+// batchDue reports whether the queue should be flushed at now
+func (d *deferredSettler) batchDue(now time.Time) bool {
+	entries := d.queue.List()
+	if len(entries) == 0 {
+		return false
+	}
+	if len(entries) >= d.maxBatch {
+		return true
+	}
+
+	for _, entry := range entries {
+		if now.Sub(entry.QueuedAt) >= d.interval {
+			return true
+		}
+		if entry.deadline().Sub(now) <= deferredDeadlineMargin+deferredTick {
+			return true
+		}
+	}
+	return false
+}
+
+// Flush settles everything currently queued, in batches of at most maxBatch
+func (d *deferredSettler) Flush(ctx context.Context) {
+	d.flushMu.Lock()
+	defer d.flushMu.Unlock()
+
+	entries := d.queue.List()
+	for start := 0; start < len(entries); start += d.maxBatch {
+		end := start + d.maxBatch
+		if end > len(entries) {
+			end = len(entries)
+		}
+
+		report := d.settleBatch(ctx, entries[start:end])
+		d.addReport(report)
+		slog.InfoContext(ctx, "settled deferred batch", "batch", report.BatchID, "items", report.Items,
+			"settled", len(report.Settled), "failed", len(report.Failed), "requeued", len(report.Requeued), "tx", report.Transaction)
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// Reports returns the most recent batch reports, newest first
+func (d *deferredSettler) Reports() []batchReport {
+	d.reportsMu.Lock()
+	defer d.reportsMu.Unlock()
+
+	reports := make([]batchReport, len(d.reports))
+	for i, report := range d.reports {
+		reports[len(d.reports)-1-i] = report
+	}
+	return reports
+}
+
+// addReport records a batch report and persists the report log
+func (d *deferredSettler) addReport(report batchReport) {
+	d.reportsMu.Lock()
+	defer d.reportsMu.Unlock()
+
+	d.reports = append(d.reports, report)
+	if len(d.reports) > maxBatchReports {
+		d.reports = d.reports[len(d.reports)-maxBatchReports:]
+	}
+	if err := writeJSONFile(d.reportsPath, d.reports); err != nil {
+		slog.Warn("failed to persist batch reports", "error", err)
+	}
+}
+
+// settleBatch settles one batch of queued authorizations through Multicall3
+func (d *deferredSettler) settleBatch(ctx context.Context, entries []deferredAuthorization) (report batchReport) {
+	report = batchReport{
+		BatchID:   newRandomID(),
+		Network:   d.signer.network(),
+		Items:     len(entries),
+		Settled:   []string{},
+		Failed:    []batchItemFailure{},
+		StartedAt: time.Now().UTC(),
+	}
+	defer func() { report.FinishedAt = time.Now().UTC() }()
+
+	settled := make(map[string]string) // id -> transaction
+	failed := make(map[string]string)  // id -> reason
+	defer func() { d.finalize(entries, settled, failed, &report) }()
+
+	// Drop entries that can no longer be settled and build the calls for the rest
+	var batch []deferredAuthorization
+	var calls []multicallCall
+	for _, entry := range entries {
+		if time.Now().After(entry.deadline()) {
+			failed[entry.ID] = "authorization_expired"
+			continue
+		}
+
+		used, err := d.authorizationUsed(ctx, entry)
+		if err != nil {
+			report.Requeued = append(report.Requeued, entry.ID)
+			continue
+		}
+		if used {
+			// A previous batch that was interrupted before its receipt was
+			// seen may already have settled this authorization
+			if entry.SubmittedTx != "" {
+				settled[entry.ID] = entry.SubmittedTx
+			} else {
+				failed[entry.ID] = "authorization_already_used"
+			}
+			continue
+		}
+
+		// Don't resubmit while an earlier batch carrying it may still land
+		if entry.SubmittedTx != "" {
+			status, err := d.signer.TransactionStatus(ctx, entry.SubmittedTx)
+			if err != nil || status == txStatusPending {
+				report.Requeued = append(report.Requeued, entry.ID)
+				continue
+			}
+		}
+
+		callData, err := transferWithAuthorizationCall(entry)
+		if err != nil {
+			failed[entry.ID] = "invalid_authorization"
+			continue
+		}
+
+		batch = append(batch, entry)
+		calls = append(calls, multicallCall{
+			Target:       common.HexToAddress(entry.Asset),
+			AllowFailure: true,
+			CallData:     callData,
+		})
+	}
+	if len(calls) == 0 {
+		return report
+	}
+
+	// Simulate the batch and keep only the calls that would succeed
+	results, err := d.simulate(ctx, calls)
+	if err != nil {
+		report.Error = err.Error()
+		for _, entry := range batch {
+			report.Requeued = append(report.Requeued, entry.ID)
+		}
+		return report
+	}
+
+	var submitted []deferredAuthorization
+	var submittedCalls []multicallCall
+	for i, result := range results {
+		if !result.Success {
+			reason := "transfer_reverted"
+			if msg, err := abi.UnpackRevert(result.ReturnData); err == nil {
+				reason = msg
+			}
+			failed[batch[i].ID] = reason
+			continue
+		}
+		submitted = append(submitted, batch[i])
+		submittedCalls = append(submittedCalls, calls[i])
+	}
+	if len(submittedCalls) == 0 {
+		return report
+	}
+
+	data, err := multicall3Parsed.Pack("aggregate3", submittedCalls)
+	if err != nil {
+		report.Error = fmt.Sprintf("failed to pack batch: %v", err)
+		for _, entry := range submitted {
+			report.Requeued = append(report.Requeued, entry.ID)
+		}
+		return report
+	}
+
+	batchCtx := withPendingPayment(ctx, pendingPayment{Kind: pendingKindBatch})
+	txHash, err := d.signer.sendWithEstimatedGas(batchCtx, common.HexToAddress(Multicall3Address), data)
+	if err != nil {
+		report.Error = err.Error()
+		for _, entry := range submitted {
+			report.Requeued = append(report.Requeued, entry.ID)
+		}
+		return report
+	}
+	report.Transaction = txHash
+
+	// Remember the transaction so a restart can tell these were submitted
+	for i := range submitted {
+		submitted[i].SubmittedTx = txHash
+	}
+	d.queue.Update(submitted...)
+
+	waitCtx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+	receipt, err := d.signer.waitForReceipt(waitCtx, txHash)
+	if err != nil {
+		report.Error = err.Error()
+		for _, entry := range submitted {
+			report.Requeued = append(report.Requeued, entry.ID)
+		}
+		return report
+	}
+
+	report.GasUsed = receipt.GasUsed
+	if receipt.EffectiveGasPrice != nil {
+		report.Fee = new(big.Int).Mul(receipt.EffectiveGasPrice, new(big.Int).SetUint64(receipt.GasUsed)).String()
+	}
+
+	// Each successful transfer emits AuthorizationUsed(authorizer, nonce)
+	used := make(map[string]bool)
+	for _, l := range receipt.Logs {
+		if len(l.Topics) == 3 && l.Topics[0] == authorizationUsedTopic {
+			authorizer := common.BytesToAddress(l.Topics[1].Bytes())
+			used[strings.ToLower(l.Address.Hex()+":"+authorizer.Hex()+":"+l.Topics[2].Hex())] = true
+		}
+	}
+	for _, entry := range submitted {
+		if used[authorizationLogKey(entry)] {
+			settled[entry.ID] = txHash
+		} else if receipt.Status == 0 {
+			report.Requeued = append(report.Requeued, entry.ID)
+		} else {
+			failed[entry.ID] = "transfer_failed"
+		}
+	}
+
+	return report
+}
+
+// finalize applies the outcome of a batch to the queue, reports each item to
+// the settlement hook and webhook under the ID of the request that queued it,
+// and fills in the report
+func (d *deferredSettler) finalize(
+	entries []deferredAuthorization,
+	settled map[string]string,
+	failed map[string]string,
+	report *batchReport,
+) {
+	var done []string
+	for _, entry := range entries {
+		ctx := logging.WithRequestID(context.Background(), entry.RequestID)
+		result := &x402.SettleResponse{
+			Payer:   entry.From,
+			Network: x402.Network(entry.Network),
+		}
+
+		if tx, ok := settled[entry.ID]; ok {
+			result.Success = true
+			result.Transaction = tx
+			report.Settled = append(report.Settled, entry.ID)
+			slog.InfoContext(ctx, "deferred payment settled", "id", entry.ID, "batch", report.BatchID, "tx", tx)
+			if d.onSettled != nil {
+				d.onSettled(ctx, result)
+			}
+		} else if reason, ok := failed[entry.ID]; ok {
+			result.ErrorReason = reason
+			result.Transaction = entry.SubmittedTx
+			report.Failed = append(report.Failed, batchItemFailure{ID: entry.ID, Reason: reason})
+			slog.WarnContext(ctx, "deferred payment failed", "id", entry.ID, "batch", report.BatchID, "reason", reason)
+		} else {
+			continue
+		}
+
+		done = append(done, entry.ID)
+		d.webhook.NotifyAsync(ctx, result, false)
+	}
+
+	d.queue.Remove(done...)
+}
+
+// authorizationUsed asks the token whether the authorization was already consumed
+func (d *deferredSettler) authorizationUsed(ctx context.Context, entry deferredAuthorization) (bool, error) {
+	result, err := d.signer.ReadContract(ctx, entry.Asset, []byte(eip3009ABI), "authorizationState",
+		common.HexToAddress(entry.From), common.HexToHash(entry.Nonce))
+	if err != nil {
+		return false, err
+	}
+	used, ok := result.(bool)
+	if !ok {
+		return false, fmt.Errorf("unexpected authorizationState result: %T", result)
+	}
+	return used, nil
+}
+
+// simulate runs aggregate3 through eth_call and returns the per-call results
+func (d *deferredSettler) simulate(ctx context.Context, calls []multicallCall) ([]multicallResult, error) {
+	data, err := multicall3Parsed.Pack("aggregate3", calls)
+	if err != nil {
+		return nil, fmt.Errorf("failed to pack batch: %w", err)
+	}
+
+	to := common.HexToAddress(Multicall3Address)
+	output, err := d.signer.client.CallContract(ctx, ethereum.CallMsg{
+		From: d.signer.address,
+		To:   &to,
+		Data: data,
+	}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("batch simulation failed: %s", revertReason(err))
+	}
+
+	unpacked, err := multicall3Parsed.Methods["aggregate3"].Outputs.Unpack(output)
+	if err != nil || len(unpacked) == 0 {
+		return nil, fmt.Errorf("failed to unpack batch results: %v", err)
+	}
+	results := *abi.ConvertType(unpacked[0], new([]multicallResult)).(*[]multicallResult)
+	if len(results) != len(calls) {
+		return nil, fmt.Errorf("batch returned %d results for %d calls", len(results), len(calls))
+	}
+	return results, nil
+}
+
+// transferWithAuthorizationCall encodes the token call that settles a queued
+// authorization, using the (v, r, s) overload for 65-byte ECDSA signatures
+// and the bytes overload for anything else
+func transferWithAuthorizationCall(entry deferredAuthorization) ([]byte, error) {
+	value, ok1 := new(big.Int).SetString(entry.Value, 10)
+	validAfter, ok2 := new(big.Int).SetString(entry.ValidAfter, 10)
+	validBefore, ok3 := new(big.Int).SetString(entry.ValidBefore, 10)
+	if !ok1 || !ok2 || !ok3 {
+		return nil, fmt.Errorf("invalid authorization amounts")
+	}
+
+	signature, err := hexutil.Decode(entry.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %w", err)
+	}
+
+	from := common.HexToAddress(entry.From)
+	to := common.HexToAddress(entry.To)
+	nonce := common.HexToHash(entry.Nonce)
+
+	if len(signature) != 65 {
+		return eip3009Parsed.Pack("transferWithAuthorization0",
+			from, to, value, validAfter, validBefore, nonce, signature)
+	}
+
+	v := signature[64]
+	if v < 27 {
+		v += 27
+	}
+	var r, s [32]byte
+	copy(r[:], signature[:32])
+	copy(s[:], signature[32:64])
+
+	return eip3009Parsed.Pack("transferWithAuthorization",
+		from, to, value, validAfter, validBefore, nonce, v, r, s)
+}
+
+// authorizationLogKey matches a queued entry against AuthorizationUsed logs
+func authorizationLogKey(entry deferredAuthorization) string {
+	return strings.ToLower(common.HexToAddress(entry.Asset).Hex() + ":" +
+		common.HexToAddress(entry.From).Hex() + ":" + common.HexToHash(entry.Nonce).Hex())
+}
+
+// newRandomID returns a random identifier for queue entries and batches
+func newRandomID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// mustParseABI parses a constant ABI definition
+func mustParseABI(definition string) abi.ABI {
+	parsed, err := abi.JSON(strings.NewReader(definition))
+	if err != nil {
+		panic(fmt.Sprintf("invalid ABI: %v", err))
+	}
+	return parsed
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	x402 "github.com/coinbase/x402/go"
+	evmmech "github.com/coinbase/x402/go/mechanisms/evm"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+)
+
+var (
+	// testTokenCode is a minimal EIP-3009 and EIP-2612 token. An account's
+	// balance is stored in the slot named by its address and its permit
+	// nonce at address + 2^160; allowances and used authorizations are
+	// stored at keccak256(owner, spender) and keccak256(authorizer, nonce);
+	// DOMAIN_SEPARATOR() is slot 1. Signatures are not checked, the
+	// facilitator verifies them before anything reaches the token. The bytes
+	// overload of transferWithAuthorization reverts unless from has code.
+	testTokenCode = common.FromHex(
+		"0x5f3560e01c806370a082311461006b578063dd62ed3e146100745780637ecebe00146100895780633644e51514" +
+			"6100a9578063e94a0102146100b1578063e3ee160e146100ec578063cf092995146100c6578063d505accf146101" +
+			"9d57806323b872dd146101d3575f5ffd5b60043554610264565b6004355f5260243560205260405f205461026456" +
+			"5b600435740100000000000000000000000000000000000000000154610264565b600154610264565b6004355f52" +
+			"60243560205260405f2054610264565b6004353b6100ec5760137277616c6c6574206e6f74206465706c6f796564" +
+			"60681b61026b565b6004355f5260a43560205260405f2080541561012257601574617574686f72697a6174696f6e" +
+			"206973207573656460581b61026b565b60019055600435546044358082101561015f57601f7e7472616e73666572" +
+			"20616d6f756e7420657863656564732062616c616e636560081b61026b565b900360043555602435546044350160" +
+			"24355560a4356004357f98de503528ee59b575ef0c0a2576a82497bfc029a5685b209e9ec333479b10a55f5fa300" +
+			"5b6044356004355f5260243560205260405f20556004357401000000000000000000000000000000000000000001" +
+			"80546001019055005b336020526004355f5260405f2080546044358082101561020e57601675696e737566666963" +
+			"69656e7420616c6c6f77616e636560501b61026b565b90039055600435546044358082101561024b57601f7e7472" +
+			"616e7366657220616d6f756e7420657863656564732062616c616e636560081b61026b565b900360043555602435" +
+			"5460443501602435556001610264565b5f5260205ff35b60445260245260206004526308c379a060e01b5f526064" +
+			"5ffd",
+	)
+
+	// testPermit2Code implements DOMAIN_SEPARATOR() (slot 1), nonceBitmap and
+	// permitWitnessTransferFrom, which checks the requested amount and the
+	// nonce bit and pulls the tokens with transferFrom. Deadlines and
+	// signatures are not checked.
+	testPermit2Code = common.FromHex(
+		"0x5f3560e01c80633644e515146100295780634fe02b4414610031578063137c29fe14610046575f5ffd5b600154" +
+			"6100df565b6004355f5260243560205260405f20546100df565b60243560a435111561006a57600d6c496e76616c" +
+			"6964416d6f756e7460981b6100e6565b60c4355f5260443560081c60205260405f208054600160443560ff161b80" +
+			"8216156100a657600c6b496e76616c69644e6f6e636560a01b6100e6565b1790556323b872dd60e01b5f5260c435" +
+			"60045260843560245260a43560445260205f60645f5f6004355af16100dd573d5f5f3e3d5ffd5b005b5f5260205f" +
+			"f35b60445260245260206004526308c379a060e01b5f5260645ffd",
+	)
+
+	// testMulticall3Code treats every call as aggregate3 with allowFailure
+	// set, returning each call's success and return data
+	testMulticall3Code = common.FromHex(
+		"0x60205f5260243560205260243560051b6040015f5b602435811461008d57604082038160051b60400152806005" +
+			"1b60440135604401806040013581018035808260200186606001375f5f82876060015f87355af185525050506040" +
+			"82602001523d82604001523d5f836060013e5f3d830160600152601f3d0160051c60051b60600182019150600101" +
+			"610014565b505ff3",
+	)
+
+	testToken = common.HexToAddress("0x00000000000000000000000000000000000070c3")
+	testPayTo = common.HexToAddress("0x209693Bc6afc0C5328bA36FaF03C514EF312287C")
+
+	// testTokenDomain is the domain testToken answers DOMAIN_SEPARATOR() for
+	testTokenDomain = tokenDomain{
+		name: "Test Token",
+		payload: evmmech.TypedDataDomain{
+			Name: "Test Token", Version: "1", ChainID: testSimulatedChainID,
+			VerifyingContract: testToken.Hex(),
+		},
+		domainType: standardDomainType,
+		domainValues: [][]byte{
+			encodeString("Test Token"), encodeString("1"), encodeUint(testSimulatedChainID.Int64()),
+			encodeAddress(testToken.Hex()),
+		},
+	}
+
+	// testPermit2Domain is the domain of the canonical Permit2 deployment
+	testPermit2Domain = tokenDomain{
+		name:       "Permit2",
+		domainType: "EIP712Domain(string name,uint256 chainId,address verifyingContract)",
+		domainValues: [][]byte{
+			encodeString("Permit2"), encodeUint(testSimulatedChainID.Int64()), encodeAddress(Permit2Address),
+		},
+	}
+)
+
+// testTokenAlloc returns the genesis accounts of testToken with balances,
+// Permit2 and Multicall3
+func testTokenAlloc(balances map[common.Address]*big.Int) types.GenesisAlloc {
+	domainSlot := common.BigToHash(big.NewInt(1))
+	storage := map[common.Hash]common.Hash{
+		domainSlot: common.BytesToHash(testTokenDomain.separator()),
+	}
+	for holder, balance := range balances {
+		storage[common.BytesToHash(holder.Bytes())] = common.BigToHash(balance)
+	}
+
+	return types.GenesisAlloc{
+		testToken: {Code: testTokenCode, Storage: storage, Nonce: 1},
+		common.HexToAddress(Permit2Address): {
+			Code:    testPermit2Code,
+			Storage: map[common.Hash]common.Hash{domainSlot: common.BytesToHash(testPermit2Domain.separator())},
+			Nonce:   1,
+		},
+		common.HexToAddress(Multicall3Address): {Code: testMulticall3Code, Nonce: 1},
+	}
+}
+
+// tokenBalance reads the testToken balance of holder
+func tokenBalance(t *testing.T, signer *facilitatorEvmSigner, holder common.Address) *big.Int {
+	t.Helper()
+
+	balance, err := signer.GetBalance(context.Background(), holder.Hex(), testToken.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return balance
+}
+
+// mineBlocks commits a block every 100ms until the test ends, for code that
+// waits for a receipt
+func mineBlocks(t *testing.T, backend *simulated.Backend) {
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	go func() {
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				backend.Commit()
+			}
+		}
+	}()
+}
+
+// payerProcessor verifies every payment for the payer named in its
+// authorization and never settles, standing in for the SDK facilitator
+type payerProcessor struct{}
+
+func (payerProcessor) Verify(ctx context.Context, payload []byte, requirements []byte) (*x402.VerifyResponse, error) {
+	var evmPayload exactEvmPayload
+	if err := json.Unmarshal(payload, &evmPayload); err != nil {
+		return nil, err
+	}
+	return &x402.VerifyResponse{IsValid: true, Payer: evmPayload.Payload.Authorization.From}, nil
+}
+
+func (payerProcessor) Settle(ctx context.Context, payload []byte, requirements []byte) (*x402.SettleResponse, error) {
+	return nil, errors.New("immediate settlement")
+}
+
+// deferredRequest builds an exact EIP-3009 payment of value testToken from
+// payer, valid for an hour
+func deferredRequest(t *testing.T, from common.Address, value int64, nonce string, signature []byte) ([]byte, []byte) {
+	t.Helper()
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"x402Version": 2,
+		"payload": map[string]interface{}{
+			"signature": hexutil.Encode(signature),
+			"authorization": map[string]string{
+				"from":        from.Hex(),
+				"to":          testPayTo.Hex(),
+				"value":       big.NewInt(value).String(),
+				"validAfter":  "0",
+				"validBefore": big.NewInt(time.Now().Add(time.Hour).Unix()).String(),
+				"nonce":       crypto.Keccak256Hash([]byte(nonce)).Hex(),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	requirements, err := json.Marshal(map[string]interface{}{
+		"scheme":  "exact",
+		"network": "eip155:1337",
+		"asset":   testToken.Hex(),
+		"amount":  big.NewInt(value).String(),
+		"payTo":   testPayTo.Hex(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload, requirements
+}
+
+// newTestDeferredSettler returns a settler on a chain where each payer holds
+// the given testToken balance
+func newTestDeferredSettler(t *testing.T, balances map[common.Address]*big.Int) (*deferredSettler, *simulated.Backend) {
+	t.Helper()
+
+	signer, backend := newTestChain(t, testTokenAlloc(balances))
+	dir := t.TempDir()
+	settler, err := newDeferredSettler(payerProcessor{}, signer,
+		filepath.Join(dir, "queue.json"), filepath.Join(dir, "batches.json"), time.Minute, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return settler, backend
+}
+
+func TestDeferredQueueDedupAndBalance(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.json")
+	queue, err := newDeferredQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry := deferredAuthorization{
+		ID: "a", Asset: testToken.Hex(), From: testPayTo.Hex(), Value: "600",
+		ValidBefore: "4102444800", Nonce: "0x01",
+	}
+	if err := queue.Add(entry, big.NewInt(1000)); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+
+	// The same authorization under another ID, with the address in another case
+	duplicate := entry
+	duplicate.ID = "b"
+	duplicate.From = strings.ToLower(testPayTo.Hex())
+	if err := queue.Add(duplicate, big.NewInt(1000)); !errors.Is(err, errAuthorizationQueued) {
+		t.Fatalf("duplicate Add() error = %v, want errAuthorizationQueued", err)
+	}
+
+	// 600 is already queued for the payer: another 600 exceeds the balance
+	second := entry
+	second.ID, second.Nonce = "c", "0x02"
+	if err := queue.Add(second, big.NewInt(1000)); !errors.Is(err, errQueuedOverBalance) {
+		t.Fatalf("over-balance Add() error = %v, want errQueuedOverBalance", err)
+	}
+	second.Value = "400"
+	if err := queue.Add(second, big.NewInt(1000)); err != nil {
+		t.Fatalf("Add() within balance error = %v", err)
+	}
+
+	// Another payer's queued payments don't count
+	other := entry
+	other.ID, other.From = "d", testRejectingWallet.Hex()
+	if err := queue.Add(other, big.NewInt(600)); err != nil {
+		t.Fatalf("other payer Add() error = %v", err)
+	}
+
+	reopened, err := newDeferredQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reopened.List(); len(got) != 3 {
+		t.Fatalf("reopened queue has %d entries, want 3", len(got))
+	}
+}
+
+func TestDeferredSettleQueues(t *testing.T) {
+	payer := common.HexToAddress("0x0000000000000000000000000000000000000bee")
+	settler, _ := newTestDeferredSettler(t, map[common.Address]*big.Int{payer: big.NewInt(1000)})
+	ctx := context.Background()
+	signature := make([]byte, 65)
+
+	payload, requirements := deferredRequest(t, payer, 600, "first", signature)
+	response, deferred, err := settler.Settle(ctx, payload, requirements)
+	if err != nil || !deferred || !response.Queued || response.Payer != payer.Hex() {
+		t.Fatalf("Settle() = %+v, %v, %v; want queued", response, deferred, err)
+	}
+
+	// Replaying the same authorization is refused
+	if _, deferred, err := settler.Settle(ctx, payload, requirements); !deferred || err == nil {
+		t.Fatalf("duplicate Settle() deferred=%v err=%v, want a duplicate_authorization error", deferred, err)
+	}
+
+	// The balance covers 600 queued, not another 600: settle it now
+	payload, requirements = deferredRequest(t, payer, 600, "second", signature)
+	if _, deferred, err := settler.Settle(ctx, payload, requirements); deferred || err != nil {
+		t.Fatalf("over-balance Settle() deferred=%v err=%v, want immediate settlement", deferred, err)
+	}
+
+	// Counterfactual wallets are deployed by the settlement itself
+	wrapped := wrapERC6492(t, testFactory, []byte{0x01}, signature)
+	payload, requirements = deferredRequest(t, testCounterfactual, 1, "wrapped", wrapped)
+	if _, deferred, err := settler.Settle(ctx, payload, requirements); deferred || err != nil {
+		t.Fatalf("EIP-6492 Settle() deferred=%v err=%v, want immediate settlement", deferred, err)
+	}
+
+	if entries := settler.queue.List(); len(entries) != 1 {
+		t.Fatalf("queue has %d entries, want 1", len(entries))
+	}
+}
+
+func TestDeferredBatchWithRevertingEntry(t *testing.T) {
+	payer := common.HexToAddress("0x0000000000000000000000000000000000000bee")
+	poorPayer := common.HexToAddress("0x0000000000000000000000000000000000000bef")
+	settler, backend := newTestDeferredSettler(t, map[common.Address]*big.Int{
+		payer:     big.NewInt(1000),
+		poorPayer: big.NewInt(100),
+	})
+	mineBlocks(t, backend)
+	ctx := context.Background()
+
+	var settled []string
+	settler.onSettled = func(ctx context.Context, result *x402.SettleResponse) {
+		settled = append(settled, result.Payer)
+	}
+
+	payload, requirements := deferredRequest(t, payer, 600, "paid", make([]byte, 65))
+	if _, deferred, err := settler.Settle(ctx, payload, requirements); !deferred || err != nil {
+		t.Fatalf("Settle() deferred=%v err=%v, want queued", deferred, err)
+	}
+	payload, requirements = deferredRequest(t, poorPayer, 100, "spent", make([]byte, 65))
+	if _, deferred, err := settler.Settle(ctx, payload, requirements); !deferred || err != nil {
+		t.Fatalf("Settle() deferred=%v err=%v, want queued", deferred, err)
+	}
+
+	// The poor payer spends their balance before the batch is sent
+	spend, err := eip3009Parsed.Pack("transferWithAuthorization", poorPayer, payer, big.NewInt(100),
+		big.NewInt(0), big.NewInt(time.Now().Add(time.Hour).Unix()), crypto.Keccak256Hash([]byte("elsewhere")),
+		uint8(27), [32]byte{}, [32]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := settler.signer.sendWithEstimatedGas(ctx, testToken, spend); err != nil {
+		t.Fatal(err)
+	}
+	backend.Commit()
+
+	settler.Flush(ctx)
+
+	reports := settler.Reports()
+	if len(reports) != 1 {
+		t.Fatalf("%d batch reports, want 1", len(reports))
+	}
+	report := reports[0]
+	if report.Transaction == "" || len(report.Settled) != 1 || len(report.Failed) != 1 {
+		t.Fatalf("report = %+v, want one settled and one failed item", report)
+	}
+	if reason := report.Failed[0].Reason; reason != "transfer amount exceeds balance" {
+		t.Fatalf("failure reason = %q, want the token's revert reason", reason)
+	}
+	if len(settled) != 1 || settled[0] != payer.Hex() {
+		t.Fatalf("settled payers = %v, want only %s", settled, payer.Hex())
+	}
+	if entries := settler.queue.List(); len(entries) != 0 {
+		t.Fatalf("queue has %d entries after the batch, want 0", len(entries))
+	}
+
+	if balance := tokenBalance(t, settler.signer, testPayTo); balance.Cmp(big.NewInt(600)) != 0 {
+		t.Fatalf("payTo balance = %s, want 600", balance)
+	}
+}
@@ -0,0 +1,554 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strings"
+
+	evmmech "github.com/coinbase/x402/go/mechanisms/evm"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+	"github.com/holiman/uint256"
+)
+
+// ============================================================================
+// EIP-712 Domains
+// ============================================================================
+
+// EIP-5267 field bits, in canonical EIP712Domain order
+const (
+	domainFieldName              = 0x01
+	domainFieldVersion           = 0x02
+	domainFieldChainID           = 0x04
+	domainFieldVerifyingContract = 0x08
+	domainFieldSalt              = 0x10
+)
+
+const eip5267ABI = `[{"inputs":[],"name":"eip712Domain","outputs":[{"name":"fields","type":"bytes1"},{"name":"name","type":"string"},{"name":"version","type":"string"},{"name":"chainId","type":"uint256"},{"name":"verifyingContract","type":"address"},{"name":"salt","type":"bytes32"},{"name":"extensions","type":"uint256[]"}],"stateMutability":"view","type":"function"}]`
+
+const domainSeparatorABI = `[{"inputs":[],"name":"DOMAIN_SEPARATOR","outputs":[{"name":"","type":"bytes32"}],"stateMutability":"view","type":"function"}]`
+
+var (
+	eip5267Parsed         = mustParseABI(eip5267ABI)
+	domainSeparatorParsed = mustParseABI(domainSeparatorABI)
+)
+
+// maxSafeFloat is the largest integer a float64 holds exactly (2^53)
+const maxSafeFloat = 1 << 53
+
+// onchainDomain is a domain reported by a token's eip712Domain() (EIP-5267).
+// A nil *onchainDomain in the cache means the token does not implement it.
+type onchainDomain struct {
+	domain apitypes.TypedDataDomain
+	fields []apitypes.Type
+}
+
+// parseTypedDataDomain converts the domain from a payment payload into an
+// apitypes domain. Only fields the payload actually provides are set, so
+// partial domains (no version, no chainId, ...) hash correctly. A salt is
+// picked up when the domain type carries one.
+func parseTypedDataDomain(domain evmmech.TypedDataDomain) (apitypes.TypedDataDomain, error) {
+	var result apitypes.TypedDataDomain
+
+	// Go through JSON so every field of the SDK type is seen, whatever its
+	// Go type and tag
+	raw, err := json.Marshal(domain)
+	if err != nil {
+		return result, fmt.Errorf("invalid EIP-712 domain: %w", err)
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(raw)))
+	decoder.UseNumber()
+	var fields map[string]interface{}
+	if err := decoder.Decode(&fields); err != nil {
+		return result, fmt.Errorf("invalid EIP-712 domain: %w", err)
+	}
+
+	for key, value := range fields {
+		if value == nil {
+			continue
+		}
+		switch strings.ToLower(key) {
+		case "name":
+			result.Name, err = domainString(key, value)
+		case "version":
+			result.Version, err = domainString(key, value)
+		case "chainid":
+			var chainID *big.Int
+			if s, ok := value.(string); ok && s == "" {
+				continue
+			}
+			chainID, err = parseUint256(value)
+			if err != nil {
+				return result, fmt.Errorf("invalid EIP-712 domain chainId: %w", err)
+			}
+			result.ChainId = (*math.HexOrDecimal256)(chainID)
+		case "verifyingcontract":
+			result.VerifyingContract, err = domainString(key, value)
+			if err == nil && result.VerifyingContract != "" && !common.IsHexAddress(result.VerifyingContract) {
+				err = fmt.Errorf("invalid EIP-712 domain verifyingContract: %q", result.VerifyingContract)
+			}
+		case "salt":
+			result.Salt, err = domainSalt(value)
+		}
+		if err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+// domainString reads a string domain field
+func domainString(key string, value interface{}) (string, error) {
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("invalid EIP-712 domain %s: expected string, got %T", key, value)
+	}
+	return s, nil
+}
+
+// domainSalt reads a bytes32 salt given as hex or as a number
+func domainSalt(value interface{}) (string, error) {
+	if s, ok := value.(string); ok {
+		if s == "" {
+			return "", nil
+		}
+		if b, err := hexutil.Decode(s); err == nil {
+			if len(b) != 32 {
+				return "", fmt.Errorf("invalid EIP-712 domain salt: %d bytes, want 32", len(b))
+			}
+			return hexutil.Encode(b), nil
+		}
+	}
+	n, err := parseUint256(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid EIP-712 domain salt: %w", err)
+	}
+	return hexutil.Encode(math.U256Bytes(n)), nil
+}
+
+// domainType returns the EIP712Domain type for the fields set on domain, in
+// the canonical order
+func domainType(domain apitypes.TypedDataDomain) []apitypes.Type {
+	var fields []apitypes.Type
+	if domain.Name != "" {
+		fields = append(fields, apitypes.Type{Name: "name", Type: "string"})
+	}
+	if domain.Version != "" {
+		fields = append(fields, apitypes.Type{Name: "version", Type: "string"})
+	}
+	if domain.ChainId != nil {
+		fields = append(fields, apitypes.Type{Name: "chainId", Type: "uint256"})
+	}
+	if domain.VerifyingContract != "" {
+		fields = append(fields, apitypes.Type{Name: "verifyingContract", Type: "address"})
+	}
+	if domain.Salt != "" {
+		fields = append(fields, apitypes.Type{Name: "salt", Type: "bytes32"})
+	}
+	return fields
+}
+
+// domainCandidate is a domain and EIP712Domain type to verify a signature with
+type domainCandidate struct {
+	domain apitypes.TypedDataDomain
+	fields []apitypes.Type
+}
+
+// domainCandidates returns the domains a signature may have been made over,
+// most authoritative first, without duplicates:
+//
+//  1. the EIP712Domain type sent with the payload, if any
+//  2. the token's own eip712Domain() (EIP-5267) when it implements it
+//
+// Only when neither is available does it fall back to guesses, and report
+// so through fallback:
+//
+//  3. the fields the payload provides
+//  4. the legacy salt = bytes32(chainId) layout without chainId, used by
+//     bridged tokens such as USDC.e on Polygon PoS
+//
+// A signature over a guessed domain may not be one the token accepts, so
+// the caller must confirm it with confirmDomain.
+func (s *facilitatorEvmSigner) domainCandidates(
+	ctx context.Context,
+	explicit []apitypes.Type,
+	domain apitypes.TypedDataDomain,
+) (candidates []domainCandidate, fallback bool) {
+	add := func(candidate domainCandidate) {
+		for _, existing := range candidates {
+			if reflect.DeepEqual(existing, candidate) {
+				return
+			}
+		}
+		candidates = append(candidates, candidate)
+	}
+
+	if len(explicit) > 0 {
+		add(domainCandidate{domain: domain, fields: explicit})
+	}
+
+	if common.IsHexAddress(domain.VerifyingContract) {
+		if onchain := s.eip712Domain(ctx, common.HexToAddress(domain.VerifyingContract)); onchain != nil {
+			add(domainCandidate{domain: onchain.domain, fields: onchain.fields})
+		}
+	}
+
+	if len(candidates) > 0 {
+		return candidates, false
+	}
+
+	add(domainCandidate{domain: domain, fields: domainType(domain)})
+
+	if domain.Salt == "" && domain.ChainId != nil && domain.VerifyingContract != "" {
+		salted := domain
+		salted.Salt = hexutil.Encode(math.U256Bytes(new(big.Int).Set((*big.Int)(domain.ChainId))))
+		salted.ChainId = nil
+		add(domainCandidate{domain: salted, fields: domainType(salted)})
+	}
+	return candidates, true
+}
+
+// confirmDomain checks with the verifying contract that a signature made
+// over a guessed domain is one it will accept. A contract exposing
+// DOMAIN_SEPARATOR() must report the same separator. Otherwise an EIP-3009
+// transfer is simulated with the signature; other messages can't be
+// confirmed and are rejected.
+func (s *facilitatorEvmSigner) confirmDomain(
+	ctx context.Context,
+	typedData apitypes.TypedData,
+	signature []byte,
+) (bool, error) {
+	if !common.IsHexAddress(typedData.Domain.VerifyingContract) {
+		return false, nil
+	}
+	contract := common.HexToAddress(typedData.Domain.VerifyingContract)
+
+	// Nothing deployed: settlement against it can't succeed either
+	code, err := s.client.CodeAt(ctx, contract, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to get code: %w", err)
+	}
+	if len(code) == 0 {
+		return false, nil
+	}
+
+	separator, err := typedData.HashStruct("EIP712Domain", domainMap(typedData))
+	if err != nil {
+		return false, fmt.Errorf("failed to hash domain: %w", err)
+	}
+
+	data, err := domainSeparatorParsed.Pack("DOMAIN_SEPARATOR")
+	if err != nil {
+		return false, err
+	}
+	output, err := s.client.CallContract(ctx, ethereum.CallMsg{To: &contract, Data: data}, nil)
+	if err != nil && !isRevert(err) {
+		return false, fmt.Errorf("failed to read DOMAIN_SEPARATOR: %w", err)
+	}
+	if err == nil && len(output) == 32 {
+		return bytes.Equal(output, separator), nil
+	}
+
+	if typedData.PrimaryType != "TransferWithAuthorization" {
+		return false, nil
+	}
+	str := func(key string) string { return fmt.Sprint(typedData.Message[key]) }
+	call, err := transferWithAuthorizationCall(deferredAuthorization{
+		From:        str("from"),
+		To:          str("to"),
+		Value:       str("value"),
+		ValidAfter:  str("validAfter"),
+		ValidBefore: str("validBefore"),
+		Nonce:       str("nonce"),
+		Signature:   hexutil.Encode(signature),
+	})
+	if err != nil {
+		return false, nil
+	}
+	return s.preflight(ctx, contract, call) == nil, nil
+}
+
+// eip712Domain reads and caches a token's EIP-5267 domain. Returns nil when
+// the token does not implement eip712Domain().
+func (s *facilitatorEvmSigner) eip712Domain(ctx context.Context, token common.Address) *onchainDomain {
+	if cached, ok := s.domains.Load(token); ok {
+		return cached.(*onchainDomain)
+	}
+
+	data, err := eip5267Parsed.Pack("eip712Domain")
+	if err != nil {
+		return nil
+	}
+	output, err := s.client.CallContract(ctx, ethereum.CallMsg{To: &token, Data: data}, nil)
+	if err != nil && !isRevert(err) {
+		// RPC trouble: don't remember the answer, fall back to the payload
+		return nil
+	}
+
+	var onchain *onchainDomain
+	if err == nil {
+		onchain = decodeEIP712Domain(output)
+	}
+	s.domains.Store(token, onchain)
+	return onchain
+}
+
+// decodeEIP712Domain decodes the result of eip712Domain(), or returns nil if
+// it is not a valid EIP-5267 answer
+func decodeEIP712Domain(output []byte) *onchainDomain {
+	values, err := eip5267Parsed.Methods["eip712Domain"].Outputs.Unpack(output)
+	if err != nil || len(values) != 7 {
+		return nil
+	}
+
+	bits, _ := values[0].([1]byte)
+	name, _ := values[1].(string)
+	version, _ := values[2].(string)
+	chainID, _ := values[3].(*big.Int)
+	verifyingContract, _ := values[4].(common.Address)
+	salt, _ := values[5].([32]byte)
+	if extensions, _ := values[6].([]*big.Int); len(extensions) > 0 {
+		// Extensions change the domain in ways we can't know about
+		return nil
+	}
+
+	var domain apitypes.TypedDataDomain
+	var fields []apitypes.Type
+	if bits[0]&domainFieldName != 0 {
+		domain.Name = name
+		fields = append(fields, apitypes.Type{Name: "name", Type: "string"})
+	}
+	if bits[0]&domainFieldVersion != 0 {
+		domain.Version = version
+		fields = append(fields, apitypes.Type{Name: "version", Type: "string"})
+	}
+	if bits[0]&domainFieldChainID != 0 && chainID != nil {
+		domain.ChainId = (*math.HexOrDecimal256)(chainID)
+		fields = append(fields, apitypes.Type{Name: "chainId", Type: "uint256"})
+	}
+	if bits[0]&domainFieldVerifyingContract != 0 {
+		domain.VerifyingContract = verifyingContract.Hex()
+		fields = append(fields, apitypes.Type{Name: "verifyingContract", Type: "address"})
+	}
+	if bits[0]&domainFieldSalt != 0 {
+		domain.Salt = hexutil.Encode(salt[:])
+		fields = append(fields, apitypes.Type{Name: "salt", Type: "bytes32"})
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+
+	return &onchainDomain{domain: domain, fields: fields}
+}
+
+// typedDataDigest computes the EIP-712 digest of typedData
+func typedDataDigest(typedData apitypes.TypedData) (common.Hash, error) {
+	dataHash, err := typedData.HashStruct(typedData.PrimaryType, typedData.Message)
+	if err != nil {
+		return common.Hash{}, fmt.Errorf("failed to hash struct: %w", err)
+	}
+
+	domainSeparator, err := typedData.HashStruct("EIP712Domain", domainMap(typedData))
+	if err != nil {
+		return common.Hash{}, fmt.Errorf("failed to hash domain: %w", err)
+	}
+
+	rawData := []byte{0x19, 0x01}
+	rawData = append(rawData, domainSeparator...)
+	rawData = append(rawData, dataHash...)
+	return crypto.Keccak256Hash(rawData), nil
+}
+
+// domainMap returns the domain values for the fields of the EIP712Domain type
+// only, since hashing rejects values the type does not declare
+func domainMap(typedData apitypes.TypedData) apitypes.TypedDataMessage {
+	all := typedData.Domain.Map()
+	m := make(apitypes.TypedDataMessage, len(all))
+	for _, field := range typedData.Types["EIP712Domain"] {
+		if v, ok := all[field.Name]; ok {
+			m[field.Name] = v
+		}
+	}
+	return m
+}
+
+// ============================================================================
+// Numeric Parsing
+// ============================================================================
+
+// errNotInteger is returned for values that are not whole numbers
+var errNotInteger = errors.New("not an integer")
+
+// parseBigInt converts a numeric value from a payload into a big.Int. It
+// accepts Go integers, integral float64 values as produced by encoding/json,
+// json.Number, decimal and 0x-prefixed hex strings, *big.Int,
+// math.HexOrDecimal256 and uint256.Int. Anything else is an error rather than
+// a silent zero.
+func parseBigInt(v interface{}) (*big.Int, error) {
+	switch val := v.(type) {
+	case nil:
+		return nil, errors.New("missing value")
+	case *big.Int:
+		if val == nil {
+			return nil, errors.New("missing value")
+		}
+		return new(big.Int).Set(val), nil
+	case big.Int:
+		return new(big.Int).Set(&val), nil
+	case *math.HexOrDecimal256:
+		if val == nil {
+			return nil, errors.New("missing value")
+		}
+		return new(big.Int).Set((*big.Int)(val)), nil
+	case math.HexOrDecimal256:
+		return new(big.Int).Set((*big.Int)(&val)), nil
+	case *uint256.Int:
+		if val == nil {
+			return nil, errors.New("missing value")
+		}
+		return val.ToBig(), nil
+	case uint256.Int:
+		return val.ToBig(), nil
+	case int:
+		return big.NewInt(int64(val)), nil
+	case int8:
+		return big.NewInt(int64(val)), nil
+	case int16:
+		return big.NewInt(int64(val)), nil
+	case int32:
+		return big.NewInt(int64(val)), nil
+	case int64:
+		return big.NewInt(val), nil
+	case uint:
+		return new(big.Int).SetUint64(uint64(val)), nil
+	case uint8:
+		return new(big.Int).SetUint64(uint64(val)), nil
+	case uint16:
+		return new(big.Int).SetUint64(uint64(val)), nil
+	case uint32:
+		return new(big.Int).SetUint64(uint64(val)), nil
+	case uint64:
+		return new(big.Int).SetUint64(val), nil
+	case float64:
+		// Larger floats have already lost precision when the JSON was decoded
+		if val > maxSafeFloat || val < -maxSafeFloat || val != float64(int64(val)) {
+			return nil, fmt.Errorf("%v: %w or not exactly representable, send it as a string", val, errNotInteger)
+		}
+		return big.NewInt(int64(val)), nil
+	case json.Number:
+		return parseIntegerString(string(val))
+	case string:
+		return parseIntegerString(val)
+	}
+	return nil, fmt.Errorf("unsupported numeric type %T", v)
+}
+
+// parseIntegerString parses a decimal or 0x-prefixed hex integer
+func parseIntegerString(s string) (*big.Int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, errors.New("empty string")
+	}
+
+	negative := strings.HasPrefix(s, "-")
+	digits := strings.TrimPrefix(s, "-")
+
+	var n *big.Int
+	var ok bool
+	if strings.HasPrefix(digits, "0x") || strings.HasPrefix(digits, "0X") {
+		n, ok = new(big.Int).SetString(digits[2:], 16)
+	} else {
+		n, ok = new(big.Int).SetString(digits, 10)
+	}
+	if !ok || strings.HasPrefix(digits, "+") || strings.HasPrefix(digits, "-") {
+		return nil, fmt.Errorf("%q: %w", s, errNotInteger)
+	}
+	if negative {
+		n.Neg(n)
+	}
+	return n, nil
+}
+
+// parseUint256 parses a value that must fit in a uint256
+func parseUint256(v interface{}) (*big.Int, error) {
+	n, err := parseBigInt(v)
+	if err != nil {
+		return nil, err
+	}
+	if n.Sign() < 0 || n.BitLen() > 256 {
+		return nil, fmt.Errorf("%s out of uint256 range", n)
+	}
+	return n, nil
+}
+
+// normalizeTypedValue converts numeric leaves of an EIP-712 value into
+// *big.Int according to the declared types, so any representation accepted
+// by parseBigInt hashes correctly
+func normalizeTypedValue(types apitypes.Types, typ string, value interface{}) (interface{}, error) {
+	// Arrays: T[] and T[n]
+	if strings.HasSuffix(typ, "]") {
+		elemType := typ[:strings.LastIndex(typ, "[")]
+		items, ok := value.([]interface{})
+		if !ok {
+			return value, nil
+		}
+		normalized := make([]interface{}, len(items))
+		for i, item := range items {
+			v, err := normalizeTypedValue(types, elemType, item)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %w", i, err)
+			}
+			normalized[i] = v
+		}
+		return normalized, nil
+	}
+
+	// Structs
+	if fields, ok := types[typ]; ok {
+		message, ok := value.(map[string]interface{})
+		if !ok {
+			return value, nil
+		}
+		normalized := make(map[string]interface{}, len(message))
+		for k, v := range message {
+			normalized[k] = v
+		}
+		for _, field := range fields {
+			v, exists := message[field.Name]
+			if !exists {
+				continue
+			}
+			n, err := normalizeTypedValue(types, field.Type, v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", field.Name, err)
+			}
+			normalized[field.Name] = n
+		}
+		return normalized, nil
+	}
+
+	switch {
+	case strings.HasPrefix(typ, "uint"):
+		n, err := parseBigInt(value)
+		if err != nil {
+			return nil, err
+		}
+		if n.Sign() < 0 {
+			return nil, fmt.Errorf("negative value %s for %s", n, typ)
+		}
+		return n, nil
+	case strings.HasPrefix(typ, "int"):
+		return parseBigInt(value)
+	}
+	return value, nil
+}
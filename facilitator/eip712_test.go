@@ -0,0 +1,480 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+
+	evmmech "github.com/coinbase/x402/go/mechanisms/evm"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+	"github.com/holiman/uint256"
+)
+
+// tokenDomain is a real token's EIP-712 domain: what a payment payload
+// carries, and the domain the token contract actually hashes
+type tokenDomain struct {
+	name    string
+	payload evmmech.TypedDataDomain
+
+	// domainType and domainValues describe the on-chain domain, values
+	// already abi-encoded in type order
+	domainType   string
+	domainValues [][]byte
+
+	// onchainSeparator is DOMAIN_SEPARATOR() read from the deployed token,
+	// when pinned
+	onchainSeparator string
+}
+
+func encodeString(s string) []byte  { return crypto.Keccak256([]byte(s)) }
+func encodeUint(n int64) []byte     { return math.U256Bytes(big.NewInt(n)) }
+func encodeAddress(a string) []byte { return common.LeftPadBytes(common.HexToAddress(a).Bytes(), 32) }
+func (d tokenDomain) separator() []byte {
+	data := crypto.Keccak256([]byte(d.domainType))
+	for _, v := range d.domainValues {
+		data = append(data, v...)
+	}
+	return crypto.Keccak256(data)
+}
+
+const standardDomainType = "EIP712Domain(string name,string version,uint256 chainId,address verifyingContract)"
+
+var tokenDomains = []tokenDomain{
+	{
+		name: "USDC Ethereum",
+		payload: evmmech.TypedDataDomain{
+			Name: "USD Coin", Version: "2", ChainID: big.NewInt(1),
+			VerifyingContract: "0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48",
+		},
+		domainType: standardDomainType,
+		domainValues: [][]byte{
+			encodeString("USD Coin"), encodeString("2"), encodeUint(1),
+			encodeAddress("0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48"),
+		},
+		onchainSeparator: "0x06c37168a7db5138defc7866392bb87a741f9b3d104deb5094588ce041cae335",
+	},
+	{
+		name: "USDC Base",
+		payload: evmmech.TypedDataDomain{
+			Name: "USD Coin", Version: "2", ChainID: big.NewInt(8453),
+			VerifyingContract: "0x833589fCD6eDb6E08f4c7C32D4f71b54bdA02913",
+		},
+		domainType: standardDomainType,
+		domainValues: [][]byte{
+			encodeString("USD Coin"), encodeString("2"), encodeUint(8453),
+			encodeAddress("0x833589fCD6eDb6E08f4c7C32D4f71b54bdA02913"),
+		},
+	},
+	{
+		name: "USDC Base Sepolia",
+		payload: evmmech.TypedDataDomain{
+			Name: "USDC", Version: "2", ChainID: big.NewInt(84532),
+			VerifyingContract: "0x036CbD53842c5426634e7929541eC2318f3dCF7e",
+		},
+		domainType: standardDomainType,
+		domainValues: [][]byte{
+			encodeString("USDC"), encodeString("2"), encodeUint(84532),
+			encodeAddress("0x036CbD53842c5426634e7929541eC2318f3dCF7e"),
+		},
+	},
+	{
+		name: "EURC Base",
+		payload: evmmech.TypedDataDomain{
+			Name: "EURC", Version: "2", ChainID: big.NewInt(8453),
+			VerifyingContract: "0x60a3E35Cc302bFA44Cb288Bc5a4F316Fdb1adb42",
+		},
+		domainType: standardDomainType,
+		domainValues: [][]byte{
+			encodeString("EURC"), encodeString("2"), encodeUint(8453),
+			encodeAddress("0x60a3E35Cc302bFA44Cb288Bc5a4F316Fdb1adb42"),
+		},
+	},
+	{
+		name: "DAI Ethereum",
+		payload: evmmech.TypedDataDomain{
+			Name: "Dai Stablecoin", Version: "1", ChainID: big.NewInt(1),
+			VerifyingContract: "0x6B175474E89094C44Da98b954EedeAC495271d0F",
+		},
+		domainType: standardDomainType,
+		domainValues: [][]byte{
+			encodeString("Dai Stablecoin"), encodeString("1"), encodeUint(1),
+			encodeAddress("0x6B175474E89094C44Da98b954EedeAC495271d0F"),
+		},
+		onchainSeparator: "0xdbb8cf42e1ecb028be3f3dbc922e1d878b963f411dc388ced501601c60f7c6f7",
+	},
+	{
+		// Partial domain: UNI has no version
+		name: "UNI Ethereum",
+		payload: evmmech.TypedDataDomain{
+			Name: "Uniswap", ChainID: big.NewInt(1),
+			VerifyingContract: "0x1f9840a85d5aF5bf1D1762F925BDADdC4201F984",
+		},
+		domainType: "EIP712Domain(string name,uint256 chainId,address verifyingContract)",
+		domainValues: [][]byte{
+			encodeString("Uniswap"), encodeUint(1),
+			encodeAddress("0x1f9840a85d5aF5bf1D1762F925BDADdC4201F984"),
+		},
+	},
+	{
+		// Salted domain: bridged USDC.e replaces chainId with salt = bytes32(chainId)
+		name: "USDC.e Polygon PoS",
+		payload: evmmech.TypedDataDomain{
+			Name: "USD Coin (PoS)", Version: "1", ChainID: big.NewInt(137),
+			VerifyingContract: "0x2791Bca1f2de4661ED88A30C99A7a9449Aa84174",
+		},
+		domainType: "EIP712Domain(string name,string version,address verifyingContract,bytes32 salt)",
+		domainValues: [][]byte{
+			encodeString("USD Coin (PoS)"), encodeString("1"),
+			encodeAddress("0x2791Bca1f2de4661ED88A30C99A7a9449Aa84174"), encodeUint(137),
+		},
+	},
+}
+
+// testTransferTypes are the EIP-3009 TransferWithAuthorization types
+var testTransferTypes = map[string][]evmmech.TypedDataField{
+	"TransferWithAuthorization": {
+		{Name: "from", Type: "address"},
+		{Name: "to", Type: "address"},
+		{Name: "value", Type: "uint256"},
+		{Name: "validAfter", Type: "uint256"},
+		{Name: "validBefore", Type: "uint256"},
+		{Name: "nonce", Type: "bytes32"},
+	},
+}
+
+// transferMessage is a TransferWithAuthorization with value given as is
+func transferMessage(from common.Address, value interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"from":        from.Hex(),
+		"to":          "0x209693Bc6afc0C5328bA36FaF03C514EF312287C",
+		"value":       value,
+		"validAfter":  "0",
+		"validBefore": "99999999999",
+		"nonce":       "0x" + common.Bytes2Hex(crypto.Keccak256([]byte("nonce"))),
+	}
+}
+
+// signTransfer signs a TransferWithAuthorization of 1 USDC under separator
+// with a fresh key and returns the signature and the signer
+func signTransfer(t *testing.T, separator []byte) ([]byte, common.Address) {
+	t.Helper()
+
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := crypto.PubkeyToAddress(key.PublicKey)
+
+	// Only the struct hash is taken from apitypes, which insists on a domain
+	typedData := apitypes.TypedData{
+		Types:       apitypes.Types{},
+		PrimaryType: "TransferWithAuthorization",
+		Domain:      apitypes.TypedDataDomain{Name: "unused"},
+	}
+	for _, field := range testTransferTypes["TransferWithAuthorization"] {
+		typedData.Types["TransferWithAuthorization"] = append(typedData.Types["TransferWithAuthorization"],
+			apitypes.Type{Name: field.Name, Type: field.Type})
+	}
+	structHash, err := typedData.HashStruct("TransferWithAuthorization", transferMessage(from, "1000000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest := crypto.Keccak256(append(append([]byte{0x19, 0x01}, separator...), structHash...))
+	signature, err := crypto.Sign(digest, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature[64] += 27
+	return signature, from
+}
+
+func TestTokenDomainSeparators(t *testing.T) {
+	for _, token := range tokenDomains {
+		if token.onchainSeparator == "" {
+			continue
+		}
+		if got := common.BytesToHash(token.separator()).Hex(); got != token.onchainSeparator {
+			t.Errorf("%s: separator = %s, want on-chain %s", token.name, got, token.onchainSeparator)
+		}
+	}
+}
+
+// newTokenTestSigner starts a simulated chain where every token of
+// tokenDomains answers DOMAIN_SEPARATOR() with its on-chain separator, and
+// returns a signer connected to it
+func newTokenTestSigner(t *testing.T) *facilitatorEvmSigner {
+	t.Helper()
+
+	facilitatorKey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	alloc := types.GenesisAlloc{
+		crypto.PubkeyToAddress(facilitatorKey.PublicKey): {Balance: big.NewInt(1e18)},
+	}
+	for _, token := range tokenDomains {
+		alloc[common.HexToAddress(token.payload.VerifyingContract)] = types.Account{
+			Code: eip5267TokenCode(token.separator()), Nonce: 1,
+		}
+	}
+	backend := simulated.NewBackend(alloc)
+	t.Cleanup(func() { backend.Close() })
+
+	signer, err := newFacilitatorEvmSignerWithClient(common.Bytes2Hex(crypto.FromECDSA(facilitatorKey)), backend.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func TestVerifyTypedDataTokenDomains(t *testing.T) {
+	signer := newTokenTestSigner(t)
+
+	for _, token := range tokenDomains {
+		t.Run(token.name, func(t *testing.T) {
+			signature, from := signTransfer(t, token.separator())
+
+			valid, err := signer.VerifyTypedData(context.Background(), from.Hex(), token.payload,
+				testTransferTypes, "TransferWithAuthorization", transferMessage(from, "1000000"), signature)
+			if err != nil || !valid {
+				t.Fatalf("valid=%v err=%v, want valid", valid, err)
+			}
+
+			// A signature over another token's domain must not verify
+			other := tokenDomains[0]
+			if other.name == token.name {
+				other = tokenDomains[1]
+			}
+			valid, err = signer.VerifyTypedData(context.Background(), from.Hex(), other.payload,
+				testTransferTypes, "TransferWithAuthorization", transferMessage(from, "1000000"), signature)
+			if err != nil || valid {
+				t.Fatalf("other domain %s: valid=%v err=%v, want invalid", other.name, valid, err)
+			}
+		})
+	}
+}
+
+func TestVerifyTypedDataChainIDEncodings(t *testing.T) {
+	signer := newTokenTestSigner(t)
+	base := tokenDomains[1] // USDC Base, chainId 8453
+	signature, from := signTransfer(t, base.separator())
+
+	chainIDs := []interface{}{
+		big.NewInt(8453),
+		int64(8453),
+		uint64(8453),
+		float64(8453),
+		json.Number("8453"),
+		"8453",
+		"0x2105",
+		uint256.NewInt(8453),
+		(*math.HexOrDecimal256)(big.NewInt(8453)),
+	}
+	for _, chainID := range chainIDs {
+		domain := base.payload
+		domain.ChainID = chainID
+		valid, err := signer.VerifyTypedData(context.Background(), from.Hex(), domain,
+			testTransferTypes, "TransferWithAuthorization", transferMessage(from, "1000000"), signature)
+		if err != nil || !valid {
+			t.Errorf("chainId %T(%v): valid=%v err=%v, want valid", chainID, chainID, valid, err)
+		}
+	}
+
+	for _, chainID := range []interface{}{"base", 8453.5, "-8453", true} {
+		domain := base.payload
+		domain.ChainID = chainID
+		if _, err := signer.VerifyTypedData(context.Background(), from.Hex(), domain,
+			testTransferTypes, "TransferWithAuthorization", transferMessage(from, "1000000"), signature); err == nil {
+			t.Errorf("chainId %T(%v): want error", chainID, chainID)
+		}
+	}
+}
+
+func TestVerifyTypedDataMessageValues(t *testing.T) {
+	signer := newTokenTestSigner(t)
+	base := tokenDomains[1]
+	signature, from := signTransfer(t, base.separator())
+
+	values := []interface{}{
+		"1000000",
+		"0xf4240",
+		json.Number("1000000"),
+		float64(1000000),
+		int(1000000),
+		big.NewInt(1000000),
+		uint256.NewInt(1000000),
+	}
+	for _, value := range values {
+		valid, err := signer.VerifyTypedData(context.Background(), from.Hex(), base.payload,
+			testTransferTypes, "TransferWithAuthorization", transferMessage(from, value), signature)
+		if err != nil || !valid {
+			t.Errorf("value %T(%v): valid=%v err=%v, want valid", value, value, valid, err)
+		}
+	}
+
+	for _, value := range []interface{}{"1.5", "-1000000", json.Number("1e6"), 1e300, struct{}{}} {
+		_, err := signer.VerifyTypedData(context.Background(), from.Hex(), base.payload,
+			testTransferTypes, "TransferWithAuthorization", transferMessage(from, value), signature)
+		if err == nil {
+			t.Errorf("value %T(%v): want error", value, value)
+		}
+	}
+}
+
+func TestVerifyTypedDataUnconfirmedDomain(t *testing.T) {
+	base := tokenDomains[1]
+
+	// The signature matches the domain the payload describes, but the token
+	// at that address (EURC) reports a different separator
+	mismatched := base.payload
+	mismatched.VerifyingContract = tokenDomains[3].payload.VerifyingContract
+	claimed := tokenDomain{domainType: base.domainType, domainValues: [][]byte{
+		encodeString("USD Coin"), encodeString("2"), encodeUint(8453), encodeAddress(mismatched.VerifyingContract),
+	}}
+	signature, from := signTransfer(t, claimed.separator())
+
+	signer := newTokenTestSigner(t)
+	valid, err := signer.VerifyTypedData(context.Background(), from.Hex(), mismatched,
+		testTransferTypes, "TransferWithAuthorization", transferMessage(from, "1000000"), signature)
+	if err != nil || valid {
+		t.Fatalf("separator mismatch: valid=%v err=%v, want invalid", valid, err)
+	}
+
+	// No contract at the verifying address: nothing can confirm the domain
+	signature, from = signTransfer(t, base.separator())
+	valid, err = newTestSigner(t).VerifyTypedData(context.Background(), from.Hex(), base.payload,
+		testTransferTypes, "TransferWithAuthorization", transferMessage(from, "1000000"), signature)
+	if err != nil || valid {
+		t.Fatalf("undeployed token: valid=%v err=%v, want invalid", valid, err)
+	}
+}
+
+// eip5267TokenCode returns runtime code answering every call with output,
+// enough to stand in for eip712Domain()
+func eip5267TokenCode(output []byte) []byte {
+	size := math.U256Bytes(big.NewInt(int64(len(output))))[30:]
+	code := []byte{0x61, size[0], size[1], 0x80, 0x60, 0x0c, 0x60, 0x00, 0x39, 0x60, 0x00, 0xf3}
+	return append(code, output...)
+}
+
+func TestVerifyTypedDataEIP5267(t *testing.T) {
+	// A token whose domain is name + version + verifyingContract + a custom
+	// salt, which can't be guessed from the payload
+	token := common.HexToAddress("0x0000000000000000000000000000000000005267")
+	salt := crypto.Keccak256Hash([]byte("custom salt"))
+	output, err := eip5267Parsed.Methods["eip712Domain"].Outputs.Pack(
+		[1]byte{domainFieldName | domainFieldVersion | domainFieldVerifyingContract | domainFieldSalt},
+		"Salted Dollar", "3", big.NewInt(0), token, [32]byte(salt), []*big.Int{},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	facilitatorKey, _ := crypto.GenerateKey()
+	backend := simulated.NewBackend(types.GenesisAlloc{
+		crypto.PubkeyToAddress(facilitatorKey.PublicKey): {Balance: big.NewInt(1e18)},
+		token: {Code: eip5267TokenCode(output), Nonce: 1},
+	})
+	defer backend.Close()
+	signer, err := newFacilitatorEvmSignerWithClient(common.Bytes2Hex(crypto.FromECDSA(facilitatorKey)), backend.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := tokenDomain{
+		domainType: "EIP712Domain(string name,string version,address verifyingContract,bytes32 salt)",
+		domainValues: [][]byte{
+			encodeString("Salted Dollar"), encodeString("3"), encodeAddress(token.Hex()), salt.Bytes(),
+		},
+	}
+	signature, from := signTransfer(t, expected.separator())
+
+	payload := evmmech.TypedDataDomain{
+		Name: "Salted Dollar", Version: "3", ChainID: testSimulatedChainID, VerifyingContract: token.Hex(),
+	}
+	valid, err := signer.VerifyTypedData(context.Background(), from.Hex(), payload,
+		testTransferTypes, "TransferWithAuthorization", transferMessage(from, "1000000"), signature)
+	if err != nil || !valid {
+		t.Fatalf("valid=%v err=%v, want valid", valid, err)
+	}
+
+	if cached, ok := signer.domains.Load(token); !ok || cached.(*onchainDomain) == nil {
+		t.Fatal("EIP-5267 domain was not cached")
+	}
+}
+
+func TestParseBigInt(t *testing.T) {
+	maxUint256 := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1))
+
+	valid := []struct {
+		in   interface{}
+		want string
+	}{
+		{big.NewInt(42), "42"},
+		{*big.NewInt(42), "42"},
+		{int(42), "42"},
+		{int64(-42), "-42"},
+		{uint8(42), "42"},
+		{uint64(1 << 63), "9223372036854775808"},
+		{float64(42), "42"},
+		{float64(1 << 53), "9007199254740992"},
+		{json.Number("42"), "42"},
+		{"42", "42"},
+		{" 42 ", "42"},
+		{"-42", "-42"},
+		{"0x2a", "42"},
+		{"0X2A", "42"},
+		{uint256.NewInt(42), "42"},
+		{*uint256.NewInt(42), "42"},
+		{(*math.HexOrDecimal256)(big.NewInt(42)), "42"},
+		{"0x" + strings.Repeat("f", 64), maxUint256.String()},
+	}
+	for _, tt := range valid {
+		got, err := parseBigInt(tt.in)
+		if err != nil {
+			t.Errorf("parseBigInt(%T %v): unexpected error %v", tt.in, tt.in, err)
+			continue
+		}
+		if got.String() != tt.want {
+			t.Errorf("parseBigInt(%T %v) = %s, want %s", tt.in, tt.in, got, tt.want)
+		}
+	}
+
+	invalid := []interface{}{
+		nil,
+		(*big.Int)(nil),
+		"",
+		"abc",
+		"0x",
+		"0xzz",
+		"1.5",
+		"1e18",
+		"+42",
+		"--42",
+		json.Number("1e18"),
+		float64(1.5),
+		float64(1 << 60),
+		true,
+		[]byte{42},
+	}
+	for _, in := range invalid {
+		if got, err := parseBigInt(in); err == nil {
+			t.Errorf("parseBigInt(%T %v) = %s, want error", in, in, got)
+		}
+	}
+
+	if _, err := parseUint256("-1"); err == nil {
+		t.Error("parseUint256(-1): want error")
+	}
+	if _, err := parseUint256(new(big.Int).Add(maxUint256, big.NewInt(1))); err == nil {
+		t.Error("parseUint256(2^256): want error")
+	}
+}
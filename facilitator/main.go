@@ -4,9 +4,11 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	x402 "github.com/coinbase/x402/go"
@@ -16,6 +18,8 @@ import (
 	svmv1 "github.com/coinbase/x402/go/mechanisms/svm/exact/v1/facilitator"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
+	"go_code/x402/logging"
+	"go_code/x402/shutdown"
 )
 
 // 客户端账户 ──────→ 收款方账户
@@ -24,15 +28,31 @@ import (
 
 const (
 	DefaultPort = "4022"
+
+	// ShutdownTimeout bounds how long in-flight requests may keep running after
+	// a shutdown signal. It is longer than the /settle timeout so a settlement
+	// that already broadcast its transaction can wait for the receipt.
+	ShutdownTimeout = 90 * time.Second
 )
 
 func main() {
 	godotenv.Load()
+	// Redact secrets from everything printed from here on
+	installErr := logging.Install()
+	defer logging.Close()
+	gin.DefaultWriter, gin.DefaultErrorWriter = os.Stdout, os.Stderr
+	if _, err := logging.Setup("facilitator"); err != nil {
+		fmt.Println(err)
+		logging.Exit(1)
+	}
+	if installErr != nil {
+		slog.Warn("output is not redacted", "error", installErr)
+	}
+	logging.WarnSecretsInSource()
 
 	evmPrivateKey := os.Getenv("EVM_PRIVATE_KEY")
 	if evmPrivateKey == "" {
-		fmt.Println("❌ EVM_PRIVATE_KEY environment variable is required")
-		os.Exit(1)
+		logging.Fatal("EVM_PRIVATE_KEY environment variable is required")
 	}
 
 	svmPrivateKey := os.Getenv("SVM_PRIVATE_KEY")
@@ -44,8 +64,7 @@ func main() {
 
 	evmSigner, err := newFacilitatorEvmSigner(evmPrivateKey, DefaultEvmRPC)
 	if err != nil {
-		fmt.Printf("❌ Failed to create EVM signer: %v\n", err)
-		os.Exit(1)
+		logging.Fatal("failed to create EVM signer", "error", err)
 	}
 
 	var svmSigner *facilitatorSvmSigner
@@ -53,6 +72,27 @@ func main() {
 		svmSigner, _ = newFacilitatorSvmSigner(svmPrivateKey, DefaultSvmRPC)
 	}
 
+	// Track broadcast-but-unconfirmed settlements so a restart can resume them
+	pendingFile := os.Getenv("PENDING_SETTLEMENTS_FILE")
+	if pendingFile == "" {
+		pendingFile = DefaultPendingFile
+	}
+	pendingSettlements, err := newPendingStore(pendingFile)
+	if err != nil {
+		logging.Fatal("failed to open pending settlement store", "error", err)
+	}
+	if leftover := pendingSettlements.List(); len(leftover) > 0 {
+		slog.Warn("pending settlements left by a previous run", "count", len(leftover))
+		for _, p := range leftover {
+			slog.Warn("pending settlement", "tx", p.TxHash, "network", p.Network,
+				"broadcast", p.CreatedAt.Format(time.RFC3339), "request_id", p.RequestID)
+		}
+	}
+	evmSigner.pending = pendingSettlements
+	if svmSigner != nil {
+		svmSigner.pending = pendingSettlements
+	}
+
 	facilitator := x402.Newx402Facilitator()
 
 	// Register V2 EVM scheme with smart wallet deployment enabled
@@ -76,24 +116,107 @@ func main() {
 		facilitator.RegisterV1([]x402.Network{"solana-mainnet"}, svmv1.NewExactSvmSchemeV1(svmSigner))
 	}
 
+	afterVerify := func(ctx context.Context, result *x402.VerifyResponse) {
+		slog.InfoContext(ctx, "payment verified", "payer", result.Payer)
+	}
+
 	facilitator.OnAfterVerify(func(ctx x402.FacilitatorVerifyResultContext) error {
-		fmt.Printf("✅ Payment verified\n")
+		afterVerify(ctx.Ctx, ctx.Result)
 		return nil
 	})
 
+	// Optional webhook notified about every settlement outcome
+	webhook := newSettlementWebhook(os.Getenv("SETTLEMENT_WEBHOOK_URL"))
+
+	onSettled := func(ctx context.Context, result *x402.SettleResponse) {
+		slog.InfoContext(ctx, "payment settled", "payer", result.Payer, "network", result.Network, "tx", result.Transaction)
+	}
+
+	afterSettle := func(ctx context.Context, result *x402.SettleResponse) {
+		// Dry runs from /simulate never reach the chain
+		if simulationFrom(ctx) != nil {
+			return
+		}
+		onSettled(ctx, result)
+		webhook.NotifyAsync(ctx, result, recoveredFrom(ctx))
+	}
+
 	facilitator.OnAfterSettle(func(ctx x402.FacilitatorSettleResultContext) error {
-		fmt.Printf("🎉 Payment settled: %s\n", ctx.Result.Transaction)
+		afterSettle(ctx.Ctx, ctx.Result)
 		return nil
 	})
 
+	// Mechanisms implemented here rather than in the SDK: Permit2 and
+	// EIP-2612 payments for tokens without EIP-3009, metered upto payments
+	// and ETH / SOL payments
+	router := newPaymentRouter(facilitator).
+		Register(newPermitScheme(evmSigner)).
+		Register(newUptoScheme(evmSigner)).
+		Register(newNativeScheme(evmSigner, svmSigner, string(svmNetwork2)))
+	router.afterVerify = afterVerify
+	router.afterSettle = afterSettle
+
+	// Deferred mode: verify immediately, settle EIP-3009 authorizations later
+	// in Multicall3 batches to spread gas over many payments
+	var deferred *deferredSettler
+	if os.Getenv("SETTLEMENT_MODE") == "deferred" {
+		queueFile := os.Getenv("DEFERRED_QUEUE_FILE")
+		if queueFile == "" {
+			queueFile = DefaultDeferredQueueFile
+		}
+		reportsFile := os.Getenv("DEFERRED_REPORTS_FILE")
+		if reportsFile == "" {
+			reportsFile = DefaultDeferredReportsFile
+		}
+		interval := DefaultDeferredInterval
+		if value := os.Getenv("DEFERRED_BATCH_INTERVAL"); value != "" {
+			if interval, err = time.ParseDuration(value); err != nil {
+				logging.Fatal("invalid DEFERRED_BATCH_INTERVAL", "error", err)
+			}
+		}
+		maxBatch := DefaultDeferredMaxBatch
+		if value := os.Getenv("DEFERRED_MAX_BATCH"); value != "" {
+			if maxBatch, err = strconv.Atoi(value); err != nil || maxBatch <= 0 {
+				logging.Fatal("invalid DEFERRED_MAX_BATCH", "value", value)
+			}
+		}
+
+		deferred, err = newDeferredSettler(facilitator, evmSigner, queueFile, reportsFile, interval, maxBatch)
+		if err != nil {
+			logging.Fatal("failed to open deferred settlement queue", "error", err)
+		}
+		deferred.webhook = webhook
+		deferred.onSettled = onSettled
+	}
+
+	// settle settles a payment on-chain, or queues it when deferred mode is
+	// enabled and the payment is an EIP-3009 authorization
+	settle := func(ctx context.Context, payload, requirements json.RawMessage) (interface{}, error) {
+		ctx = withPendingPayment(ctx, describePayment(payload, requirements))
+		if deferred != nil {
+			if result, ok, err := deferred.Settle(ctx, payload, requirements); ok {
+				if err != nil {
+					return nil, err
+				}
+				return result, nil
+			}
+		}
+		return router.Settle(ctx, payload, requirements)
+	}
+
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.New()
 	r.Use(gin.Recovery())
 
+	inFlight := &shutdown.InFlightTracker{}
+	r.Use(inFlight.Middleware())
+	r.Use(logging.RequestIDMiddleware())
+	r.Use(logging.AccessLog())
+
 	// Supported endpoint - returns supported networks and schemes
 	r.GET("/supported", func(c *gin.Context) {
 		// Get supported kinds - networks already registered
-		supported := facilitator.GetSupported()
+		supported := router.GetSupported()
 		c.JSON(http.StatusOK, supported)
 	})
 
@@ -114,13 +237,13 @@ func main() {
 		}
 
 		// Verify payment
-		result, err := facilitator.Verify(ctx, reqBody.PaymentPayload, reqBody.PaymentRequirements)
+		result, err := router.Verify(ctx, reqBody.PaymentPayload, reqBody.PaymentRequirements)
 		if err != nil {
 			// All failures (business logic and system errors) are returned as errors
 			// You can extract structured information from VerifyError if needed:
 			if ve, ok := err.(*x402.VerifyError); ok {
-				log.Printf("Verification failed: reason=%s, payer=%s, network=%s",
-					ve.Reason, ve.Payer, ve.Network)
+				slog.WarnContext(ctx, "verification failed",
+					"reason", ve.Reason, "payer", ve.Payer, "network", ve.Network)
 			}
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -146,14 +269,14 @@ func main() {
 			return
 		}
 
-		// Settle payment
-		result, err := facilitator.Settle(ctx, reqBody.PaymentPayload, reqBody.PaymentRequirements)
+		// Settle payment (or queue it in deferred mode)
+		result, err := settle(ctx, reqBody.PaymentPayload, reqBody.PaymentRequirements)
 		if err != nil {
 			// All failures (business logic and system errors) are returned as errors
 			// You can extract structured information from SettleError if needed:
 			if se, ok := err.(*x402.SettleError); ok {
-				log.Printf("Settlement failed: reason=%s, payer=%s, network=%s, tx=%s",
-					se.Reason, se.Payer, se.Network, se.Transaction)
+				slog.WarnContext(ctx, "settlement failed",
+					"reason", se.Reason, "payer", se.Payer, "network", se.Network, "tx", se.Transaction)
 			}
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -163,15 +286,170 @@ func main() {
 		c.JSON(http.StatusOK, result)
 	})
 
-	fmt.Printf("🚀 Facilitator listening on http://localhost:%s\n", DefaultPort)
-	fmt.Printf("   EVM: %s on %s\n", evmSigner.GetAddresses()[0], evmNetwork2)
+	parallelism := batchParallelism()
+
+	// Batch verify endpoint - verifies many payments concurrently
+	r.POST("/verify/batch", func(c *gin.Context) {
+		var reqBody batchRequest
+		if err := c.BindJSON(&reqBody); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+		if len(reqBody.Items) == 0 || len(reqBody.Items) > MaxBatchSize {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Batch must contain 1-%d items", MaxBatchSize)})
+			return
+		}
+
+		results := runBatch(c.Request.Context(), reqBody.Items, parallelism, func(ctx context.Context, item paymentRequest) (interface{}, error) {
+			ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+			defer cancel()
+
+			result, err := router.Verify(ctx, item.PaymentPayload, item.PaymentRequirements)
+			if err != nil {
+				if ve, ok := err.(*x402.VerifyError); ok {
+					slog.WarnContext(ctx, "verification failed",
+						"reason", ve.Reason, "payer", ve.Payer, "network", ve.Network)
+				}
+				return nil, err
+			}
+			return result, nil
+		})
+
+		c.JSON(http.StatusOK, batchResponse{Results: results})
+	})
+
+	// Batch settle endpoint - settles many payments concurrently; EVM nonces
+	// are assigned locally so the transactions are broadcast back to back
+	r.POST("/settle/batch", func(c *gin.Context) {
+		var reqBody batchRequest
+		if err := c.BindJSON(&reqBody); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+		if len(reqBody.Items) == 0 || len(reqBody.Items) > MaxBatchSize {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Batch must contain 1-%d items", MaxBatchSize)})
+			return
+		}
+
+		results := runBatch(c.Request.Context(), reqBody.Items, parallelism, func(ctx context.Context, item paymentRequest) (interface{}, error) {
+			ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
+			defer cancel()
+
+			result, err := settle(ctx, item.PaymentPayload, item.PaymentRequirements)
+			if err != nil {
+				if se, ok := err.(*x402.SettleError); ok {
+					slog.WarnContext(ctx, "settlement failed",
+						"reason", se.Reason, "payer", se.Payer, "network", se.Network, "tx", se.Transaction)
+				}
+				return nil, err
+			}
+			return result, nil
+		})
+
+		c.JSON(http.StatusOK, batchResponse{Results: results})
+	})
+
+	if deferred != nil {
+		// The queue exposes payer authorizations and a flush spends gas, so
+		// these require ADMIN_API_TOKEN as a bearer token
+		adminToken := os.Getenv("ADMIN_API_TOKEN")
+		if adminToken == "" {
+			slog.Warn("ADMIN_API_TOKEN not set, the deferred admin endpoints are disabled")
+		}
+		admin := r.Group("/deferred", requireAdminToken(adminToken))
+
+		// Deferred queue endpoint - authorizations waiting for a batch
+		admin.GET("/queue", func(c *gin.Context) {
+			c.JSON(http.StatusOK, gin.H{"queued": deferred.queue.List()})
+		})
+
+		// Deferred batches endpoint - reports of recent settlement batches
+		admin.GET("/batches", func(c *gin.Context) {
+			c.JSON(http.StatusOK, gin.H{"batches": deferred.Reports()})
+		})
+
+		// Deferred flush endpoint - settles everything queued right away
+		admin.POST("/flush", func(c *gin.Context) {
+			deferred.Flush(c.Request.Context())
+			c.JSON(http.StatusOK, gin.H{"batches": deferred.Reports()})
+		})
+	}
+
+	// Simulate endpoint - runs the full settle path without broadcasting
+	r.POST("/simulate", func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+		defer cancel()
+
+		// Read request body
+		var reqBody struct {
+			PaymentPayload      json.RawMessage `json:"paymentPayload"`
+			PaymentRequirements json.RawMessage `json:"paymentRequirements"`
+		}
+
+		if err := c.BindJSON(&reqBody); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+
+		feePayer := func(network string) string {
+			if strings.HasPrefix(network, "solana") {
+				if svmSigner == nil {
+					return ""
+				}
+				return svmSigner.GetAddresses(ctx, network)[0].String()
+			}
+			return evmSigner.GetAddresses()[0]
+		}
+
+		// Simulation outcomes (including reverts) are reported in the body
+		result := simulateSettlement(ctx, router, feePayer, reqBody.PaymentPayload, reqBody.PaymentRequirements)
+		c.JSON(http.StatusOK, result)
+	})
+
+	slog.Info("facilitator listening", "url", "http://localhost:"+DefaultPort)
+	slog.Info("EVM signer", "address", evmSigner.GetAddresses()[0], "network", evmNetwork2)
 	if svmSigner != nil {
-		fmt.Printf("   SVM: %s on %s\n", svmSigner.GetAddresses(context.Background(), string(svmNetwork2))[0], svmNetwork2)
+		slog.Info("SVM signer", "address", svmSigner.GetAddresses(context.Background(), string(svmNetwork2))[0].String(), "network", svmNetwork2)
+	}
+
+	// Resolve settlements a previous run broadcast but never saw confirmed
+	backgroundCtx, stopBackground := context.WithCancel(context.Background())
+	recovery := &settlementRecovery{
+		store:       pendingSettlements,
+		evmSigner:   evmSigner,
+		svmSigner:   svmSigner,
+		webhook:     webhook,
+		afterSettle: afterSettle,
+	}
+	go recovery.Run(backgroundCtx, pendingSettlements.List())
+
+	// Keep the EVM nonces in line with the chain and unstick gaps
+	go evmSigner.runNonceResync(backgroundCtx)
+
+	if deferred != nil {
+		slog.Info("deferred settlement enabled", "queued", len(deferred.queue.List()),
+			"interval", deferred.interval, "max_batch", deferred.maxBatch)
+		go deferred.Run(backgroundCtx)
+	}
+
+	srv := &http.Server{
+		Addr:    ":" + DefaultPort,
+		Handler: r,
+	}
+
+	serveErr := shutdown.ServeUntilSignal(srv, inFlight, ShutdownTimeout)
+	stopBackground()
+
+	// Persist whatever is still unconfirmed so the next start can resume it
+	if err := pendingSettlements.Flush(); err != nil {
+		slog.Error("failed to persist pending settlements", "error", err)
+	}
+	if remaining := pendingSettlements.List(); len(remaining) > 0 {
+		slog.Warn("settlements still pending", "count", len(remaining), "file", pendingFile)
 	}
-	fmt.Println()
 
-	if err := r.Run(":" + DefaultPort); err != nil {
-		fmt.Printf("Error starting server: %v\n", err)
-		os.Exit(1)
+	if serveErr != nil {
+		logging.Fatal("error running server", "error", serveErr)
 	}
+	slog.Info("facilitator stopped")
 }
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	x402 "github.com/coinbase/x402/go"
+)
+
+// ============================================================================
+// Payment Routing
+// ============================================================================
+
+// paymentProcessor verifies and settles payments. *x402.X402Facilitator and
+// paymentRouter both implement it.
+type paymentProcessor interface {
+	Verify(ctx context.Context, payload []byte, requirements []byte) (*x402.VerifyResponse, error)
+	Settle(ctx context.Context, payload []byte, requirements []byte) (*x402.SettleResponse, error)
+}
+
+// localMechanism is a payment mechanism implemented in this facilitator
+// instead of being registered with the x402 SDK
+type localMechanism interface {
+	paymentProcessor
+
+	// Handles reports whether the mechanism is responsible for a payment
+	Handles(payload []byte, requirements requirementsFields) bool
+
+	// Supported returns the kinds the mechanism adds to /supported
+	Supported() []x402.SupportedKind
+}
+
+// paymentRouter sends each payment to the first local mechanism that handles
+// it, and everything else to the x402 facilitator
+type paymentRouter struct {
+	facilitator *x402.X402Facilitator
+	mechanisms  []localMechanism
+
+	// afterVerify and afterSettle mirror the facilitator's lifecycle hooks for
+	// payments handled by local mechanisms
+	afterVerify func(ctx context.Context, result *x402.VerifyResponse)
+	afterSettle func(ctx context.Context, result *x402.SettleResponse)
+}
+
+// newPaymentRouter creates a router in front of facilitator
+func newPaymentRouter(facilitator *x402.X402Facilitator) *paymentRouter {
+	return &paymentRouter{facilitator: facilitator}
+}
+
+// Register adds a local mechanism. Mechanisms are consulted in registration order.
+func (r *paymentRouter) Register(mechanism localMechanism) *paymentRouter {
+	r.mechanisms = append(r.mechanisms, mechanism)
+	return r
+}
+
+// route returns the local mechanism responsible for a payment, or nil
+func (r *paymentRouter) route(payload []byte, requirements []byte) localMechanism {
+	fields, err := parseRequirementsFields(requirements)
+	if err != nil {
+		return nil
+	}
+	for _, mechanism := range r.mechanisms {
+		if mechanism.Handles(payload, fields) {
+			return mechanism
+		}
+	}
+	return nil
+}
+
+func (r *paymentRouter) Verify(ctx context.Context, payload []byte, requirements []byte) (*x402.VerifyResponse, error) {
+	mechanism := r.route(payload, requirements)
+	if mechanism == nil {
+		return r.facilitator.Verify(ctx, payload, requirements)
+	}
+
+	result, err := mechanism.Verify(ctx, payload, requirements)
+	if err == nil && r.afterVerify != nil {
+		r.afterVerify(ctx, result)
+	}
+	return result, err
+}
+
+func (r *paymentRouter) Settle(ctx context.Context, payload []byte, requirements []byte) (*x402.SettleResponse, error) {
+	mechanism := r.route(payload, requirements)
+	if mechanism == nil {
+		return r.facilitator.Settle(ctx, payload, requirements)
+	}
+
+	result, err := mechanism.Settle(ctx, payload, requirements)
+	if err == nil && r.afterSettle != nil {
+		r.afterSettle(ctx, result)
+	}
+	return result, err
+}
+
+// GetSupported returns the facilitator's supported kinds merged with those of
+// the local mechanisms. Kinds already supported gain the mechanism's extra
+// fields; list values such as assetTransferMethods are combined.
+func (r *paymentRouter) GetSupported() x402.SupportedResponse {
+	supported := r.facilitator.GetSupported()
+
+	for _, mechanism := range r.mechanisms {
+		for _, kind := range mechanism.Supported() {
+			merged := false
+			for i := range supported.Kinds {
+				existing := &supported.Kinds[i]
+				if existing.X402Version != kind.X402Version || existing.Scheme != kind.Scheme || existing.Network != kind.Network {
+					continue
+				}
+				if existing.Extra == nil {
+					existing.Extra = make(map[string]interface{})
+				}
+				for key, value := range kind.Extra {
+					existing.Extra[key] = mergeExtraValue(existing.Extra[key], value)
+				}
+				merged = true
+				break
+			}
+			if !merged {
+				supported.Kinds = append(supported.Kinds, kind)
+			}
+		}
+	}
+
+	return supported
+}
+
+// mergeExtraValue combines two values of a supported kind's extra field
+func mergeExtraValue(existing interface{}, value interface{}) interface{} {
+	current, ok := existing.([]string)
+	added, addedOK := value.([]string)
+	if !ok || !addedOK {
+		return value
+	}
+
+	seen := make(map[string]bool, len(current))
+	result := append([]string{}, current...)
+	for _, v := range current {
+		seen[v] = true
+	}
+	for _, v := range added {
+		if !seen[v] {
+			result = append(result, v)
+			seen[v] = true
+		}
+	}
+	return result
+}
+
+// verifyFailure builds the VerifyError returned by local mechanisms
+func verifyFailure(reason string, payer string, network string, format string, args ...interface{}) error {
+	return &x402.VerifyError{
+		Reason:  reason,
+		Payer:   payer,
+		Network: x402.Network(network),
+		Err:     fmt.Errorf(format, args...),
+	}
+}
+
+// settleFailure converts a verification failure met while settling into the
+// equivalent SettleError
+func settleFailure(err error) error {
+	var ve *x402.VerifyError
+	if errors.As(err, &ve) {
+		return &x402.SettleError{Reason: ve.Reason, Payer: ve.Payer, Network: ve.Network, Err: ve.Err}
+	}
+	return err
+}
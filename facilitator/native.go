@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	x402 "github.com/coinbase/x402/go"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	solana "github.com/gagliardetto/solana-go"
+)
+
+const (
+	// SchemeNative pays in the network's native asset (ETH, SOL) instead of a token
+	SchemeNative = "native"
+
+	// NativeAssetEvm is the asset sentinel for ETH in native requirements
+	NativeAssetEvm = "0xEeeeeEeeeEeEeeEeEeEeeEEEeeeeEeeeeeeeEEeE"
+
+	// NativeAssetSvm is the asset for SOL in native requirements (the System Program)
+	NativeAssetSvm = "11111111111111111111111111111111"
+)
+
+// nativePayload is a native scheme payment payload. The transaction is signed
+// by the payer but not broadcast: a raw EIP-2718 transaction as 0x hex on EVM,
+// a base64 transaction with the facilitator as fee payer on Solana.
+type nativePayload struct {
+	Payload struct {
+		Transaction string `json:"transaction"`
+	} `json:"payload"`
+}
+
+// nativeScheme settles payments in ETH and SOL. On EVM the payer signs a plain
+// value transfer and pays its own gas; the facilitator only broadcasts it. On
+// Solana the payer signs a System Program transfer and the facilitator
+// co-signs as fee payer, as with exact SPL payments.
+type nativeScheme struct {
+	evmSigner  *facilitatorEvmSigner
+	svmSigner  *facilitatorSvmSigner
+	svmNetwork string
+}
+
+// newNativeScheme creates the native mechanism. svmSigner may be nil, in
+// which case only the EVM network is served.
+func newNativeScheme(evmSigner *facilitatorEvmSigner, svmSigner *facilitatorSvmSigner, svmNetwork string) *nativeScheme {
+	return &nativeScheme{evmSigner: evmSigner, svmSigner: svmSigner, svmNetwork: svmNetwork}
+}
+
+// Handles accepts native payments on the networks the facilitator has signers for
+func (n *nativeScheme) Handles(payload []byte, requirements requirementsFields) bool {
+	if requirements.Scheme != SchemeNative {
+		return false
+	}
+	return requirements.Network == n.evmSigner.network() ||
+		(n.svmSigner != nil && requirements.Network == n.svmNetwork)
+}
+
+// Supported advertises the native scheme. Solana kinds carry the fee payer the
+// client has to put in its transaction.
+func (n *nativeScheme) Supported() []x402.SupportedKind {
+	kinds := []x402.SupportedKind{{
+		X402Version: 2,
+		Scheme:      SchemeNative,
+		Network:     n.evmSigner.network(),
+	}}
+	if n.svmSigner != nil {
+		kinds = append(kinds, x402.SupportedKind{
+			X402Version: 2,
+			Scheme:      SchemeNative,
+			Network:     n.svmNetwork,
+			Extra: map[string]interface{}{
+				"feePayer": n.svmSigner.privateKey.PublicKey().String(),
+			},
+		})
+	}
+	return kinds
+}
+
+func (n *nativeScheme) Verify(ctx context.Context, payload []byte, requirements []byte) (*x402.VerifyResponse, error) {
+	fields, parsed, err := n.parse(payload, requirements)
+	if err != nil {
+		return nil, err
+	}
+
+	var payer string
+	if strings.HasPrefix(fields.Network, "solana:") {
+		var from solana.PublicKey
+		_, from, err = n.verifySvm(ctx, fields, parsed)
+		payer = from.String()
+	} else {
+		var from common.Address
+		_, from, err = n.verifyEvm(ctx, fields, parsed)
+		payer = from.Hex()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &x402.VerifyResponse{IsValid: true, Payer: payer}, nil
+}
+
+func (n *nativeScheme) Settle(ctx context.Context, payload []byte, requirements []byte) (*x402.SettleResponse, error) {
+	fields, parsed, err := n.parse(payload, requirements)
+	if err != nil {
+		return nil, settleFailure(err)
+	}
+
+	var payer, txHash string
+	if strings.HasPrefix(fields.Network, "solana:") {
+		tx, from, verifyErr := n.verifySvm(ctx, fields, parsed)
+		if verifyErr != nil {
+			return nil, settleFailure(verifyErr)
+		}
+		payer = from.String()
+		txHash, err = n.svmSigner.SettleNativeTransfer(ctx, tx, fields.Network)
+	} else {
+		tx, from, verifyErr := n.verifyEvm(ctx, fields, parsed)
+		if verifyErr != nil {
+			return nil, settleFailure(verifyErr)
+		}
+		payer = from.Hex()
+		txHash, err = n.evmSigner.SettleNativeTransfer(ctx, tx)
+	}
+	if err != nil {
+		return nil, &x402.SettleError{
+			Reason:      "transaction_failed",
+			Payer:       payer,
+			Network:     x402.Network(fields.Network),
+			Transaction: txHash,
+			Err:         err,
+		}
+	}
+
+	return &x402.SettleResponse{
+		Success:     true,
+		Payer:       payer,
+		Transaction: txHash,
+		Network:     x402.Network(fields.Network),
+	}, nil
+}
+
+// parse decodes the requirements and payload shared by both networks
+func (n *nativeScheme) parse(payload []byte, requirements []byte) (requirementsFields, *nativePayload, error) {
+	fields, err := parseRequirementsFields(requirements)
+	if err != nil {
+		return fields, nil, verifyFailure("invalid_payment_requirements", "", "", "%v", err)
+	}
+
+	var parsed nativePayload
+	if err := json.Unmarshal(payload, &parsed); err != nil || parsed.Payload.Transaction == "" {
+		return fields, nil, verifyFailure("invalid_payload", "", fields.Network, "payload carries no transaction")
+	}
+	return fields, &parsed, nil
+}
+
+// verifyEvm checks an ETH transfer against the requirements
+func (n *nativeScheme) verifyEvm(ctx context.Context, fields requirementsFields, parsed *nativePayload) (*types.Transaction, common.Address, error) {
+	network := fields.Network
+
+	if !strings.EqualFold(fields.Asset, NativeAssetEvm) || !common.IsHexAddress(fields.PayTo) {
+		return nil, common.Address{}, verifyFailure("invalid_payment_requirements", "", network, "invalid asset or payTo address")
+	}
+	amount, err := parseUint256(fields.amount())
+	if err != nil {
+		return nil, common.Address{}, verifyFailure("invalid_payment_requirements", "", network, "invalid amount: %v", err)
+	}
+
+	rawTx, err := hexutil.Decode(parsed.Payload.Transaction)
+	if err != nil {
+		return nil, common.Address{}, verifyFailure("invalid_payload", "", network, "invalid transaction encoding: %v", err)
+	}
+
+	return n.evmSigner.VerifyNativeTransfer(ctx, rawTx, common.HexToAddress(fields.PayTo), amount)
+}
+
+// verifySvm checks a SOL transfer against the requirements
+func (n *nativeScheme) verifySvm(ctx context.Context, fields requirementsFields, parsed *nativePayload) (*solana.Transaction, solana.PublicKey, error) {
+	network := fields.Network
+
+	payTo, err := solana.PublicKeyFromBase58(fields.PayTo)
+	if err != nil || fields.Asset != NativeAssetSvm {
+		return nil, solana.PublicKey{}, verifyFailure("invalid_payment_requirements", "", network, "invalid asset or payTo address")
+	}
+	amount, err := parseUint256(fields.amount())
+	if err != nil || !amount.IsUint64() {
+		return nil, solana.PublicKey{}, verifyFailure("invalid_payment_requirements", "", network, "invalid amount %q", fields.amount())
+	}
+
+	tx, err := solana.TransactionFromBase64(parsed.Payload.Transaction)
+	if err != nil {
+		return nil, solana.PublicKey{}, verifyFailure("invalid_payload", "", network, "invalid transaction encoding: %v", err)
+	}
+
+	from, err := n.svmSigner.VerifyNativeTransfer(ctx, tx, network, payTo, amount.Uint64())
+	if err != nil {
+		return nil, from, err
+	}
+	return tx, from, nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	x402 "github.com/coinbase/x402/go"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+)
+
+var testNativePayTo = common.HexToAddress("0x209693Bc6afc0C5328bA36FaF03C514EF312287C")
+
+// newNativeTestChain starts a simulated chain with a funded payer and returns
+// the native mechanism, the backend and the payer's key
+func newNativeTestChain(t *testing.T) (*nativeScheme, *simulated.Backend, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	facilitatorKey, _ := crypto.GenerateKey()
+	payerKey, _ := crypto.GenerateKey()
+
+	backend := simulated.NewBackend(types.GenesisAlloc{
+		crypto.PubkeyToAddress(facilitatorKey.PublicKey): {Balance: big.NewInt(1e18)},
+		crypto.PubkeyToAddress(payerKey.PublicKey):       {Balance: big.NewInt(1e18)},
+	})
+	t.Cleanup(func() { backend.Close() })
+
+	signer, err := newFacilitatorEvmSignerWithClient(common.Bytes2Hex(crypto.FromECDSA(facilitatorKey)), backend.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer.pending, err = newPendingStore(t.TempDir() + "/pending.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return newNativeScheme(signer, nil, ""), backend, payerKey
+}
+
+// nativeTransferTx builds a signed ETH transfer the way the client does
+func nativeTransferTx(t *testing.T, backend *simulated.Backend, key *ecdsa.PrivateKey, edit func(*types.DynamicFeeTx)) []byte {
+	t.Helper()
+
+	ctx := context.Background()
+	client := backend.Client()
+	from := crypto.PubkeyToAddress(key.PublicKey)
+
+	nonce, err := client.PendingNonceAt(ctx, from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := client.HeaderByNumber(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tip, err := client.SuggestGasTipCap(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx := &types.DynamicFeeTx{
+		ChainID:   testSimulatedChainID,
+		Nonce:     nonce,
+		GasTipCap: tip,
+		GasFeeCap: new(big.Int).Add(new(big.Int).Mul(head.BaseFee, big.NewInt(2)), tip),
+		Gas:       21000,
+		To:        &testNativePayTo,
+		Value:     big.NewInt(1e15),
+	}
+	if edit != nil {
+		edit(tx)
+	}
+
+	signed, err := types.SignNewTx(key, types.LatestSignerForChainID(tx.ChainID), tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := signed.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// nativeRequest encodes a native payload and requirements for amount wei
+func nativeRequest(t *testing.T, rawTx []byte, amount string) ([]byte, []byte) {
+	t.Helper()
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"x402Version": 2,
+		"payload":     map[string]string{"transaction": hexutil.Encode(rawTx)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	requirements, err := json.Marshal(map[string]interface{}{
+		"scheme":  SchemeNative,
+		"network": "eip155:1337",
+		"asset":   NativeAssetEvm,
+		"amount":  amount,
+		"payTo":   testNativePayTo.Hex(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload, requirements
+}
+
+func TestNativeSchemeVerifyEvm(t *testing.T) {
+	scheme, backend, payerKey := newNativeTestChain(t)
+	payer := crypto.PubkeyToAddress(payerKey.PublicKey)
+	otherKey, _ := crypto.GenerateKey()
+
+	tests := []struct {
+		name   string
+		key    *ecdsa.PrivateKey
+		amount string
+		edit   func(*types.DynamicFeeTx)
+		reason string
+	}{
+		{name: "valid", key: payerKey, amount: "1000000000000000"},
+		{name: "overpaid", key: payerKey, amount: "1"},
+		{name: "underpaid", key: payerKey, amount: "1000000000000001", reason: "invalid_native_amount"},
+		{
+			name: "wrong recipient", key: payerKey, amount: "1",
+			edit:   func(tx *types.DynamicFeeTx) { tx.To = &payer },
+			reason: "invalid_native_recipient",
+		},
+		{
+			name: "wrong chain", key: payerKey, amount: "1",
+			edit:   func(tx *types.DynamicFeeTx) { tx.ChainID = big.NewInt(8453) },
+			reason: "invalid_network",
+		},
+		{
+			name: "future nonce", key: payerKey, amount: "1",
+			edit:   func(tx *types.DynamicFeeTx) { tx.Nonce++ },
+			reason: "invalid_native_nonce",
+		},
+		{
+			name: "calldata", key: payerKey, amount: "1",
+			edit:   func(tx *types.DynamicFeeTx) { tx.Data = []byte{1} },
+			reason: "invalid_payload",
+		},
+		{
+			name: "gas too low", key: payerKey, amount: "1",
+			edit:   func(tx *types.DynamicFeeTx) { tx.Gas = 20999 },
+			reason: "invalid_native_gas",
+		},
+		{
+			name: "fee cap too low", key: payerKey, amount: "1",
+			edit:   func(tx *types.DynamicFeeTx) { tx.GasFeeCap, tx.GasTipCap = big.NewInt(1), big.NewInt(1) },
+			reason: "invalid_native_gas",
+		},
+		{name: "unfunded payer", key: otherKey, amount: "1", reason: "insufficient_funds"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, requirements := nativeRequest(t, nativeTransferTx(t, backend, tt.key, tt.edit), tt.amount)
+
+			result, err := scheme.Verify(context.Background(), payload, requirements)
+			if tt.reason == "" {
+				if err != nil {
+					t.Fatalf("Verify() error = %v", err)
+				}
+				if !result.IsValid || result.Payer != payer.Hex() {
+					t.Fatalf("Verify() = %+v, want valid payment from %s", result, payer.Hex())
+				}
+				return
+			}
+
+			var ve *x402.VerifyError
+			if !errors.As(err, &ve) {
+				t.Fatalf("Verify() error = %v, want VerifyError %q", err, tt.reason)
+			}
+			if ve.Reason != tt.reason {
+				t.Fatalf("Verify() reason = %q (%v), want %q", ve.Reason, ve.Err, tt.reason)
+			}
+		})
+	}
+}
+
+func TestNativeSchemeSettleEvm(t *testing.T) {
+	scheme, backend, payerKey := newNativeTestChain(t)
+	payload, requirements := nativeRequest(t, nativeTransferTx(t, backend, payerKey, nil), "1000000000000000")
+
+	// Mine blocks while the settlement waits for its receipt
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				backend.Commit()
+			}
+		}
+	}()
+
+	result, err := scheme.Settle(context.Background(), payload, requirements)
+	if err != nil {
+		t.Fatalf("Settle() error = %v", err)
+	}
+	if !result.Success || result.Payer != crypto.PubkeyToAddress(payerKey.PublicKey).Hex() {
+		t.Fatalf("Settle() = %+v", result)
+	}
+
+	balance, err := backend.Client().BalanceAt(context.Background(), testNativePayTo, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance.Cmp(big.NewInt(1e15)) != 0 {
+		t.Fatalf("payTo balance = %s, want 1e15", balance)
+	}
+
+	// The same transaction cannot be settled twice
+	if _, err := scheme.Settle(context.Background(), payload, requirements); err == nil {
+		t.Fatal("second Settle() succeeded")
+	}
+}
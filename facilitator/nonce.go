@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// ============================================================================
+// Nonce Tracking
+// ============================================================================
+
+const (
+	// nonceResyncInterval is how often the local nonce state is checked
+	// against the chain, in the background and before handing out a nonce
+	nonceResyncInterval = 30 * time.Second
+
+	// fillerGasLimit is the gas of a plain transfer, used for the no-op
+	// transactions that fill nonce gaps
+	fillerGasLimit = 21000
+)
+
+// nonceTracker hands out nonces for the facilitator account so concurrent
+// settlements can be broadcast back to back without waiting for each other
+// to be mined.
+//
+// Every nonce handed out stays outstanding until its transaction is mined,
+// replaced or dropped. A resync with the chain never reissues an outstanding
+// nonce; it only recomputes the next free nonce and the gaps: nonces below
+// it that have no transaction, because one was dropped or never broadcast.
+// Gaps are handed out before new nonces, and a gap that holds back later
+// transactions is filled by the background loop.
+type nonceTracker struct {
+	client  evmClient
+	address common.Address
+
+	// syncMu serializes resyncs, which talk to the node without holding mu
+	syncMu sync.Mutex
+
+	mu          sync.Mutex
+	synced      bool
+	lastSync    time.Time
+	next        uint64
+	minedBelow  uint64            // every nonce below has a receipt
+	gaps        []uint64          // ascending
+	outstanding map[uint64]string // nonce -> tx hash, "" until broadcast
+}
+
+// newNonceTracker creates a tracker for address; it syncs on first use
+func newNonceTracker(client evmClient, address common.Address) *nonceTracker {
+	return &nonceTracker{
+		client:      client,
+		address:     address,
+		outstanding: make(map[uint64]string),
+	}
+}
+
+// acquire returns a nonce nobody else holds: the lowest gap if any, or the
+// next one. The caller must report it with broadcast or release.
+func (t *nonceTracker) acquire(ctx context.Context) (uint64, error) {
+	if t.stale() {
+		t.syncMu.Lock()
+		var err error
+		if t.stale() {
+			err = t.resync(ctx)
+		}
+		t.syncMu.Unlock()
+		if err != nil {
+			t.mu.Lock()
+			neverSynced := t.lastSync.IsZero()
+			t.mu.Unlock()
+			if neverSynced {
+				return 0, err
+			}
+			slog.WarnContext(ctx, "nonce resync failed, using local state", "error", err)
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var nonce uint64
+	if len(t.gaps) > 0 {
+		nonce = t.gaps[0]
+		t.gaps = t.gaps[1:]
+	} else {
+		nonce = t.next
+		t.next++
+	}
+	t.outstanding[nonce] = ""
+	return nonce, nil
+}
+
+// stale reports whether the local state must be resynced before use
+func (t *nonceTracker) stale() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return !t.synced || time.Since(t.lastSync) > nonceResyncInterval
+}
+
+// broadcast records the transaction sent with nonce
+func (t *nonceTracker) broadcast(nonce uint64, txHash string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.outstanding[nonce] = txHash
+}
+
+// release gives back a nonce whose transaction was not broadcast. Whether
+// the node saw it anyway is only known after a resync, so one is forced.
+func (t *nonceTracker) release(nonce uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.outstanding, nonce)
+	t.synced = false
+}
+
+// mined forgets the nonce of a transaction that has a receipt
+func (t *nonceTracker) mined(txHash string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for nonce, hash := range t.outstanding {
+		if hash == txHash {
+			delete(t.outstanding, nonce)
+			t.minedBelow = max(t.minedBelow, nonce+1)
+			return
+		}
+	}
+}
+
+// invalidate forces a resync before the next nonce is handed out, for
+// example after a transaction was not mined in time
+func (t *nonceTracker) invalidate() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.synced = false
+}
+
+// resync reconciles the local state with the chain. The node is queried
+// without holding t.mu, so nonces keep being handed out meanwhile; the
+// answers are applied to the state as it is once they are in. Must hold
+// t.syncMu.
+func (t *nonceTracker) resync(ctx context.Context) error {
+	latest, err := t.client.NonceAt(ctx, t.address, nil)
+	if err != nil {
+		return fmt.Errorf("failed to get nonce: %w", err)
+	}
+	pending, err := t.client.PendingNonceAt(ctx, t.address)
+	if err != nil {
+		return fmt.Errorf("failed to get pending nonce: %w", err)
+	}
+
+	t.mu.Lock()
+	broadcast := make(map[uint64]string)
+	for nonce, hash := range t.outstanding {
+		if nonce >= latest && hash != "" {
+			broadcast[nonce] = hash
+		}
+	}
+	t.mu.Unlock()
+
+	dropped := make(map[uint64]string)
+	for nonce, hash := range broadcast {
+		if _, _, err := t.client.TransactionByHash(ctx, common.HexToHash(hash)); errors.Is(err, ethereum.NotFound) {
+			dropped[nonce] = hash
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Transactions mined while the node was queried are newer than its answers
+	latest = max(latest, t.minedBelow)
+	pending = max(pending, latest)
+
+	for nonce, hash := range t.outstanding {
+		// Mined, or replaced by another sender using the same key
+		if nonce < latest {
+			delete(t.outstanding, nonce)
+			continue
+		}
+		// Dropped from the mempool: the nonce is free again, unless it was
+		// handed out anew in the meantime
+		if dropped[nonce] != "" && dropped[nonce] == hash {
+			slog.WarnContext(ctx, "transaction dropped, reusing its nonce", "tx", hash, "nonce", nonce)
+			delete(t.outstanding, nonce)
+		}
+	}
+
+	next := pending
+	for nonce := range t.outstanding {
+		next = max(next, nonce+1)
+	}
+
+	// Below pending the node has contiguous transactions; above it, any
+	// nonce nobody holds is a gap
+	t.gaps = t.gaps[:0]
+	for nonce := pending; nonce < next; nonce++ {
+		if _, held := t.outstanding[nonce]; !held {
+			t.gaps = append(t.gaps, nonce)
+		}
+	}
+
+	t.next = next
+	t.synced = true
+	t.lastSync = time.Now()
+	return nil
+}
+
+// blockingGaps takes the gaps that hold back an outstanding transaction and
+// marks them outstanding, for the caller to fill
+func (t *nonceTracker) blockingGaps() []uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var highest uint64
+	found := false
+	for nonce, hash := range t.outstanding {
+		if hash != "" && (!found || nonce > highest) {
+			highest, found = nonce, true
+		}
+	}
+	if !found {
+		return nil
+	}
+
+	var blocking, rest []uint64
+	for _, nonce := range t.gaps {
+		if nonce < highest {
+			blocking = append(blocking, nonce)
+			t.outstanding[nonce] = ""
+		} else {
+			rest = append(rest, nonce)
+		}
+	}
+	t.gaps = rest
+	return blocking
+}
+
+// runNonceResync periodically resyncs the signer's nonces with the chain and
+// fills gaps that hold back later settlements, until ctx is done
+func (s *facilitatorEvmSigner) runNonceResync(ctx context.Context) {
+	ticker := time.NewTicker(nonceResyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s.nonces.syncMu.Lock()
+		err := s.nonces.resync(ctx)
+		s.nonces.syncMu.Unlock()
+		if err != nil {
+			slog.WarnContext(ctx, "nonce resync failed", "error", err)
+			continue
+		}
+
+		for _, nonce := range s.nonces.blockingGaps() {
+			txHash, err := s.sendFiller(ctx, nonce)
+			if err != nil {
+				slog.WarnContext(ctx, "failed to fill nonce gap", "nonce", nonce, "error", err)
+				s.nonces.release(nonce)
+				continue
+			}
+			slog.InfoContext(ctx, "filled nonce gap", "nonce", nonce, "tx", txHash)
+			s.nonces.broadcast(nonce, txHash)
+		}
+	}
+}
+
+// sendFiller sends a zero-value transfer to the facilitator itself with
+// nonce, so transactions queued behind a missing nonce can be mined
+func (s *facilitatorEvmSigner) sendFiller(ctx context.Context, nonce uint64) (string, error) {
+	gasPrice, err := s.client.SuggestGasPrice(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get gas price: %w", err)
+	}
+
+	tx := types.NewTransaction(nonce, s.address, big.NewInt(0), fillerGasLimit, gasPrice, nil)
+	signedTx, err := types.SignTx(tx, types.LatestSignerForChainID(s.chainID), s.privateKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign transaction: %w", err)
+	}
+	if err := s.client.SendTransaction(ctx, signedTx); err != nil {
+		return "", fmt.Errorf("failed to send transaction: %w", err)
+	}
+	return signedTx.Hash().Hex(), nil
+}
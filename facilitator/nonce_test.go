@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+)
+
+// waitForTxIndex mines a block and waits until the node has indexed the
+// chain, so lookups of unknown transactions report them as not found rather
+// than failing while indexing is in progress
+func waitForTxIndex(t *testing.T, signer *facilitatorEvmSigner, backend *simulated.Backend) {
+	t.Helper()
+
+	backend.Commit()
+	unknown := crypto.Keccak256Hash([]byte("unknown"))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, _, err := signer.client.TransactionByHash(context.Background(), unknown)
+		if errors.Is(err, ethereum.NotFound) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("transaction index not ready: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNonceTrackerReleaseKeepsOutstanding(t *testing.T) {
+	signer := newTestSigner(t)
+	ctx := context.Background()
+
+	var nonces []uint64
+	for i := 0; i < 3; i++ {
+		nonce, err := signer.nonces.acquire(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nonces = append(nonces, nonce)
+	}
+	if nonces[0] != 0 || nonces[1] != 1 || nonces[2] != 2 {
+		t.Fatalf("nonces = %v, want [0 1 2]", nonces)
+	}
+
+	// Releasing 1 forces a resync; 0 and 2 are still held and must not be
+	// handed out again
+	signer.nonces.release(1)
+	seen := map[uint64]bool{}
+	for i := 0; i < 2; i++ {
+		nonce, err := signer.nonces.acquire(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nonce == 0 || nonce == 2 || seen[nonce] {
+			t.Fatalf("acquire returned %d while it is outstanding", nonce)
+		}
+		seen[nonce] = true
+	}
+	if !seen[1] || !seen[3] {
+		t.Fatalf("acquired %v after release, want the gap 1 and then 3", seen)
+	}
+}
+
+func TestNonceTrackerDroppedTransaction(t *testing.T) {
+	signer, backend := newTestChain(t, nil)
+	ctx := context.Background()
+	waitForTxIndex(t, signer, backend)
+
+	first, _ := signer.nonces.acquire(ctx)
+	second, _ := signer.nonces.acquire(ctx)
+
+	// The node has never seen this hash: the transaction was dropped
+	signer.nonces.broadcast(first, crypto.Keccak256Hash([]byte("dropped")).Hex())
+	signer.nonces.invalidate()
+
+	nonce, err := signer.nonces.acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nonce != first {
+		t.Fatalf("acquire = %d, want the dropped nonce %d back", nonce, first)
+	}
+	if nonce == second {
+		t.Fatal("outstanding nonce reissued")
+	}
+}
+
+func TestNonceTrackerBlockingGaps(t *testing.T) {
+	signer := newTestSigner(t)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		signer.nonces.acquire(ctx)
+	}
+	// 0 and 1 never made it out, 2 was broadcast and is held back by them
+	signer.nonces.release(0)
+	signer.nonces.release(1)
+	signer.nonces.syncMu.Lock()
+	err := signer.nonces.resync(ctx)
+	signer.nonces.syncMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer.nonces.broadcast(2, crypto.Keccak256Hash([]byte("queued")).Hex())
+
+	gaps := signer.nonces.blockingGaps()
+	if len(gaps) != 2 || gaps[0] != 0 || gaps[1] != 1 {
+		t.Fatalf("blockingGaps = %v, want [0 1]", gaps)
+	}
+	if again := signer.nonces.blockingGaps(); len(again) != 0 {
+		t.Fatalf("gaps handed out twice: %v", again)
+	}
+}
+
+func TestNonceTrackerConcurrentAcquire(t *testing.T) {
+	signer := newTestSigner(t)
+	ctx := context.Background()
+
+	const workers = 20
+	nonces := make(chan uint64, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			nonce, err := signer.nonces.acquire(ctx)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			// Force the next acquire to resync while others hand out nonces
+			signer.nonces.invalidate()
+			nonces <- nonce
+		}()
+	}
+	wg.Wait()
+	close(nonces)
+
+	seen := map[uint64]bool{}
+	for nonce := range nonces {
+		if seen[nonce] {
+			t.Fatalf("nonce %d handed out twice", nonce)
+		}
+		seen[nonce] = true
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"go_code/x402/logging"
+)
+
+const (
+	DefaultPendingFile = "pending_settlements.json"
+
+	// pendingKindBatch marks a deferred Multicall3 batch, which the deferred
+	// queue resumes itself from the transaction recorded on its entries
+	pendingKindBatch = "deferred_batch"
+)
+
+// ============================================================================
+// Pending Settlement Store
+// ============================================================================
+
+// pendingSettlement is a settlement transaction that has been broadcast but
+// whose confirmation has not been observed yet. Payer, Amount and Kind
+// describe the payment it settles, so recovery can report it in full; Kind is
+// the payment scheme, or pendingKindBatch for a deferred batch.
+type pendingSettlement struct {
+	TxHash    string    `json:"txHash"`
+	Network   string    `json:"network"`
+	Payer     string    `json:"payer,omitempty"`
+	Amount    string    `json:"amount,omitempty"`
+	Kind      string    `json:"kind,omitempty"`
+	RequestID string    `json:"requestId,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// pendingPayment describes the payment whose settlement a request broadcasts
+type pendingPayment struct {
+	Payer  string
+	Amount string
+	Kind   string
+}
+
+type pendingPaymentKey struct{}
+
+// withPendingPayment attaches the payment being settled to ctx, so the
+// pending entry of the transaction broadcast for it records its details
+func withPendingPayment(ctx context.Context, payment pendingPayment) context.Context {
+	return context.WithValue(ctx, pendingPaymentKey{}, payment)
+}
+
+// pendingPaymentFrom returns the payment attached to ctx, if any
+func pendingPaymentFrom(ctx context.Context) pendingPayment {
+	payment, _ := ctx.Value(pendingPaymentKey{}).(pendingPayment)
+	return payment
+}
+
+// paymentPayload is the part of a payment payload that names the payer, for
+// each of the EVM payload shapes the facilitator settles
+type paymentPayload struct {
+	Payload struct {
+		Authorization struct {
+			From string `json:"from"`
+		} `json:"authorization"`
+		Permit2Authorization struct {
+			From string `json:"from"`
+		} `json:"permit2Authorization"`
+		Permit struct {
+			Owner string `json:"owner"`
+		} `json:"permit"`
+	} `json:"payload"`
+}
+
+// describePayment extracts the payer, amount and scheme of a payment on a
+// best-effort basis; fields that cannot be determined are left empty
+func describePayment(payload, requirements json.RawMessage) pendingPayment {
+	var payment pendingPayment
+
+	if fields, err := parseRequirementsFields(requirements); err == nil {
+		payment.Amount = fields.amount()
+		payment.Kind = fields.Scheme
+	}
+
+	var parsed paymentPayload
+	if err := json.Unmarshal(payload, &parsed); err == nil {
+		switch {
+		case parsed.Payload.Authorization.From != "":
+			payment.Payer = parsed.Payload.Authorization.From
+		case parsed.Payload.Permit2Authorization.From != "":
+			payment.Payer = parsed.Payload.Permit2Authorization.From
+		case parsed.Payload.Permit.Owner != "":
+			payment.Payer = parsed.Payload.Permit.Owner
+		}
+	}
+
+	return payment
+}
+
+// pendingStore keeps track of broadcast-but-unconfirmed settlement
+// transactions in a JSON file, so they survive a shutdown or crash of the
+// facilitator and can be resumed on the next start.
+//
+// A nil *pendingStore is valid and records nothing.
+type pendingStore struct {
+	mu      sync.Mutex
+	path    string
+	pending map[string]pendingSettlement
+}
+
+// newPendingStore opens the pending settlement store at path, loading any
+// entries left behind by a previous run
+//
+// Args:
+//
+//	path: JSON file used for persistence (created on first write)
+//
+// Returns:
+//
+//	*pendingStore or error
+func newPendingStore(path string) (*pendingStore, error) {
+	store := &pendingStore{
+		path:    path,
+		pending: make(map[string]pendingSettlement),
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pending settlements: %w", err)
+	}
+	if len(data) == 0 {
+		return store, nil
+	}
+
+	var entries []pendingSettlement
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse pending settlements: %w", err)
+	}
+	for _, entry := range entries {
+		store.pending[entry.TxHash] = entry
+	}
+
+	return store, nil
+}
+
+// Add records a broadcast transaction, with the ID of the request that
+// broadcast it and the payment attached to ctx, and persists the store
+// immediately
+func (p *pendingStore) Add(ctx context.Context, txHash string, network string) {
+	if p == nil || txHash == "" {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	payment := pendingPaymentFrom(ctx)
+	p.pending[txHash] = pendingSettlement{
+		TxHash:    txHash,
+		Network:   network,
+		Payer:     payment.Payer,
+		Amount:    payment.Amount,
+		Kind:      payment.Kind,
+		RequestID: logging.RequestID(ctx),
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := p.saveLocked(); err != nil {
+		slog.WarnContext(ctx, "failed to persist pending settlement", "tx", txHash, "error", err)
+	}
+}
+
+// Remove forgets a transaction once its outcome is known
+func (p *pendingStore) Remove(txHash string) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.pending[txHash]; !ok {
+		return
+	}
+	delete(p.pending, txHash)
+	if err := p.saveLocked(); err != nil {
+		slog.Warn("failed to persist pending settlements", "error", err)
+	}
+}
+
+// List returns the pending transactions, oldest first
+func (p *pendingStore) List() []pendingSettlement {
+	if p == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.sortedLocked()
+}
+
+// Flush writes the current set of pending transactions to disk
+func (p *pendingStore) Flush() error {
+	if p == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.saveLocked()
+}
+
+// saveLocked atomically replaces the store file. Callers must hold p.mu.
+func (p *pendingStore) saveLocked() error {
+	return writeJSONFile(p.path, p.sortedLocked())
+}
+
+// sortedLocked returns the entries ordered by broadcast time. Callers must
+// hold p.mu.
+func (p *pendingStore) sortedLocked() []pendingSettlement {
+	entries := make([]pendingSettlement, 0, len(p.pending))
+	for _, entry := range p.pending {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].CreatedAt.Before(entries[j].CreatedAt)
+	})
+	return entries
+}
+
+// writeJSONFile atomically replaces path with the indented JSON encoding of v,
+// so a crash mid-write never leaves a truncated file behind
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,679 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"time"
+
+	x402 "github.com/coinbase/x402/go"
+	evmmech "github.com/coinbase/x402/go/mechanisms/evm"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// ============================================================================
+// Permit2 / EIP-2612 Payments
+// ============================================================================
+
+const (
+	// Permit2 is deployed at the same address on every EVM chain it supports
+	Permit2Address = "0x000000000022D473030F116dDEE9F6B43aC78BA3"
+
+	// Asset transfer methods, advertised in /supported as
+	// extra.assetTransferMethods for the exact EVM scheme
+	TransferMethodEIP3009 = "eip3009"
+	TransferMethodPermit2 = "permit2"
+	TransferMethodEIP2612 = "eip2612"
+
+	// SchemeUpto authorizes a maximum and settles what the resource server
+	// reports as consumed. Only permit based transfers can move less than
+	// the signed amount, so EIP-3009 is not offered.
+	SchemeUpto = "upto"
+
+	// permitDeadlineBuffer is the least time a permit must still be valid
+	// for, so it doesn't expire while its transaction is being mined
+	permitDeadlineBuffer = 6 * time.Second
+)
+
+const permit2ABI = `[
+{"inputs":[{"components":[{"components":[{"name":"token","type":"address"},{"name":"amount","type":"uint256"}],"name":"permitted","type":"tuple"},{"name":"nonce","type":"uint256"},{"name":"deadline","type":"uint256"}],"name":"permit","type":"tuple"},{"components":[{"name":"to","type":"address"},{"name":"requestedAmount","type":"uint256"}],"name":"transferDetails","type":"tuple"},{"name":"owner","type":"address"},{"name":"witness","type":"bytes32"},{"name":"witnessTypeString","type":"string"},{"name":"signature","type":"bytes"}],"name":"permitWitnessTransferFrom","outputs":[],"stateMutability":"nonpayable","type":"function"},
+{"inputs":[{"name":"owner","type":"address"},{"name":"wordPos","type":"uint256"}],"name":"nonceBitmap","outputs":[{"name":"","type":"uint256"}],"stateMutability":"view","type":"function"}
+]`
+
+const erc20PermitABI = `[
+{"inputs":[{"name":"account","type":"address"}],"name":"balanceOf","outputs":[{"name":"","type":"uint256"}],"stateMutability":"view","type":"function"},
+{"inputs":[{"name":"owner","type":"address"},{"name":"spender","type":"address"}],"name":"allowance","outputs":[{"name":"","type":"uint256"}],"stateMutability":"view","type":"function"},
+{"inputs":[{"name":"owner","type":"address"}],"name":"nonces","outputs":[{"name":"","type":"uint256"}],"stateMutability":"view","type":"function"},
+{"inputs":[{"name":"owner","type":"address"},{"name":"spender","type":"address"},{"name":"value","type":"uint256"},{"name":"deadline","type":"uint256"},{"name":"v","type":"uint8"},{"name":"r","type":"bytes32"},{"name":"s","type":"bytes32"}],"name":"permit","outputs":[],"stateMutability":"nonpayable","type":"function"},
+{"inputs":[{"name":"from","type":"address"},{"name":"to","type":"address"},{"name":"amount","type":"uint256"}],"name":"transferFrom","outputs":[{"name":"","type":"bool"}],"stateMutability":"nonpayable","type":"function"}
+]`
+
+// Permit2 witness: the payer's signature also commits to the recipient, so
+// whoever holds the payload can't settle it to another address.
+// permit2WitnessTypeString is what permitWitnessTransferFrom appends to its
+// "PermitWitnessTransferFrom(...," stub: the witness field, then the
+// referenced types in alphabetical order.
+const (
+	permit2WitnessType       = "Witness(address to,uint256 validAfter)"
+	permit2WitnessTypeString = "Witness witness)TokenPermissions(address token,uint256 amount)" + permit2WitnessType
+)
+
+// EIP-2612 permits don't name a recipient, so the payer signs a
+// PermitWitness for the same permit under this domain, with the facilitator
+// as verifying contract
+const (
+	permitWitnessDomainName    = "x402 Permit Witness"
+	permitWitnessDomainVersion = "1"
+)
+
+// EIP-712 types signed by the payer
+var (
+	permit2Types = map[string][]evmmech.TypedDataField{
+		"PermitWitnessTransferFrom": {
+			{Name: "permitted", Type: "TokenPermissions"},
+			{Name: "spender", Type: "address"},
+			{Name: "nonce", Type: "uint256"},
+			{Name: "deadline", Type: "uint256"},
+			{Name: "witness", Type: "Witness"},
+		},
+		"TokenPermissions": {
+			{Name: "token", Type: "address"},
+			{Name: "amount", Type: "uint256"},
+		},
+		"Witness": {
+			{Name: "to", Type: "address"},
+			{Name: "validAfter", Type: "uint256"},
+		},
+	}
+
+	eip2612Types = map[string][]evmmech.TypedDataField{
+		"Permit": {
+			{Name: "owner", Type: "address"},
+			{Name: "spender", Type: "address"},
+			{Name: "value", Type: "uint256"},
+			{Name: "nonce", Type: "uint256"},
+			{Name: "deadline", Type: "uint256"},
+		},
+	}
+
+	permitWitnessTypes = map[string][]evmmech.TypedDataField{
+		"EIP712Domain": {
+			{Name: "name", Type: "string"},
+			{Name: "version", Type: "string"},
+			{Name: "chainId", Type: "uint256"},
+			{Name: "verifyingContract", Type: "address"},
+		},
+		"PermitWitness": {
+			{Name: "token", Type: "address"},
+			{Name: "owner", Type: "address"},
+			{Name: "nonce", Type: "uint256"},
+			{Name: "deadline", Type: "uint256"},
+			{Name: "payTo", Type: "address"},
+		},
+	}
+
+	// permit2WitnessTypeHash is keccak256 of permit2WitnessType
+	permit2WitnessTypeHash = crypto.Keccak256Hash([]byte(permit2WitnessType))
+)
+
+// Go mirrors of the Permit2 SignatureTransfer structs, for ABI packing
+type permit2TokenPermissions struct {
+	Token  common.Address
+	Amount *big.Int
+}
+
+type permit2PermitTransferFrom struct {
+	Permitted permit2TokenPermissions
+	Nonce     *big.Int
+	Deadline  *big.Int
+}
+
+type permit2TransferDetails struct {
+	To              common.Address
+	RequestedAmount *big.Int
+}
+
+// permitPayload is an exact EVM payment payload carrying a Permit2 or
+// EIP-2612 signature instead of an EIP-3009 authorization. Numbers may be
+// decimal or hex strings or JSON numbers.
+//
+//	Permit2:  {"signature": "0x...", "permit2Authorization": {"from", "permitted": {"token", "amount"}, "spender", "nonce", "deadline", "witness": {"to", "validAfter"}}}
+//	EIP-2612: {"signature": "0x...", "witnessSignature": "0x...", "permit": {"owner", "spender", "value", "nonce", "deadline"}}
+type permitPayload struct {
+	Payload struct {
+		Signature            string `json:"signature"`
+		WitnessSignature     string `json:"witnessSignature"`
+		Permit2Authorization *struct {
+			From      string `json:"from"`
+			Permitted struct {
+				Token  string      `json:"token"`
+				Amount interface{} `json:"amount"`
+			} `json:"permitted"`
+			Spender  string      `json:"spender"`
+			Nonce    interface{} `json:"nonce"`
+			Deadline interface{} `json:"deadline"`
+			Witness  struct {
+				To         string      `json:"to"`
+				ValidAfter interface{} `json:"validAfter"`
+			} `json:"witness"`
+		} `json:"permit2Authorization"`
+		Permit *struct {
+			Owner    string      `json:"owner"`
+			Spender  string      `json:"spender"`
+			Value    interface{} `json:"value"`
+			Nonce    interface{} `json:"nonce"`
+			Deadline interface{} `json:"deadline"`
+		} `json:"permit"`
+	} `json:"payload"`
+}
+
+// permitTransfer is a verified permit payment, ready to settle
+type permitTransfer struct {
+	method    string
+	network   string
+	payer     common.Address
+	token     common.Address
+	payTo     common.Address
+	amount    *big.Int
+	signature []byte
+
+	// Permit2
+	permit2 permit2PermitTransferFrom
+	witness common.Hash
+
+	// EIP-2612
+	value    *big.Int
+	deadline *big.Int
+}
+
+// permitScheme settles exact EVM payments for tokens without EIP-3009,
+// through Uniswap Permit2 permitWitnessTransferFrom or EIP-2612 permit
+// followed by transferFrom. In both cases the facilitator is the spender and
+// pays gas, and every settlement needs a fresh signature from the payer that
+// names payTo: the Permit2 witness, or the PermitWitness signed next to an
+// EIP-2612 permit. An allowance left from an earlier permit is never used.
+//
+// The same mechanism serves the upto scheme: the payer signs a permit for
+// the maximum, verification runs against that maximum, and the resource
+// server settles with the consumed amount in the requirements. Permit2
+// transfers just the requested amount and EIP-2612 transferFrom pulls less
+// than the permitted value. The rest of an EIP-2612 permit stays approved to
+// the facilitator until the payer's next permit replaces it, so payers trust
+// the facilitator key with it; permits are capped at the request's maximum
+// to bound that.
+type permitScheme struct {
+	signer *facilitatorEvmSigner
+	scheme string
+}
+
+// newPermitScheme creates the Permit2 / EIP-2612 mechanism for signer's network
+func newPermitScheme(signer *facilitatorEvmSigner) *permitScheme {
+	return &permitScheme{signer: signer, scheme: "exact"}
+}
+
+// newUptoScheme creates the upto mechanism for signer's network
+func newUptoScheme(signer *facilitatorEvmSigner) *permitScheme {
+	return &permitScheme{signer: signer, scheme: SchemeUpto}
+}
+
+// Handles accepts payments of the mechanism's scheme on the signer's network
+// whose payload carries a Permit2 authorization or an EIP-2612 permit
+func (p *permitScheme) Handles(payload []byte, requirements requirementsFields) bool {
+	if requirements.Scheme != p.scheme || requirements.Network != p.signer.network() {
+		return false
+	}
+	var parsed permitPayload
+	if err := json.Unmarshal(payload, &parsed); err != nil {
+		return false
+	}
+	return parsed.Payload.Permit2Authorization != nil || parsed.Payload.Permit != nil
+}
+
+// Supported advertises the extra transfer methods on the exact scheme. The
+// upto kind also names the spender its permits must be signed for.
+func (p *permitScheme) Supported() []x402.SupportedKind {
+	if p.scheme == SchemeUpto {
+		return []x402.SupportedKind{{
+			X402Version: 2,
+			Scheme:      SchemeUpto,
+			Network:     p.signer.network(),
+			Extra: map[string]interface{}{
+				"assetTransferMethods": []string{TransferMethodPermit2, TransferMethodEIP2612},
+				"spender":              p.signer.address.Hex(),
+			},
+		}}
+	}
+
+	return []x402.SupportedKind{{
+		X402Version: 2,
+		Scheme:      "exact",
+		Network:     p.signer.network(),
+		Extra: map[string]interface{}{
+			"assetTransferMethods": []string{TransferMethodEIP3009, TransferMethodPermit2, TransferMethodEIP2612},
+		},
+	}}
+}
+
+func (p *permitScheme) Verify(ctx context.Context, payload []byte, requirements []byte) (*x402.VerifyResponse, error) {
+	transfer, err := p.verify(ctx, payload, requirements)
+	if err != nil {
+		return nil, err
+	}
+	return &x402.VerifyResponse{IsValid: true, Payer: transfer.payer.Hex()}, nil
+}
+
+func (p *permitScheme) Settle(ctx context.Context, payload []byte, requirements []byte) (*x402.SettleResponse, error) {
+	transfer, err := p.verify(ctx, payload, requirements)
+	if err != nil {
+		return nil, settleFailure(err)
+	}
+
+	// Nothing consumed on an upto payment: there is nothing to transfer
+	if transfer.amount.Sign() == 0 {
+		return &x402.SettleResponse{
+			Success: true,
+			Payer:   transfer.payer.Hex(),
+			Network: x402.Network(transfer.network),
+		}, nil
+	}
+
+	var txHash string
+	switch transfer.method {
+	case TransferMethodPermit2:
+		txHash, err = p.settlePermit2(ctx, transfer)
+	case TransferMethodEIP2612:
+		txHash, err = p.settleEIP2612(ctx, transfer)
+	}
+	if err != nil {
+		return nil, &x402.SettleError{
+			Reason:      "transaction_failed",
+			Payer:       transfer.payer.Hex(),
+			Network:     x402.Network(transfer.network),
+			Transaction: txHash,
+			Err:         err,
+		}
+	}
+
+	return &x402.SettleResponse{
+		Success:     true,
+		Payer:       transfer.payer.Hex(),
+		Transaction: txHash,
+		Network:     x402.Network(transfer.network),
+	}, nil
+}
+
+// verify checks a permit payment against its requirements and the chain
+func (p *permitScheme) verify(ctx context.Context, payload []byte, requirements []byte) (*permitTransfer, error) {
+	fields, err := parseRequirementsFields(requirements)
+	if err != nil {
+		return nil, verifyFailure("invalid_payment_requirements", "", "", "%v", err)
+	}
+	network := fields.Network
+
+	var parsed permitPayload
+	if err := json.Unmarshal(payload, &parsed); err != nil {
+		return nil, verifyFailure("invalid_payload", "", network, "invalid permit payload: %v", err)
+	}
+
+	amount, err := parseUint256(fields.amount())
+	if err != nil {
+		return nil, verifyFailure("invalid_payment_requirements", "", network, "invalid amount: %v", err)
+	}
+	if !common.IsHexAddress(fields.Asset) || !common.IsHexAddress(fields.PayTo) {
+		return nil, verifyFailure("invalid_payment_requirements", "", network, "invalid asset or payTo address")
+	}
+
+	signature, err := hexutil.Decode(parsed.Payload.Signature)
+	if err != nil {
+		return nil, verifyFailure("invalid_payload", "", network, "invalid signature encoding: %v", err)
+	}
+
+	transfer := &permitTransfer{
+		network:   network,
+		token:     common.HexToAddress(fields.Asset),
+		payTo:     common.HexToAddress(fields.PayTo),
+		amount:    amount,
+		signature: signature,
+	}
+
+	switch {
+	case parsed.Payload.Permit2Authorization != nil:
+		transfer.method = TransferMethodPermit2
+		err = p.verifyPermit2(ctx, &parsed, transfer)
+	case parsed.Payload.Permit != nil:
+		transfer.method = TransferMethodEIP2612
+		err = p.verifyEIP2612(ctx, &parsed, fields, transfer)
+	default:
+		err = verifyFailure("invalid_payload", "", network, "payload has neither permit2Authorization nor permit")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Both methods move tokens out of the payer's balance
+	balance, err := p.readUint(ctx, transfer.token, erc20PermitABI, "balanceOf", transfer.payer)
+	if err != nil {
+		return nil, err
+	}
+	if balance.Cmp(amount) < 0 {
+		return nil, verifyFailure("insufficient_funds", transfer.payer.Hex(), network,
+			"balance %s is below the required %s", balance, amount)
+	}
+
+	return transfer, nil
+}
+
+// verifyPermit2 checks a Permit2 SignatureTransfer permit
+func (p *permitScheme) verifyPermit2(ctx context.Context, parsed *permitPayload, transfer *permitTransfer) error {
+	auth := parsed.Payload.Permit2Authorization
+	network := transfer.network
+
+	if !common.IsHexAddress(auth.From) || !common.IsHexAddress(auth.Spender) || !common.IsHexAddress(auth.Permitted.Token) {
+		return verifyFailure("invalid_payload", auth.From, network, "invalid address in permit2Authorization")
+	}
+	transfer.payer = common.HexToAddress(auth.From)
+	payer := transfer.payer.Hex()
+
+	permitted, err := parseUint256(auth.Permitted.Amount)
+	if err != nil {
+		return verifyFailure("invalid_payload", payer, network, "invalid permitted amount: %v", err)
+	}
+	nonce, err := parseUint256(auth.Nonce)
+	if err != nil {
+		return verifyFailure("invalid_payload", payer, network, "invalid nonce: %v", err)
+	}
+	deadline, err := parseUint256(auth.Deadline)
+	if err != nil {
+		return verifyFailure("invalid_payload", payer, network, "invalid deadline: %v", err)
+	}
+
+	if common.HexToAddress(auth.Permitted.Token) != transfer.token {
+		return verifyFailure("invalid_permit2_token", payer, network, "permit is for token %s, requirements ask for %s",
+			auth.Permitted.Token, transfer.token.Hex())
+	}
+	if permitted.Cmp(transfer.amount) < 0 {
+		return verifyFailure("invalid_permit2_amount", payer, network, "permitted amount %s is below the required %s",
+			permitted, transfer.amount)
+	}
+	if common.HexToAddress(auth.Spender) != p.signer.address {
+		return verifyFailure("invalid_permit2_spender", payer, network, "spender %s is not the facilitator %s",
+			auth.Spender, p.signer.address.Hex())
+	}
+	if err := checkDeadline(deadline); err != nil {
+		return verifyFailure("permit2_deadline_expired", payer, network, "%v", err)
+	}
+
+	// The witness must send the funds where the requirements say
+	if !common.IsHexAddress(auth.Witness.To) || common.HexToAddress(auth.Witness.To) != transfer.payTo {
+		return verifyFailure("invalid_permit2_witness", payer, network, "witness recipient %q is not payTo %s",
+			auth.Witness.To, transfer.payTo.Hex())
+	}
+	validAfter, err := parseUint256(auth.Witness.ValidAfter)
+	if err != nil {
+		return verifyFailure("invalid_payload", payer, network, "invalid witness validAfter: %v", err)
+	}
+	if validAfter.Cmp(big.NewInt(time.Now().Unix())) > 0 {
+		return verifyFailure("invalid_permit2_witness", payer, network, "permit is not valid before %s", validAfter)
+	}
+	transfer.witness = crypto.Keccak256Hash(
+		permit2WitnessTypeHash.Bytes(),
+		common.LeftPadBytes(transfer.payTo.Bytes(), 32),
+		math.U256Bytes(new(big.Int).Set(validAfter)),
+	)
+
+	transfer.permit2 = permit2PermitTransferFrom{
+		Permitted: permit2TokenPermissions{Token: transfer.token, Amount: permitted},
+		Nonce:     nonce,
+		Deadline:  deadline,
+	}
+
+	domain := evmmech.TypedDataDomain{
+		Name:              "Permit2",
+		ChainID:           p.signer.chainID,
+		VerifyingContract: Permit2Address,
+	}
+	message := map[string]interface{}{
+		"permitted": map[string]interface{}{
+			"token":  transfer.token.Hex(),
+			"amount": permitted,
+		},
+		"spender":  p.signer.address.Hex(),
+		"nonce":    nonce,
+		"deadline": deadline,
+		"witness": map[string]interface{}{
+			"to":         transfer.payTo.Hex(),
+			"validAfter": validAfter,
+		},
+	}
+	valid, err := p.signer.VerifyTypedData(ctx, payer, domain, permit2Types, "PermitWitnessTransferFrom", message, transfer.signature)
+	if err != nil {
+		return verifyFailure("invalid_permit2_signature", payer, network, "%v", err)
+	}
+	if !valid {
+		return verifyFailure("invalid_permit2_signature", payer, network, "permit2 signature does not match the payer")
+	}
+
+	// Permit2 nonces are bits in a per-owner bitmap: word nonce>>8, bit nonce&0xff
+	bitmap, err := p.readUint(ctx, common.HexToAddress(Permit2Address), permit2ABI, "nonceBitmap",
+		transfer.payer, new(big.Int).Rsh(nonce, 8))
+	if err != nil {
+		return err
+	}
+	if bitmap.Bit(int(new(big.Int).And(nonce, big.NewInt(0xff)).Int64())) == 1 {
+		return verifyFailure("permit2_nonce_used", payer, network, "permit2 nonce %s was already used", nonce)
+	}
+
+	// The payer must have approved Permit2 on the token
+	allowance, err := p.readUint(ctx, transfer.token, erc20PermitABI, "allowance",
+		transfer.payer, common.HexToAddress(Permit2Address))
+	if err != nil {
+		return err
+	}
+	if allowance.Cmp(transfer.amount) < 0 {
+		return verifyFailure("permit2_allowance_required", payer, network,
+			"payer has approved %s to Permit2, %s required", allowance, transfer.amount)
+	}
+
+	return nil
+}
+
+// verifyEIP2612 checks an EIP-2612 permit with the facilitator as spender
+func (p *permitScheme) verifyEIP2612(ctx context.Context, parsed *permitPayload, fields requirementsFields, transfer *permitTransfer) error {
+	permit := parsed.Payload.Permit
+	network := transfer.network
+
+	if !common.IsHexAddress(permit.Owner) || !common.IsHexAddress(permit.Spender) {
+		return verifyFailure("invalid_payload", permit.Owner, network, "invalid address in permit")
+	}
+	transfer.payer = common.HexToAddress(permit.Owner)
+	payer := transfer.payer.Hex()
+
+	value, err := parseUint256(permit.Value)
+	if err != nil {
+		return verifyFailure("invalid_payload", payer, network, "invalid value: %v", err)
+	}
+	nonce, err := parseUint256(permit.Nonce)
+	if err != nil {
+		return verifyFailure("invalid_payload", payer, network, "invalid nonce: %v", err)
+	}
+	deadline, err := parseUint256(permit.Deadline)
+	if err != nil {
+		return verifyFailure("invalid_payload", payer, network, "invalid deadline: %v", err)
+	}
+	transfer.value = value
+	transfer.deadline = deadline
+
+	if len(transfer.signature) != 65 {
+		return verifyFailure("invalid_permit_signature", payer, network, "EIP-2612 permits need a 65 byte signature, got %d", len(transfer.signature))
+	}
+	if value.Cmp(transfer.amount) < 0 {
+		return verifyFailure("invalid_permit_value", payer, network, "permit value %s is below the required %s", value, transfer.amount)
+	}
+	// An upto permit leaves what was not consumed as allowance with the
+	// facilitator, so it may not exceed the request's maximum: the amount
+	// when verifying, extra.maxAmount once the amount is lowered to the usage
+	if p.scheme == SchemeUpto {
+		limit := transfer.amount
+		if raw, ok := fields.Extra["maxAmount"].(string); ok {
+			maxAmount, err := parseUint256(raw)
+			if err != nil || maxAmount.Cmp(transfer.amount) < 0 {
+				return verifyFailure("invalid_payment_requirements", payer, network, "invalid maxAmount %q", raw)
+			}
+			limit = maxAmount
+		}
+		if value.Cmp(limit) > 0 {
+			return verifyFailure("invalid_permit_value", payer, network, "upto permit value %s exceeds the maximum %s", value, limit)
+		}
+	}
+	if common.HexToAddress(permit.Spender) != p.signer.address {
+		return verifyFailure("invalid_permit_spender", payer, network, "spender %s is not the facilitator %s",
+			permit.Spender, p.signer.address.Hex())
+	}
+
+	if err := checkDeadline(deadline); err != nil {
+		return verifyFailure("permit_deadline_expired", payer, network, "%v", err)
+	}
+
+	name, _ := fields.Extra["name"].(string)
+	version, _ := fields.Extra["version"].(string)
+	domain := evmmech.TypedDataDomain{
+		Name:              name,
+		Version:           version,
+		ChainID:           p.signer.chainID,
+		VerifyingContract: transfer.token.Hex(),
+	}
+	message := map[string]interface{}{
+		"owner":    payer,
+		"spender":  p.signer.address.Hex(),
+		"value":    value,
+		"nonce":    nonce,
+		"deadline": deadline,
+	}
+	valid, err := p.signer.VerifyTypedData(ctx, payer, domain, eip2612Types, "Permit", message, transfer.signature)
+	if err != nil {
+		return verifyFailure("invalid_permit_signature", payer, network, "%v", err)
+	}
+	if !valid {
+		return verifyFailure("invalid_permit_signature", payer, network, "permit signature does not match the payer")
+	}
+
+	// The permit itself doesn't name a recipient: the witness binds it to payTo
+	witnessSignature, err := hexutil.Decode(parsed.Payload.WitnessSignature)
+	if err != nil {
+		return verifyFailure("invalid_permit_witness", payer, network, "missing or invalid witnessSignature: %v", err)
+	}
+	witnessDomain := evmmech.TypedDataDomain{
+		Name:              permitWitnessDomainName,
+		Version:           permitWitnessDomainVersion,
+		ChainID:           p.signer.chainID,
+		VerifyingContract: p.signer.address.Hex(),
+	}
+	witness := map[string]interface{}{
+		"token":    transfer.token.Hex(),
+		"owner":    payer,
+		"nonce":    nonce,
+		"deadline": deadline,
+		"payTo":    transfer.payTo.Hex(),
+	}
+	valid, err = p.signer.VerifyTypedData(ctx, payer, witnessDomain, permitWitnessTypes, "PermitWitness", witness, witnessSignature)
+	if err != nil {
+		return verifyFailure("invalid_permit_witness", payer, network, "%v", err)
+	}
+	if !valid {
+		return verifyFailure("invalid_permit_witness", payer, network, "witness signature does not bind the permit to payTo %s", transfer.payTo.Hex())
+	}
+
+	// The permit must be the next one the token accepts, so it is submitted
+	// (and its allowance replaced) by this settlement
+	current, err := p.readUint(ctx, transfer.token, erc20PermitABI, "nonces", transfer.payer)
+	if err != nil {
+		return err
+	}
+	if current.Cmp(nonce) != 0 {
+		return verifyFailure("invalid_permit_nonce", payer, network, "permit nonce %s, token expects %s", nonce, current)
+	}
+
+	return nil
+}
+
+// settlePermit2 pulls the payment to payTo through Permit2, which checks the
+// signed witness against the recipient
+func (p *permitScheme) settlePermit2(ctx context.Context, transfer *permitTransfer) (string, error) {
+	details := permit2TransferDetails{To: transfer.payTo, RequestedAmount: transfer.amount}
+	txHash, err := p.signer.WriteContract(ctx, Permit2Address, []byte(permit2ABI), "permitWitnessTransferFrom",
+		transfer.permit2, details, transfer.payer, [32]byte(transfer.witness), permit2WitnessTypeString, transfer.signature)
+	if err != nil {
+		return "", err
+	}
+	return txHash, p.waitSuccess(ctx, txHash)
+}
+
+// settleEIP2612 submits the verified permit, then transfers from the payer
+// to payTo. The permit always goes first, so the transfer only ever spends
+// the allowance this payment's signature just granted.
+func (p *permitScheme) settleEIP2612(ctx context.Context, transfer *permitTransfer) (string, error) {
+	var r, s [32]byte
+	copy(r[:], transfer.signature[:32])
+	copy(s[:], transfer.signature[32:64])
+	v := transfer.signature[64]
+	if v < 27 {
+		v += 27
+	}
+
+	permitHash, err := p.signer.WriteContract(ctx, transfer.token.Hex(), []byte(erc20PermitABI), "permit",
+		transfer.payer, p.signer.address, transfer.value, transfer.deadline, v, r, s)
+	if err != nil {
+		return "", fmt.Errorf("permit: %w", err)
+	}
+	if err := p.waitSuccess(ctx, permitHash); err != nil {
+		return permitHash, fmt.Errorf("permit: %w", err)
+	}
+	slog.InfoContext(ctx, "permit submitted", "payer", transfer.payer.Hex(), "tx", permitHash)
+
+	txHash, err := p.signer.WriteContract(ctx, transfer.token.Hex(), []byte(erc20PermitABI), "transferFrom",
+		transfer.payer, transfer.payTo, transfer.amount)
+	if err != nil {
+		return "", fmt.Errorf("transferFrom: %w", err)
+	}
+	return txHash, p.waitSuccess(ctx, txHash)
+}
+
+// waitSuccess waits for a transaction and fails if it reverted
+func (p *permitScheme) waitSuccess(ctx context.Context, txHash string) error {
+	receipt, err := p.signer.WaitForTransactionReceipt(ctx, txHash)
+	if err != nil {
+		return err
+	}
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		return fmt.Errorf("transaction %s reverted", txHash)
+	}
+	return nil
+}
+
+// readUint reads a uint256 view function through ReadContract
+func (p *permitScheme) readUint(ctx context.Context, contract common.Address, abiJSON string, method string, args ...interface{}) (*big.Int, error) {
+	result, err := p.signer.ReadContract(ctx, contract.Hex(), []byte(abiJSON), method, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", method, err)
+	}
+	value, ok := result.(*big.Int)
+	if !ok {
+		return nil, fmt.Errorf("unexpected %s result type: %T", method, result)
+	}
+	return value, nil
+}
+
+// checkDeadline fails when a unix-seconds deadline is passed or too close
+func checkDeadline(deadline *big.Int) error {
+	limit := big.NewInt(time.Now().Add(permitDeadlineBuffer).Unix())
+	if deadline.Cmp(limit) < 0 {
+		return fmt.Errorf("deadline %s has passed or is too close", deadline)
+	}
+	return nil
+}
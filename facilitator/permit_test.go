@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	x402 "github.com/coinbase/x402/go"
+	evmmech "github.com/coinbase/x402/go/mechanisms/evm"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+)
+
+// permit2TypedData converts permit2Types for hashing with apitypes
+func permit2TypedData() apitypes.TypedData {
+	typedData := apitypes.TypedData{Types: apitypes.Types{}, Domain: apitypes.TypedDataDomain{Name: "unused"}}
+	for name, fields := range permit2Types {
+		for _, field := range fields {
+			typedData.Types[name] = append(typedData.Types[name], apitypes.Type{Name: field.Name, Type: field.Type})
+		}
+	}
+	return typedData
+}
+
+func TestPermit2WitnessTypeString(t *testing.T) {
+	// Permit2 hashes its stub followed by the witness type string; that must
+	// be the type the payer signed
+	stub := "PermitWitnessTransferFrom(TokenPermissions permitted,address spender,uint256 nonce,uint256 deadline,"
+	onchain := crypto.Keccak256Hash([]byte(stub + permit2WitnessTypeString))
+
+	typedData := permit2TypedData()
+	if signed := common.BytesToHash(typedData.TypeHash("PermitWitnessTransferFrom")); signed != onchain {
+		t.Fatalf("signed type hash %s, Permit2 computes %s", signed.Hex(), onchain.Hex())
+	}
+}
+
+func TestPermit2WitnessHash(t *testing.T) {
+	payTo := common.HexToAddress("0x209693Bc6afc0C5328bA36FaF03C514EF312287C")
+	validAfter := big.NewInt(1700000000)
+
+	typedData := permit2TypedData()
+	want, err := typedData.HashStruct("Witness", apitypes.TypedDataMessage{
+		"to":         payTo.Hex(),
+		"validAfter": validAfter,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := crypto.Keccak256Hash(
+		permit2WitnessTypeHash.Bytes(),
+		common.LeftPadBytes(payTo.Bytes(), 32),
+		common.LeftPadBytes(validAfter.Bytes(), 32),
+	)
+	if got != common.BytesToHash(want) {
+		t.Fatalf("witness hash %s, EIP-712 hashStruct %s", got.Hex(), common.BytesToHash(want).Hex())
+	}
+}
+
+func TestUptoPermitCappedAtMaximum(t *testing.T) {
+	signer := newTestSigner(t)
+	upto := newUptoScheme(signer)
+
+	payer := common.HexToAddress("0x857b06519E91e3A54538791bDbb0E22373e36b66")
+	payload := []byte(fmt.Sprintf(`{"payload":{"signature":"0x%x","permit":{"owner":"%s","spender":"%s","value":"2000","nonce":"0","deadline":"99999999999"}}}`,
+		make([]byte, 65), payer.Hex(), signer.address.Hex()))
+	requirements := func(amount string, extra string) []byte {
+		return []byte(fmt.Sprintf(`{"scheme":"upto","network":"%s","asset":"%s","payTo":"0x209693Bc6afc0C5328bA36FaF03C514EF312287C","amount":"%s","extra":{%s}}`,
+			signer.network(), testToken.Hex(), amount, extra))
+	}
+
+	tests := []struct {
+		name         string
+		requirements []byte
+		want         string
+	}{
+		{"permit above the maximum", requirements("1000", ""), "invalid_permit_value"},
+		{"permit above maxAmount", requirements("500", `"maxAmount":"1000"`), "invalid_permit_value"},
+		{"maxAmount below the amount", requirements("500", `"maxAmount":"100"`), "invalid_payment_requirements"},
+		// Within the cap, verification moves on to the signature
+		{"permit at maxAmount", requirements("500", `"maxAmount":"2000"`), "invalid_permit_signature"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := upto.Verify(context.Background(), payload, tt.requirements)
+			var ve *x402.VerifyError
+			if !errors.As(err, &ve) || ve.Reason != tt.want {
+				t.Fatalf("Verify() error = %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
+
+// signTypedData signs message of type primary under a domain with the given
+// EIP712Domain fields
+func signTypedData(t *testing.T, key *ecdsa.PrivateKey, domain apitypes.TypedDataDomain, domainFields []apitypes.Type,
+	fields map[string][]evmmech.TypedDataField, primary string, message map[string]interface{}) []byte {
+	t.Helper()
+
+	typedData := apitypes.TypedData{
+		Types:       apitypes.Types{"EIP712Domain": domainFields},
+		PrimaryType: primary,
+		Domain:      domain,
+		Message:     message,
+	}
+	for name, typeFields := range fields {
+		if name == "EIP712Domain" {
+			continue
+		}
+		for _, field := range typeFields {
+			typedData.Types[name] = append(typedData.Types[name], apitypes.Type{Name: field.Name, Type: field.Type})
+		}
+	}
+
+	digest, _, err := apitypes.TypedDataAndHash(typedData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := crypto.Sign(digest, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature[64] += 27
+	return signature
+}
+
+var (
+	permit2DomainFields = []apitypes.Type{
+		{Name: "name", Type: "string"},
+		{Name: "chainId", Type: "uint256"},
+		{Name: "verifyingContract", Type: "address"},
+	}
+	standardDomainFields = []apitypes.Type{
+		{Name: "name", Type: "string"},
+		{Name: "version", Type: "string"},
+		{Name: "chainId", Type: "uint256"},
+		{Name: "verifyingContract", Type: "address"},
+	}
+)
+
+// permitPayment describes a permit payment of testToken to testPayTo; the
+// zero value of an override keeps the honest value
+type permitPayment struct {
+	key     *ecdsa.PrivateKey
+	amount  int64
+	nonce   int64
+	spender common.Address // defaults to the facilitator
+	payTo   common.Address // signed recipient, defaults to testPayTo
+}
+
+// payer returns the address of the payment's key
+func (p permitPayment) payer() common.Address {
+	return crypto.PubkeyToAddress(p.key.PublicKey)
+}
+
+// requirements returns exact requirements for the payment's amount
+func (p permitPayment) requirements(t *testing.T) []byte {
+	t.Helper()
+
+	requirements, err := json.Marshal(map[string]interface{}{
+		"scheme":  "exact",
+		"network": "eip155:" + testSimulatedChainID.String(),
+		"asset":   testToken.Hex(),
+		"amount":  big.NewInt(p.amount).String(),
+		"payTo":   testPayTo.Hex(),
+		"extra":   map[string]interface{}{"name": "Test Token", "version": "1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return requirements
+}
+
+// defaults fills in the facilitator as spender and testPayTo as recipient
+func (p permitPayment) defaults(signer *facilitatorEvmSigner) permitPayment {
+	if p.spender == (common.Address{}) {
+		p.spender = signer.address
+	}
+	if p.payTo == (common.Address{}) {
+		p.payTo = testPayTo
+	}
+	return p
+}
+
+// permit2 returns a Permit2 payload signed by the payment's key
+func (p permitPayment) permit2(t *testing.T, signer *facilitatorEvmSigner) []byte {
+	t.Helper()
+	p = p.defaults(signer)
+
+	deadline := big.NewInt(time.Now().Add(time.Hour).Unix()).String()
+	amount := big.NewInt(p.amount).String()
+	nonce := big.NewInt(p.nonce).String()
+	signature := signTypedData(t, p.key, apitypes.TypedDataDomain{
+		Name:              "Permit2",
+		ChainId:           (*math.HexOrDecimal256)(testSimulatedChainID),
+		VerifyingContract: Permit2Address,
+	}, permit2DomainFields, permit2Types, "PermitWitnessTransferFrom", map[string]interface{}{
+		"permitted": map[string]interface{}{"token": testToken.Hex(), "amount": amount},
+		"spender":   p.spender.Hex(),
+		"nonce":     nonce,
+		"deadline":  deadline,
+		"witness":   map[string]interface{}{"to": p.payTo.Hex(), "validAfter": "0"},
+	})
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"x402Version": 2,
+		"payload": map[string]interface{}{
+			"signature": hexutil.Encode(signature),
+			"permit2Authorization": map[string]interface{}{
+				"from":      p.payer().Hex(),
+				"permitted": map[string]string{"token": testToken.Hex(), "amount": amount},
+				"spender":   p.spender.Hex(),
+				"nonce":     nonce,
+				"deadline":  deadline,
+				"witness":   map[string]string{"to": p.payTo.Hex(), "validAfter": "0"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+// eip2612 returns an EIP-2612 payload with its permit witness, signed by
+// the payment's key
+func (p permitPayment) eip2612(t *testing.T, signer *facilitatorEvmSigner) []byte {
+	t.Helper()
+	p = p.defaults(signer)
+
+	deadline := big.NewInt(time.Now().Add(time.Hour).Unix()).String()
+	value := big.NewInt(p.amount).String()
+	nonce := big.NewInt(p.nonce).String()
+	signature := signTypedData(t, p.key, apitypes.TypedDataDomain{
+		Name:              "Test Token",
+		Version:           "1",
+		ChainId:           (*math.HexOrDecimal256)(testSimulatedChainID),
+		VerifyingContract: testToken.Hex(),
+	}, standardDomainFields, eip2612Types, "Permit", map[string]interface{}{
+		"owner":    p.payer().Hex(),
+		"spender":  p.spender.Hex(),
+		"value":    value,
+		"nonce":    nonce,
+		"deadline": deadline,
+	})
+	witnessSignature := signTypedData(t, p.key, apitypes.TypedDataDomain{
+		Name:              permitWitnessDomainName,
+		Version:           permitWitnessDomainVersion,
+		ChainId:           (*math.HexOrDecimal256)(testSimulatedChainID),
+		VerifyingContract: signer.address.Hex(),
+	}, standardDomainFields, permitWitnessTypes, "PermitWitness", map[string]interface{}{
+		"token":    testToken.Hex(),
+		"owner":    p.payer().Hex(),
+		"nonce":    nonce,
+		"deadline": deadline,
+		"payTo":    p.payTo.Hex(),
+	})
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"x402Version": 2,
+		"payload": map[string]interface{}{
+			"signature":        hexutil.Encode(signature),
+			"witnessSignature": hexutil.Encode(witnessSignature),
+			"permit": map[string]string{
+				"owner":    p.payer().Hex(),
+				"spender":  p.spender.Hex(),
+				"value":    value,
+				"nonce":    nonce,
+				"deadline": deadline,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+// permitChain describes the token state of a test chain for one payer
+type permitChain struct {
+	balance          int64
+	permit2Allowance int64
+	usedPermit2Nonce *int64
+	tokenNonce       int64
+}
+
+// newTestPermitScheme starts a chain with testToken and Permit2 set up for
+// payer as described and returns the exact permit mechanism on it
+func newTestPermitScheme(t *testing.T, payer common.Address, state permitChain) (*permitScheme, *simulated.Backend) {
+	t.Helper()
+
+	alloc := testTokenAlloc(map[common.Address]*big.Int{payer: big.NewInt(state.balance)})
+	permit2 := common.HexToAddress(Permit2Address)
+	pad := func(a common.Address) []byte { return common.LeftPadBytes(a.Bytes(), 32) }
+
+	token := alloc[testToken]
+	token.Storage[crypto.Keccak256Hash(pad(payer), pad(permit2))] = common.BigToHash(big.NewInt(state.permit2Allowance))
+	nonceSlot := new(big.Int).Add(new(big.Int).SetBytes(payer.Bytes()), new(big.Int).Lsh(big.NewInt(1), 160))
+	token.Storage[common.BigToHash(nonceSlot)] = common.BigToHash(big.NewInt(state.tokenNonce))
+	alloc[testToken] = token
+
+	if state.usedPermit2Nonce != nil {
+		nonce := big.NewInt(*state.usedPermit2Nonce)
+		word := common.LeftPadBytes(new(big.Int).Rsh(nonce, 8).Bytes(), 32)
+		bit := new(big.Int).Lsh(big.NewInt(1), uint(nonce.Int64()&0xff))
+		alloc[permit2].Storage[crypto.Keccak256Hash(pad(payer), word)] = common.BigToHash(bit)
+	}
+
+	signer, backend := newTestChain(t, alloc)
+	return newPermitScheme(signer), backend
+}
+
+func TestPermitVerify(t *testing.T) {
+	payerKey, _ := crypto.GenerateKey()
+	payer := crypto.PubkeyToAddress(payerKey.PublicKey)
+	other := common.HexToAddress("0x00000000000000000000000000000000deadbeef")
+	used := int64(7)
+
+	funded := permitChain{balance: 1000, permit2Allowance: 1000}
+	tests := []struct {
+		name    string
+		state   permitChain
+		payment permitPayment
+		method  func(permitPayment, *testing.T, *facilitatorEvmSigner) []byte
+		want    string // VerifyError reason, "" when valid
+	}{
+		{"permit2", funded, permitPayment{amount: 100, nonce: 1}, permitPayment.permit2, ""},
+		{"permit2 for another spender", funded, permitPayment{amount: 100, nonce: 1, spender: other}, permitPayment.permit2, "invalid_permit2_spender"},
+		{"permit2 to another payTo", funded, permitPayment{amount: 100, nonce: 1, payTo: other}, permitPayment.permit2, "invalid_permit2_witness"},
+		{"permit2 above the balance", permitChain{balance: 10, permit2Allowance: 1000}, permitPayment{amount: 100, nonce: 1}, permitPayment.permit2, "insufficient_funds"},
+		{"permit2 without allowance", permitChain{balance: 1000, permit2Allowance: 10}, permitPayment{amount: 100, nonce: 1}, permitPayment.permit2, "permit2_allowance_required"},
+		{"permit2 nonce used", permitChain{balance: 1000, permit2Allowance: 1000, usedPermit2Nonce: &used}, permitPayment{amount: 100, nonce: used}, permitPayment.permit2, "permit2_nonce_used"},
+		{"permit2 other nonce in a used word", permitChain{balance: 1000, permit2Allowance: 1000, usedPermit2Nonce: &used}, permitPayment{amount: 100, nonce: used + 1}, permitPayment.permit2, ""},
+		{"eip2612", funded, permitPayment{amount: 100}, permitPayment.eip2612, ""},
+		{"eip2612 for another spender", funded, permitPayment{amount: 100, spender: other}, permitPayment.eip2612, "invalid_permit_spender"},
+		{"eip2612 to another payTo", funded, permitPayment{amount: 100, payTo: other}, permitPayment.eip2612, "invalid_permit_witness"},
+		{"eip2612 above the balance", permitChain{balance: 10}, permitPayment{amount: 100}, permitPayment.eip2612, "insufficient_funds"},
+		{"eip2612 stale token nonce", permitChain{balance: 1000, tokenNonce: 3}, permitPayment{amount: 100, nonce: 2}, permitPayment.eip2612, "invalid_permit_nonce"},
+		{"eip2612 future token nonce", permitChain{balance: 1000, tokenNonce: 3}, permitPayment{amount: 100, nonce: 4}, permitPayment.eip2612, "invalid_permit_nonce"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scheme, _ := newTestPermitScheme(t, payer, tt.state)
+			tt.payment.key = payerKey
+			payload := tt.method(tt.payment, t, scheme.signer)
+
+			result, err := scheme.Verify(context.Background(), payload, tt.payment.requirements(t))
+			if tt.want == "" {
+				if err != nil || !result.IsValid || result.Payer != payer.Hex() {
+					t.Fatalf("Verify() = %+v, %v, want valid for %s", result, err, payer.Hex())
+				}
+				return
+			}
+			var ve *x402.VerifyError
+			if !errors.As(err, &ve) || ve.Reason != tt.want {
+				t.Fatalf("Verify() error = %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPermitSettle(t *testing.T) {
+	payerKey, _ := crypto.GenerateKey()
+	payer := crypto.PubkeyToAddress(payerKey.PublicKey)
+	payment := permitPayment{key: payerKey, amount: 100, nonce: 0}
+
+	tests := []struct {
+		name   string
+		method func(permitPayment, *testing.T, *facilitatorEvmSigner) []byte
+	}{
+		{"permit2", permitPayment.permit2},
+		{"eip2612", permitPayment.eip2612},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scheme, backend := newTestPermitScheme(t, payer, permitChain{balance: 1000, permit2Allowance: 1000})
+			mineBlocks(t, backend)
+			payload := tt.method(payment, t, scheme.signer)
+
+			result, err := scheme.Settle(context.Background(), payload, payment.requirements(t))
+			if err != nil || !result.Success {
+				t.Fatalf("Settle() = %+v, %v", result, err)
+			}
+			if got := tokenBalance(t, scheme.signer, testPayTo); got.Int64() != 100 {
+				t.Errorf("payTo balance = %s, want 100", got)
+			}
+			if got := tokenBalance(t, scheme.signer, payer); got.Int64() != 900 {
+				t.Errorf("payer balance = %s, want 900", got)
+			}
+
+			// The permit is spent: settling it again fails on chain state
+			if _, err := scheme.Settle(context.Background(), payload, payment.requirements(t)); err == nil {
+				t.Error("second Settle() of the same permit succeeded")
+			}
+		})
+	}
+}
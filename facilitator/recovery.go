@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	x402 "github.com/coinbase/x402/go"
+	"go_code/x402/logging"
+)
+
+const (
+	// RecoveryPollInterval is how often unresolved settlements are re-checked
+	RecoveryPollInterval = 10 * time.Second
+
+	// RecoveryNotFoundGrace is how long a transaction may be unknown to the
+	// node before it is considered dropped
+	RecoveryNotFoundGrace = 5 * time.Minute
+
+	// RecoveryMaxAge is how long a settlement may stay pending before recovery
+	// gives up and reports it as failed
+	RecoveryMaxAge = 30 * time.Minute
+)
+
+// txStatus is the on-chain state of a previously broadcast transaction
+type txStatus int
+
+const (
+	// txStatusPending: known to the node but not yet included/confirmed
+	txStatusPending txStatus = iota
+	// txStatusConfirmed: included and succeeded
+	txStatusConfirmed
+	// txStatusFailed: included but reverted / errored
+	txStatusFailed
+	// txStatusNotFound: unknown to the node (not yet propagated, or dropped)
+	txStatusNotFound
+)
+
+// settlementRecovery resolves settlements that a previous run broadcast but
+// never saw confirmed, using the signers to check their status on chain
+type settlementRecovery struct {
+	store     *pendingStore
+	evmSigner *facilitatorEvmSigner
+	svmSigner *facilitatorSvmSigner
+	webhook   *settlementWebhook
+
+	// afterSettle runs the facilitator's after-settle hooks for a confirmed
+	// settlement, as if it had been confirmed by the run that broadcast it
+	afterSettle func(ctx context.Context, result *x402.SettleResponse)
+}
+
+type recoveredKey struct{}
+
+// withRecovered marks ctx as reporting a settlement of a previous run
+func withRecovered(ctx context.Context) context.Context {
+	return context.WithValue(ctx, recoveredKey{}, true)
+}
+
+// recoveredFrom reports whether ctx reports a settlement of a previous run
+func recoveredFrom(ctx context.Context) bool {
+	recovered, _ := ctx.Value(recoveredKey{}).(bool)
+	return recovered
+}
+
+// Run checks each entry until it is confirmed, failed, or too old, then
+// finalizes it. It returns when every entry is resolved or ctx is cancelled;
+// unresolved entries stay in the store for the next start.
+//
+// Args:
+//
+//	ctx: cancelled on shutdown
+//	entries: pending settlements loaded at startup
+func (r *settlementRecovery) Run(ctx context.Context, entries []pendingSettlement) {
+	if len(entries) == 0 {
+		return
+	}
+
+	slog.Info("recovering pending settlements", "count", len(entries))
+
+	remaining := entries
+	for {
+		var unresolved []pendingSettlement
+		for _, entry := range remaining {
+			if !r.resolve(ctx, entry) {
+				unresolved = append(unresolved, entry)
+			}
+		}
+
+		if len(unresolved) == 0 {
+			slog.Info("pending settlement recovery complete")
+			return
+		}
+		remaining = unresolved
+
+		select {
+		case <-ctx.Done():
+			slog.Warn("pending settlement recovery stopped", "unresolved", len(remaining))
+			return
+		case <-time.After(RecoveryPollInterval):
+		}
+	}
+}
+
+// resolve checks a single pending settlement and finalizes it if its outcome
+// is known. It reports whether the entry was resolved.
+func (r *settlementRecovery) resolve(ctx context.Context, entry pendingSettlement) bool {
+	// Deferred batches are resumed by the deferred queue, which reports each
+	// authorization they carry; reporting the batch here would duplicate that
+	if entry.Kind == pendingKindBatch {
+		r.store.Remove(entry.TxHash)
+		return true
+	}
+
+	checkCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+
+	age := time.Since(entry.CreatedAt)
+	status, err := r.status(checkCtx, entry)
+	if err != nil {
+		slog.WarnContext(logging.WithRequestID(ctx, entry.RequestID), "failed to check pending settlement",
+			"tx", entry.TxHash, "network", entry.Network, "error", err)
+		// An entry that can never be checked, such as one for a network the
+		// signer is no longer connected to, must not stay forever
+		if age > RecoveryMaxAge {
+			r.finalize(entry, "transaction_timeout")
+			return true
+		}
+		return false
+	}
+
+	switch status {
+	case txStatusConfirmed:
+		r.finalize(entry, "")
+		return true
+	case txStatusFailed:
+		r.finalize(entry, "transaction_failed")
+		return true
+	case txStatusNotFound:
+		if age > RecoveryNotFoundGrace {
+			r.finalize(entry, "transaction_dropped")
+			return true
+		}
+	}
+
+	if age > RecoveryMaxAge {
+		r.finalize(entry, "transaction_timeout")
+		return true
+	}
+	return false
+}
+
+// status asks the signer responsible for the entry's network about the transaction
+func (r *settlementRecovery) status(ctx context.Context, entry pendingSettlement) (txStatus, error) {
+	switch {
+	case strings.HasPrefix(entry.Network, "eip155:"):
+		if r.evmSigner == nil {
+			return txStatusPending, fmt.Errorf("no EVM signer configured")
+		}
+		if entry.Network != r.evmSigner.network() {
+			return txStatusPending, fmt.Errorf("EVM signer is connected to %s", r.evmSigner.network())
+		}
+		return r.evmSigner.TransactionStatus(ctx, entry.TxHash)
+	case strings.HasPrefix(entry.Network, "solana:"):
+		if r.svmSigner == nil {
+			return txStatusPending, fmt.Errorf("no SVM signer configured")
+		}
+		return r.svmSigner.TransactionStatus(ctx, entry.TxHash, entry.Network)
+	}
+	return txStatusPending, fmt.Errorf("unsupported network %s", entry.Network)
+}
+
+// finalize removes the entry from the store and reports its outcome, logging
+// under the ID of the request that broadcast it: confirmed settlements go
+// through the after-settle hooks, failures to the webhook. An empty reason
+// means the settlement succeeded.
+func (r *settlementRecovery) finalize(entry pendingSettlement, reason string) {
+	ctx := withRecovered(logging.WithRequestID(context.Background(), entry.RequestID))
+
+	result := &x402.SettleResponse{
+		Success:     reason == "",
+		ErrorReason: reason,
+		Payer:       entry.Payer,
+		Transaction: entry.TxHash,
+		Network:     x402.Network(entry.Network),
+	}
+
+	if result.Success {
+		slog.InfoContext(ctx, "recovered settlement confirmed", "tx", entry.TxHash, "network", entry.Network,
+			"payer", entry.Payer, "amount", entry.Amount, "kind", entry.Kind)
+		if r.afterSettle != nil {
+			r.afterSettle(ctx, result)
+		}
+	} else {
+		slog.ErrorContext(ctx, "recovered settlement failed", "tx", entry.TxHash, "network", entry.Network,
+			"payer", entry.Payer, "amount", entry.Amount, "kind", entry.Kind, "reason", reason)
+		r.webhook.NotifyAsync(ctx, result, true)
+	}
+
+	r.store.Remove(entry.TxHash)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	x402 "github.com/coinbase/x402/go"
+)
+
+func TestRecoveryExpiresUncheckableEntries(t *testing.T) {
+	store, err := newPendingStore(filepath.Join(t.TempDir(), "pending.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recovery := &settlementRecovery{store: store}
+
+	// No signer can check these; only the old one is given up on
+	store.Add(context.Background(), "0xfresh", "eip155:8453")
+	store.Add(context.Background(), "0xstale", "eip155:8453")
+	entries := store.List()
+	for i := range entries {
+		if entries[i].TxHash == "0xstale" {
+			entries[i].CreatedAt = time.Now().Add(-RecoveryMaxAge - time.Minute)
+		}
+	}
+
+	for _, entry := range entries {
+		resolved := recovery.resolve(context.Background(), entry)
+		if resolved != (entry.TxHash == "0xstale") {
+			t.Errorf("resolve(%s) = %v", entry.TxHash, resolved)
+		}
+	}
+	if remaining := store.List(); len(remaining) != 1 || remaining[0].TxHash != "0xfresh" {
+		t.Errorf("pending after recovery = %+v, want only 0xfresh", remaining)
+	}
+}
+
+func TestRecoveryRunsAfterSettleHooks(t *testing.T) {
+	var settled []*x402.SettleResponse
+	recovery := &settlementRecovery{
+		afterSettle: func(ctx context.Context, result *x402.SettleResponse) {
+			if !recoveredFrom(ctx) {
+				t.Error("after-settle hook not told the settlement was recovered")
+			}
+			settled = append(settled, result)
+		},
+	}
+
+	recovery.finalize(pendingSettlement{TxHash: "0xok", Network: "eip155:8453"}, "")
+	recovery.finalize(pendingSettlement{TxHash: "0xreverted", Network: "eip155:8453"}, "transaction_failed")
+	if len(settled) != 1 || !settled[0].Success || settled[0].Transaction != "0xok" {
+		t.Errorf("after-settle hooks ran for %+v, want only the confirmed settlement", settled)
+	}
+}
+
+func TestRecoveryReportsPaymentDetails(t *testing.T) {
+	store, err := newPendingStore(filepath.Join(t.TempDir(), "pending.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := []byte(`{"x402Version":2,"payload":{"signature":"0x","authorization":{"from":"0x857b06519E91e3A54538791bDbb0E22373e36b66"}}}`)
+	requirements := []byte(`{"scheme":"exact","network":"eip155:8453","amount":"1000"}`)
+	ctx := withPendingPayment(context.Background(), describePayment(payload, requirements))
+	store.Add(ctx, "0xpayment", "eip155:8453")
+	store.Add(withPendingPayment(ctx, pendingPayment{Kind: pendingKindBatch}), "0xbatch", "eip155:8453")
+
+	reopened, err := newPendingStore(store.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var settled []*x402.SettleResponse
+	recovery := &settlementRecovery{
+		store: reopened,
+		afterSettle: func(ctx context.Context, result *x402.SettleResponse) {
+			settled = append(settled, result)
+		},
+	}
+	for _, entry := range reopened.List() {
+		switch entry.TxHash {
+		case "0xpayment":
+			if entry.Payer != "0x857b06519E91e3A54538791bDbb0E22373e36b66" || entry.Amount != "1000" || entry.Kind != "exact" {
+				t.Errorf("payment entry = %+v", entry)
+			}
+			recovery.finalize(entry, "")
+		case "0xbatch":
+			// Resolved without a signer: the deferred queue reports batches
+			if !recovery.resolve(context.Background(), entry) {
+				t.Error("deferred batch entry left unresolved")
+			}
+		}
+	}
+
+	if len(settled) != 1 || settled[0].Payer != "0x857b06519E91e3A54538791bDbb0E22373e36b66" {
+		t.Errorf("after-settle hooks ran for %+v, want the payment with its payer", settled)
+	}
+	if remaining := reopened.List(); len(remaining) != 0 {
+		t.Errorf("pending after recovery = %+v, want none", remaining)
+	}
+}
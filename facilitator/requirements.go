@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// requirementsFields are the payment requirement fields the facilitator
+// endpoints inspect directly, on top of what the x402 facilitator does.
+// v2 requirements carry "amount", v1 requirements "maxAmountRequired".
+type requirementsFields struct {
+	Scheme            string `json:"scheme"`
+	Network           string `json:"network"`
+	Asset             string `json:"asset"`
+	Amount            string `json:"amount"`
+	MaxAmountRequired string `json:"maxAmountRequired"`
+	PayTo             string `json:"payTo"`
+
+	Extra map[string]interface{} `json:"extra"`
+}
+
+// parseRequirementsFields decodes the fields of interest from raw payment requirements
+func parseRequirementsFields(raw json.RawMessage) (requirementsFields, error) {
+	var fields requirementsFields
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return fields, fmt.Errorf("invalid payment requirements: %w", err)
+	}
+	return fields, nil
+}
+
+// amount returns the required amount in the asset's smallest unit
+func (r requirementsFields) amount() string {
+	if r.Amount != "" {
+		return r.Amount
+	}
+	return r.MaxAmountRequired
+}
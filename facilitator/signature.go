@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/crypto"
+	gethrpc "github.com/ethereum/go-ethereum/rpc"
+)
+
+// ============================================================================
+// Signature Verification (ECDSA / EIP-1271 / EIP-6492)
+// ============================================================================
+
+const erc1271ABI = `[{"inputs":[{"name":"hash","type":"bytes32"},{"name":"signature","type":"bytes"}],"name":"isValidSignature","outputs":[{"name":"magicValue","type":"bytes4"}],"stateMutability":"view","type":"function"}]`
+
+var (
+	// erc1271MagicValue is bytes4(keccak256("isValidSignature(bytes32,bytes)"))
+	erc1271MagicValue = [4]byte{0x16, 0x26, 0xba, 0x7e}
+
+	// erc6492MagicSuffix ends every EIP-6492 wrapped signature
+	erc6492MagicSuffix = common.FromHex("0x6492649264926492649264926492649264926492649264926492649264926492")
+
+	// eip7702DelegationPrefix starts the code of an EOA delegated via EIP-7702
+	eip7702DelegationPrefix = []byte{0xef, 0x01, 0x00}
+
+	erc1271Parsed = mustParseABI(erc1271ABI)
+
+	// erc6492WrapperArgs is the layout of a wrapped signature before the suffix:
+	// abi.encode(address factory, bytes factoryCalldata, bytes signature)
+	erc6492WrapperArgs = abi.Arguments{
+		{Type: mustNewABIType("address")},
+		{Type: mustNewABIType("bytes")},
+		{Type: mustNewABIType("bytes")},
+	}
+)
+
+// counterfactualValidatorCode is init code executed with eth_call (no
+// deployment) to check a signature of a wallet that does not exist yet. It
+// expects abi-style words appended after it:
+//
+//	factory | len(factoryCalldata) | wallet | len(validationCalldata) | factoryCalldata | validationCalldata
+//
+// It calls factory with factoryCalldata (deploying the wallet), then
+// staticcalls wallet with validationCalldata and returns the first 32 bytes
+// of its answer. Nothing is broadcast, so the deployment only exists for the
+// duration of the call.
+var counterfactualValidatorCode = common.FromHex(
+	"0x6100388038039060003960006000602051608060006000515af150600060005260206000606051602051608001604051" +
+		"5afa5060206000f3",
+)
+
+// erc6492Signature is an unwrapped EIP-6492 signature
+type erc6492Signature struct {
+	Factory         common.Address
+	FactoryCalldata []byte
+	Signature       []byte
+}
+
+// parseERC6492Signature unwraps an EIP-6492 signature. ok is false when the
+// signature does not carry the magic suffix.
+func parseERC6492Signature(signature []byte) (*erc6492Signature, bool, error) {
+	if len(signature) < len(erc6492MagicSuffix) || !bytes.HasSuffix(signature, erc6492MagicSuffix) {
+		return nil, false, nil
+	}
+
+	values, err := erc6492WrapperArgs.Unpack(signature[:len(signature)-len(erc6492MagicSuffix)])
+	if err != nil {
+		return nil, true, fmt.Errorf("invalid EIP-6492 signature: %w", err)
+	}
+
+	return &erc6492Signature{
+		Factory:         values[0].(common.Address),
+		FactoryCalldata: values[1].([]byte),
+		Signature:       values[2].([]byte),
+	}, true, nil
+}
+
+// verifySignature checks that signature over digest was produced by signer
+//
+// Args:
+//
+//	ctx: request context
+//	signer: address the signature claims to come from
+//	digest: EIP-712 digest that was signed
+//	signature: ECDSA, EIP-1271 or EIP-6492 wrapped signature
+//
+// Returns:
+//
+//	true if the signature is valid for signer
+func (s *facilitatorEvmSigner) verifySignature(
+	ctx context.Context,
+	signer common.Address,
+	digest common.Hash,
+	signature []byte,
+) (bool, error) {
+	wrapped, isWrapped, err := parseERC6492Signature(signature)
+	if err != nil {
+		return false, err
+	}
+
+	code, err := s.client.CodeAt(ctx, signer, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to get code: %w", err)
+	}
+
+	if isWrapped {
+		if len(code) == 0 {
+			// Wallet not deployed yet: validate against the counterfactual deployment
+			return s.verifyCounterfactual(ctx, signer, digest, wrapped)
+		}
+		// Already deployed, the factory call is no longer needed
+		signature = wrapped.Signature
+	}
+
+	if len(code) == 0 {
+		return verifyECDSA(signer, digest, signature)
+	}
+
+	// An EIP-7702 delegated EOA can still sign with its own key
+	if bytes.HasPrefix(code, eip7702DelegationPrefix) && len(signature) == 65 {
+		if ok, _ := verifyECDSA(signer, digest, signature); ok {
+			return true, nil
+		}
+	}
+
+	return s.verifyERC1271(ctx, signer, digest, signature)
+}
+
+// verifyERC1271 asks a deployed contract wallet whether it accepts signature
+func (s *facilitatorEvmSigner) verifyERC1271(
+	ctx context.Context,
+	wallet common.Address,
+	digest common.Hash,
+	signature []byte,
+) (bool, error) {
+	result, err := s.ReadContract(ctx, wallet.Hex(), []byte(erc1271ABI), "isValidSignature", digest, signature)
+	if err != nil {
+		// Wallets revert on signatures they reject
+		if isRevert(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("EIP-1271 check failed: %w", err)
+	}
+
+	magic, ok := result.([4]byte)
+	if !ok {
+		return false, fmt.Errorf("unexpected isValidSignature result type: %T", result)
+	}
+	return magic == erc1271MagicValue, nil
+}
+
+// verifyCounterfactual validates an EIP-6492 signature of a wallet that is not
+// deployed yet by simulating its deployment and the EIP-1271 check in one
+// eth_call
+func (s *facilitatorEvmSigner) verifyCounterfactual(
+	ctx context.Context,
+	wallet common.Address,
+	digest common.Hash,
+	wrapped *erc6492Signature,
+) (bool, error) {
+	validation, err := erc1271Parsed.Pack("isValidSignature", digest, wrapped.Signature)
+	if err != nil {
+		return false, fmt.Errorf("failed to pack isValidSignature: %w", err)
+	}
+
+	data := make([]byte, 0, len(counterfactualValidatorCode)+128+len(wrapped.FactoryCalldata)+len(validation))
+	data = append(data, counterfactualValidatorCode...)
+	data = append(data, common.LeftPadBytes(wrapped.Factory.Bytes(), 32)...)
+	data = append(data, math.U256Bytes(big.NewInt(int64(len(wrapped.FactoryCalldata))))...)
+	data = append(data, common.LeftPadBytes(wallet.Bytes(), 32)...)
+	data = append(data, math.U256Bytes(big.NewInt(int64(len(validation))))...)
+	data = append(data, wrapped.FactoryCalldata...)
+	data = append(data, validation...)
+
+	result, err := s.client.CallContract(ctx, ethereum.CallMsg{Data: data}, nil)
+	if err != nil {
+		return false, fmt.Errorf("EIP-6492 check failed: %s", revertReason(err))
+	}
+	if len(result) < 4 {
+		return false, nil
+	}
+
+	var magic [4]byte
+	copy(magic[:], result[:4])
+	return magic == erc1271MagicValue, nil
+}
+
+// verifyECDSA recovers the signer of a 65 byte (r, s, v) signature
+func verifyECDSA(signer common.Address, digest common.Hash, signature []byte) (bool, error) {
+	if len(signature) != 65 {
+		return false, fmt.Errorf("invalid signature length: %d", len(signature))
+	}
+
+	// Adjust v value
+	sigCopy := make([]byte, 65)
+	copy(sigCopy, signature)
+	if sigCopy[64] >= 27 {
+		sigCopy[64] -= 27
+	}
+
+	pubKey, err := crypto.SigToPub(digest.Bytes(), sigCopy)
+	if err != nil {
+		return false, fmt.Errorf("failed to recover public key: %w", err)
+	}
+
+	return crypto.PubkeyToAddress(*pubKey) == signer, nil
+}
+
+// isRevert reports whether a call failed because the contract reverted, as
+// opposed to an RPC or transport error
+func isRevert(err error) bool {
+	var dataErr gethrpc.DataError
+	return errors.As(err, &dataErr) || strings.Contains(err.Error(), "execution reverted")
+}
+
+// mustNewABIType builds an ABI type from a constant type name
+func mustNewABIType(name string) abi.Type {
+	t, err := abi.NewType(name, "", nil)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"math/big"
+	"reflect"
+	"testing"
+
+	evmmech "github.com/coinbase/x402/go/mechanisms/evm"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+)
+
+var (
+	// acceptingWalletCode returns the EIP-1271 magic value for any signature
+	acceptingWalletCode = common.FromHex("0x631626ba7e60e01b60005260206000f3")
+
+	// rejectingWalletCode returns 0xffffffff for any signature
+	rejectingWalletCode = common.FromHex("0x63ffffffff60e01b60005260206000f3")
+
+	// revertingWalletCode reverts on every call
+	revertingWalletCode = common.FromHex("0x60006000fd")
+
+	// walletFactoryCode deploys a contract with acceptingWalletCode via CREATE
+	// on every call and returns its address
+	walletFactoryCode = common.FromHex(
+		"0x78" + "6f" + "631626ba7e60e01b60005260206000f3" + "60005260106010f3" +
+			"600052" + "6019" + "6007" + "6000" + "f0" + "600052" + "60206000f3",
+	)
+
+	testFactory          = common.HexToAddress("0x000000000000000000000000000000000000fac7")
+	testAcceptingWallet  = common.HexToAddress("0x0000000000000000000000000000000000001271")
+	testRejectingWallet  = common.HexToAddress("0x0000000000000000000000000000000000001272")
+	testRevertingWallet  = common.HexToAddress("0x0000000000000000000000000000000000001273")
+	testFactoryNonce     = uint64(1)
+	testCounterfactual   = crypto.CreateAddress(testFactory, testFactoryNonce)
+	testSimulatedChainID = big.NewInt(1337)
+)
+
+// newTestSigner starts a simulated chain with the test wallets and returns a
+// signer connected to it
+func newTestSigner(t *testing.T) *facilitatorEvmSigner {
+	t.Helper()
+
+	signer, _ := newTestChain(t, nil)
+	return signer
+}
+
+// newTestChain starts a simulated chain with the test wallets and the
+// accounts of alloc, and returns a signer connected to it and the backend,
+// which only mines when committed
+func newTestChain(t *testing.T, alloc types.GenesisAlloc) (*facilitatorEvmSigner, *simulated.Backend) {
+	t.Helper()
+
+	facilitatorKey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	genesis := types.GenesisAlloc{
+		crypto.PubkeyToAddress(facilitatorKey.PublicKey): {Balance: big.NewInt(1e18)},
+		testFactory:         {Code: walletFactoryCode, Nonce: testFactoryNonce},
+		testAcceptingWallet: {Code: acceptingWalletCode, Nonce: 1},
+		testRejectingWallet: {Code: rejectingWalletCode, Nonce: 1},
+		testRevertingWallet: {Code: revertingWalletCode, Nonce: 1},
+	}
+	for address, account := range alloc {
+		genesis[address] = account
+	}
+	backend := simulated.NewBackend(genesis)
+	t.Cleanup(func() { backend.Close() })
+
+	// The simulated client wraps an *ethclient.Client in a field named
+	// Client, which hides its Client() method; the signer gets the ethclient
+	// itself, as in production, so it can reach eth_simulateV1
+	client := reflect.ValueOf(backend.Client()).FieldByName("Client").Interface().(*ethclient.Client)
+	signer, err := newFacilitatorEvmSignerWithClient(common.Bytes2Hex(crypto.FromECDSA(facilitatorKey)), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, backend
+}
+
+// testAuthorization is an EIP-3009 TransferWithAuthorization from "from"
+func testAuthorization(from common.Address) (evmmech.TypedDataDomain, map[string][]evmmech.TypedDataField, map[string]interface{}) {
+	domain := evmmech.TypedDataDomain{
+		Name:              "USD Coin",
+		Version:           "2",
+		ChainID:           testSimulatedChainID,
+		VerifyingContract: "0x036CbD53842c5426634e7929541eC2318f3dCF7e",
+	}
+	fields := map[string][]evmmech.TypedDataField{
+		"EIP712Domain": {
+			{Name: "name", Type: "string"},
+			{Name: "version", Type: "string"},
+			{Name: "chainId", Type: "uint256"},
+			{Name: "verifyingContract", Type: "address"},
+		},
+		"TransferWithAuthorization": {
+			{Name: "from", Type: "address"},
+			{Name: "to", Type: "address"},
+			{Name: "value", Type: "uint256"},
+			{Name: "validAfter", Type: "uint256"},
+			{Name: "validBefore", Type: "uint256"},
+			{Name: "nonce", Type: "bytes32"},
+		},
+	}
+	message := map[string]interface{}{
+		"from":        from.Hex(),
+		"to":          "0x209693Bc6afc0C5328bA36FaF03C514EF312287C",
+		"value":       "1000000",
+		"validAfter":  "0",
+		"validBefore": "99999999999",
+		"nonce":       "0x" + common.Bytes2Hex(crypto.Keccak256([]byte("nonce"))),
+	}
+	return domain, fields, message
+}
+
+// signAuthorization signs the EIP-712 digest of testAuthorization with key
+func signAuthorization(t *testing.T, key *ecdsa.PrivateKey, from common.Address) []byte {
+	t.Helper()
+
+	_, fields, message := testAuthorization(from)
+	typedData := apitypes.TypedData{
+		Types: apitypes.Types{
+			"EIP712Domain": {
+				{Name: "name", Type: "string"},
+				{Name: "version", Type: "string"},
+				{Name: "chainId", Type: "uint256"},
+				{Name: "verifyingContract", Type: "address"},
+			},
+		},
+		PrimaryType: "TransferWithAuthorization",
+		Domain: apitypes.TypedDataDomain{
+			Name:              "USD Coin",
+			Version:           "2",
+			ChainId:           (*math.HexOrDecimal256)(testSimulatedChainID),
+			VerifyingContract: "0x036CbD53842c5426634e7929541eC2318f3dCF7e",
+		},
+		Message: message,
+	}
+	for _, field := range fields["TransferWithAuthorization"] {
+		typedData.Types["TransferWithAuthorization"] = append(typedData.Types["TransferWithAuthorization"],
+			apitypes.Type{Name: field.Name, Type: field.Type})
+	}
+
+	digest, _, err := apitypes.TypedDataAndHash(typedData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := crypto.Sign(digest, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature[64] += 27
+	return signature
+}
+
+// wrapERC6492 wraps signature for a wallet deployed by factory with calldata
+func wrapERC6492(t *testing.T, factory common.Address, calldata []byte, signature []byte) []byte {
+	t.Helper()
+
+	encoded, err := erc6492WrapperArgs.Pack(factory, calldata, signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(encoded, erc6492MagicSuffix...)
+}
+
+func verifyTestAuthorization(t *testing.T, signer *facilitatorEvmSigner, from common.Address, signature []byte) (bool, error) {
+	t.Helper()
+
+	domain, fields, message := testAuthorization(from)
+	return signer.VerifyTypedData(context.Background(), from.Hex(), domain, fields, "TransferWithAuthorization", message, signature)
+}
+
+func TestVerifyTypedDataEOA(t *testing.T) {
+	signer := newTestSigner(t)
+
+	payerKey, _ := crypto.GenerateKey()
+	otherKey, _ := crypto.GenerateKey()
+	payer := crypto.PubkeyToAddress(payerKey.PublicKey)
+
+	valid, err := verifyTestAuthorization(t, signer, payer, signAuthorization(t, payerKey, payer))
+	if err != nil || !valid {
+		t.Fatalf("payer signature: valid=%v err=%v, want valid", valid, err)
+	}
+
+	valid, err = verifyTestAuthorization(t, signer, payer, signAuthorization(t, otherKey, payer))
+	if err != nil || valid {
+		t.Fatalf("foreign signature: valid=%v err=%v, want invalid", valid, err)
+	}
+
+	if _, err := verifyTestAuthorization(t, signer, payer, []byte{0x01, 0x02}); err == nil {
+		t.Fatal("short signature: want error")
+	}
+}
+
+func TestVerifyTypedDataERC1271(t *testing.T) {
+	signer := newTestSigner(t)
+	signature := make([]byte, 96) // contract wallets define their own format
+
+	tests := []struct {
+		name   string
+		wallet common.Address
+		want   bool
+	}{
+		{"accepting wallet", testAcceptingWallet, true},
+		{"rejecting wallet", testRejectingWallet, false},
+		{"reverting wallet", testRevertingWallet, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			valid, err := verifyTestAuthorization(t, signer, tt.wallet, signature)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if valid != tt.want {
+				t.Fatalf("valid = %v, want %v", valid, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyTypedDataERC6492(t *testing.T) {
+	signer := newTestSigner(t)
+	inner := make([]byte, 65)
+
+	// Counterfactual: the factory deploys the wallet at the payer address
+	valid, err := verifyTestAuthorization(t, signer, testCounterfactual, wrapERC6492(t, testFactory, nil, inner))
+	if err != nil || !valid {
+		t.Fatalf("counterfactual wallet: valid=%v err=%v, want valid", valid, err)
+	}
+
+	// The factory deploys somewhere else, so the payer stays without code
+	other := common.HexToAddress("0x00000000000000000000000000000000deadbeef")
+	valid, err = verifyTestAuthorization(t, signer, other, wrapERC6492(t, testFactory, nil, inner))
+	if err != nil || valid {
+		t.Fatalf("wrong counterfactual address: valid=%v err=%v, want invalid", valid, err)
+	}
+
+	// Already deployed: the inner signature goes straight to EIP-1271
+	valid, err = verifyTestAuthorization(t, signer, testAcceptingWallet, wrapERC6492(t, testFactory, nil, inner))
+	if err != nil || !valid {
+		t.Fatalf("deployed accepting wallet: valid=%v err=%v, want valid", valid, err)
+	}
+	valid, err = verifyTestAuthorization(t, signer, testRejectingWallet, wrapERC6492(t, testFactory, nil, inner))
+	if err != nil || valid {
+		t.Fatalf("deployed rejecting wallet: valid=%v err=%v, want invalid", valid, err)
+	}
+
+	// Nothing is broadcast while validating
+	code, err := signer.GetCode(context.Background(), testCounterfactual.Hex())
+	if err != nil || len(code) != 0 {
+		t.Fatalf("counterfactual wallet was deployed: code=%x err=%v", code, err)
+	}
+}
+
+func TestParseERC6492Signature(t *testing.T) {
+	if _, ok, err := parseERC6492Signature(make([]byte, 65)); ok || err != nil {
+		t.Fatalf("plain signature: ok=%v err=%v, want not wrapped", ok, err)
+	}
+
+	if _, ok, err := parseERC6492Signature(append([]byte{0x01}, erc6492MagicSuffix...)); !ok || err == nil {
+		t.Fatalf("truncated wrapper: ok=%v err=%v, want wrapped with error", ok, err)
+	}
+
+	calldata := []byte{0xde, 0xad}
+	inner := []byte{0xbe, 0xef}
+	wrapped, ok, err := parseERC6492Signature(wrapERC6492(t, testFactory, calldata, inner))
+	if !ok || err != nil {
+		t.Fatalf("wrapped signature: ok=%v err=%v", ok, err)
+	}
+	if wrapped.Factory != testFactory || string(wrapped.FactoryCalldata) != string(calldata) || string(wrapped.Signature) != string(inner) {
+		t.Fatalf("unexpected unwrap result: %+v", wrapped)
+	}
+}
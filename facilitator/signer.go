@@ -1,13 +1,14 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"crypto/ecdsa"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"math/big"
 	"strings"
+	"sync"
 	"time"
 
 	evmmech "github.com/coinbase/x402/go/mechanisms/evm"
@@ -15,12 +16,14 @@ import (
 	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethclient"
+	gethrpc "github.com/ethereum/go-ethereum/rpc"
 	"github.com/ethereum/go-ethereum/signer/core/apitypes"
 	solana "github.com/gagliardetto/solana-go"
+	"github.com/gagliardetto/solana-go/programs/system"
 	"github.com/gagliardetto/solana-go/rpc"
 )
 
@@ -36,12 +39,32 @@ const (
 // EVM Facilitator Signer
 // ============================================================================
 
+// evmClient is the part of *ethclient.Client the EVM signer uses. Tests
+// substitute a simulated backend.
+type evmClient interface {
+	ethereum.ChainIDReader
+	ethereum.ChainStateReader
+	ethereum.ContractCaller
+	ethereum.GasEstimator
+	ethereum.GasPricer
+	ethereum.PendingStateReader
+	ethereum.TransactionReader
+	ethereum.TransactionSender
+}
+
 // facilitatorEvmSigner implements the FacilitatorEvmSigner interface
 type facilitatorEvmSigner struct {
 	privateKey *ecdsa.PrivateKey
 	address    common.Address
-	client     *ethclient.Client
+	client     evmClient
 	chainID    *big.Int
+	pending    *pendingStore
+
+	// EIP-5267 domains by token address, nil when unsupported
+	domains sync.Map
+
+	// Local nonce tracking so concurrent settlements can be pipelined
+	nonces *nonceTracker
 }
 
 // newFacilitatorEvmSigner creates a new EVM facilitator signer
@@ -55,6 +78,27 @@ type facilitatorEvmSigner struct {
 //
 //	*facilitatorEvmSigner or error
 func newFacilitatorEvmSigner(privateKeyHex string, rpcURL string) (*facilitatorEvmSigner, error) {
+	// Connect to blockchain
+	client, err := ethclient.Dial(rpcURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to RPC: %w", err)
+	}
+
+	return newFacilitatorEvmSignerWithClient(privateKeyHex, client)
+}
+
+// newFacilitatorEvmSignerWithClient creates an EVM facilitator signer on top
+// of an existing client
+//
+// Args:
+//
+//	privateKeyHex: Private key in hex format (with or without 0x prefix)
+//	client: connected chain client
+//
+// Returns:
+//
+//	*facilitatorEvmSigner or error
+func newFacilitatorEvmSignerWithClient(privateKeyHex string, client evmClient) (*facilitatorEvmSigner, error) {
 	// Remove 0x prefix if present
 	privateKeyHex = strings.TrimPrefix(privateKeyHex, "0x")
 
@@ -65,12 +109,6 @@ func newFacilitatorEvmSigner(privateKeyHex string, rpcURL string) (*facilitatorE
 
 	address := crypto.PubkeyToAddress(privateKey.PublicKey)
 
-	// Connect to blockchain
-	client, err := ethclient.Dial(rpcURL)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to RPC: %w", err)
-	}
-
 	// Get chain ID
 	ctx := context.Background()
 	chainID, err := client.ChainID(ctx)
@@ -83,6 +121,7 @@ func newFacilitatorEvmSigner(privateKeyHex string, rpcURL string) (*facilitatorE
 		address:    address,
 		client:     client,
 		chainID:    chainID,
+		nonces:     newNonceTracker(client, address),
 	}, nil
 }
 
@@ -94,6 +133,11 @@ func (s *facilitatorEvmSigner) GetChainID(ctx context.Context) (*big.Int, error)
 	return s.chainID, nil
 }
 
+// network returns the CAIP-2 identifier of the chain this signer is connected to
+func (s *facilitatorEvmSigner) network() string {
+	return "eip155:" + s.chainID.String()
+}
+
 func (s *facilitatorEvmSigner) VerifyTypedData(
 	ctx context.Context,
 	address string,
@@ -104,17 +148,14 @@ func (s *facilitatorEvmSigner) VerifyTypedData(
 	signature []byte,
 ) (bool, error) {
 	// Convert to apitypes for EIP-712 verification
-	chainId := getBigIntFromInterface(domain.ChainID)
+	payloadDomain, err := parseTypedDataDomain(domain)
+	if err != nil {
+		return false, err
+	}
+
 	typedData := apitypes.TypedData{
 		Types:       make(apitypes.Types),
 		PrimaryType: primaryType,
-		Domain: apitypes.TypedDataDomain{
-			Name:              getStringFromInterface(domain.Name),
-			Version:           getStringFromInterface(domain.Version),
-			ChainId:           (*math.HexOrDecimal256)(chainId),
-			VerifyingContract: getStringFromInterface(domain.VerifyingContract),
-		},
-		Message: message,
 	}
 
 	// Convert types
@@ -129,56 +170,44 @@ func (s *facilitatorEvmSigner) VerifyTypedData(
 		typedData.Types[typeName] = typedFields
 	}
 
-	// Add EIP712Domain if not present
-	if _, exists := typedData.Types["EIP712Domain"]; !exists {
-		typedData.Types["EIP712Domain"] = []apitypes.Type{
-			{Name: "name", Type: "string"},
-			{Name: "version", Type: "string"},
-			{Name: "chainId", Type: "uint256"},
-			{Name: "verifyingContract", Type: "address"},
-		}
-	}
-
-	// Hash the data
-	dataHash, err := typedData.HashStruct(typedData.PrimaryType, typedData.Message)
-	if err != nil {
-		return false, fmt.Errorf("failed to hash struct: %w", err)
-	}
-
-	domainSeparator, err := typedData.HashStruct("EIP712Domain", typedData.Domain.Map())
+	normalized, err := normalizeTypedValue(typedData.Types, primaryType, message)
 	if err != nil {
-		return false, fmt.Errorf("failed to hash domain: %w", err)
+		return false, fmt.Errorf("invalid %s message: %w", primaryType, err)
 	}
+	typedData.Message, _ = normalized.(map[string]interface{})
 
-	rawData := []byte{0x19, 0x01}
-	rawData = append(rawData, domainSeparator...)
-	rawData = append(rawData, dataHash...)
-	digest := crypto.Keccak256(rawData)
+	signer := common.HexToAddress(address)
+	candidates, fallback := s.domainCandidates(ctx, typedData.Types["EIP712Domain"], payloadDomain)
+	for _, candidate := range candidates {
+		typedData.Domain = candidate.domain
+		typedData.Types["EIP712Domain"] = candidate.fields
 
-	// Recover the address from signature
-	if len(signature) != 65 {
-		return false, fmt.Errorf("invalid signature length: %d", len(signature))
-	}
-
-	// Adjust v value
-	v := signature[64]
-	if v >= 27 {
-		v -= 27
-	}
+		digest, err := typedDataDigest(typedData)
+		if err != nil {
+			return false, err
+		}
 
-	sigCopy := make([]byte, 65)
-	copy(sigCopy, signature)
-	sigCopy[64] = v
+		// EOAs, deployed contract wallets (EIP-1271) and counterfactual wallets
+		// (EIP-6492) are all accepted
+		valid, err := s.verifySignature(ctx, signer, digest, signature)
+		if err != nil {
+			return false, err
+		}
+		if !valid {
+			continue
+		}
+		if !fallback {
+			return true, nil
+		}
 
-	pubKey, err := crypto.SigToPub(digest, sigCopy)
-	if err != nil {
-		return false, fmt.Errorf("failed to recover public key: %w", err)
+		// The domain was guessed: only accept what the token would accept
+		confirmed, err := s.confirmDomain(ctx, typedData, signature)
+		if err != nil || confirmed {
+			return confirmed, err
+		}
 	}
 
-	recoveredAddr := crypto.PubkeyToAddress(*pubKey)
-	expectedAddr := common.HexToAddress(address)
-
-	return bytes.Equal(recoveredAddr.Bytes(), expectedAddr.Bytes()), nil
+	return false, nil
 }
 
 func (s *facilitatorEvmSigner) ReadContract(
@@ -261,10 +290,14 @@ func (s *facilitatorEvmSigner) WriteContract(
 		return "", fmt.Errorf("failed to pack method call: %w", err)
 	}
 
-	// Get nonce
-	nonce, err := s.client.PendingNonceAt(ctx, s.address)
-	if err != nil {
-		return "", fmt.Errorf("failed to get nonce: %w", err)
+	to := common.HexToAddress(contractAddress)
+	if report := simulationFrom(ctx); report != nil {
+		return s.simulateTransaction(ctx, report, to, data)
+	}
+
+	// Refuse to broadcast a transaction that would revert
+	if err := s.preflight(ctx, to, data); err != nil {
+		return "", err
 	}
 
 	// Get gas price
@@ -273,8 +306,13 @@ func (s *facilitatorEvmSigner) WriteContract(
 		return "", fmt.Errorf("failed to get gas price: %w", err)
 	}
 
+	// Get nonce
+	nonce, err := s.nonces.acquire(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get nonce: %w", err)
+	}
+
 	// Create transaction
-	to := common.HexToAddress(contractAddress)
 	tx := types.NewTransaction(
 		nonce,
 		to,
@@ -287,14 +325,18 @@ func (s *facilitatorEvmSigner) WriteContract(
 	// Sign transaction
 	signedTx, err := types.SignTx(tx, types.LatestSignerForChainID(s.chainID), s.privateKey)
 	if err != nil {
+		s.nonces.release(nonce)
 		return "", fmt.Errorf("failed to sign transaction: %w", err)
 	}
 
 	// Send transaction
 	err = s.client.SendTransaction(ctx, signedTx)
 	if err != nil {
+		s.nonces.release(nonce)
 		return "", fmt.Errorf("failed to send transaction: %w", err)
 	}
+	s.nonces.broadcast(nonce, signedTx.Hash().Hex())
+	s.pending.Add(ctx, signedTx.Hash().Hex(), s.network())
 
 	return signedTx.Hash().Hex(), nil
 }
@@ -304,34 +346,44 @@ func (s *facilitatorEvmSigner) SendTransaction(
 	to string,
 	data []byte,
 ) (string, error) {
-	log.Printf("📝 SendTransaction called: to=%s, dataLen=%d", to, len(data))
+	slog.DebugContext(ctx, "sending transaction", "to", to, "data_len", len(data))
 
-	// Get nonce
-	nonce, err := s.client.PendingNonceAt(ctx, s.address)
-	if err != nil {
-		log.Printf("❌ Failed to get nonce: %v", err)
-		return "", fmt.Errorf("failed to get nonce: %w", err)
+	toAddr := common.HexToAddress(to)
+	if report := simulationFrom(ctx); report != nil {
+		return s.simulateTransaction(ctx, report, toAddr, data)
+	}
+
+	// Refuse to broadcast a transaction that would revert
+	if err := s.preflight(ctx, toAddr, data); err != nil {
+		slog.WarnContext(ctx, "transaction preflight failed", "to", to, "error", err)
+		return "", err
 	}
-	log.Printf("✅ Got nonce: %d", nonce)
 
 	// Get gas price
 	gasPrice, err := s.client.SuggestGasPrice(ctx)
 	if err != nil {
-		log.Printf("❌ Failed to get gas price: %v", err)
+		slog.ErrorContext(ctx, "failed to get gas price", "error", err)
 		return "", fmt.Errorf("failed to get gas price: %w", err)
 	}
-	log.Printf("✅ Got gas price: %s wei", gasPrice.String())
+	slog.DebugContext(ctx, "got gas price", "wei", gasPrice.String())
 
 	// Check Facilitator balance
 	balance, err := s.client.BalanceAt(ctx, s.address, nil)
 	if err != nil {
-		log.Printf("⚠️  Failed to check balance: %v", err)
+		slog.WarnContext(ctx, "failed to check facilitator balance", "error", err)
 	} else {
-		log.Printf("💰 Facilitator balance: %s wei (%.6f ETH)", balance.String(), new(big.Float).Quo(new(big.Float).SetInt(balance), big.NewFloat(1e18)))
+		slog.DebugContext(ctx, "facilitator balance", "wei", balance.String(), "eth", new(big.Float).Quo(new(big.Float).SetInt(balance), big.NewFloat(1e18)).Text('f', 6))
+	}
+
+	// Get nonce
+	nonce, err := s.nonces.acquire(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to get nonce", "error", err)
+		return "", fmt.Errorf("failed to get nonce: %w", err)
 	}
+	slog.DebugContext(ctx, "got nonce", "nonce", nonce)
 
 	// Create transaction with raw data
-	toAddr := common.HexToAddress(to)
 	tx := types.NewTransaction(
 		nonce,
 		toAddr,
@@ -344,18 +396,22 @@ func (s *facilitatorEvmSigner) SendTransaction(
 	// Sign transaction
 	signedTx, err := types.SignTx(tx, types.LatestSignerForChainID(s.chainID), s.privateKey)
 	if err != nil {
-		log.Printf("❌ Failed to sign transaction: %v", err)
+		slog.ErrorContext(ctx, "failed to sign transaction", "error", err)
+		s.nonces.release(nonce)
 		return "", fmt.Errorf("failed to sign transaction: %w", err)
 	}
-	log.Printf("✅ Transaction signed, hash: %s", signedTx.Hash().Hex())
+	slog.DebugContext(ctx, "transaction signed", "tx", signedTx.Hash().Hex())
 
 	// Send transaction
 	err = s.client.SendTransaction(ctx, signedTx)
 	if err != nil {
-		log.Printf("❌ Failed to send transaction: %v", err)
+		slog.ErrorContext(ctx, "failed to send transaction", "tx", signedTx.Hash().Hex(), "error", err)
+		s.nonces.release(nonce)
 		return "", fmt.Errorf("failed to send transaction: %w", err)
 	}
-	log.Printf("✅ Transaction sent successfully: %s", signedTx.Hash().Hex())
+	slog.InfoContext(ctx, "transaction sent", "tx", signedTx.Hash().Hex(), "nonce", nonce, "network", s.network())
+	s.nonces.broadcast(nonce, signedTx.Hash().Hex())
+	s.pending.Add(ctx, signedTx.Hash().Hex(), s.network())
 
 	return signedTx.Hash().Hex(), nil
 }
@@ -363,10 +419,20 @@ func (s *facilitatorEvmSigner) SendTransaction(
 func (s *facilitatorEvmSigner) WaitForTransactionReceipt(ctx context.Context, txHash string) (*evmmech.TransactionReceipt, error) {
 	hash := common.HexToHash(txHash)
 
+	// Simulated transactions were never broadcast; report them as successful
+	if simulationFrom(ctx) != nil {
+		return &evmmech.TransactionReceipt{
+			Status: uint64(types.ReceiptStatusSuccessful),
+			TxHash: hash.Hex(),
+		}, nil
+	}
+
 	// Poll for receipt
 	for i := 0; i < 30; i++ { // 30 seconds timeout
 		receipt, err := s.client.TransactionReceipt(ctx, hash)
 		if err == nil && receipt != nil {
+			s.nonces.mined(hash.Hex())
+			s.pending.Remove(hash.Hex())
 			return &evmmech.TransactionReceipt{
 				Status:      uint64(receipt.Status),
 				BlockNumber: receipt.BlockNumber.Uint64(),
@@ -376,9 +442,191 @@ func (s *facilitatorEvmSigner) WaitForTransactionReceipt(ctx context.Context, tx
 		time.Sleep(1 * time.Second)
 	}
 
+	// Dropped or stuck: check the nonces against the chain before the next send
+	s.nonces.invalidate()
 	return nil, fmt.Errorf("transaction receipt not found after 30 seconds")
 }
 
+// preflight runs the transaction through eth_call from the facilitator address
+// and returns an error carrying the revert reason if it would fail
+func (s *facilitatorEvmSigner) preflight(ctx context.Context, to common.Address, data []byte) error {
+	_, err := s.client.CallContract(ctx, ethereum.CallMsg{
+		From: s.address,
+		To:   &to,
+		Data: data,
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("transaction would revert: %s", revertReason(err))
+	}
+	return nil
+}
+
+// simulateTransaction estimates the transaction the settle path is about to
+// broadcast and records it in the simulation report instead of sending it.
+// Transactions after the first are simulated on top of the earlier ones when
+// the node supports eth_simulateV1, and recorded without a fee estimate when
+// it doesn't. The returned hash is the one the signed transaction would have
+// had.
+func (s *facilitatorEvmSigner) simulateTransaction(
+	ctx context.Context,
+	report *simulationReport,
+	to common.Address,
+	data []byte,
+) (string, error) {
+	msg := ethereum.CallMsg{
+		From: s.address,
+		To:   &to,
+		Data: data,
+	}
+
+	var gasLimit uint64
+	if earlier := report.earlierEVMCalls(); len(earlier) > 0 {
+		gasUsed, err := s.simulateAfter(ctx, earlier, msg)
+		switch {
+		case errors.Is(err, errChainedSimulationUnsupported):
+			slog.DebugContext(ctx, "transaction not simulated after earlier ones", "to", to.Hex(), "error", err)
+		case err != nil:
+			report.fail(err.Error())
+			return "", fmt.Errorf("transaction would revert: %s", err)
+		default:
+			gasLimit = gasUsed
+		}
+	} else {
+		if _, err := s.client.CallContract(ctx, msg, nil); err != nil {
+			reason := revertReason(err)
+			report.fail(reason)
+			return "", fmt.Errorf("transaction would revert: %s", reason)
+		}
+
+		estimated, err := s.client.EstimateGas(ctx, msg)
+		if err != nil {
+			reason := revertReason(err)
+			report.fail(reason)
+			return "", fmt.Errorf("failed to estimate gas: %s", reason)
+		}
+		gasLimit = estimated
+	}
+	report.addEVMCall(msg)
+
+	gasPrice, err := s.client.SuggestGasPrice(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get gas price: %w", err)
+	}
+
+	nonce, err := s.client.PendingNonceAt(ctx, s.address)
+	if err != nil {
+		return "", fmt.Errorf("failed to get nonce: %w", err)
+	}
+
+	tx := types.NewTransaction(nonce, to, big.NewInt(0), gasLimit, gasPrice, data)
+	signedTx, err := types.SignTx(tx, types.LatestSignerForChainID(s.chainID), s.privateKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign transaction: %w", err)
+	}
+
+	fee := new(big.Int).Mul(gasPrice, new(big.Int).SetUint64(gasLimit))
+	report.addTransaction(simulatedTx{
+		Hash:     signedTx.Hash().Hex(),
+		To:       to.Hex(),
+		GasLimit: gasLimit,
+		GasPrice: gasPrice.String(),
+		Fee:      fee.String(),
+	})
+
+	return signedTx.Hash().Hex(), nil
+}
+
+// sendWithEstimatedGas broadcasts a transaction whose gas limit is estimated
+// rather than fixed, for calls such as batched settlements whose cost grows
+// with their size
+func (s *facilitatorEvmSigner) sendWithEstimatedGas(ctx context.Context, to common.Address, data []byte) (string, error) {
+	gasLimit, err := s.client.EstimateGas(ctx, ethereum.CallMsg{
+		From: s.address,
+		To:   &to,
+		Data: data,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to estimate gas: %s", revertReason(err))
+	}
+	// Leave headroom for state changes between estimation and inclusion
+	gasLimit = gasLimit * 6 / 5
+
+	gasPrice, err := s.client.SuggestGasPrice(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get gas price: %w", err)
+	}
+
+	nonce, err := s.nonces.acquire(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get nonce: %w", err)
+	}
+
+	tx := types.NewTransaction(nonce, to, big.NewInt(0), gasLimit, gasPrice, data)
+	signedTx, err := types.SignTx(tx, types.LatestSignerForChainID(s.chainID), s.privateKey)
+	if err != nil {
+		s.nonces.release(nonce)
+		return "", fmt.Errorf("failed to sign transaction: %w", err)
+	}
+
+	if err := s.client.SendTransaction(ctx, signedTx); err != nil {
+		s.nonces.release(nonce)
+		return "", fmt.Errorf("failed to send transaction: %w", err)
+	}
+	s.nonces.broadcast(nonce, signedTx.Hash().Hex())
+	s.pending.Add(ctx, signedTx.Hash().Hex(), s.network())
+
+	return signedTx.Hash().Hex(), nil
+}
+
+// waitForReceipt polls for the full receipt of a transaction, including its
+// logs, until ctx is done
+func (s *facilitatorEvmSigner) waitForReceipt(ctx context.Context, txHash string) (*types.Receipt, error) {
+	hash := common.HexToHash(txHash)
+
+	for {
+		receipt, err := s.client.TransactionReceipt(ctx, hash)
+		if err == nil && receipt != nil {
+			s.nonces.mined(hash.Hex())
+			s.pending.Remove(hash.Hex())
+			return receipt, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			s.nonces.invalidate()
+			return nil, fmt.Errorf("transaction receipt not found: %w", ctx.Err())
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// TransactionStatus reports the on-chain state of a previously broadcast transaction
+func (s *facilitatorEvmSigner) TransactionStatus(ctx context.Context, txHash string) (txStatus, error) {
+	hash := common.HexToHash(txHash)
+
+	receipt, err := s.client.TransactionReceipt(ctx, hash)
+	if err == nil && receipt != nil {
+		if receipt.Status == types.ReceiptStatusSuccessful {
+			return txStatusConfirmed, nil
+		}
+		return txStatusFailed, nil
+	}
+	if err != nil && !errors.Is(err, ethereum.NotFound) {
+		return txStatusPending, fmt.Errorf("failed to get receipt: %w", err)
+	}
+
+	// No receipt yet - check whether the node still knows the transaction
+	_, _, err = s.client.TransactionByHash(ctx, hash)
+	if errors.Is(err, ethereum.NotFound) {
+		return txStatusNotFound, nil
+	}
+	if err != nil {
+		return txStatusPending, fmt.Errorf("failed to get transaction: %w", err)
+	}
+
+	return txStatusPending, nil
+}
+
 func (s *facilitatorEvmSigner) GetBalance(ctx context.Context, address string, tokenAddress string) (*big.Int, error) {
 	if tokenAddress == "" || tokenAddress == "0x0000000000000000000000000000000000000000" {
 		// Native balance
@@ -413,6 +661,123 @@ func (s *facilitatorEvmSigner) GetCode(ctx context.Context, address string) ([]b
 	return code, nil
 }
 
+// VerifyNativeTransfer checks a payer-signed ETH transfer for the native
+// scheme without broadcasting it. The transaction must pay at least amount to
+// payTo on this chain, use the sender's next nonce and carry enough gas and
+// fee for the node to mine it; the payer's balance must cover value plus fee.
+//
+// Returns the decoded transaction and its sender.
+func (s *facilitatorEvmSigner) VerifyNativeTransfer(
+	ctx context.Context,
+	rawTx []byte,
+	payTo common.Address,
+	amount *big.Int,
+) (*types.Transaction, common.Address, error) {
+	network := s.network()
+
+	tx := new(types.Transaction)
+	if err := tx.UnmarshalBinary(rawTx); err != nil {
+		return nil, common.Address{}, verifyFailure("invalid_payload", "", network, "invalid transaction encoding: %v", err)
+	}
+
+	// Unprotected legacy transactions report chain ID 0 and could be replayed elsewhere
+	if tx.ChainId().Cmp(s.chainID) != 0 {
+		return nil, common.Address{}, verifyFailure("invalid_network", "", network,
+			"transaction is for chain %s, facilitator is on %s", tx.ChainId(), s.chainID)
+	}
+
+	from, err := types.Sender(types.LatestSignerForChainID(s.chainID), tx)
+	if err != nil {
+		return nil, common.Address{}, verifyFailure("invalid_signature", "", network, "failed to recover sender: %v", err)
+	}
+	payer := from.Hex()
+
+	if tx.To() == nil || *tx.To() != payTo {
+		return nil, from, verifyFailure("invalid_native_recipient", payer, network, "transaction does not pay %s", payTo.Hex())
+	}
+	if len(tx.Data()) != 0 {
+		return nil, from, verifyFailure("invalid_payload", payer, network, "native transfers must not carry calldata")
+	}
+	if tx.Value().Cmp(amount) < 0 {
+		return nil, from, verifyFailure("invalid_native_amount", payer, network,
+			"transaction value %s is below the required %s", tx.Value(), amount)
+	}
+
+	nonce, err := s.client.PendingNonceAt(ctx, from)
+	if err != nil {
+		return nil, from, fmt.Errorf("failed to get payer nonce: %w", err)
+	}
+	if tx.Nonce() != nonce {
+		return nil, from, verifyFailure("invalid_native_nonce", payer, network,
+			"transaction nonce %d is not the payer's next nonce %d", tx.Nonce(), nonce)
+	}
+
+	balance, err := s.client.BalanceAt(ctx, from, nil)
+	if err != nil {
+		return nil, from, fmt.Errorf("failed to get payer balance: %w", err)
+	}
+	if balance.Cmp(tx.Cost()) < 0 {
+		return nil, from, verifyFailure("insufficient_funds", payer, network,
+			"balance %s does not cover value plus fee %s", balance, tx.Cost())
+	}
+
+	// payTo may be a contract wallet whose receive hook costs more than 21000
+	gasLimit, err := s.client.EstimateGas(ctx, ethereum.CallMsg{From: from, To: &payTo, Value: tx.Value()})
+	if err != nil {
+		return nil, from, verifyFailure("invalid_native_recipient", payer, network,
+			"transfer would revert: %s", revertReason(err))
+	}
+	if tx.Gas() < gasLimit {
+		return nil, from, verifyFailure("invalid_native_gas", payer, network,
+			"gas limit %d is below the estimated %d", tx.Gas(), gasLimit)
+	}
+
+	gasPrice, err := s.client.SuggestGasPrice(ctx)
+	if err != nil {
+		return nil, from, fmt.Errorf("failed to get gas price: %w", err)
+	}
+	if tx.GasFeeCap().Cmp(gasPrice) < 0 {
+		return nil, from, verifyFailure("invalid_native_gas", payer, network,
+			"fee cap %s is below the current gas price %s", tx.GasFeeCap(), gasPrice)
+	}
+
+	return tx, from, nil
+}
+
+// SettleNativeTransfer broadcasts a transaction checked by
+// VerifyNativeTransfer and waits for it to be mined. The payer signed it, so
+// it does not use the facilitator's nonce and the payer pays the gas.
+func (s *facilitatorEvmSigner) SettleNativeTransfer(ctx context.Context, tx *types.Transaction) (string, error) {
+	txHash := tx.Hash().Hex()
+
+	if report := simulationFrom(ctx); report != nil {
+		report.addTransaction(simulatedTx{
+			Hash:     txHash,
+			To:       tx.To().Hex(),
+			GasLimit: tx.Gas(),
+			GasPrice: tx.GasFeeCap().String(),
+			Fee:      new(big.Int).Mul(tx.GasFeeCap(), new(big.Int).SetUint64(tx.Gas())).String(),
+		})
+		return txHash, nil
+	}
+
+	if err := s.client.SendTransaction(ctx, tx); err != nil {
+		return "", fmt.Errorf("failed to send transaction: %w", err)
+	}
+	slog.InfoContext(ctx, "native transfer sent", "tx", txHash, "network", s.network())
+	s.pending.Add(ctx, txHash, s.network())
+
+	receipt, err := s.WaitForTransactionReceipt(ctx, txHash)
+	if err != nil {
+		return txHash, err
+	}
+	if receipt.Status != uint64(types.ReceiptStatusSuccessful) {
+		return txHash, fmt.Errorf("transaction %s reverted", txHash)
+	}
+
+	return txHash, nil
+}
+
 // ============================================================================
 // SVM (Solana) Facilitator Signer
 // ============================================================================
@@ -420,8 +785,12 @@ func (s *facilitatorEvmSigner) GetCode(ctx context.Context, address string) ([]b
 // facilitatorSvmSigner implements the FacilitatorSvmSigner interface
 type facilitatorSvmSigner struct {
 	privateKey solana.PrivateKey
-	rpcClients map[string]*rpc.Client
 	rpcURL     string
+	pending    *pendingStore
+
+	// rpcMu guards rpcClients, which settlements fill concurrently
+	rpcMu      sync.Mutex
+	rpcClients map[string]*rpc.Client
 }
 
 // newFacilitatorSvmSigner creates a new SVM facilitator signer
@@ -449,6 +818,9 @@ func newFacilitatorSvmSigner(privateKeyBase58 string, rpcURL string) (*facilitat
 
 // getRPC is a private helper method to get RPC client for a network
 func (s *facilitatorSvmSigner) getRPC(ctx context.Context, network string) (*rpc.Client, error) {
+	s.rpcMu.Lock()
+	defer s.rpcMu.Unlock()
+
 	if client, ok := s.rpcClients[network]; ok {
 		return client, nil
 	}
@@ -528,6 +900,10 @@ func (s *facilitatorSvmSigner) SendTransaction(ctx context.Context, tx *solana.T
 		return solana.Signature{}, err
 	}
 
+	if report := simulationFrom(ctx); report != nil {
+		return s.simulateTransaction(ctx, rpcClient, report, tx)
+	}
+
 	sig, err := rpcClient.SendTransactionWithOpts(ctx, tx, rpc.TransactionOpts{
 		SkipPreflight:       true,
 		PreflightCommitment: svmmech.DefaultCommitment,
@@ -535,11 +911,18 @@ func (s *facilitatorSvmSigner) SendTransaction(ctx context.Context, tx *solana.T
 	if err != nil {
 		return solana.Signature{}, fmt.Errorf("failed to send transaction: %w", err)
 	}
+	slog.InfoContext(ctx, "transaction sent", "tx", sig.String(), "network", network)
+	s.pending.Add(ctx, sig.String(), network)
 
 	return sig, nil
 }
 
 func (s *facilitatorSvmSigner) ConfirmTransaction(ctx context.Context, signature solana.Signature, network string) error {
+	// Simulated transactions were never broadcast
+	if simulationFrom(ctx) != nil {
+		return nil
+	}
+
 	rpcClient, err := s.getRPC(ctx, network)
 	if err != nil {
 		return err
@@ -559,10 +942,12 @@ func (s *facilitatorSvmSigner) ConfirmTransaction(ctx context.Context, signature
 			status := statuses.Value[0]
 			if status != nil {
 				if status.Err != nil {
+					s.pending.Remove(signature.String())
 					return fmt.Errorf("transaction failed on-chain")
 				}
 				if status.ConfirmationStatus == rpc.ConfirmationStatusConfirmed ||
 					status.ConfirmationStatus == rpc.ConfirmationStatusFinalized {
+					s.pending.Remove(signature.String())
 					return nil
 				}
 			}
@@ -576,6 +961,7 @@ func (s *facilitatorSvmSigner) ConfirmTransaction(ctx context.Context, signature
 			})
 
 			if txErr == nil && txResult != nil && txResult.Meta != nil {
+				s.pending.Remove(signature.String())
 				if txResult.Meta.Err != nil {
 					return fmt.Errorf("transaction failed on-chain")
 				}
@@ -590,41 +976,198 @@ func (s *facilitatorSvmSigner) ConfirmTransaction(ctx context.Context, signature
 	return fmt.Errorf("transaction confirmation timed out after %d attempts", svmmech.MaxConfirmAttempts)
 }
 
+// simulateTransaction runs the fully signed transaction through
+// simulateTransaction and records its fee and logs instead of sending it
+func (s *facilitatorSvmSigner) simulateTransaction(
+	ctx context.Context,
+	rpcClient *rpc.Client,
+	report *simulationReport,
+	tx *solana.Transaction,
+) (solana.Signature, error) {
+	if len(tx.Signatures) == 0 {
+		return solana.Signature{}, fmt.Errorf("transaction is not signed")
+	}
+
+	simResult, err := rpcClient.SimulateTransactionWithOpts(ctx, tx, &rpc.SimulateTransactionOpts{
+		SigVerify:  true,
+		Commitment: svmmech.DefaultCommitment,
+	})
+	if err != nil {
+		return solana.Signature{}, fmt.Errorf("simulation failed: %w", err)
+	}
+
+	simulated := simulatedTx{
+		Hash: tx.Signatures[0].String(),
+		Fee:  "0",
+	}
+	if simResult != nil && simResult.Value != nil {
+		simulated.Logs = simResult.Value.Logs
+		if simResult.Value.Err != nil {
+			reason := fmt.Sprintf("%v", simResult.Value.Err)
+			report.fail(reason)
+			report.addTransaction(simulated)
+			return solana.Signature{}, fmt.Errorf("simulation failed: %s", reason)
+		}
+	}
+
+	feeResult, err := rpcClient.GetFeeForMessage(ctx, tx.Message.ToBase64(), svmmech.DefaultCommitment)
+	if err == nil && feeResult != nil && feeResult.Value != nil {
+		simulated.Fee = fmt.Sprintf("%d", *feeResult.Value)
+	}
+	report.addTransaction(simulated)
+
+	return tx.Signatures[0], nil
+}
+
+// TransactionStatus reports the on-chain state of a previously broadcast transaction
+func (s *facilitatorSvmSigner) TransactionStatus(ctx context.Context, txHash string, network string) (txStatus, error) {
+	signature, err := solana.SignatureFromBase58(txHash)
+	if err != nil {
+		return txStatusPending, fmt.Errorf("invalid signature: %w", err)
+	}
+
+	rpcClient, err := s.getRPC(ctx, network)
+	if err != nil {
+		return txStatusPending, err
+	}
+
+	statuses, err := rpcClient.GetSignatureStatuses(ctx, true, signature)
+	if err != nil {
+		return txStatusPending, fmt.Errorf("failed to get signature status: %w", err)
+	}
+	if statuses == nil || len(statuses.Value) == 0 || statuses.Value[0] == nil {
+		return txStatusNotFound, nil
+	}
+
+	status := statuses.Value[0]
+	if status.Err != nil {
+		return txStatusFailed, nil
+	}
+	if status.ConfirmationStatus == rpc.ConfirmationStatusConfirmed ||
+		status.ConfirmationStatus == rpc.ConfirmationStatusFinalized {
+		return txStatusConfirmed, nil
+	}
+
+	return txStatusPending, nil
+}
+
 func (s *facilitatorSvmSigner) GetAddresses(ctx context.Context, network string) []solana.PublicKey {
 	return []solana.PublicKey{s.privateKey.PublicKey()}
 }
 
-// ============================================================================
-// Helper Functions
-// ============================================================================
+// VerifyNativeTransfer checks a partially signed SOL transfer for the native
+// scheme. The transaction must consist of a single System Program transfer of
+// at least lamports to payTo, with the facilitator as fee payer but not as
+// the source of funds, and carry a valid signature from the source. It is
+// then co-signed and simulated so balance problems surface before settling.
+//
+// Returns the paying account.
+func (s *facilitatorSvmSigner) VerifyNativeTransfer(
+	ctx context.Context,
+	tx *solana.Transaction,
+	network string,
+	payTo solana.PublicKey,
+	lamports uint64,
+) (solana.PublicKey, error) {
+	feePayer := s.privateKey.PublicKey()
+
+	if len(tx.Message.AccountKeys) == 0 || tx.Message.AccountKeys[0] != feePayer {
+		return solana.PublicKey{}, verifyFailure("invalid_fee_payer", "", network,
+			"fee payer must be the facilitator %s", feePayer)
+	}
+	if len(tx.Message.Instructions) != 1 {
+		return solana.PublicKey{}, verifyFailure("invalid_payload", "", network,
+			"expected a single transfer instruction, got %d instructions", len(tx.Message.Instructions))
+	}
 
-func getStringFromInterface(v interface{}) string {
-	if v == nil {
-		return ""
+	instruction := tx.Message.Instructions[0]
+	programID, err := tx.Message.ResolveProgramIDIndex(instruction.ProgramIDIndex)
+	if err != nil || !programID.Equals(solana.SystemProgramID) {
+		return solana.PublicKey{}, verifyFailure("invalid_payload", "", network, "instruction is not a System Program transfer")
 	}
-	switch val := v.(type) {
-	case string:
-		return val
-	case *string:
-		if val != nil {
-			return *val
-		}
+	accounts, err := instruction.ResolveInstructionAccounts(&tx.Message)
+	if err != nil {
+		return solana.PublicKey{}, verifyFailure("invalid_payload", "", network, "failed to resolve accounts: %v", err)
+	}
+	decoded, err := system.DecodeInstruction(accounts, instruction.Data)
+	if err != nil {
+		return solana.PublicKey{}, verifyFailure("invalid_payload", "", network, "failed to decode instruction: %v", err)
+	}
+	transfer, ok := decoded.Impl.(*system.Transfer)
+	if !ok || transfer.Lamports == nil {
+		return solana.PublicKey{}, verifyFailure("invalid_payload", "", network, "instruction is not a System Program transfer")
+	}
+
+	from := transfer.GetFundingAccount().PublicKey
+	payer := from.String()
+	if from.Equals(feePayer) {
+		return from, verifyFailure("invalid_native_source", payer, network, "the facilitator cannot fund the transfer")
+	}
+	if !transfer.GetRecipientAccount().PublicKey.Equals(payTo) {
+		return from, verifyFailure("invalid_native_recipient", payer, network, "transfer does not pay %s", payTo)
+	}
+	if *transfer.Lamports < lamports {
+		return from, verifyFailure("invalid_native_amount", payer, network,
+			"transfer of %d lamports is below the required %d", *transfer.Lamports, lamports)
+	}
+
+	// The source must have signed; the fee payer's slot is still empty
+	messageBytes, err := tx.Message.MarshalBinary()
+	if err != nil {
+		return from, fmt.Errorf("failed to marshal message: %w", err)
+	}
+	index, err := tx.GetAccountIndex(from)
+	if err != nil || !tx.Message.IsSigner(from) || int(index) >= len(tx.Signatures) ||
+		!tx.Signatures[index].Verify(from, messageBytes) {
+		return from, verifyFailure("invalid_signature", payer, network, "missing or invalid signature from %s", from)
 	}
-	return ""
+
+	signed := *tx
+	signed.Signatures = append([]solana.Signature{}, tx.Signatures...)
+	if err := s.SignTransaction(ctx, &signed, feePayer, network); err != nil {
+		return from, err
+	}
+	if err := s.SimulateTransaction(ctx, &signed, network); err != nil {
+		return from, verifyFailure("insufficient_funds", payer, network, "%v", err)
+	}
+
+	return from, nil
 }
 
-func getBigIntFromInterface(v interface{}) *big.Int {
-	if v == nil {
-		return big.NewInt(0)
+// SettleNativeTransfer co-signs a transfer checked by VerifyNativeTransfer as
+// fee payer, sends it and waits for confirmation
+func (s *facilitatorSvmSigner) SettleNativeTransfer(ctx context.Context, tx *solana.Transaction, network string) (string, error) {
+	if err := s.SignTransaction(ctx, tx, s.privateKey.PublicKey(), network); err != nil {
+		return "", err
 	}
-	switch val := v.(type) {
-	case *big.Int:
-		return val
-	case int64:
-		return big.NewInt(val)
-	case string:
-		n, _ := new(big.Int).SetString(val, 10)
-		return n
+
+	signature, err := s.SendTransaction(ctx, tx, network)
+	if err != nil {
+		return "", err
+	}
+	if err := s.ConfirmTransaction(ctx, signature, network); err != nil {
+		return signature.String(), err
+	}
+
+	return signature.String(), nil
+}
+
+// ============================================================================
+// Helper Functions
+// ============================================================================
+
+// revertReason extracts a human readable revert reason from an eth_call or
+// eth_estimateGas error, falling back to the error message
+func revertReason(err error) string {
+	var dataErr gethrpc.DataError
+	if errors.As(err, &dataErr) {
+		if data, ok := dataErr.ErrorData().(string); ok {
+			if raw, decodeErr := hexutil.Decode(data); decodeErr == nil {
+				if reason, unpackErr := abi.UnpackRevert(raw); unpackErr == nil {
+					return reason
+				}
+			}
+		}
 	}
-	return big.NewInt(0)
+	return err.Error()
 }
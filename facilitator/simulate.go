@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+
+	x402 "github.com/coinbase/x402/go"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	gethrpc "github.com/ethereum/go-ethereum/rpc"
+)
+
+// ============================================================================
+// Settlement Simulation
+// ============================================================================
+
+type simulationKey struct{}
+
+// simulatedTx is a transaction the settle path would have broadcast
+type simulatedTx struct {
+	Hash     string   `json:"hash"`
+	To       string   `json:"to,omitempty"`
+	GasLimit uint64   `json:"gasLimit,omitempty"`
+	GasPrice string   `json:"gasPrice,omitempty"`
+	Fee      string   `json:"fee"`
+	Logs     []string `json:"logs,omitempty"`
+}
+
+// simulationReport collects what the signers would have done while a
+// settlement runs in simulation mode
+type simulationReport struct {
+	mu           sync.Mutex
+	transactions []simulatedTx
+	revertReason string
+
+	// evmCalls are the EVM transactions simulated so far, which later ones
+	// are simulated on top of
+	evmCalls []ethereum.CallMsg
+}
+
+// withSimulation returns a context that makes the signers simulate instead
+// of broadcasting, and the report they record into
+func withSimulation(ctx context.Context) (context.Context, *simulationReport) {
+	report := &simulationReport{}
+	return context.WithValue(ctx, simulationKey{}, report), report
+}
+
+// simulationFrom returns the simulation report carried by ctx, or nil when
+// the call is a real settlement
+func simulationFrom(ctx context.Context) *simulationReport {
+	if ctx == nil {
+		return nil
+	}
+	report, _ := ctx.Value(simulationKey{}).(*simulationReport)
+	return report
+}
+
+// addTransaction records a transaction that would have been broadcast
+func (r *simulationReport) addTransaction(tx simulatedTx) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.transactions = append(r.transactions, tx)
+}
+
+// addEVMCall records an EVM transaction later ones must see the effects of
+func (r *simulationReport) addEVMCall(msg ethereum.CallMsg) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.evmCalls = append(r.evmCalls, msg)
+}
+
+// earlierEVMCalls returns the EVM transactions simulated so far
+func (r *simulationReport) earlierEVMCalls() []ethereum.CallMsg {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]ethereum.CallMsg(nil), r.evmCalls...)
+}
+
+// fail records why the simulated transaction would revert
+func (r *simulationReport) fail(reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.revertReason == "" {
+		r.revertReason = reason
+	}
+}
+
+// errChainedSimulationUnsupported means the node can't simulate a
+// transaction on top of earlier ones
+var errChainedSimulationUnsupported = errors.New("node does not support eth_simulateV1")
+
+// simulateV1Call is a call in an eth_simulateV1 block
+type simulateV1Call struct {
+	From  common.Address  `json:"from"`
+	To    *common.Address `json:"to"`
+	Input hexutil.Bytes   `json:"input"`
+}
+
+// simulateV1Result is the outcome of one call of an eth_simulateV1 block
+type simulateV1Result struct {
+	Status     hexutil.Uint64 `json:"status"`
+	GasUsed    hexutil.Uint64 `json:"gasUsed"`
+	ReturnData hexutil.Bytes  `json:"returnData"`
+	Error      *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// simulateAfter runs msg through eth_simulateV1 after the earlier calls of
+// the same settlement, in one block, so it sees their effects: a wallet an
+// EIP-6492 factory call deployed, or an allowance a permit granted. It
+// returns the gas msg used, or an error carrying its revert reason.
+func (s *facilitatorEvmSigner) simulateAfter(ctx context.Context, earlier []ethereum.CallMsg, msg ethereum.CallMsg) (uint64, error) {
+	rpcClient, ok := s.client.(interface{ Client() *gethrpc.Client })
+	if !ok {
+		return 0, errChainedSimulationUnsupported
+	}
+
+	calls := make([]simulateV1Call, 0, len(earlier)+1)
+	for _, call := range append(earlier, msg) {
+		calls = append(calls, simulateV1Call{From: call.From, To: call.To, Input: call.Data})
+	}
+	params := map[string]interface{}{
+		"blockStateCalls": []map[string]interface{}{{"calls": calls}},
+		"validation":      false,
+	}
+
+	var blocks []struct {
+		Calls []simulateV1Result `json:"calls"`
+	}
+	if err := rpcClient.Client().CallContext(ctx, &blocks, "eth_simulateV1", params, "latest"); err != nil {
+		var rpcErr gethrpc.Error
+		if errors.As(err, &rpcErr) && rpcErr.ErrorCode() == -32601 {
+			return 0, errChainedSimulationUnsupported
+		}
+		return 0, fmt.Errorf("failed to simulate: %w", err)
+	}
+	if len(blocks) != 1 || len(blocks[0].Calls) != len(calls) {
+		return 0, fmt.Errorf("unexpected eth_simulateV1 result")
+	}
+
+	result := blocks[0].Calls[len(calls)-1]
+	if result.Status != 1 {
+		if reason, err := abi.UnpackRevert(result.ReturnData); err == nil {
+			return 0, errors.New(reason)
+		}
+		if result.Error != nil {
+			return 0, errors.New(result.Error.Message)
+		}
+		return 0, errors.New("execution reverted")
+	}
+	return uint64(result.GasUsed), nil
+}
+
+// balanceChange is the expected effect of a settlement on one account
+type balanceChange struct {
+	Address string `json:"address"`
+	Asset   string `json:"asset"`
+	Delta   string `json:"delta"`
+}
+
+// simulateResponse is returned by POST /simulate
+type simulateResponse struct {
+	Success        bool            `json:"success"`
+	Simulated      bool            `json:"simulated"`
+	Network        string          `json:"network,omitempty"`
+	Payer          string          `json:"payer,omitempty"`
+	Transaction    string          `json:"transaction,omitempty"`
+	EstimatedFee   string          `json:"estimatedFee"`
+	FeeUnit        string          `json:"feeUnit,omitempty"`
+	BalanceChanges []balanceChange `json:"balanceChanges"`
+	Transactions   []simulatedTx   `json:"transactions"`
+	RevertReason   string          `json:"revertReason,omitempty"`
+	Error          string          `json:"error,omitempty"`
+}
+
+// simulateSettlement runs the full verify + settle path for a payment with the
+// signers in simulation mode, so nothing is broadcast
+//
+// Args:
+//
+//	ctx: request context
+//	processor: facilitator or router with the registered schemes
+//	feePayer: returns the address paying network fees on a network
+//	payload: raw payment payload
+//	requirements: raw payment requirements
+//
+// Returns:
+//
+//	simulateResponse describing fee, balance changes and any revert reason
+func simulateSettlement(
+	ctx context.Context,
+	processor paymentProcessor,
+	feePayer func(network string) string,
+	payload json.RawMessage,
+	requirements json.RawMessage,
+) simulateResponse {
+	response := simulateResponse{
+		Simulated:      true,
+		EstimatedFee:   "0",
+		BalanceChanges: []balanceChange{},
+		Transactions:   []simulatedTx{},
+	}
+
+	fields, err := parseRequirementsFields(requirements)
+	if err != nil {
+		response.Error = err.Error()
+		return response
+	}
+	response.Network = fields.Network
+	response.FeeUnit = feeUnit(fields.Network)
+
+	simCtx, report := withSimulation(ctx)
+
+	verifyResult, err := processor.Verify(simCtx, payload, requirements)
+	if err != nil {
+		var ve *x402.VerifyError
+		if errors.As(err, &ve) {
+			response.Payer = ve.Payer
+		}
+		response.Error = err.Error()
+		return response
+	}
+	response.Payer = verifyResult.Payer
+
+	settleResult, err := processor.Settle(simCtx, payload, requirements)
+
+	report.mu.Lock()
+	response.Transactions = append(response.Transactions, report.transactions...)
+	response.RevertReason = report.revertReason
+	report.mu.Unlock()
+
+	totalFee := new(big.Int)
+	for _, tx := range response.Transactions {
+		if fee, ok := new(big.Int).SetString(tx.Fee, 10); ok {
+			totalFee.Add(totalFee, fee)
+		}
+	}
+	response.EstimatedFee = totalFee.String()
+
+	if err != nil {
+		response.Error = err.Error()
+		return response
+	}
+
+	response.Success = settleResult.Success
+	response.Transaction = settleResult.Transaction
+	if settleResult.Payer != "" {
+		response.Payer = settleResult.Payer
+	}
+
+	// The token transfer moves the required amount from payer to payee; the
+	// facilitator pays the network fee in the native asset
+	amount := fields.amount()
+	response.BalanceChanges = append(response.BalanceChanges,
+		balanceChange{Address: response.Payer, Asset: fields.Asset, Delta: "-" + amount},
+		balanceChange{Address: fields.PayTo, Asset: fields.Asset, Delta: amount},
+	)
+	if payer := feePayer(fields.Network); totalFee.Sign() > 0 && payer != "" {
+		response.BalanceChanges = append(response.BalanceChanges,
+			balanceChange{Address: payer, Asset: "native", Delta: "-" + totalFee.String()},
+		)
+	}
+
+	return response
+}
+
+// feeUnit returns the smallest native unit fees are quoted in for a network
+func feeUnit(network string) string {
+	switch {
+	case strings.HasPrefix(network, "eip155:"), strings.HasPrefix(network, "base"):
+		return "wei"
+	case strings.HasPrefix(network, "solana"):
+		return "lamports"
+	}
+	return ""
+}
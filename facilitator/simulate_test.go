@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// simulateTransfer simulates the bytes overload of transferWithAuthorization
+// from "from" to testPayTo, as the settle path sends it for contract wallets
+func simulateTransfer(ctx context.Context, signer *facilitatorEvmSigner, from common.Address, nonce byte) (string, error) {
+	return signer.WriteContract(ctx, testToken.Hex(), []byte(eip3009ABI), "transferWithAuthorization0",
+		from, testPayTo, big.NewInt(100), big.NewInt(0), big.NewInt(1<<40), [32]byte{nonce}, []byte{0x01})
+}
+
+// assertNothingBroadcast fails if a simulation reached the chain
+func assertNothingBroadcast(t *testing.T, signer *facilitatorEvmSigner) {
+	t.Helper()
+
+	if got := tokenBalance(t, signer, testPayTo); got.Sign() != 0 {
+		t.Errorf("payTo balance = %s, want 0", got)
+	}
+	nonce, err := signer.client.PendingNonceAt(context.Background(), signer.address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nonce != 0 {
+		t.Errorf("facilitator pending nonce = %d, want 0", nonce)
+	}
+}
+
+func TestSimulateTransferWithAuthorization(t *testing.T) {
+	payer := common.HexToAddress("0x00000000000000000000000000000000000a11ce")
+	signer, _ := newTestChain(t, testTokenAlloc(map[common.Address]*big.Int{payer: big.NewInt(1000)}))
+	ctx, report := withSimulation(context.Background())
+
+	_, err := signer.WriteContract(ctx, testToken.Hex(), []byte(eip3009ABI), "transferWithAuthorization",
+		payer, testPayTo, big.NewInt(100), big.NewInt(0), big.NewInt(1<<40), [32]byte{1}, uint8(27), [32]byte{}, [32]byte{})
+	if err != nil {
+		t.Fatalf("WriteContract() error = %v", err)
+	}
+	if len(report.transactions) != 1 || report.transactions[0].GasLimit == 0 || report.revertReason != "" {
+		t.Fatalf("report = %+v, want one estimated transaction", report.transactions)
+	}
+	assertNothingBroadcast(t, signer)
+
+	// A transfer above the balance is reported with its revert reason
+	ctx, report = withSimulation(context.Background())
+	_, err = signer.WriteContract(ctx, testToken.Hex(), []byte(eip3009ABI), "transferWithAuthorization",
+		payer, testPayTo, big.NewInt(5000), big.NewInt(0), big.NewInt(1<<40), [32]byte{2}, uint8(27), [32]byte{}, [32]byte{})
+	if err == nil || !strings.Contains(report.revertReason, "exceeds balance") {
+		t.Fatalf("WriteContract() error = %v, revert reason = %q, want exceeds balance", err, report.revertReason)
+	}
+}
+
+func TestSimulateSettlementEIP2612(t *testing.T) {
+	payerKey, _ := crypto.GenerateKey()
+	payer := crypto.PubkeyToAddress(payerKey.PublicKey)
+	payment := permitPayment{key: payerKey, amount: 100}
+
+	scheme, _ := newTestPermitScheme(t, payer, permitChain{balance: 1000})
+	feePayer := func(string) string { return scheme.signer.address.Hex() }
+	payload := payment.eip2612(t, scheme.signer)
+
+	// transferFrom only succeeds on top of the allowance the permit grants
+	response := simulateSettlement(context.Background(), scheme, feePayer, payload, payment.requirements(t))
+	if !response.Success || response.RevertReason != "" {
+		t.Fatalf("simulateSettlement() = %+v, want success", response)
+	}
+	if len(response.Transactions) != 2 {
+		t.Fatalf("transactions = %+v, want permit and transferFrom", response.Transactions)
+	}
+	for _, tx := range response.Transactions {
+		if tx.GasLimit == 0 {
+			t.Errorf("transaction %s has no gas estimate", tx.To)
+		}
+	}
+	assertNothingBroadcast(t, scheme.signer)
+}
+
+func TestSimulateERC6492Deployment(t *testing.T) {
+	signer, _ := newTestChain(t, testTokenAlloc(map[common.Address]*big.Int{testCounterfactual: big.NewInt(1000)}))
+
+	// The token refuses the bytes overload from an account without code, so
+	// the transfer only succeeds on top of the factory deployment
+	ctx, report := withSimulation(context.Background())
+	if _, err := signer.SendTransaction(ctx, testFactory.Hex(), []byte{0x01}); err != nil {
+		t.Fatalf("SendTransaction() error = %v", err)
+	}
+	if _, err := simulateTransfer(ctx, signer, testCounterfactual, 1); err != nil {
+		t.Fatalf("WriteContract() error = %v, revert reason = %q", err, report.revertReason)
+	}
+	if len(report.transactions) != 2 || report.transactions[1].GasLimit == 0 {
+		t.Fatalf("transactions = %+v, want deployment and estimated transfer", report.transactions)
+	}
+	assertNothingBroadcast(t, signer)
+
+	// Without the deployment the transfer reverts
+	ctx, report = withSimulation(context.Background())
+	if _, err := simulateTransfer(ctx, signer, testCounterfactual, 2); err == nil || report.revertReason != "wallet not deployed" {
+		t.Fatalf("WriteContract() error = %v, revert reason = %q, want wallet not deployed", err, report.revertReason)
+	}
+
+	// A failing transfer after the deployment is reported too
+	ctx, report = withSimulation(context.Background())
+	if _, err := signer.SendTransaction(ctx, testFactory.Hex(), []byte{0x01}); err != nil {
+		t.Fatalf("SendTransaction() error = %v", err)
+	}
+	_, err := signer.WriteContract(ctx, testToken.Hex(), []byte(eip3009ABI), "transferWithAuthorization0",
+		testCounterfactual, testPayTo, big.NewInt(5000), big.NewInt(0), big.NewInt(1<<40), [32]byte{3}, []byte{0x01})
+	if err == nil || !strings.Contains(report.revertReason, "exceeds balance") {
+		t.Fatalf("WriteContract() error = %v, revert reason = %q, want exceeds balance", err, report.revertReason)
+	}
+}
+
+func TestSimulateWithoutSimulateV1(t *testing.T) {
+	_, backend := newTestChain(t, testTokenAlloc(map[common.Address]*big.Int{testCounterfactual: big.NewInt(1000)}))
+
+	// The wrapped simulated client has no Client() method, like a node
+	// connection that can't reach eth_simulateV1
+	key, _ := crypto.GenerateKey()
+	signer, err := newFacilitatorEvmSignerWithClient(common.Bytes2Hex(crypto.FromECDSA(key)), backend.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Later transactions are recorded without a gas estimate instead of
+	// failing on state the earlier ones would have created
+	ctx, report := withSimulation(context.Background())
+	if _, err := signer.SendTransaction(ctx, testFactory.Hex(), []byte{0x01}); err != nil {
+		t.Fatalf("SendTransaction() error = %v", err)
+	}
+	if _, err := simulateTransfer(ctx, signer, testCounterfactual, 1); err != nil {
+		t.Fatalf("WriteContract() error = %v", err)
+	}
+	if len(report.transactions) != 2 || report.transactions[1].GasLimit != 0 || report.revertReason != "" {
+		t.Fatalf("report = %+v, %q, want the transfer recorded unestimated", report.transactions, report.revertReason)
+	}
+}
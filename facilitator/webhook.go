@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	x402 "github.com/coinbase/x402/go"
+)
+
+const (
+	EventSettlementSettled = "settlement.settled"
+	EventSettlementFailed  = "settlement.failed"
+
+	webhookTimeout = 10 * time.Second
+)
+
+// settlementEvent is the JSON body posted to the settlement webhook
+type settlementEvent struct {
+	Event      string               `json:"event"`
+	Recovered  bool                 `json:"recovered"`
+	Settlement *x402.SettleResponse `json:"settlement"`
+	Timestamp  time.Time            `json:"timestamp"`
+}
+
+// settlementWebhook notifies an external URL about settlement outcomes.
+//
+// A nil *settlementWebhook is valid and sends nothing.
+type settlementWebhook struct {
+	url    string
+	client *http.Client
+}
+
+// newSettlementWebhook creates a webhook notifier, or returns nil if url is empty
+func newSettlementWebhook(url string) *settlementWebhook {
+	if url == "" {
+		return nil
+	}
+	return &settlementWebhook{
+		url:    url,
+		client: &http.Client{Timeout: webhookTimeout},
+	}
+}
+
+// Notify posts a settlement outcome to the webhook URL
+func (w *settlementWebhook) Notify(ctx context.Context, result *x402.SettleResponse, recovered bool) error {
+	if w == nil || result == nil {
+		return nil
+	}
+
+	event := settlementEvent{
+		Event:      EventSettlementSettled,
+		Recovered:  recovered,
+		Settlement: result,
+		Timestamp:  time.Now().UTC(),
+	}
+	if !result.Success {
+		event.Event = EventSettlementFailed
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal webhook event: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// NotifyAsync posts a settlement outcome in the background, logging failures
+// under the request ID ctx carries
+func (w *settlementWebhook) NotifyAsync(ctx context.Context, result *x402.SettleResponse, recovered bool) {
+	if w == nil || result == nil {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), webhookTimeout)
+		defer cancel()
+
+		if err := w.Notify(ctx, result, recovered); err != nil {
+			slog.WarnContext(ctx, "settlement webhook failed", "tx", result.Transaction, "error", err)
+		}
+	}()
+}
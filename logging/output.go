@@ -0,0 +1,85 @@
+package logging
+
+import (
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// Default redacts the process output once Install has run
+var Default = NewRedactor()
+
+// redirect is stdout or stderr routed through a redacting pipe
+type redirect struct {
+	original *os.File
+	pipe     *os.File
+	done     chan struct{}
+}
+
+var (
+	installMu sync.Mutex
+	redirects []*redirect
+)
+
+// Install redacts everything the process prints: os.Stdout and os.Stderr are
+// replaced by pipes whose output is redacted before it reaches the terminal,
+// and the log package writes to the new os.Stderr. Secrets come from the
+// environment (see SecretsFromEnv), so load .env first.
+//
+// Output written to a pipe is lost if the process exits before it has been
+// copied: exit with Exit rather than os.Exit, and defer Close in main.
+// Libraries that kept a reference to the original os.Stdout (gin's
+// DefaultWriter) have to be pointed at the new one.
+func Install() error {
+	installMu.Lock()
+	defer installMu.Unlock()
+	if len(redirects) > 0 {
+		return nil
+	}
+	Default.Add(SecretsFromEnv()...)
+
+	for _, target := range []**os.File{&os.Stdout, &os.Stderr} {
+		reader, writer, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		r := &redirect{original: *target, pipe: writer, done: make(chan struct{})}
+		go func() {
+			defer close(r.done)
+			out := NewWriter(r.original, Default)
+			io.Copy(out, reader)
+			out.Flush()
+			reader.Close()
+		}()
+		*target = writer
+		redirects = append(redirects, r)
+	}
+	log.SetOutput(os.Stderr)
+	return nil
+}
+
+// Close writes out everything printed so far and restores the original
+// os.Stdout and os.Stderr
+func Close() {
+	installMu.Lock()
+	defer installMu.Unlock()
+	for i, r := range redirects {
+		r.pipe.Close()
+		<-r.done
+		if i == 0 {
+			os.Stdout = r.original
+		} else {
+			os.Stderr = r.original
+		}
+	}
+	redirects = nil
+	log.SetOutput(os.Stderr)
+}
+
+// Exit is os.Exit for a process that called Install: it writes out pending
+// output first
+func Exit(code int) {
+	Close()
+	os.Exit(code)
+}
@@ -0,0 +1,203 @@
+// Package logging is the logging shared by the x402 binaries: structured
+// logs (see Setup) tagged with request IDs, with secrets kept out of
+// everything they print. Configured secrets (the values of secret
+// environment variables) are redacted, and so is anything that looks like a
+// key: PEM private keys, hex private keys, Solana keypairs, bearer tokens,
+// JWTs and passwords in URLs.
+package logging
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mr-tron/base58"
+)
+
+// Redacted replaces every secret
+const Redacted = "[REDACTED]"
+
+// secretVarName matches environment variables holding secrets, such as
+// EVM_PRIVATE_KEY, CDP_API_KEY_SECRET or ADMIN_API_TOKEN
+var secretVarName = regexp.MustCompile(`(^|_)(KEY|SECRET|TOKEN|PASSWORD|PASS)($|_)`)
+
+// minSecretLength keeps short values such as "true" from being redacted
+// everywhere they appear
+const minSecretLength = 8
+
+// pattern is a kind of secret recognized by its shape
+type pattern struct {
+	kind string
+	re   *regexp.Regexp
+	// keep is the number of leading submatches kept, such as "Bearer "
+	keep int
+	// suffix is kept at the end of a match, such as the @ after a password
+	suffix string
+	// check confirms a match; nil accepts every match
+	check func(match string) bool
+}
+
+var patterns = []pattern{
+	{kind: "PEM private key", re: regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`)},
+	{kind: "bearer token", re: regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9\-._~+/]{16,}=*`), keep: 1},
+	{kind: "JWT", re: regexp.MustCompile(`eyJ[A-Za-z0-9_-]{8,}\.eyJ[A-Za-z0-9_-]{8,}\.[A-Za-z0-9_-]+`)},
+	{kind: "URL password", re: regexp.MustCompile(`(://[^:/@\s\[\]]*:)[^@/\s\[\]]+@`), keep: 1, suffix: "@"},
+	// 0x-prefixed 32-byte hex is also a transaction hash, so it only counts
+	// as a key when labelled as one
+	{kind: "hex private key", re: regexp.MustCompile(`(?i)((?:private[_ ]?key|secret|priv)\w*["']?\s*[:=]\s*["']?)(?:0x)?[0-9a-f]{64}\b`), keep: 1},
+	{kind: "hex private key", re: regexp.MustCompile(`(^|[^0-9A-Za-z])[0-9a-fA-F]{64}\b`), keep: 1},
+	// Solana transaction signatures have the same length, so a match must
+	// decode to a seed followed by its own public key
+	{kind: "Solana keypair", re: regexp.MustCompile(`\b[1-9A-HJ-NP-Za-km-z]{86,88}\b`), check: isSolanaKeypair},
+}
+
+// isSolanaKeypair reports whether value is a base58 64-byte ed25519 keypair
+func isSolanaKeypair(value string) bool {
+	decoded, err := base58.Decode(value)
+	if err != nil || len(decoded) != ed25519.PrivateKeySize {
+		return false
+	}
+	public := ed25519.NewKeyFromSeed(decoded[:ed25519.SeedSize]).Public().(ed25519.PublicKey)
+	return bytes.Equal(public, decoded[ed25519.SeedSize:])
+}
+
+// Redactor removes secrets from text
+type Redactor struct {
+	mu      sync.RWMutex
+	secrets []string // longest first, so a secret containing another goes whole
+}
+
+// NewRedactor creates a redactor for secrets, on top of the key patterns
+//
+// Args:
+//
+//	secrets: values to redact wherever they appear
+//
+// Returns:
+//
+//	*Redactor
+func NewRedactor(secrets ...string) *Redactor {
+	r := &Redactor{}
+	r.Add(secrets...)
+	return r
+}
+
+// Add registers more secrets; values shorter than 8 characters are ignored
+func (r *Redactor) Add(secrets ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, secret := range secrets {
+		secret = strings.TrimSpace(secret)
+		if len(secret) < minSecretLength {
+			continue
+		}
+		r.secrets = append(r.secrets, secret)
+		// Hex keys are written with and without 0x
+		if trimmed := strings.TrimPrefix(secret, "0x"); trimmed != secret && len(trimmed) >= minSecretLength {
+			r.secrets = append(r.secrets, trimmed)
+		}
+	}
+	sort.Slice(r.secrets, func(i, j int) bool { return len(r.secrets[i]) > len(r.secrets[j]) })
+}
+
+// Redact replaces the secrets in text with [REDACTED]
+func (r *Redactor) Redact(text string) string {
+	r.mu.RLock()
+	for _, secret := range r.secrets {
+		text = strings.ReplaceAll(text, secret, Redacted)
+	}
+	r.mu.RUnlock()
+
+	for _, p := range patterns {
+		text = p.re.ReplaceAllStringFunc(text, func(match string) string {
+			kept := ""
+			if p.keep > 0 {
+				kept = p.re.FindStringSubmatch(match)[p.keep]
+			}
+			if p.check != nil && !p.check(match[len(kept):len(match)-len(p.suffix)]) {
+				return match
+			}
+			return kept + Redacted + p.suffix
+		})
+	}
+	return text
+}
+
+// SecretsFromEnv returns the values of the environment variables that hold
+// secrets: names with a KEY, SECRET, TOKEN or PASSWORD part (but not IDs
+// such as CDP_API_KEY_ID), plus the ones listed in LOG_SECRET_VARS
+func SecretsFromEnv() []string {
+	extra := make(map[string]bool)
+	for _, name := range strings.Split(os.Getenv("LOG_SECRET_VARS"), ",") {
+		extra[strings.TrimSpace(name)] = true
+	}
+
+	var secrets []string
+	for _, entry := range os.Environ() {
+		name, value, _ := strings.Cut(entry, "=")
+		if extra[name] || (secretVarName.MatchString(name) && !strings.HasSuffix(name, "_ID")) {
+			secrets = append(secrets, value)
+		}
+	}
+	return secrets
+}
+
+// Writer redacts what is written to it, a line at a time so that a secret
+// is never split between two writes
+type Writer struct {
+	mu       sync.Mutex
+	out      io.Writer
+	redactor *Redactor
+	pending  []byte
+}
+
+// maxPending flushes output that has no newline for this long
+const maxPending = 64 * 1024
+
+// NewWriter creates a writer redacting into out
+//
+// Args:
+//
+//	out: where the redacted output goes
+//	redactor: secrets to remove
+//
+// Returns:
+//
+//	*Writer
+func NewWriter(out io.Writer, redactor *Redactor) *Writer {
+	return &Writer{out: out, redactor: redactor}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending = append(w.pending, p...)
+
+	end := bytes.LastIndexByte(w.pending, '\n') + 1
+	if end == 0 && len(w.pending) >= maxPending {
+		end = len(w.pending)
+	}
+	if end == 0 {
+		return len(p), nil
+	}
+	_, err := io.WriteString(w.out, w.redactor.Redact(string(w.pending[:end])))
+	w.pending = append(w.pending[:0], w.pending[end:]...)
+	return len(p), err
+}
+
+// Flush writes out a final line without a newline
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.pending) == 0 {
+		return nil
+	}
+	_, err := io.WriteString(w.out, w.redactor.Redact(string(w.pending)))
+	w.pending = w.pending[:0]
+	return err
+}
@@ -0,0 +1,63 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+)
+
+// RequestIDHeader carries the ID of a request, both ways, and from the
+// server on to the facilitator
+const RequestIDHeader = "X-Request-ID"
+
+// validRequestID limits the request IDs taken from clients to plain tokens
+var validRequestID = regexp.MustCompile(`^[-_.a-zA-Z0-9]{1,64}$`)
+
+type requestIDKey struct{}
+
+// RequestIDFrom returns the ID sent in a request header if it is usable,
+// a new random one otherwise
+func RequestIDFrom(header string) string {
+	if validRequestID.MatchString(header) {
+		return header
+	}
+	random := make([]byte, 8)
+	rand.Read(random)
+	return hex.EncodeToString(random)
+}
+
+// WithRequestID returns ctx carrying a request ID
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID ctx carries, if any
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestIDTransport sends the request ID of a request's context along
+type requestIDTransport struct {
+	next http.RoundTripper
+}
+
+// Transport wraps next (http.DefaultTransport if nil) to send the request ID
+// of each outgoing request's context in X-Request-ID, so the service called
+// logs under the same ID
+func Transport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &requestIDTransport{next: next}
+}
+
+func (t *requestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if id := RequestID(req.Context()); id != "" && req.Header.Get(RequestIDHeader) == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set(RequestIDHeader, id)
+	}
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,172 @@
+package logging
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// maxScanSize skips files too large to be source
+const maxScanSize = 1 << 20
+
+// hardcodedSecret matches a long literal assigned to a secret-looking name,
+// such as keySecret := "..."
+var hardcodedSecret = regexp.MustCompile(`(?i)(secret|private_?key|password|api_?key)\w*["']?\s*(:=|=|:)\s*["'][A-Za-z0-9+/=_\-]{32,}["']`)
+
+// Finding is a possible secret in a source file
+type Finding struct {
+	File string
+	Line int
+	Kind string
+}
+
+func (f Finding) String() string {
+	if f.Line == 0 {
+		return fmt.Sprintf("%s: %s", f.File, f.Kind)
+	}
+	return fmt.Sprintf("%s:%d: %s", f.File, f.Line, f.Kind)
+}
+
+// ScanSource looks for secrets under root: the values of secret environment
+// variables and key patterns in any text file except .env files, which is
+// where secrets belong, plus .env files .gitignore does not exclude. Hidden,
+// vendor and node_modules directories are skipped, and so are tests, whose
+// keys are made up.
+//
+// Args:
+//
+//	root: directory to scan
+//	secrets: values that must not appear in source
+//
+// Returns:
+//
+//	[]Finding, with paths relative to root
+func ScanSource(root string, secrets ...string) ([]Finding, error) {
+	redactor := NewRedactor(secrets...)
+	envIgnored := gitignoresEnv(root)
+
+	var findings []Finding
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		name := entry.Name()
+		if entry.IsDir() {
+			if path != root && (strings.HasPrefix(name, ".") || name == "vendor" || name == "node_modules") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		relative, _ := filepath.Rel(root, path)
+
+		if name == ".env" || strings.HasPrefix(name, ".env.") {
+			if !envIgnored && name != ".env.example" {
+				findings = append(findings, Finding{File: relative, Kind: ".env file not excluded by .gitignore"})
+			}
+			return nil
+		}
+		if strings.HasSuffix(name, "_test.go") {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() || info.Size() > maxScanSize {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil || bytes.IndexByte(data, 0) >= 0 {
+			return nil // unreadable or binary
+		}
+
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		scanner.Buffer(make([]byte, 64*1024), maxScanSize)
+		for line := 1; scanner.Scan(); line++ {
+			if kind := secretKind(redactor, scanner.Text()); kind != "" {
+				findings = append(findings, Finding{File: relative, Line: line, Kind: kind})
+			}
+		}
+		return nil
+	})
+	return findings, err
+}
+
+// secretKind names the first kind of secret found in line, if any
+func secretKind(redactor *Redactor, line string) string {
+	if hardcodedSecret.MatchString(line) {
+		return "hard-coded secret"
+	}
+	redactor.mu.RLock()
+	for _, secret := range redactor.secrets {
+		if strings.Contains(line, secret) {
+			redactor.mu.RUnlock()
+			return "value of a secret environment variable"
+		}
+	}
+	redactor.mu.RUnlock()
+	for _, p := range patterns {
+		for _, match := range p.re.FindAllStringSubmatch(line, -1) {
+			kept := ""
+			if p.keep > 0 {
+				kept = match[p.keep]
+			}
+			secret := match[0][len(kept) : len(match[0])-len(p.suffix)]
+			if p.check == nil || p.check(secret) {
+				return p.kind
+			}
+		}
+	}
+	return ""
+}
+
+// gitignoresEnv reports whether root's .gitignore excludes .env files
+func gitignoresEnv(root string) bool {
+	data, err := os.ReadFile(filepath.Join(root, ".gitignore"))
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		switch strings.TrimSpace(line) {
+		case ".env", "*.env", "**/.env", ".env*", "/.env":
+			return true
+		}
+	}
+	return false
+}
+
+// WarnSecretsInSource scans the source tree the binary runs in (the
+// directory holding go.mod, above the working directory) for secrets and
+// logs a warning for each one found. It does nothing outside a source
+// tree, such as for a deployed binary.
+func WarnSecretsInSource() {
+	root, err := os.Getwd()
+	if err != nil {
+		return
+	}
+	for {
+		if _, err := os.Stat(filepath.Join(root, "go.mod")); err == nil {
+			break
+		}
+		parent := filepath.Dir(root)
+		if parent == root {
+			return
+		}
+		root = parent
+	}
+
+	findings, err := ScanSource(root, SecretsFromEnv()...)
+	if err != nil {
+		slog.Warn("secret scan failed", "root", root, "error", err)
+		return
+	}
+	for _, finding := range findings {
+		slog.Warn("possible secret in source", "file", finding.File, "line", finding.Line, "kind", finding.Kind)
+	}
+	if len(findings) > 0 {
+		slog.Warn("move secrets to the environment and rotate any that were committed", "findings", len(findings), "root", root)
+	}
+}
@@ -0,0 +1,73 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Setup makes slog the logger of the process: records are written to
+// os.Stdout (redacted once Install has run), as text or, with
+// LOG_FORMAT=json, as JSON, at LOG_LEVEL (debug, info, warn or error;
+// default info). Every record names the service, and records logged with a
+// request's context carry its request_id, so one grep finds everything a
+// request did. The log package is routed to slog too.
+//
+// Args:
+//
+//	service: name of the binary, such as "server"
+//
+// Returns:
+//
+//	The logger, also installed as slog.Default
+func Setup(service string) (*slog.Logger, error) {
+	var level slog.Level
+	if value := os.Getenv("LOG_LEVEL"); value != "" {
+		if err := level.UnmarshalText([]byte(value)); err != nil {
+			return nil, fmt.Errorf("invalid LOG_LEVEL %q: use debug, info, warn or error", value)
+		}
+	}
+	options := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	switch format := strings.ToLower(os.Getenv("LOG_FORMAT")); format {
+	case "", "text":
+		handler = slog.NewTextHandler(os.Stdout, options)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stdout, options)
+	default:
+		return nil, fmt.Errorf("invalid LOG_FORMAT %q: use text or json", format)
+	}
+
+	logger := slog.New(contextHandler{handler}).With("service", service)
+	slog.SetDefault(logger)
+	return logger, nil
+}
+
+// contextHandler adds the request ID of a record's context
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// Fatal logs an error and exits with status 1, writing out pending output
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	Exit(1)
+}
@@ -0,0 +1,73 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestContextHandlerAddsRequestID(t *testing.T) {
+	var out bytes.Buffer
+	logger := slog.New(contextHandler{slog.NewJSONHandler(&out, nil)}).With("service", "test")
+
+	logger.InfoContext(WithRequestID(context.Background(), "req-1"), "settled", "tx", "0xabc")
+	logger.Info("started")
+
+	var records []map[string]any
+	decoder := json.NewDecoder(&out)
+	for decoder.More() {
+		var record map[string]any
+		if err := decoder.Decode(&record); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2", len(records))
+	}
+	if records[0]["request_id"] != "req-1" || records[0]["service"] != "test" || records[0]["tx"] != "0xabc" {
+		t.Errorf("record with request ID = %v", records[0])
+	}
+	if _, ok := records[1]["request_id"]; ok {
+		t.Errorf("record without request ID = %v", records[1])
+	}
+}
+
+func TestRequestIDFrom(t *testing.T) {
+	if got := RequestIDFrom("abc-123"); got != "abc-123" {
+		t.Errorf("RequestIDFrom(valid) = %q", got)
+	}
+	for _, header := range []string{"", "has space", "a\nb"} {
+		got := RequestIDFrom(header)
+		if got == header || !validRequestID.MatchString(got) {
+			t.Errorf("RequestIDFrom(%q) = %q, want a new ID", header, got)
+		}
+	}
+}
+
+func TestTransportSendsRequestID(t *testing.T) {
+	var got string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get(RequestIDHeader)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: Transport(nil)}
+	req, _ := http.NewRequestWithContext(WithRequestID(context.Background(), "req-2"), http.MethodGet, server.URL, nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	resp.Body.Close()
+
+	if got != "req-2" {
+		t.Errorf("%s = %q, want req-2", RequestIDHeader, got)
+	}
+	if req.Header.Get(RequestIDHeader) != "" {
+		t.Error("Transport modified the caller's request")
+	}
+}
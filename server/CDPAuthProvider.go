@@ -2,35 +2,159 @@ package main
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
 	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/coinbase/cdp-sdk/go/auth"
 	x402http "github.com/coinbase/x402/go/http"
 )
 
-// CDPAuthProvider implements AuthProvider for Coinbase CDP API
+const (
+	// cdpJWTLifetime is how long the JWTs signed for the CDP API are valid
+	cdpJWTLifetime = 120 * time.Second
+	// cdpJWTRenewBefore is how long before expiry a cached JWT is replaced,
+	// so one is never sent that expires in flight
+	cdpJWTRenewBefore = 15 * time.Second
+)
+
+// cdpKeysURL is where CDP API keys are managed
+const cdpKeysURL = "https://portal.cdp.coinbase.com/settings/api-keys"
+
+// CDPAuthProvider implements AuthProvider for Coinbase CDP API. Each request
+// needs a JWT bound to its method, host and path; the JWTs are signed for the
+// facilitator URL's host and path and reused until shortly before they
+// expire.
 type CDPAuthProvider struct {
-	APIKeyID     string
-	APIKeySecret string
+	keyID     string
+	keySecret string
+	host      string
+	basePath  string
+
+	// generate signs a JWT; auth.GenerateJWT outside tests
+	generate func(auth.JwtOptions) (string, error)
+	now      func() time.Time
+
+	mu     sync.Mutex
+	tokens map[string]cdpJWT
 }
 
-func (a *CDPAuthProvider) GetAuthHeaders(ctx context.Context) (x402http.AuthHeaders, error) {
-	// Generate JWT for /supported endpoint
-	supportedJWT, err := generateCDPJWT(a.APIKeyID, a.APIKeySecret, "GET", "api.cdp.coinbase.com", "/platform/v2/x402/supported")
+// cdpJWT is a signed JWT and when it expires
+type cdpJWT struct {
+	token   string
+	expires time.Time
+}
+
+// NewCDPAuthProvider creates an auth provider for the facilitator at
+// facilitatorURL, checking the key up front so a bad one fails at startup
+// instead of on the first payment
+//
+// Args:
+//
+//	keyID: CDP API key ID
+//	keySecret: CDP API key secret, a base64 Ed25519 key or an ECDSA PEM key
+//	facilitatorURL: facilitator base URL, such as https://api.cdp.coinbase.com/platform/v2/x402
+//
+// Returns:
+//
+//	*CDPAuthProvider or error
+func NewCDPAuthProvider(keyID string, keySecret string, facilitatorURL string) (*CDPAuthProvider, error) {
+	if keyID == "" {
+		return nil, fmt.Errorf("CDP API key ID is empty")
+	}
+	keySecret, err := checkCDPKeySecret(keySecret)
 	if err != nil {
-		return x402http.AuthHeaders{}, fmt.Errorf("failed to generate JWT: %w", err)
+		return nil, err
+	}
+
+	parsed, err := url.Parse(facilitatorURL)
+	if err != nil || parsed.Host == "" {
+		return nil, fmt.Errorf("facilitator URL %q is not an absolute URL", facilitatorURL)
+	}
+
+	return &CDPAuthProvider{
+		keyID:     keyID,
+		keySecret: keySecret,
+		host:      parsed.Host,
+		basePath:  strings.TrimSuffix(parsed.Path, "/"),
+		generate:  auth.GenerateJWT,
+		now:       time.Now,
+		tokens:    make(map[string]cdpJWT),
+	}, nil
+}
+
+// checkCDPKeySecret checks that secret is a key the CDP API accepts: an
+// Ed25519 key as base64 of its 64 bytes (seed and public key), or an ECDSA
+// key in PEM. Newlines escaped as \n, as .env files often have them, are
+// restored.
+//
+// Returns:
+//
+//	The secret to sign with, or an error saying what is wrong with it
+func checkCDPKeySecret(secret string) (string, error) {
+	secret = strings.TrimSpace(strings.ReplaceAll(secret, `\n`, "\n"))
+	if secret == "" {
+		return "", fmt.Errorf("CDP API key secret is empty")
+	}
+
+	if strings.HasPrefix(secret, "-----BEGIN") {
+		block, _ := pem.Decode([]byte(secret))
+		if block == nil {
+			return "", fmt.Errorf("CDP API key secret looks like PEM but cannot be decoded; check that it was copied whole")
+		}
+		switch block.Type {
+		case "EC PRIVATE KEY":
+			if _, err := x509.ParseECPrivateKey(block.Bytes); err != nil {
+				return "", fmt.Errorf("CDP API key secret is not a valid ECDSA key: %w", err)
+			}
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return "", fmt.Errorf("CDP API key secret is not a valid private key: %w", err)
+			}
+			if _, ok := key.(*ecdsa.PrivateKey); !ok {
+				return "", fmt.Errorf("CDP API key secret is a PEM %T, PEM CDP keys are ECDSA", key)
+			}
+		default:
+			return "", fmt.Errorf("CDP API key secret is a PEM %q block, want an EC PRIVATE KEY", block.Type)
+		}
+		return secret, nil
 	}
 
-	// Generate JWT for /verify endpoint
-	verifyJWT, err := generateCDPJWT(a.APIKeyID, a.APIKeySecret, "POST", "api.cdp.coinbase.com", "/platform/v2/x402/verify")
+	decoded, err := base64.StdEncoding.DecodeString(secret)
 	if err != nil {
-		return x402http.AuthHeaders{}, fmt.Errorf("failed to generate JWT: %w", err)
+		return "", fmt.Errorf("CDP API key secret is neither an ECDSA PEM key nor a base64 Ed25519 key")
+	}
+	if len(decoded) != ed25519.PrivateKeySize {
+		return "", fmt.Errorf("CDP API key secret is %d bytes, Ed25519 keys are %d (32-byte seed + 32-byte public key); it is likely truncated, regenerate it at %s",
+			len(decoded), ed25519.PrivateKeySize, cdpKeysURL)
 	}
+	public := ed25519.NewKeyFromSeed(decoded[:ed25519.SeedSize]).Public().(ed25519.PublicKey)
+	if !public.Equal(ed25519.PublicKey(decoded[ed25519.SeedSize:])) {
+		return "", fmt.Errorf("CDP API key secret is corrupted: its public key does not match its seed; regenerate it at %s", cdpKeysURL)
+	}
+	return secret, nil
+}
 
-	// Generate JWT for /settle endpoint
-	settleJWT, err := generateCDPJWT(a.APIKeyID, a.APIKeySecret, "POST", "api.cdp.coinbase.com", "/platform/v2/x402/settle")
+func (a *CDPAuthProvider) GetAuthHeaders(ctx context.Context) (x402http.AuthHeaders, error) {
+	supportedJWT, err := a.jwt("GET", "/supported")
 	if err != nil {
-		return x402http.AuthHeaders{}, fmt.Errorf("failed to generate JWT: %w", err)
+		return x402http.AuthHeaders{}, err
+	}
+	verifyJWT, err := a.jwt("POST", "/verify")
+	if err != nil {
+		return x402http.AuthHeaders{}, err
+	}
+	settleJWT, err := a.jwt("POST", "/settle")
+	if err != nil {
+		return x402http.AuthHeaders{}, err
 	}
 
 	return x402http.AuthHeaders{
@@ -46,18 +170,31 @@ func (a *CDPAuthProvider) GetAuthHeaders(ctx context.Context) (x402http.AuthHead
 	}, nil
 }
 
-// generateCDPJWT generates a JWT token for CDP API authentication
-func generateCDPJWT(keyID, keySecret, method, host, path string) (string, error) {
-	jwt, err := auth.GenerateJWT(auth.JwtOptions{
-		KeyID:         keyID,
-		KeySecret:     keySecret,
+// jwt returns a JWT for method on the facilitator endpoint, signing a new one
+// when the cached one is about to expire
+func (a *CDPAuthProvider) jwt(method string, endpoint string) (string, error) {
+	path := a.basePath + endpoint
+	key := method + " " + path
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.now()
+	if cached, ok := a.tokens[key]; ok && now.Before(cached.expires.Add(-cdpJWTRenewBefore)) {
+		return cached.token, nil
+	}
+
+	token, err := a.generate(auth.JwtOptions{
+		KeyID:         a.keyID,
+		KeySecret:     a.keySecret,
 		RequestMethod: method,
-		RequestHost:   host,
+		RequestHost:   a.host,
 		RequestPath:   path,
-		ExpiresIn:     120, // 2 minutes
+		ExpiresIn:     int64(cdpJWTLifetime / time.Second),
 	})
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("failed to generate JWT for %s: %w", key, err)
 	}
-	return jwt, nil
+	a.tokens[key] = cdpJWT{token: token, expires: now.Add(cdpJWTLifetime)}
+	return token, nil
 }
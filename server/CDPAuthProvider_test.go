@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coinbase/cdp-sdk/go/auth"
+)
+
+func TestCheckCDPKeySecret(t *testing.T) {
+	edKey := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{3}, ed25519.SeedSize))
+	corrupted := append(ed25519.PrivateKey{}, edKey...)
+	corrupted[40] ^= 1
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ecDER, _ := x509.MarshalECPrivateKey(ecKey)
+	ecPEM := string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER}))
+	edDER, _ := x509.MarshalPKCS8PrivateKey(edKey)
+	edPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: edDER}))
+
+	for _, test := range []struct {
+		name    string
+		secret  string
+		problem string
+	}{
+		{"ed25519", base64.StdEncoding.EncodeToString(edKey), ""},
+		{"ecdsa pem", ecPEM, ""},
+		{"ecdsa pem with escaped newlines", strings.ReplaceAll(ecPEM, "\n", `\n`), ""},
+		{"empty", "", "is empty"},
+		{"truncated ed25519", base64.StdEncoding.EncodeToString(edKey[:48]), "is 48 bytes"},
+		{"corrupted ed25519", base64.StdEncoding.EncodeToString(corrupted), "does not match its seed"},
+		{"not base64", "not a key!", "neither an ECDSA PEM key nor a base64 Ed25519 key"},
+		{"truncated pem", ecPEM[:60], "cannot be decoded"},
+		{"ed25519 pem", edPEM, "PEM CDP keys are ECDSA"},
+		{"certificate", "-----BEGIN CERTIFICATE-----\nAAAA\n-----END CERTIFICATE-----\n", `"CERTIFICATE" block`},
+	} {
+		_, err := checkCDPKeySecret(test.secret)
+		if test.problem == "" && err != nil || test.problem != "" && (err == nil || !strings.Contains(err.Error(), test.problem)) {
+			t.Errorf("%s: checkCDPKeySecret() = %v, want %q", test.name, err, test.problem)
+		}
+	}
+}
+
+func TestCDPAuthProviderCachesJWTs(t *testing.T) {
+	secret := base64.StdEncoding.EncodeToString(ed25519.NewKeyFromSeed(bytes.Repeat([]byte{3}, ed25519.SeedSize)))
+	provider, err := NewCDPAuthProvider("key-id", secret, "https://facilitator.example.com:8443/x402/")
+	if err != nil {
+		t.Fatalf("NewCDPAuthProvider() error = %v", err)
+	}
+
+	now := time.Unix(1700000000, 0)
+	provider.now = func() time.Time { return now }
+	var signed []string
+	provider.generate = func(options auth.JwtOptions) (string, error) {
+		if options.RequestHost != "facilitator.example.com:8443" || options.ExpiresIn != 120 {
+			t.Errorf("JWT options = %+v", options)
+		}
+		signed = append(signed, options.RequestMethod+" "+options.RequestPath)
+		return options.RequestMethod + options.RequestPath + now.Format(time.TimeOnly), nil
+	}
+
+	first, err := provider.GetAuthHeaders(context.Background())
+	if err != nil {
+		t.Fatalf("GetAuthHeaders() error = %v", err)
+	}
+	want := []string{"GET /x402/supported", "POST /x402/verify", "POST /x402/settle"}
+	if strings.Join(signed, ",") != strings.Join(want, ",") {
+		t.Errorf("signed %v, want %v", signed, want)
+	}
+
+	// Reused while fresh
+	now = now.Add(cdpJWTLifetime - cdpJWTRenewBefore - time.Second)
+	second, _ := provider.GetAuthHeaders(context.Background())
+	if len(signed) != 3 || second.Settle["Authorization"] != first.Settle["Authorization"] {
+		t.Errorf("JWTs were signed again before expiry: %v", signed)
+	}
+
+	// Renewed shortly before expiry
+	now = now.Add(time.Second)
+	third, _ := provider.GetAuthHeaders(context.Background())
+	if len(signed) != 6 || third.Settle["Authorization"] == first.Settle["Authorization"] {
+		t.Errorf("JWTs were not renewed before expiry: %v", signed)
+	}
+}
+
+func TestNewCDPAuthProviderRejectsRelativeURL(t *testing.T) {
+	secret := base64.StdEncoding.EncodeToString(ed25519.NewKeyFromSeed(bytes.Repeat([]byte{3}, ed25519.SeedSize)))
+	if _, err := NewCDPAuthProvider("key-id", secret, "/x402"); err == nil {
+		t.Error("NewCDPAuthProvider() accepted a URL without a host")
+	}
+	if _, err := NewCDPAuthProvider("", secret, "https://api.cdp.coinbase.com/platform/v2/x402"); err == nil {
+		t.Error("NewCDPAuthProvider() accepted an empty key ID")
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	x402 "github.com/coinbase/x402/go"
+	ginfw "github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// AccessTokenHeader carries an access token: issued in the response to a
+	// settled payment, sent back by the client instead of paying again
+	AccessTokenHeader = "PAYMENT-ACCESS-TOKEN"
+	// AccessRemainingHeader reports how many requests the token has left
+	AccessRemainingHeader = "PAYMENT-ACCESS-REMAINING"
+	// AccessStatusHeader says why a token was not accepted
+	AccessStatusHeader = "PAYMENT-ACCESS-STATUS"
+
+	accessTokenIssuer = "x402-server"
+)
+
+var (
+	errAccessOtherGroup = errors.New("access token is for another route group")
+	errAccessUsedUp     = errors.New("access token has no requests left")
+)
+
+// AccessGroupConfig is a route group in the payment config. A payment on any
+// route of the group buys a token valid for Requests requests (0 for no
+// limit) on the group's routes until TTL has passed.
+type AccessGroupConfig struct {
+	Requests int    `json:"requests" yaml:"requests"`
+	TTL      string `json:"ttl" yaml:"ttl"`
+}
+
+// accessGroup is a checked AccessGroupConfig
+type accessGroup struct {
+	name     string
+	requests int
+	ttl      time.Duration
+}
+
+// accessClaims are the claims of an access token
+type accessClaims struct {
+	Group    string `json:"grp"`
+	Requests int    `json:"req,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// accessTokens issues access tokens after payments on routes in an access
+// group and lets requests carrying one through without paying. Tokens are
+// HS256 JWTs; requests are counted in the quota store, so Redis-backed
+// counts hold across servers sharing the secret.
+type accessTokens struct {
+	secret []byte
+	store  quotaStore
+	groups func() map[string]accessGroup
+}
+
+// newAccessTokens creates the token issuer
+//
+// Args:
+//
+//	secret: HMAC key tokens are signed with
+//	store: counts requests made with each token
+//	groups: returns the current access groups
+//
+// Returns:
+//
+//	*accessTokens
+func newAccessTokens(secret []byte, store quotaStore, groups func() map[string]accessGroup) *accessTokens {
+	return &accessTokens{secret: secret, store: store, groups: groups}
+}
+
+// accessTokensFromEnv creates the token issuer with the ACCESS_TOKEN_SECRET key
+func accessTokensFromEnv(store quotaStore, groups func() map[string]accessGroup) (*accessTokens, error) {
+	secret := []byte(os.Getenv("ACCESS_TOKEN_SECRET"))
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		slog.Warn("ACCESS_TOKEN_SECRET not set, access tokens will not survive a restart")
+	}
+	return newAccessTokens(secret, store, groups), nil
+}
+
+// Issue signs a token for group to payer
+func (a *accessTokens) Issue(group accessGroup, payer string, now time.Time) (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	claims := accessClaims{
+		Group:    group.name,
+		Requests: group.requests,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        hex.EncodeToString(id),
+			Issuer:    accessTokenIssuer,
+			Subject:   payer,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(group.ttl)),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(a.secret)
+}
+
+// verify checks a token's signature, expiry and group
+func (a *accessTokens) verify(token string, group string) (*accessClaims, error) {
+	claims := &accessClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+		return a.secret, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(accessTokenIssuer),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Group != group {
+		return nil, errAccessOtherGroup
+	}
+	return claims, nil
+}
+
+// Middleware wraps the payment middleware in next. Requests to routes in an
+// access group are let through with a valid token; otherwise a token is
+// issued once their payment settles.
+func (a *accessTokens) Middleware(routes routeMatcher, next ginfw.HandlerFunc) ginfw.HandlerFunc {
+	return func(c *ginfw.Context) {
+		_, route, ok := routes.Match(c.Request.Method, c.Request.URL.Path)
+		if !ok || route.AccessGroup == "" {
+			next(c)
+			return
+		}
+		group, ok := a.groups()[route.AccessGroup]
+		if !ok {
+			next(c)
+			return
+		}
+
+		if token := c.GetHeader(AccessTokenHeader); token != "" {
+			if a.serve(c, group, token) {
+				return
+			}
+		}
+
+		recordSettlement(c).onSettle(func(settled *x402.SettleResponse) {
+			// Free calls settle without a transaction and buy nothing
+			if settled == nil || !settled.Success || settled.Transaction == "" {
+				return
+			}
+			token, err := a.Issue(group, settled.Payer, time.Now())
+			if err != nil {
+				slog.WarnContext(c.Request.Context(), "failed to issue access token", "group", group.name, "error", err)
+				return
+			}
+			c.Header(AccessTokenHeader, token)
+			if group.requests > 0 {
+				c.Header(AccessRemainingHeader, strconv.Itoa(group.requests))
+			}
+		})
+		next(c)
+	}
+}
+
+// serve runs a request paid for by an access token. It returns false, without
+// running the handler, when the token cannot be used.
+func (a *accessTokens) serve(c *ginfw.Context, group accessGroup, token string) bool {
+	claims, err := a.verify(token, group.name)
+	if err != nil {
+		c.Header(AccessStatusHeader, err.Error())
+		return false
+	}
+
+	if claims.Requests > 0 {
+		remaining, ok, err := a.store.Take(c.Request.Context(), "x402:access:"+claims.ID, claims.Requests, claims.ExpiresAt.Time)
+		if err != nil {
+			slog.WarnContext(c.Request.Context(), "access tokens unavailable", "error", err)
+			return false
+		}
+		if !ok {
+			c.Header(AccessStatusHeader, errAccessUsedUp.Error())
+			return false
+		}
+		c.Header(AccessRemainingHeader, strconv.Itoa(remaining))
+	}
+
+	c.Next()
+	return true
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	x402 "github.com/coinbase/x402/go"
+	x402http "github.com/coinbase/x402/go/http"
+	ginfw "github.com/gin-gonic/gin"
+)
+
+// newTestAccessTokens serves GET /a and GET /b in access group "g" (two
+// requests per token) and GET /c in group "other", behind a payment
+// middleware that settles through the settlement recorder and counts payments
+func newTestAccessTokens(t *testing.T) (*ginfw.Engine, *accessTokens, *int) {
+	t.Helper()
+	ginfw.SetMode(ginfw.TestMode)
+
+	groups := map[string]accessGroup{
+		"g":     {name: "g", requests: 2, ttl: time.Minute},
+		"other": {name: "other", ttl: time.Minute},
+	}
+	tokens := newAccessTokens([]byte("secret"), newMemoryQuotaStore(), func() map[string]accessGroup { return groups })
+
+	option := x402http.PaymentOptions{{Scheme: "exact", Price: "$0.01"}}
+	routes := mustCompile(t, RoutesConfig{
+		"GET /a": {RouteConfig: x402http.RouteConfig{Accepts: option}, AccessGroup: "g"},
+		"GET /b": {RouteConfig: x402http.RouteConfig{Accepts: option}, AccessGroup: "g"},
+		"GET /c": {RouteConfig: x402http.RouteConfig{Accepts: option}, AccessGroup: "other"},
+	})
+
+	payments := 0
+	recorder := newSettlementRecorder(&settlingFacilitator{})
+	payment := func(c *ginfw.Context) {
+		if c.GetHeader("PAYMENT-SIGNATURE") == "" {
+			c.AbortWithStatus(http.StatusPaymentRequired)
+			return
+		}
+		payments++
+		recorder.Settle(c.Request.Context(), []byte(`{}`), []byte(`{}`))
+		c.Next()
+	}
+
+	r := ginfw.New()
+	r.Use(tokens.Middleware(routes, payment))
+	for _, path := range []string{"/a", "/b", "/c"} {
+		r.GET(path, func(c *ginfw.Context) { c.Status(http.StatusOK) })
+	}
+	return r, tokens, &payments
+}
+
+// settlingFacilitator settles every payment with a transaction
+type settlingFacilitator struct {
+	recordingFacilitator
+}
+
+func (f *settlingFacilitator) Settle(ctx context.Context, payload []byte, requirements []byte) (*x402.SettleResponse, error) {
+	return &x402.SettleResponse{Success: true, Payer: "0x00000000000000000000000000000000000000aa", Transaction: "0xpaid"}, nil
+}
+
+func TestAccessTokenReplacesPayment(t *testing.T) {
+	r, _, payments := newTestAccessTokens(t)
+
+	w := get(r, "/a", map[string]string{"PAYMENT-SIGNATURE": "signed"})
+	token := w.Header().Get(AccessTokenHeader)
+	if w.Code != http.StatusOK || token == "" || *payments != 1 {
+		t.Fatalf("paid request: status %d, token %q, payments %d", w.Code, token, *payments)
+	}
+
+	// The token covers both routes of the group, two requests in all
+	for _, path := range []string{"/b", "/a"} {
+		w := get(r, path, map[string]string{AccessTokenHeader: token})
+		if w.Code != http.StatusOK || *payments != 1 {
+			t.Fatalf("%s with token: status %d, payments %d", path, w.Code, *payments)
+		}
+	}
+	if w.Header().Get(AccessRemainingHeader) != "2" {
+		t.Errorf("remaining after issue = %q, want 2", w.Header().Get(AccessRemainingHeader))
+	}
+
+	w = get(r, "/a", map[string]string{AccessTokenHeader: token})
+	if w.Code != http.StatusPaymentRequired || w.Header().Get(AccessStatusHeader) != errAccessUsedUp.Error() {
+		t.Errorf("used up token: status %d, access status %q", w.Code, w.Header().Get(AccessStatusHeader))
+	}
+	w = get(r, "/c", map[string]string{AccessTokenHeader: token})
+	if w.Code != http.StatusPaymentRequired || w.Header().Get(AccessStatusHeader) != errAccessOtherGroup.Error() {
+		t.Errorf("token for another group: status %d, access status %q", w.Code, w.Header().Get(AccessStatusHeader))
+	}
+}
+
+func TestAccessTokenRejectsForgedAndExpired(t *testing.T) {
+	r, tokens, _ := newTestAccessTokens(t)
+
+	expired, _ := tokens.Issue(accessGroup{name: "g", ttl: time.Minute}, "0xaa", time.Now().Add(-time.Hour))
+	forger := newAccessTokens([]byte("guess"), newMemoryQuotaStore(), nil)
+	forged, _ := forger.Issue(accessGroup{name: "g", ttl: time.Minute}, "0xaa", time.Now())
+
+	for name, token := range map[string]string{"expired": expired, "forged": forged, "garbage": "not.a.token"} {
+		w := get(r, "/a", map[string]string{AccessTokenHeader: token})
+		if w.Code != http.StatusPaymentRequired || w.Header().Get(AccessStatusHeader) == "" {
+			t.Errorf("%s token: status %d, access status %q", name, w.Code, w.Header().Get(AccessStatusHeader))
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	x402 "github.com/coinbase/x402/go"
+	x402http "github.com/coinbase/x402/go/http"
+	ginmw "github.com/coinbase/x402/go/http/gin"
+	"github.com/goccy/go-yaml"
+)
+
+// DefaultRoutesConfigFile is read when ROUTES_CONFIG is not set
+const DefaultRoutesConfigFile = "routes.yaml"
+
+// envReference matches ${VAR}; a bare $ is left alone since USD prices use it
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// caip2Pattern matches CAIP-2 network identifiers such as "eip155:8453"
+var caip2Pattern = regexp.MustCompile(`^[-a-z0-9]{3,8}:[-_a-zA-Z0-9]{1,32}$`)
+
+// ServerConfig is the payment configuration file: who gets paid, which
+// schemes are offered on which networks, and what each route costs. It is
+// YAML or JSON (by extension); ${VAR} references are expanded from the
+// environment.
+type ServerConfig struct {
+	// Payees names addresses that payTo fields can refer to
+	Payees map[string]string `json:"payees" yaml:"payees"`
+	// Schemes lists the scheme and network pairs payments are accepted with
+	Schemes []SchemeRegistration `json:"schemes" yaml:"schemes"`
+	// Routes maps route patterns (see RoutesConfig) to their payment options
+	Routes map[string]RouteFileConfig `json:"routes" yaml:"routes"`
+	// FreeTier configures the free calls of routes marked freeTier
+	FreeTier FreeTierConfig `json:"freeTier" yaml:"freeTier"`
+	// AccessGroups names the route groups access tokens are issued for
+	AccessGroups map[string]AccessGroupConfig `json:"accessGroups" yaml:"accessGroups"`
+}
+
+// SchemeRegistration registers a scheme on a network
+type SchemeRegistration struct {
+	Network string `json:"network" yaml:"network"`
+	Scheme  string `json:"scheme" yaml:"scheme"`
+}
+
+// RouteFileConfig is a route in the configuration file
+type RouteFileConfig struct {
+	Accepts     []PaymentOptionConfig `json:"accepts" yaml:"accepts"`
+	Description string                `json:"description" yaml:"description"`
+	MimeType    string                `json:"mimeType" yaml:"mimeType"`
+	Session     bool                  `json:"session" yaml:"session"`
+	// Pricing names a price function registered in code (see PriceFunc)
+	Pricing string `json:"pricing" yaml:"pricing"`
+	// FreeTier applies the free tier to the route
+	FreeTier bool `json:"freeTier" yaml:"freeTier"`
+	// AccessGroup issues access tokens for the named group after payments
+	AccessGroup string `json:"accessGroup" yaml:"accessGroup"`
+	// SettleAfterResponse settles only once the handler succeeded;
+	// OnServerError is skip (default) or settle for 5xx responses
+	SettleAfterResponse bool   `json:"settleAfterResponse" yaml:"settleAfterResponse"`
+	OnServerError       string `json:"onServerError" yaml:"onServerError"`
+}
+
+// PaymentOptionConfig is one way to pay for a route. Price is a USD amount
+// ("$0.001"); Asset and Amount give a raw token amount instead.
+type PaymentOptionConfig struct {
+	Scheme            string `json:"scheme" yaml:"scheme"`
+	Network           string `json:"network" yaml:"network"`
+	PayTo             string `json:"payTo" yaml:"payTo"`
+	Price             string `json:"price" yaml:"price"`
+	Asset             string `json:"asset" yaml:"asset"`
+	Amount            string `json:"amount" yaml:"amount"`
+	MaxTimeoutSeconds int    `json:"maxTimeoutSeconds" yaml:"maxTimeoutSeconds"`
+}
+
+// loadServerConfig reads the configuration file at path
+func loadServerConfig(path string) (*ServerConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	data = envReference.ReplaceAllFunc(data, func(reference []byte) []byte {
+		return []byte(os.Getenv(string(reference[2 : len(reference)-1])))
+	})
+
+	var config ServerConfig
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		decoder := json.NewDecoder(strings.NewReader(string(data)))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&config)
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalWithOptions(data, &config, yaml.Strict())
+	default:
+		return nil, fmt.Errorf("config %s: unknown format, use .yaml, .yml or .json", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+	return &config, nil
+}
+
+// Payee resolves a payTo value: a payee name or a literal address
+func (c *ServerConfig) Payee(payTo string) string {
+	if address, ok := c.Payees[payTo]; ok {
+		return address
+	}
+	return payTo
+}
+
+// RoutesConfig converts and checks the routes. Every problem found is
+// reported, not just the first.
+//
+// Args:
+//
+//	priceFuncs: price functions routes may name in pricing
+//
+// Returns:
+//
+//	RoutesConfig or error
+func (c *ServerConfig) RoutesConfig(priceFuncs map[string]PriceFunc) (RoutesConfig, error) {
+	routes, problems := c.routes(priceFuncs)
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("invalid config:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return routes, nil
+}
+
+// routes converts the routes, listing the problems found
+func (c *ServerConfig) routes(priceFuncs map[string]PriceFunc) (RoutesConfig, []string) {
+	var problems []string
+	fail := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	for name, address := range c.Payees {
+		if address == "" {
+			fail("payee %q is empty", name)
+		}
+	}
+	registered := make(map[string]bool)
+	for _, scheme := range c.Schemes {
+		if !caip2Pattern.MatchString(scheme.Network) {
+			fail("scheme %s: invalid network %q", scheme.Scheme, scheme.Network)
+		}
+		registered[scheme.Scheme+"@"+scheme.Network] = true
+	}
+
+	routes := make(RoutesConfig, len(c.Routes))
+	for key, file := range c.Routes {
+		if _, err := parseRoutePattern(key); err != nil {
+			fail("%v", err)
+			continue
+		}
+		if len(file.Accepts) == 0 {
+			fail("route %q: no payment options", key)
+		}
+
+		route := RouteConfig{
+			RouteConfig: x402http.RouteConfig{
+				Description: file.Description,
+				MimeType:    file.MimeType,
+			},
+			Session:             file.Session,
+			FreeTier:            file.FreeTier,
+			AccessGroup:         file.AccessGroup,
+			SettleAfterResponse: file.SettleAfterResponse,
+			OnServerError:       file.OnServerError,
+		}
+		if file.Pricing != "" {
+			price, ok := priceFuncs[file.Pricing]
+			if !ok {
+				fail("route %q: unknown pricing %q", key, file.Pricing)
+			}
+			route.Price = price
+		}
+		if _, ok := c.AccessGroups[file.AccessGroup]; file.AccessGroup != "" && !ok {
+			fail("route %q: unknown access group %q", key, file.AccessGroup)
+		}
+		switch file.OnServerError {
+		case "":
+			route.OnServerError = ServerErrorSkip
+		case ServerErrorSkip, ServerErrorSettle:
+			if !file.SettleAfterResponse {
+				fail("route %q: onServerError needs settleAfterResponse", key)
+			}
+		default:
+			fail("route %q: onServerError must be %s or %s", key, ServerErrorSkip, ServerErrorSettle)
+		}
+
+		for i, option := range file.Accepts {
+			where := fmt.Sprintf("route %q option %d", key, i+1)
+			if !registered[option.Scheme+"@"+option.Network] {
+				fail("%s: scheme %s is not registered on %s", where, option.Scheme, option.Network)
+			}
+			payTo := c.Payee(option.PayTo)
+			if payTo == "" {
+				fail("%s: payTo is empty", where)
+			} else if err := checkPayTo(option.Network, payTo); err != nil {
+				fail("%s: %v", where, err)
+			}
+
+			var price x402.Price
+			switch {
+			case option.Price != "" && option.Amount != "":
+				fail("%s: set price or asset and amount, not both", where)
+			case option.Price != "":
+				if _, err := parseUSDPrice(option.Price); err != nil {
+					fail("%s: %v", where, err)
+				}
+				price = option.Price
+			case option.Asset != "" && option.Amount != "":
+				price = x402.AssetAmount{Asset: option.Asset, Amount: option.Amount}
+			default:
+				fail("%s: no price", where)
+			}
+
+			route.Accepts = append(route.Accepts, x402http.PaymentOption{
+				Scheme:            option.Scheme,
+				Network:           x402.Network(option.Network),
+				PayTo:             payTo,
+				Price:             price,
+				MaxTimeoutSeconds: option.MaxTimeoutSeconds,
+			})
+		}
+		routes[key] = route
+	}
+
+	sort.Strings(problems)
+	return routes, problems
+}
+
+// FreeTierPolicy checks the free-tier section
+func (c *ServerConfig) FreeTierPolicy() (*freeTierPolicy, error) {
+	return c.FreeTier.policy()
+}
+
+// AccessGroupPolicies checks the access groups
+func (c *ServerConfig) AccessGroupPolicies() (map[string]accessGroup, error) {
+	groups := make(map[string]accessGroup, len(c.AccessGroups))
+	for name, group := range c.AccessGroups {
+		ttl, err := time.ParseDuration(group.TTL)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("access group %q: invalid ttl %q", name, group.TTL)
+		}
+		if group.Requests < 0 {
+			return nil, fmt.Errorf("access group %q: requests cannot be negative", name)
+		}
+		groups[name] = accessGroup{name: name, requests: group.Requests, ttl: ttl}
+	}
+	return groups, nil
+}
+
+// UnsupportedSchemes lists the schemes and route options no facilitator
+// supports. Payments for them cannot be verified, so they are configuration
+// mistakes, such as a testnet route without a facilitator for the testnet.
+func (c *ServerConfig) UnsupportedSchemes(supported x402.SupportedResponse) []string {
+	kinds := make(map[string]bool, len(supported.Kinds))
+	for _, kind := range supported.Kinds {
+		kinds[kind.Scheme+"@"+kind.Network] = true
+	}
+
+	var problems []string
+	for _, scheme := range c.Schemes {
+		if !kinds[scheme.Scheme+"@"+scheme.Network] {
+			problems = append(problems, fmt.Sprintf("scheme %s on %s is registered but no facilitator supports it", scheme.Scheme, scheme.Network))
+		}
+	}
+	for key, route := range c.Routes {
+		for i, option := range route.Accepts {
+			if !kinds[option.Scheme+"@"+option.Network] {
+				problems = append(problems, fmt.Sprintf("route %q option %d: no facilitator supports %s on %s", key, i+1, option.Scheme, option.Network))
+			}
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// SchemeConfigs builds the scheme registrations for the payment middleware
+//
+// Args:
+//
+//	servers: creates the server side of a scheme for a network
+//
+// Returns:
+//
+//	[]ginmw.SchemeConfig or error
+func (c *ServerConfig) SchemeConfigs(servers func(scheme string, network x402.Network) (x402.SchemeNetworkServer, error)) ([]ginmw.SchemeConfig, error) {
+	schemes := make([]ginmw.SchemeConfig, 0, len(c.Schemes))
+	for _, registration := range c.Schemes {
+		server, err := servers(registration.Scheme, x402.Network(registration.Network))
+		if err != nil {
+			return nil, fmt.Errorf("scheme %s on %s: %w", registration.Scheme, registration.Network, err)
+		}
+		schemes = append(schemes, ginmw.SchemeConfig{Network: x402.Network(registration.Network), Server: server})
+	}
+	return schemes, nil
+}
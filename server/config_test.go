@@ -0,0 +1,132 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	x402 "github.com/coinbase/x402/go"
+	x402http "github.com/coinbase/x402/go/http"
+	ginfw "github.com/gin-gonic/gin"
+)
+
+func TestShippedRoutesConfig(t *testing.T) {
+	t.Setenv("EVM_PAYEE_ADDRESS", "0x00000000000000000000000000000000000000aa")
+	t.Setenv("SVM_PAYEE_ADDRESS", "9WzDXwBbmkg8ZTbNMqUxvQRAyrZzDsGYdLVL9zYtAWWM")
+
+	config, err := loadServerConfig("routes.yaml")
+	if err != nil {
+		t.Fatalf("loadServerConfig() error = %v", err)
+	}
+	routes, err := config.RoutesConfig(map[string]PriceFunc{"weather": weatherPrice})
+	if err != nil {
+		t.Fatalf("RoutesConfig() error = %v", err)
+	}
+
+	weather := routes["GET /weather"]
+	if !weather.Session || weather.Price == nil || len(weather.Accepts) != 2 {
+		t.Fatalf("GET /weather = %+v", weather)
+	}
+	if payTo := weather.Accepts[0].PayTo; payTo != "0x00000000000000000000000000000000000000aa" {
+		t.Errorf("payTo = %q, want the evm payee", payTo)
+	}
+	if len(routes["GET /zkStash"].Accepts) != 5 {
+		t.Errorf("GET /zkStash has %d options", len(routes["GET /zkStash"].Accepts))
+	}
+}
+
+func TestRoutesConfigReportsProblems(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routes.json")
+	os.WriteFile(path, []byte(`{
+		"payees": {"evm": ""},
+		"schemes": [{"network": "eip155:8453", "scheme": "exact"}, {"network": "base", "scheme": "exact"}],
+		"routes": {
+			"GET /a": {"accepts": [{"scheme": "upto", "network": "eip155:8453", "payTo": "evm", "price": "$1"}]},
+			"GET /b": {"pricing": "surge", "accepts": [{"scheme": "exact", "network": "eip155:8453", "payTo": "0x1", "price": "one dollar"}]},
+			"GET c": {"accepts": []},
+			"GET /d": {"onServerError": "retry", "accepts": [{"scheme": "exact", "network": "eip155:8453", "payTo": "0x1", "price": "$1"}]}
+		}
+	}`), 0o644)
+
+	config, err := loadServerConfig(path)
+	if err != nil {
+		t.Fatalf("loadServerConfig() error = %v", err)
+	}
+	_, err = config.RoutesConfig(nil)
+	if err == nil {
+		t.Fatal("RoutesConfig() succeeded")
+	}
+	for _, want := range []string{
+		`payee "evm" is empty`,
+		`invalid network "base"`,
+		`route "GET /a" option 1: scheme upto is not registered on eip155:8453`,
+		`route "GET /a" option 1: payTo is empty`,
+		`route "GET /b": unknown pricing "surge"`,
+		`route "GET /b" option 1: invalid USD price`,
+		`route "GET c": path must start with /`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error does not mention %q:\n%v", want, err)
+		}
+	}
+}
+
+func TestLoadServerConfigRejectsUnknownFields(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"routes.yaml": "routes:\n  \"GET /a\":\n    prise: 1\n",
+		"routes.json": `{"routes": {"GET /a": {"prise": 1}}}`,
+		"routes.toml": "",
+	} {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte(content), 0o644)
+		if _, err := loadServerConfig(path); err == nil {
+			t.Errorf("loadServerConfig(%s) succeeded", name)
+		}
+	}
+}
+
+func TestLiveRoutesReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routes.yaml")
+	write := func(price string) {
+		os.WriteFile(path, []byte(`
+payees: {evm: "0x00000000000000000000000000000000000000aa"}
+schemes: [{network: "eip155:8453", scheme: exact}]
+routes:
+  "GET /a":
+    accepts: [{scheme: exact, network: "eip155:8453", payTo: evm, price: "`+price+`"}]
+`), 0o644)
+	}
+	build := func(config *ServerConfig) (*paymentStack, error) {
+		routes, err := config.RoutesConfig(nil)
+		if err != nil {
+			return nil, err
+		}
+		table, err := routes.Compile()
+		if err != nil {
+			return nil, err
+		}
+		return &paymentStack{table: table, gate: newPaymentGate(table, func(x402http.RoutesConfig) ginfw.HandlerFunc { return nil })}, nil
+	}
+	price := func(live *liveRoutes) x402.Price {
+		_, route, _ := live.Match("GET", "/a")
+		return route.Accepts[0].Price
+	}
+
+	write("$0.001")
+	live, err := newLiveRoutes(path, build)
+	if err != nil {
+		t.Fatalf("newLiveRoutes() error = %v", err)
+	}
+
+	write("$0.002")
+	if err := live.Reload(); err != nil || price(live) != "$0.002" {
+		t.Fatalf("after reload: price %v, error %v", price(live), err)
+	}
+
+	write("free")
+	if err := live.Reload(); err == nil || price(live) != "$0.002" {
+		t.Fatalf("after bad reload: price %v, error %v", price(live), err)
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	x402 "github.com/coinbase/x402/go"
+)
+
+const (
+	// DefaultFacilitatorCooldown is how long a failing facilitator is skipped
+	DefaultFacilitatorCooldown = 30 * time.Second
+	// DefaultFacilitatorMaxFailures is how many errors in a row take a
+	// facilitator out of rotation
+	DefaultFacilitatorMaxFailures = 3
+
+	// verifiedPinTTL is how long a verified payment is remembered, so its
+	// settlement goes to the facilitator that verified it
+	verifiedPinTTL = 10 * time.Minute
+)
+
+// facilitatorBackend is one facilitator the router can use
+type facilitatorBackend struct {
+	name   string
+	client x402.FacilitatorClient
+
+	mu        sync.Mutex
+	kinds     map[string]string // scheme@network from /supported -> fee payer; nil until known
+	failures  int
+	downUntil time.Time
+	lastError string
+}
+
+// FacilitatorStatus is the health of a facilitator, for /health
+type FacilitatorStatus struct {
+	Name      string `json:"name"`
+	Healthy   bool   `json:"healthy"`
+	Failures  int    `json:"failures"`
+	LastError string `json:"lastError,omitempty"`
+	Kinds     int    `json:"kinds"`
+}
+
+// supports reports whether the facilitator handles a kind. A payment built
+// for a fee payer (Solana) can only be handled by the facilitator that
+// advertises that fee payer.
+func (b *facilitatorBackend) supports(scheme string, network string, feePayer string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// Until /supported answered, assume it might, unless the payment needs
+	// a particular fee payer
+	if b.kinds == nil {
+		return feePayer == ""
+	}
+	advertised, ok := b.kinds[scheme+"@"+network]
+	return ok && (feePayer == "" || advertised == feePayer)
+}
+
+func (b *facilitatorBackend) healthy(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !now.Before(b.downUntil)
+}
+
+func (b *facilitatorBackend) succeeded() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.downUntil = time.Time{}
+}
+
+func (b *facilitatorBackend) failed(ctx context.Context, err error, maxFailures int, cooldown time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.lastError = err.Error()
+	if b.failures >= maxFailures {
+		b.downUntil = time.Now().Add(cooldown)
+		slog.WarnContext(ctx, "facilitator down, skipping it", "facilitator", b.name, "failures", b.failures, "cooldown", cooldown, "error", err)
+	}
+}
+
+func (b *facilitatorBackend) setKinds(kinds []x402.SupportedKind) {
+	supported := make(map[string]string, len(kinds))
+	for _, kind := range kinds {
+		feePayer, _ := kind.Extra["feePayer"].(string)
+		supported[kind.Scheme+"@"+kind.Network] = feePayer
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.kinds = supported
+}
+
+func (b *facilitatorBackend) status(now time.Time) FacilitatorStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return FacilitatorStatus{
+		Name:      b.name,
+		Healthy:   !now.Before(b.downUntil),
+		Failures:  b.failures,
+		LastError: b.lastError,
+		Kinds:     len(b.kinds),
+	}
+}
+
+// facilitatorRouter spreads payments over several facilitators. A payment
+// goes to the first facilitator, in priority order, whose /supported lists
+// its scheme and network; if verifying fails with an error (rather than an
+// answer such as an invalid payment) the next one is tried. Facilitators
+// failing repeatedly are skipped for a cooldown, and only used when no
+// healthy one is left.
+//
+// Settlements only move on when the request provably never reached the
+// facilitator (it could not be dialed). After a timeout or any later error
+// the first facilitator may already have broadcast the transaction: a
+// second attempt would race it or fail on the used authorization, and the
+// payer would be charged while the request errors either way.
+//
+// A payment is settled by the facilitator that verified it, which is also
+// the one whose checks the payer passed. Solana payments only go to the
+// facilitator whose fee payer (extra.feePayer) the transaction was signed
+// for, and are never moved.
+type facilitatorRouter struct {
+	backends    []*facilitatorBackend
+	maxFailures int
+	cooldown    time.Duration
+
+	pinsMu sync.Mutex
+	pins   map[[32]byte]verifiedPin // payload hash -> verifying facilitator
+}
+
+// verifiedPin remembers the facilitator that verified a payment
+type verifiedPin struct {
+	backend *facilitatorBackend
+	expires time.Time
+}
+
+// newFacilitatorRouter creates a router over clients, in priority order
+//
+// Args:
+//
+//	names: facilitator names for logs and /health
+//	clients: facilitator clients, same order as names
+//
+// Returns:
+//
+//	*facilitatorRouter
+func newFacilitatorRouter(names []string, clients []x402.FacilitatorClient) *facilitatorRouter {
+	router := &facilitatorRouter{
+		maxFailures: DefaultFacilitatorMaxFailures,
+		cooldown:    DefaultFacilitatorCooldown,
+		pins:        make(map[[32]byte]verifiedPin),
+	}
+	for i, client := range clients {
+		router.backends = append(router.backends, &facilitatorBackend{name: names[i], client: client})
+	}
+	return router
+}
+
+// facilitatorName names a facilitator by its URL's host
+func facilitatorName(rawURL string) string {
+	if parsed, err := url.Parse(rawURL); err == nil && parsed.Host != "" {
+		return parsed.Host
+	}
+	return rawURL
+}
+
+// candidates orders the facilitators that can handle the requirements:
+// healthy ones first, then the ones cooling down as a last resort
+func (r *facilitatorRouter) candidates(requirementsBytes []byte) []*facilitatorBackend {
+	var requirements struct {
+		Scheme  string `json:"scheme"`
+		Network string `json:"network"`
+		Extra   struct {
+			FeePayer string `json:"feePayer"`
+		} `json:"extra"`
+	}
+	json.Unmarshal(requirementsBytes, &requirements)
+
+	now := time.Now()
+	var healthy, down []*facilitatorBackend
+	for _, backend := range r.backends {
+		if !backend.supports(requirements.Scheme, requirements.Network, requirements.Extra.FeePayer) {
+			continue
+		}
+		if backend.healthy(now) {
+			healthy = append(healthy, backend)
+		} else {
+			down = append(down, backend)
+		}
+	}
+	return append(healthy, down...)
+}
+
+// pin records that backend verified the payment in payloadBytes
+func (r *facilitatorRouter) pin(payloadBytes []byte, backend *facilitatorBackend) {
+	now := time.Now()
+	r.pinsMu.Lock()
+	defer r.pinsMu.Unlock()
+
+	for key, pin := range r.pins {
+		if now.After(pin.expires) {
+			delete(r.pins, key)
+		}
+	}
+	r.pins[sha256.Sum256(payloadBytes)] = verifiedPin{backend: backend, expires: now.Add(verifiedPinTTL)}
+}
+
+// takePin returns and forgets the facilitator that verified the payment in
+// payloadBytes, or nil when none did recently
+func (r *facilitatorRouter) takePin(payloadBytes []byte) *facilitatorBackend {
+	key := sha256.Sum256(payloadBytes)
+	r.pinsMu.Lock()
+	defer r.pinsMu.Unlock()
+
+	pin, ok := r.pins[key]
+	delete(r.pins, key)
+	if !ok || time.Now().After(pin.expires) {
+		return nil
+	}
+	return pin.backend
+}
+
+// failover runs call on each candidate until one answers, or until an error
+// that retryable says must not be retried elsewhere
+func failover[T any](
+	ctx context.Context,
+	r *facilitatorRouter,
+	action string,
+	candidates []*facilitatorBackend,
+	retryable func(error) bool,
+	call func(*facilitatorBackend) (T, error),
+) (T, error) {
+	var zero T
+	if len(candidates) == 0 {
+		return zero, fmt.Errorf("no facilitator supports this payment")
+	}
+
+	var errs []error
+	for i, backend := range candidates {
+		result, err := call(backend)
+		if err == nil {
+			backend.succeeded()
+			return result, nil
+		}
+		backend.failed(ctx, err, r.maxFailures, r.cooldown)
+		if !retryable(err) {
+			return zero, fmt.Errorf("%s failed on %s: %w", action, backend.name, err)
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", backend.name, err))
+		if ctx.Err() != nil {
+			break
+		}
+		if i+1 < len(candidates) {
+			slog.WarnContext(ctx, "facilitator failed, trying the next one", "action", action, "facilitator", backend.name, "next", candidates[i+1].name, "error", err)
+		}
+	}
+	return zero, fmt.Errorf("%s failed on every facilitator: %w", action, errors.Join(errs...))
+}
+
+// Verify has no side effects, so any error moves on to the next facilitator.
+// The facilitator that accepts the payment is remembered for its settlement.
+func (r *facilitatorRouter) Verify(ctx context.Context, payloadBytes []byte, requirementsBytes []byte) (*x402.VerifyResponse, error) {
+	anyError := func(error) bool { return true }
+	return failover(ctx, r, "verify", r.candidates(requirementsBytes), anyError, func(backend *facilitatorBackend) (*x402.VerifyResponse, error) {
+		result, err := backend.client.Verify(ctx, payloadBytes, requirementsBytes)
+		if err == nil && result != nil && result.IsValid {
+			r.pin(payloadBytes, backend)
+		}
+		return result, err
+	})
+}
+
+// Settle goes to the facilitator that verified the payment first, and only
+// moves on when the payment could not have been broadcast
+func (r *facilitatorRouter) Settle(ctx context.Context, payloadBytes []byte, requirementsBytes []byte) (*x402.SettleResponse, error) {
+	var requirements struct {
+		Network string `json:"network"`
+	}
+	json.Unmarshal(requirementsBytes, &requirements)
+
+	candidates := r.candidates(requirementsBytes)
+	if verifier := r.takePin(payloadBytes); verifier != nil {
+		ordered := []*facilitatorBackend{verifier}
+		for _, backend := range candidates {
+			if backend != verifier {
+				ordered = append(ordered, backend)
+			}
+		}
+		candidates = ordered
+	}
+
+	retryable := notSent
+	if strings.HasPrefix(requirements.Network, "solana") {
+		retryable = func(error) bool { return false }
+	}
+	return failover(ctx, r, "settle", candidates, retryable, func(backend *facilitatorBackend) (*x402.SettleResponse, error) {
+		return backend.client.Settle(ctx, payloadBytes, requirementsBytes)
+	})
+}
+
+// notSent reports whether a request failed before it was sent: the
+// facilitator's host could not be resolved or connected to
+func notSent(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr)
+}
+
+// GetSupported merges what every reachable facilitator supports. Where
+// several support a kind, the first one's entry wins, since it is also the
+// one payments of that kind are sent to (its Extra, such as a Solana fee
+// payer, has to match the facilitator that settles).
+func (r *facilitatorRouter) GetSupported(ctx context.Context) (x402.SupportedResponse, error) {
+	merged := x402.SupportedResponse{Signers: make(map[string][]string)}
+	seenKinds := make(map[string]bool)
+	seenExtensions := make(map[string]bool)
+
+	var errs []error
+	for _, backend := range r.backends {
+		supported, err := backend.client.GetSupported(ctx)
+		if err != nil {
+			backend.failed(ctx, err, r.maxFailures, r.cooldown)
+			errs = append(errs, fmt.Errorf("%s: %w", backend.name, err))
+			continue
+		}
+		backend.succeeded()
+		backend.setKinds(supported.Kinds)
+
+		for _, kind := range supported.Kinds {
+			key := fmt.Sprintf("%d/%s@%s", kind.X402Version, kind.Scheme, kind.Network)
+			if !seenKinds[key] {
+				seenKinds[key] = true
+				merged.Kinds = append(merged.Kinds, kind)
+			}
+		}
+		for _, extension := range supported.Extensions {
+			if !seenExtensions[extension] {
+				seenExtensions[extension] = true
+				merged.Extensions = append(merged.Extensions, extension)
+			}
+		}
+		for family, signers := range supported.Signers {
+			merged.Signers[family] = append(merged.Signers[family], signers...)
+		}
+	}
+
+	if len(errs) == len(r.backends) {
+		return merged, fmt.Errorf("no facilitator reachable: %w", errors.Join(errs...))
+	}
+	if len(errs) > 0 {
+		slog.WarnContext(ctx, "some facilitators are unreachable", "error", errors.Join(errs...))
+	}
+	return merged, nil
+}
+
+// Status reports the health of every facilitator
+func (r *facilitatorRouter) Status() []FacilitatorStatus {
+	now := time.Now()
+	statuses := make([]FacilitatorStatus, 0, len(r.backends))
+	for _, backend := range r.backends {
+		statuses = append(statuses, backend.status(now))
+	}
+	return statuses
+}
+
+// splitURLs parses a comma-separated URL list
+func splitURLs(value string) []string {
+	var urls []string
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			urls = append(urls, part)
+		}
+	}
+	return urls
+}
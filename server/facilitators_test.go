@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	x402 "github.com/coinbase/x402/go"
+)
+
+// errUnreachable is the error of a facilitator that can't be dialed
+var errUnreachable = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+// fakeFacilitator supports kinds and fails every call while down. A
+// timingOut facilitator settles, then fails as if the response was lost.
+type fakeFacilitator struct {
+	kinds     []x402.SupportedKind
+	down      bool
+	timingOut bool
+	settles   int
+}
+
+func (f *fakeFacilitator) Verify(ctx context.Context, payload []byte, requirements []byte) (*x402.VerifyResponse, error) {
+	if f.down {
+		return nil, errUnreachable
+	}
+	return &x402.VerifyResponse{IsValid: true}, nil
+}
+
+func (f *fakeFacilitator) Settle(ctx context.Context, payload []byte, requirements []byte) (*x402.SettleResponse, error) {
+	if f.down {
+		return nil, errUnreachable
+	}
+	f.settles++
+	if f.timingOut {
+		return nil, context.DeadlineExceeded
+	}
+	return &x402.SettleResponse{Success: true, Transaction: "0xpaid"}, nil
+}
+
+func (f *fakeFacilitator) GetSupported(ctx context.Context) (x402.SupportedResponse, error) {
+	if f.down {
+		return x402.SupportedResponse{}, errUnreachable
+	}
+	return x402.SupportedResponse{Kinds: f.kinds}, nil
+}
+
+func TestFacilitatorRouterRoutesByNetwork(t *testing.T) {
+	base := &fakeFacilitator{kinds: []x402.SupportedKind{{X402Version: 2, Scheme: "exact", Network: "eip155:8453"}}}
+	solana := &fakeFacilitator{kinds: []x402.SupportedKind{
+		{X402Version: 2, Scheme: "exact", Network: "eip155:8453", Extra: map[string]interface{}{"from": "solana"}},
+		{X402Version: 2, Scheme: "exact", Network: "solana:mainnet"},
+	}}
+	router := newFacilitatorRouter([]string{"base", "solana"}, []x402.FacilitatorClient{base, solana})
+
+	supported, err := router.GetSupported(context.Background())
+	if err != nil || len(supported.Kinds) != 2 || supported.Kinds[0].Extra != nil {
+		t.Fatalf("GetSupported() = %+v, %v; want the first facilitator's entry for shared kinds", supported.Kinds, err)
+	}
+
+	router.Settle(context.Background(), nil, []byte(`{"scheme":"exact","network":"solana:mainnet"}`))
+	router.Settle(context.Background(), nil, []byte(`{"scheme":"exact","network":"eip155:8453"}`))
+	if base.settles != 1 || solana.settles != 1 {
+		t.Errorf("settles: base %d, solana %d, want 1 each", base.settles, solana.settles)
+	}
+
+	if _, err := router.Settle(context.Background(), nil, []byte(`{"scheme":"exact","network":"eip155:1"}`)); err == nil {
+		t.Error("Settle() on an unsupported network succeeded")
+	}
+}
+
+func TestFacilitatorRouterFailover(t *testing.T) {
+	primary := &fakeFacilitator{down: true}
+	fallback := &fakeFacilitator{}
+	router := newFacilitatorRouter([]string{"primary", "fallback"}, []x402.FacilitatorClient{primary, fallback})
+	requirements := []byte(`{"scheme":"exact","network":"eip155:8453"}`)
+
+	for i := 0; i < DefaultFacilitatorMaxFailures; i++ {
+		if _, err := router.Settle(context.Background(), nil, requirements); err != nil {
+			t.Fatalf("Settle() error = %v", err)
+		}
+	}
+	if fallback.settles != DefaultFacilitatorMaxFailures {
+		t.Errorf("fallback settled %d", fallback.settles)
+	}
+	if status := router.Status(); status[0].Healthy || status[0].Failures != DefaultFacilitatorMaxFailures || !status[1].Healthy {
+		t.Errorf("Status() = %+v", status)
+	}
+
+	// The primary is skipped while cooling down, and back once it works
+	primary.down = false
+	router.Settle(context.Background(), nil, requirements)
+	if primary.settles != 0 {
+		t.Error("primary used while cooling down")
+	}
+	router.backends[0].downUntil = router.backends[0].downUntil.Add(-DefaultFacilitatorCooldown)
+	router.Settle(context.Background(), nil, requirements)
+	if primary.settles != 1 || !router.Status()[0].Healthy {
+		t.Errorf("primary not back: settles %d, status %+v", primary.settles, router.Status()[0])
+	}
+
+	fallback.down, primary.down = true, true
+	if _, err := router.Verify(context.Background(), nil, requirements); err == nil {
+		t.Error("Verify() succeeded with every facilitator down")
+	}
+}
+
+func TestFacilitatorRouterSettleNoFailoverAfterSend(t *testing.T) {
+	// The primary may have broadcast before timing out: settling again on
+	// the fallback would race it
+	primary := &fakeFacilitator{timingOut: true}
+	fallback := &fakeFacilitator{}
+	router := newFacilitatorRouter([]string{"primary", "fallback"}, []x402.FacilitatorClient{primary, fallback})
+
+	if _, err := router.Settle(context.Background(), nil, []byte(`{"scheme":"exact","network":"eip155:8453"}`)); err == nil {
+		t.Fatal("Settle() succeeded after the primary timed out")
+	}
+	if fallback.settles != 0 {
+		t.Errorf("fallback settled %d after a timeout, want 0", fallback.settles)
+	}
+
+	// Verify has no side effects and still fails over
+	primary.down = true
+	if _, err := router.Verify(context.Background(), nil, []byte(`{"scheme":"exact","network":"eip155:8453"}`)); err != nil {
+		t.Errorf("Verify() error = %v, want failover", err)
+	}
+
+	// Solana transactions are signed for the primary's fee payer
+	if _, err := router.Settle(context.Background(), nil, []byte(`{"scheme":"exact","network":"solana:mainnet"}`)); err == nil {
+		t.Error("Solana Settle() failed over")
+	}
+	if fallback.settles != 0 {
+		t.Errorf("fallback settled a Solana payment")
+	}
+}
+
+func TestFacilitatorRouterRoutesSolanaByFeePayer(t *testing.T) {
+	solanaKind := func(feePayer string) []x402.SupportedKind {
+		return []x402.SupportedKind{{X402Version: 2, Scheme: "exact", Network: "solana:mainnet",
+			Extra: map[string]interface{}{"feePayer": feePayer}}}
+	}
+	first := &fakeFacilitator{kinds: solanaKind("FeePayerOne")}
+	second := &fakeFacilitator{kinds: solanaKind("FeePayerTwo")}
+	router := newFacilitatorRouter([]string{"first", "second"}, []x402.FacilitatorClient{first, second})
+	if _, err := router.GetSupported(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	requirements := []byte(`{"scheme":"exact","network":"solana:mainnet","extra":{"feePayer":"FeePayerTwo"}}`)
+	if _, err := router.Settle(context.Background(), []byte(`{"tx":"1"}`), requirements); err != nil {
+		t.Fatalf("Settle() error = %v", err)
+	}
+	if first.settles != 0 || second.settles != 1 {
+		t.Errorf("settles: first %d, second %d, want the fee payer's facilitator", first.settles, second.settles)
+	}
+
+	unknown := []byte(`{"scheme":"exact","network":"solana:mainnet","extra":{"feePayer":"Other"}}`)
+	if _, err := router.Settle(context.Background(), []byte(`{"tx":"2"}`), unknown); err == nil {
+		t.Error("Settle() for an unknown fee payer succeeded")
+	}
+}
+
+func TestFacilitatorRouterSettlesWithVerifier(t *testing.T) {
+	primary := &fakeFacilitator{down: true}
+	fallback := &fakeFacilitator{}
+	router := newFacilitatorRouter([]string{"primary", "fallback"}, []x402.FacilitatorClient{primary, fallback})
+	requirements := []byte(`{"scheme":"exact","network":"eip155:8453"}`)
+	payload := []byte(`{"signature":"0x01"}`)
+
+	if _, err := router.Verify(context.Background(), payload, requirements); err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+
+	// The primary is back and healthy, but the fallback verified the payment
+	primary.down = false
+	if _, err := router.Settle(context.Background(), payload, requirements); err != nil {
+		t.Fatalf("Settle() error = %v", err)
+	}
+	if primary.settles != 0 || fallback.settles != 1 {
+		t.Errorf("settles: primary %d, fallback %d, want the verifying facilitator", primary.settles, fallback.settles)
+	}
+
+	// Other payments follow the priority order again
+	router.Settle(context.Background(), []byte(`{"signature":"0x02"}`), requirements)
+	if primary.settles != 1 {
+		t.Errorf("primary settled %d unverified payments, want 1", primary.settles)
+	}
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	x402 "github.com/coinbase/x402/go"
+	ginfw "github.com/gin-gonic/gin"
+)
+
+const (
+	// FreeCallsHeader reports how many free calls the caller has left before
+	// requests to free-tier routes need payment
+	FreeCallsHeader = "PAYMENT-FREE-REMAINING"
+	// APIKeyHeader carries an allowlisted API key
+	APIKeyHeader = "X-API-Key"
+
+	DefaultFreeTierWindow = 24 * time.Hour
+)
+
+// FreeTierConfig is the free-tier section of the payment config. It applies
+// to routes marked freeTier.
+type FreeTierConfig struct {
+	// APIKeys never pay (dashboards, internal callers). Empty keys, such as
+	// unset ${VAR} references, are ignored.
+	APIKeys []string `json:"apiKeys" yaml:"apiKeys"`
+	// PerIP free calls per client IP and window
+	PerIP int `json:"perIP" yaml:"perIP"`
+	// PerWallet free calls per payer and window. The payment is verified, so
+	// the caller proves they own the wallet, but not settled.
+	PerWallet int `json:"perWallet" yaml:"perWallet"`
+	// Window over which quotas reset, as a Go duration (default 24h)
+	Window string `json:"window" yaml:"window"`
+}
+
+// freeTierPolicy is a checked FreeTierConfig
+type freeTierPolicy struct {
+	apiKeys   map[[32]byte]bool
+	perIP     int
+	perWallet int
+	window    time.Duration
+}
+
+// policy checks the free-tier config
+func (c *FreeTierConfig) policy() (*freeTierPolicy, error) {
+	policy := &freeTierPolicy{
+		apiKeys:   make(map[[32]byte]bool, len(c.APIKeys)),
+		perIP:     c.PerIP,
+		perWallet: c.PerWallet,
+		window:    DefaultFreeTierWindow,
+	}
+	for _, key := range c.APIKeys {
+		if key == "" {
+			continue
+		}
+		// Keys are compared by hash so lookups do not leak them through timing
+		policy.apiKeys[sha256.Sum256([]byte(key))] = true
+	}
+	if c.PerIP < 0 || c.PerWallet < 0 {
+		return nil, fmt.Errorf("freeTier: quotas cannot be negative")
+	}
+	if c.Window != "" {
+		window, err := time.ParseDuration(c.Window)
+		if err != nil || window <= 0 {
+			return nil, fmt.Errorf("freeTier: invalid window %q", c.Window)
+		}
+		policy.window = window
+	}
+	return policy, nil
+}
+
+// ============================================================================
+// Quota Stores
+// ============================================================================
+
+// quotaStore counts calls against quotas
+type quotaStore interface {
+	// Take uses one call of key's quota; the count is forgotten at expires.
+	// remaining is what is left after it; ok is false once the quota is used
+	// up.
+	Take(ctx context.Context, key string, limit int, expires time.Time) (remaining int, ok bool, err error)
+}
+
+// quotaStoreFromEnv returns the store named by FREE_TIER_STORE: "memory"
+// (default) or a redis:// URL for quotas shared between servers
+func quotaStoreFromEnv() (quotaStore, error) {
+	value := os.Getenv("FREE_TIER_STORE")
+	if value == "" || value == "memory" {
+		return newMemoryQuotaStore(), nil
+	}
+	return newRedisQuotaStore(value)
+}
+
+// trustProxiesFromEnv makes r take client IPs from X-Forwarded-For only for
+// requests arriving through TRUSTED_PROXIES, a comma-separated list of IPs
+// or CIDRs. By default no proxy is trusted and the client IP is the address
+// of the connection, so clients cannot pick their own per-IP quota.
+func trustProxiesFromEnv(r *ginfw.Engine) error {
+	proxies := splitURLs(os.Getenv("TRUSTED_PROXIES"))
+	if err := r.SetTrustedProxies(proxies); err != nil {
+		return fmt.Errorf("invalid TRUSTED_PROXIES: %w", err)
+	}
+	return nil
+}
+
+// windowKey names the free-call counter of key for the window now falls in
+// and returns when that window ends
+func windowKey(key string, window time.Duration, now time.Time) (string, time.Time) {
+	start := now.Truncate(window)
+	return fmt.Sprintf("x402:free:%s:%d", key, start.Unix()), start.Add(window)
+}
+
+// memoryQuotaStore keeps quotas in process memory
+type memoryQuotaStore struct {
+	mu     sync.Mutex
+	counts map[string]quotaCount
+}
+
+type quotaCount struct {
+	calls   int
+	expires time.Time
+}
+
+func newMemoryQuotaStore() *memoryQuotaStore {
+	return &memoryQuotaStore{counts: make(map[string]quotaCount)}
+}
+
+func (m *memoryQuotaStore) Take(ctx context.Context, key string, limit int, expires time.Time) (int, bool, error) {
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k, count := range m.counts {
+		if now.After(count.expires) {
+			delete(m.counts, k)
+		}
+	}
+
+	count := m.counts[key]
+	if count.calls >= limit {
+		return 0, false, nil
+	}
+	count.calls++
+	count.expires = expires
+	m.counts[key] = count
+	return limit - count.calls, true, nil
+}
+
+// redisQuotaStore keeps quotas in Redis (or anything speaking its protocol)
+// with INCR and PEXPIREAT on one connection
+type redisQuotaStore struct {
+	addr     string
+	password string
+	db       int
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// newRedisQuotaStore parses redis://[:password@]host:port[/db]
+func newRedisQuotaStore(rawURL string) (*redisQuotaStore, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Scheme != "redis" || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid FREE_TIER_STORE %q, want memory or redis://host:port/db", rawURL)
+	}
+	store := &redisQuotaStore{addr: parsed.Host}
+	if password, ok := parsed.User.Password(); ok {
+		store.password = password
+	}
+	if db := strings.Trim(parsed.Path, "/"); db != "" {
+		if store.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid redis database %q", db)
+		}
+	}
+	return store, nil
+}
+
+func (r *redisQuotaStore) Take(ctx context.Context, key string, limit int, expires time.Time) (int, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	reply, err := r.do(ctx, "INCR", key)
+	if err != nil {
+		return 0, false, err
+	}
+	calls, ok := reply.(int64)
+	if !ok {
+		return 0, false, fmt.Errorf("redis: unexpected INCR reply %v", reply)
+	}
+	if calls == 1 {
+		if _, err := r.do(ctx, "PEXPIREAT", key, strconv.FormatInt(expires.UnixMilli(), 10)); err != nil {
+			return 0, false, err
+		}
+	}
+	if calls > int64(limit) {
+		return 0, false, nil
+	}
+	return limit - int(calls), true, nil
+}
+
+// do sends one command and reads its reply, reconnecting when needed.
+// Callers must hold r.mu.
+func (r *redisQuotaStore) do(ctx context.Context, args ...string) (interface{}, error) {
+	if r.conn == nil {
+		if err := r.connect(ctx); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := r.roundTrip(ctx, args...)
+	if err != nil {
+		var redisErr redisError
+		if !errors.As(err, &redisErr) {
+			r.conn.Close()
+			r.conn = nil
+		}
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (r *redisQuotaStore) connect(ctx context.Context) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", r.addr)
+	if err != nil {
+		return fmt.Errorf("redis: %w", err)
+	}
+	r.conn = conn
+	r.reader = bufio.NewReader(conn)
+
+	if r.password != "" {
+		if _, err := r.roundTrip(ctx, "AUTH", r.password); err != nil {
+			conn.Close()
+			r.conn = nil
+			return err
+		}
+	}
+	if r.db != 0 {
+		if _, err := r.roundTrip(ctx, "SELECT", strconv.Itoa(r.db)); err != nil {
+			conn.Close()
+			r.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func (r *redisQuotaStore) roundTrip(ctx context.Context, args ...string) (interface{}, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(2 * time.Second)
+	}
+	r.conn.SetDeadline(deadline)
+
+	var command strings.Builder
+	fmt.Fprintf(&command, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&command, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := r.conn.Write([]byte(command.String())); err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+
+	line, err := r.reader.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	}
+	return nil, fmt.Errorf("redis: unsupported reply %q", line)
+}
+
+// ============================================================================
+// Free Tier Middleware
+// ============================================================================
+
+type freeTierKey struct{}
+
+// freeTierRequest lets the facilitator wrapper grant a wallet's free call
+// for a request the middleware could not let through for free
+type freeTierRequest struct {
+	policy *freeTierPolicy
+	header func(string)
+
+	mu    sync.Mutex
+	payer string
+}
+
+// freeTier lets requests to free-tier routes through without payment:
+// allowlisted API keys always, and callers with free calls left on their IP
+// or wallet quota. Everything else is paid as usual.
+type freeTier struct {
+	store  quotaStore
+	policy func() *freeTierPolicy
+}
+
+// newFreeTier creates the free tier
+//
+// Args:
+//
+//	store: quota counters
+//	policy: returns the current policy (nil disables the free tier)
+//
+// Returns:
+//
+//	*freeTier
+func newFreeTier(store quotaStore, policy func() *freeTierPolicy) *freeTier {
+	return &freeTier{store: store, policy: policy}
+}
+
+// Middleware wraps the session and payment middleware in next
+func (f *freeTier) Middleware(routes routeMatcher, next ginfw.HandlerFunc) ginfw.HandlerFunc {
+	return func(c *ginfw.Context) {
+		policy := f.policy()
+		_, route, ok := routes.Match(c.Request.Method, c.Request.URL.Path)
+		if policy == nil || !ok || !route.FreeTier {
+			next(c)
+			return
+		}
+
+		if key := c.GetHeader(APIKeyHeader); key != "" && policy.apiKeys[sha256.Sum256([]byte(key))] {
+			c.Next()
+			return
+		}
+
+		if policy.perIP > 0 {
+			counter, expires := windowKey("ip:"+c.ClientIP(), policy.window, time.Now())
+			remaining, free, err := f.store.Take(c.Request.Context(), counter, policy.perIP, expires)
+			if err != nil {
+				slog.WarnContext(c.Request.Context(), "free tier unavailable", "error", err)
+			} else {
+				c.Header(FreeCallsHeader, strconv.Itoa(remaining))
+				if free {
+					c.Next()
+					return
+				}
+			}
+		}
+
+		if policy.perWallet > 0 {
+			request := &freeTierRequest{policy: policy, header: func(remaining string) {
+				c.Header(FreeCallsHeader, remaining)
+			}}
+			c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), freeTierKey{}, request))
+		}
+		next(c)
+	}
+}
+
+// freeTierFacilitator grants wallet free calls: a verified payment from a
+// wallet with free calls left is not settled
+type freeTierFacilitator struct {
+	x402.FacilitatorClient
+	store quotaStore
+}
+
+// newFreeTierFacilitator wraps client with wallet free calls
+func newFreeTierFacilitator(client x402.FacilitatorClient, store quotaStore) *freeTierFacilitator {
+	return &freeTierFacilitator{FacilitatorClient: client, store: store}
+}
+
+func (f *freeTierFacilitator) Verify(ctx context.Context, payloadBytes []byte, requirementsBytes []byte) (*x402.VerifyResponse, error) {
+	response, err := f.FacilitatorClient.Verify(ctx, payloadBytes, requirementsBytes)
+	if request, _ := ctx.Value(freeTierKey{}).(*freeTierRequest); request != nil && err == nil && response.IsValid {
+		request.mu.Lock()
+		request.payer = response.Payer
+		request.mu.Unlock()
+	}
+	return response, err
+}
+
+func (f *freeTierFacilitator) Settle(ctx context.Context, payloadBytes []byte, requirementsBytes []byte) (*x402.SettleResponse, error) {
+	request, _ := ctx.Value(freeTierKey{}).(*freeTierRequest)
+	if request == nil {
+		return f.FacilitatorClient.Settle(ctx, payloadBytes, requirementsBytes)
+	}
+	request.mu.Lock()
+	payer := request.payer
+	request.mu.Unlock()
+	if payer == "" {
+		return f.FacilitatorClient.Settle(ctx, payloadBytes, requirementsBytes)
+	}
+
+	counter, expires := windowKey("wallet:"+strings.ToLower(payer), request.policy.window, time.Now())
+	remaining, free, err := f.store.Take(ctx, counter, request.policy.perWallet, expires)
+	if err != nil {
+		slog.WarnContext(ctx, "free tier unavailable", "error", err)
+		return f.FacilitatorClient.Settle(ctx, payloadBytes, requirementsBytes)
+	}
+	request.header(strconv.Itoa(remaining))
+	if !free {
+		return f.FacilitatorClient.Settle(ctx, payloadBytes, requirementsBytes)
+	}
+
+	var requirements struct {
+		Network x402.Network `json:"network"`
+	}
+	json.Unmarshal(requirementsBytes, &requirements)
+	slog.InfoContext(ctx, "free call", "payer", payer, "remaining", remaining)
+	return &x402.SettleResponse{Success: true, Payer: payer, Network: requirements.Network}, nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	x402 "github.com/coinbase/x402/go"
+	x402http "github.com/coinbase/x402/go/http"
+	ginfw "github.com/gin-gonic/gin"
+)
+
+func TestMemoryQuotaStore(t *testing.T) {
+	store := newMemoryQuotaStore()
+	expires := time.Now().Add(time.Hour)
+	for want := 1; want >= 0; want-- {
+		remaining, ok, err := store.Take(context.Background(), "ip:1.2.3.4", 2, expires)
+		if err != nil || !ok || remaining != want {
+			t.Fatalf("Take() = %d, %v, %v, want %d", remaining, ok, err, want)
+		}
+	}
+	if _, ok, _ := store.Take(context.Background(), "ip:1.2.3.4", 2, expires); ok {
+		t.Error("Take() succeeded past the quota")
+	}
+	if _, ok, _ := store.Take(context.Background(), "ip:5.6.7.8", 2, expires); !ok {
+		t.Error("quota is shared between keys")
+	}
+	if _, ok, _ := store.Take(context.Background(), "ip:9.9.9.9", 2, time.Now().Add(-time.Second)); !ok {
+		t.Fatal("Take() failed on a fresh key")
+	}
+	if _, ok, _ := store.Take(context.Background(), "ip:9.9.9.9", 1, time.Now().Add(time.Hour)); !ok {
+		t.Error("expired count was not forgotten")
+	}
+}
+
+// payingFacilitator verifies every payment as coming from payer
+type payingFacilitator struct {
+	recordingFacilitator
+	payer   string
+	settles int
+}
+
+func (f *payingFacilitator) Verify(ctx context.Context, payload []byte, requirements []byte) (*x402.VerifyResponse, error) {
+	return &x402.VerifyResponse{IsValid: true, Payer: f.payer}, nil
+}
+
+func (f *payingFacilitator) Settle(ctx context.Context, payload []byte, requirements []byte) (*x402.SettleResponse, error) {
+	f.settles++
+	return f.recordingFacilitator.Settle(ctx, payload, requirements)
+}
+
+// newTestFreeTier serves GET /free (free tier) and GET /paid behind the free
+// tier, with a payment middleware that verifies and settles through the free
+// tier facilitator
+func newTestFreeTier(t *testing.T, config FreeTierConfig) (*ginfw.Engine, *payingFacilitator) {
+	t.Helper()
+	ginfw.SetMode(ginfw.TestMode)
+
+	policy, err := config.policy()
+	if err != nil {
+		t.Fatalf("policy() error = %v", err)
+	}
+	store := newMemoryQuotaStore()
+	inner := &payingFacilitator{payer: "0x00000000000000000000000000000000000000AA"}
+	facilitator := newFreeTierFacilitator(inner, store)
+
+	routes := mustCompile(t, RoutesConfig{
+		"GET /free": {RouteConfig: x402http.RouteConfig{
+			Accepts: x402http.PaymentOptions{{Scheme: "exact", Price: "$0.01"}},
+		}, FreeTier: true},
+		"GET /paid": {RouteConfig: x402http.RouteConfig{
+			Accepts: x402http.PaymentOptions{{Scheme: "exact", Price: "$0.01"}},
+		}},
+	})
+	payment := func(c *ginfw.Context) {
+		if c.GetHeader("PAYMENT-SIGNATURE") == "" {
+			c.AbortWithStatus(http.StatusPaymentRequired)
+			return
+		}
+		ctx := c.Request.Context()
+		facilitator.Verify(ctx, []byte(`{}`), []byte(`{"network":"eip155:8453"}`))
+		if _, err := facilitator.Settle(ctx, []byte(`{}`), []byte(`{"network":"eip155:8453"}`)); err != nil {
+			t.Fatalf("Settle() error = %v", err)
+		}
+		c.Next()
+	}
+
+	r := ginfw.New()
+	r.Use(newFreeTier(store, func() *freeTierPolicy { return policy }).Middleware(routes, payment))
+	r.GET("/free", func(c *ginfw.Context) { c.Status(http.StatusOK) })
+	r.GET("/paid", func(c *ginfw.Context) { c.Status(http.StatusOK) })
+	return r, inner
+}
+
+func get(r *ginfw.Engine, path string, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestFreeTierPerIP(t *testing.T) {
+	r, _ := newTestFreeTier(t, FreeTierConfig{PerIP: 2})
+
+	for _, want := range []string{"1", "0"} {
+		w := get(r, "/free", nil)
+		if w.Code != http.StatusOK || w.Header().Get(FreeCallsHeader) != want {
+			t.Fatalf("free call: status %d, remaining %q, want %s", w.Code, w.Header().Get(FreeCallsHeader), want)
+		}
+	}
+	w := get(r, "/free", nil)
+	if w.Code != http.StatusPaymentRequired || w.Header().Get(FreeCallsHeader) != "0" {
+		t.Errorf("after the quota: status %d, remaining %q", w.Code, w.Header().Get(FreeCallsHeader))
+	}
+	if w := get(r, "/paid", nil); w.Code != http.StatusPaymentRequired || w.Header().Get(FreeCallsHeader) != "" {
+		t.Errorf("route outside the free tier: status %d, remaining %q", w.Code, w.Header().Get(FreeCallsHeader))
+	}
+}
+
+func TestFreeTierIgnoresForwardedForByDefault(t *testing.T) {
+	r, _ := newTestFreeTier(t, FreeTierConfig{PerIP: 1})
+	t.Setenv("TRUSTED_PROXIES", "")
+	if err := trustProxiesFromEnv(r); err != nil {
+		t.Fatal(err)
+	}
+
+	get(r, "/free", map[string]string{"X-Forwarded-For": "198.51.100.1"})
+	if w := get(r, "/free", map[string]string{"X-Forwarded-For": "198.51.100.2"}); w.Code != http.StatusPaymentRequired {
+		t.Fatalf("spoofed X-Forwarded-For: status %d, want the quota of the connection's IP", w.Code)
+	}
+
+	// httptest requests come from 192.0.2.1
+	t.Setenv("TRUSTED_PROXIES", "192.0.2.0/24")
+	if err := trustProxiesFromEnv(r); err != nil {
+		t.Fatal(err)
+	}
+	if w := get(r, "/free", map[string]string{"X-Forwarded-For": "198.51.100.3"}); w.Code != http.StatusOK {
+		t.Fatalf("X-Forwarded-For from a trusted proxy: status %d", w.Code)
+	}
+}
+
+func TestFreeTierAPIKey(t *testing.T) {
+	r, _ := newTestFreeTier(t, FreeTierConfig{APIKeys: []string{"dashboard", ""}})
+
+	if w := get(r, "/free", map[string]string{APIKeyHeader: "dashboard"}); w.Code != http.StatusOK {
+		t.Errorf("allowlisted key: status %d", w.Code)
+	}
+	for _, key := range []string{"", "other"} {
+		if w := get(r, "/free", map[string]string{APIKeyHeader: key}); w.Code != http.StatusPaymentRequired {
+			t.Errorf("key %q: status %d", key, w.Code)
+		}
+	}
+	if w := get(r, "/paid", map[string]string{APIKeyHeader: "dashboard"}); w.Code != http.StatusPaymentRequired {
+		t.Errorf("allowlisted key outside the free tier: status %d", w.Code)
+	}
+}
+
+func TestFreeTierPerWallet(t *testing.T) {
+	r, inner := newTestFreeTier(t, FreeTierConfig{PerWallet: 1})
+	paid := map[string]string{"PAYMENT-SIGNATURE": "signed"}
+
+	if w := get(r, "/free", nil); w.Code != http.StatusPaymentRequired {
+		t.Fatalf("unsigned request: status %d", w.Code)
+	}
+	w := get(r, "/free", paid)
+	if w.Code != http.StatusOK || inner.settles != 0 || w.Header().Get(FreeCallsHeader) != "0" {
+		t.Fatalf("free wallet call: status %d, settles %d, remaining %q", w.Code, inner.settles, w.Header().Get(FreeCallsHeader))
+	}
+	if w := get(r, "/free", paid); w.Code != http.StatusOK || inner.settles != 1 {
+		t.Errorf("after the quota: status %d, settles %d", w.Code, inner.settles)
+	}
+	if w := get(r, "/paid", paid); w.Code != http.StatusOK || inner.settles != 2 {
+		t.Errorf("route outside the free tier: status %d, settles %d", w.Code, inner.settles)
+	}
+}
+
+func TestFreeTierPolicyRejectsBadConfig(t *testing.T) {
+	for _, config := range []FreeTierConfig{{PerIP: -1}, {Window: "daily"}, {Window: "-1h"}} {
+		if _, err := config.policy(); err == nil {
+			t.Errorf("policy(%+v) succeeded", config)
+		}
+	}
+}
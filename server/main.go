@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	x402 "github.com/coinbase/x402/go"
@@ -13,59 +16,82 @@ import (
 	svm "github.com/coinbase/x402/go/mechanisms/svm/exact/server"
 	ginfw "github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
+	"go_code/x402/logging"
+	"go_code/x402/shutdown"
 )
 
 const (
 	DefaultPort = "4021"
+
+	// ShutdownTimeout bounds how long in-flight requests may keep running after
+	// a shutdown signal. It leaves room for the handler plus the facilitator
+	// verify and settle calls made by the payment middleware.
+	ShutdownTimeout = 60 * time.Second
 )
 
 func main() {
 	godotenv.Load()
+	// Redact secrets from everything printed from here on
+	installErr := logging.Install()
+	defer logging.Close()
+	ginfw.DefaultWriter, ginfw.DefaultErrorWriter = os.Stdout, os.Stderr
 
-	evmAddress := os.Getenv("EVM_PAYEE_ADDRESS")
-	if evmAddress == "" {
-		fmt.Println("❌ EVM_PAYEE_ADDRESS environment variable is required")
-		os.Exit(1)
+	// Structured logs (LOG_LEVEL, LOG_FORMAT=json) tagged with request IDs
+	if _, err := logging.Setup("server"); err != nil {
+		fmt.Println(err)
+		logging.Exit(1)
+	}
+	if installErr != nil {
+		slog.Warn("output is not redacted", "error", installErr)
 	}
+	logging.WarnSecretsInSource()
 
-	svmAddress := os.Getenv("SVM_PAYEE_ADDRESS")
-	if svmAddress == "" {
-		fmt.Println("❌ SVM_PAYEE_ADDRESS environment variable is required")
-		os.Exit(1)
+	// "server validate [config]" checks a payment config and exits
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		logging.Exit(runValidate(os.Args[2:]))
 	}
 
 	facilitatorURL := os.Getenv("FACILITATOR_URL")
 	if facilitatorURL == "" {
-		fmt.Println("❌ FACILITATOR_URL environment variable is required")
-		fmt.Println("   Example: https://x402.org/facilitator")
-		os.Exit(1)
+		logging.Fatal("FACILITATOR_URL environment variable is required", "example", "https://x402.org/facilitator")
 	}
 	cdpAPIKeyID := os.Getenv("CDP_API_KEY_ID")
 	if cdpAPIKeyID == "" {
-		fmt.Println("❌ CDP_API_KEY_ID environment variable is required")
-		os.Exit(1)
+		logging.Fatal("CDP_API_KEY_ID environment variable is required")
 	}
 	cdpAPIKeySecret := os.Getenv("CDP_API_KEY_SECRET")
 	if cdpAPIKeySecret == "" {
-		fmt.Println("❌ CDP_API_KEY_SECRET environment variable is required")
-		os.Exit(1)
-	}
-	// Network configuration - Base Sepolia testnet
-	// evmNetwork := x402.Network("eip155:84532")
-	// svmNetwork := x402.Network("solana:EtWTRABZaYq6iMfeYKouRu166VU2xqa1")
-	evmNetwork2 := x402.Network("eip155:8453")
-	svmNetwork2 := x402.Network("solana:5eykt4UsFv8P8NJdTREpY1vzqKqZKvdp")
-	fmt.Printf("🚀 Starting Gin x402 server...\n")
-	fmt.Printf("   EVM Payee address: %s\n", evmAddress)
-	fmt.Printf("   SVM Payee address: %s\n", svmAddress)
-	fmt.Printf("   EVM Network: %s\n", evmNetwork2)
-	fmt.Printf("   SVM Network: %s\n", svmNetwork2)
-	fmt.Printf("   Facilitator: %s\n", facilitatorURL)
-	fmt.Printf("   CDP API Key ID: %s\n", cdpAPIKeyID)
-	fmt.Printf("   CDP API Key Secret: %s\n", cdpAPIKeySecret)
+		logging.Fatal("CDP_API_KEY_SECRET environment variable is required")
+	}
+	slog.Info("starting Gin x402 server", "facilitator", facilitatorURL, "cdp_api_key_id", cdpAPIKeyID)
+
+	// USD price source for routes that accept ETH or SOL
+	priceOracle, err := priceOracleFromEnv()
+	if err != nil {
+		logging.Fatal("failed to create price oracle", "error", err)
+	}
+	nativeScheme := NewNativeScheme(priceOracle)
+
+	sessions, err := sessionManagerFromEnv()
+	if err != nil {
+		logging.Fatal("failed to set up payment sessions", "error", err)
+	}
+	reconcileInterval := DefaultReconcileInterval
+	if value := os.Getenv("SESSION_RECONCILE_INTERVAL"); value != "" {
+		if reconcileInterval, err = time.ParseDuration(value); err != nil {
+			logging.Fatal("invalid SESSION_RECONCILE_INTERVAL", "error", err)
+		}
+	}
 
 	// Create Gin router
-	r := ginfw.Default()
+	r := ginfw.New()
+	r.Use(ginfw.Recovery())
+	if err := trustProxiesFromEnv(r); err != nil {
+		logging.Fatal("invalid trusted proxies", "error", err)
+	}
+
+	inFlight := &shutdown.InFlightTracker{}
+	r.Use(inFlight.Middleware())
 
 	// Create HTTP facilitator client
 	// facilitatorClient := x402http.NewHTTPFacilitatorClient(&x402http.FacilitatorConfig{
@@ -73,16 +99,31 @@ func main() {
 	// })
 
 	// 创建CDP认证提供者
-	cdpAuthProvider := &CDPAuthProvider{
-		APIKeyID:     cdpAPIKeyID,
-		APIKeySecret: cdpAPIKeySecret,
+	cdpAuthProvider, err := NewCDPAuthProvider(cdpAPIKeyID, cdpAPIKeySecret, facilitatorURL)
+	if err != nil {
+		logging.Fatal("invalid CDP API key", "error", err)
 	}
 
-	facilitatorClient := x402http.NewHTTPFacilitatorClient(&x402http.FacilitatorConfig{
-		URL:          facilitatorURL,
-		AuthProvider: cdpAuthProvider,
-		Timeout:      30 * time.Second,
-	})
+	for _, fallbackURL := range splitURLs(os.Getenv("FACILITATOR_FALLBACK_URLS")) {
+		slog.Info("fallback facilitator", "url", fallbackURL)
+	}
+	facilitatorRouter := newFacilitators(facilitatorURL, cdpAuthProvider)
+
+	// Supported payment kinds are cached (SUPPORTED_CACHE_TTL, default 5m)
+	// and refreshed in the background. If no facilitator answers now, the
+	// server starts degraded and paid routes answer 503 until one does.
+	supportedTTL := DefaultSupportedTTL
+	if value := os.Getenv("SUPPORTED_CACHE_TTL"); value != "" {
+		if supportedTTL, err = time.ParseDuration(value); err != nil || supportedTTL <= 0 {
+			logging.Fatal("invalid SUPPORTED_CACHE_TTL", "value", value)
+		}
+	}
+	facilitatorClient := newSupportedCache(facilitatorRouter, supportedTTL)
+	startup, cancelStartup := context.WithTimeout(context.Background(), 15*time.Second)
+	if err := facilitatorClient.Refresh(startup); err != nil {
+		slog.Warn("starting in degraded mode: paid routes are unavailable until a facilitator answers", "error", err)
+	}
+	cancelStartup()
 
 	/**
 	 * Configure x402 payment middleware
@@ -90,58 +131,144 @@ func main() {
 	 * This middleware protects specific routes with payment requirements.
 	 * When a client accesses a protected route without payment, they receive
 	 * a 402 Payment Required response with payment details.
+	 *
+	 * Routes, prices, payees and schemes come from the payment config file
+	 * (ROUTES_CONFIG, default routes.yaml). Editing the file or sending SIGHUP
+	 * reloads it without a restart; a config that fails validation is not
+	 * applied, and the server does not start with one. Run
+	 * "server validate [config]" to check a config without starting.
 	 */
-	routes := x402http.RoutesConfig{
-		"GET /weather": {
-			Accepts: x402http.PaymentOptions{
-				{
-					Scheme:  "exact",
-					Price:   "$0.001",
-					Network: "eip155:84532",
-					PayTo:   evmAddress,
-				},
-				{
-					Scheme:  "exact",
-					Price:   "$0.001",
-					Network: "solana:EtWTRABZaYq6iMfeYKouRu166VU2xqa1",
-					PayTo:   svmAddress,
-				},
-			},
-			Description: "Get weather data for a city",
-			MimeType:    "application/json",
-		},
-		"GET /zkStash": {
-			Accepts: x402http.PaymentOptions{
-				{
-					Scheme:  "exact",
-					Price:   "$0.001",
-					Network: "eip155:8453",
-					PayTo:   evmAddress,
-				},
-				{
-					Scheme:  "exact",
-					Price:   "$0.001",
-					Network: "solana:5eykt4UsFv8P8NJdTREpY1vzqKqZKvdp",
-					PayTo:   svmAddress,
-				},
-			},
-			Description: "Get weather data for a city",
-			MimeType:    "application/json",
-		},
-	}
-
-	// Apply x402 payment middleware
-	r.Use(ginmw.X402Payment(ginmw.Config{
-		Routes:      routes,
-		Facilitator: facilitatorClient,
-		Schemes: []ginmw.SchemeConfig{
-			// {Network: "eip155:84532", Server: evm.NewExactEvmScheme()},
-			// {Network: "solana:EtWTRABZaYq6iMfeYKouRu166VU2xqa1", Server: svm.NewExactSvmScheme()},
-			{Network: "eip155:8453", Server: evm.NewExactEvmScheme()},
-			{Network: "solana:5eykt4UsFv8P8NJdTREpY1vzqKqZKvdp", Server: svm.NewExactSvmScheme()},
-		},
-		Timeout: 30 * time.Second,
-	}))
+	configPath := os.Getenv("ROUTES_CONFIG")
+	if configPath == "" {
+		configPath = DefaultRoutesConfigFile
+	}
+	slog.Info("payment config", "file", configPath)
+
+	// Server side of the schemes a config can register
+	servers := schemeServers(nativeScheme)
+
+	// Solana payees need a USDC token account to be paid in USDC
+	payees := newPayeeAccounts()
+
+	// Free calls are counted in memory, or in Redis to share them between
+	// servers (FREE_TIER_STORE=redis://host:port/db)
+	quotas, err := quotaStoreFromEnv()
+	if err != nil {
+		logging.Fatal("failed to set up the free tier", "error", err)
+	}
+
+	// A receipt for every settled payment, for the revenue API
+	receiptsPath := os.Getenv("RECEIPTS_FILE")
+	if receiptsPath == "" {
+		receiptsPath = DefaultReceiptsFile
+	}
+	receipts, err := newReceiptStore(receiptsPath)
+	if err != nil {
+		logging.Fatal("failed to open receipts", "error", err)
+	}
+	defer receipts.Close()
+	slog.Info("receipts", "file", receiptsPath)
+
+	facilitator := newDeferringFacilitator(
+		newSettlementRecorder(newFreeTierFacilitator(newMeteredFacilitator(newReceiptRecorder(facilitatorClient, receipts)), quotas)),
+	)
+
+	routes, err := newLiveRoutes(configPath, func(config *ServerConfig) (*paymentStack, error) {
+		// Facilitator kinds are checked once known; a degraded start
+		// checks them when the first /supported answer rebuilds the stack
+		var supported *x402.SupportedResponse
+		if current, err := facilitatorClient.Current(); err == nil {
+			supported = &current
+		}
+		problems := validateConfig(config, priceFuncs, servers, supported)
+		checkCtx, cancelCheck := context.WithTimeout(context.Background(), 15*time.Second)
+		problems = append(problems, payees.Check(checkCtx, config)...)
+		cancelCheck()
+		if len(problems) > 0 {
+			return nil, fmt.Errorf("invalid config:\n  %s", strings.Join(problems, "\n  "))
+		}
+
+		routesConfig, err := config.RoutesConfig(priceFuncs)
+		if err != nil {
+			return nil, err
+		}
+		free, err := config.FreeTierPolicy()
+		if err != nil {
+			return nil, err
+		}
+		access, err := config.AccessGroupPolicies()
+		if err != nil {
+			return nil, err
+		}
+
+		// Prepaid sessions: a deposit paid once on this route is spent by
+		// session-eligible routes without a settlement per request
+		routesConfig["POST /session/deposit"] = sessions.DepositRoute(config.Payees["evm"])
+
+		table, err := routesConfig.Compile()
+		if err != nil {
+			return nil, err
+		}
+		schemes, err := config.SchemeConfigs(servers)
+		if err != nil {
+			return nil, err
+		}
+		schemes = withDynamicPricing(schemes)
+
+		gate := newPaymentGate(table, func(routes x402http.RoutesConfig) ginfw.HandlerFunc {
+			return ginmw.X402Payment(ginmw.Config{
+				Routes:      routes,
+				Facilitator: facilitator,
+				Schemes:     schemes,
+				Timeout:     30 * time.Second,
+			})
+		})
+		return &paymentStack{table: table, gate: gate, free: free, access: access}, nil
+	})
+	if err != nil {
+		logging.Fatal("failed to load payment config", "error", err)
+	}
+
+	// A payment on a route in an access group buys a token for the group
+	accessTokens, err := accessTokensFromEnv(quotas, routes.AccessGroups)
+	if err != nil {
+		logging.Fatal("failed to set up access tokens", "error", err)
+	}
+
+	// Tag requests with an ID and their payment route for receipts and logs
+	r.Use(logging.RequestIDMiddleware())
+	r.Use(logging.AccessLog())
+	r.Use(RecordRoute(routes))
+
+	// Paid routes wait for the supported kinds; when they change the payment
+	// middleware is rebuilt with them, which is refused (keeping the current
+	// one) if a route is left that no facilitator can pay for
+	r.Use(facilitatorClient.Middleware(routes))
+	facilitatorClient.OnChange(func(x402.SupportedResponse) {
+		if err := routes.Reload(); err != nil {
+			slog.Error("failed to rebuild payment middleware", "error", err)
+		}
+	})
+
+	// Quote dynamically priced routes before anything builds requirements
+	r.Use(newDynamicPricing(routes, DefaultQuoteTTL).Middleware())
+
+	// Let native payments be checked at the price their 402 quoted
+	r.Use(RecordAcceptedRequirements())
+
+	// Let upto route handlers report what a request actually cost. This has
+	// to wrap the payment middleware, whose settlement reads the report.
+	r.Use(MeterUsage())
+
+	// Apply x402 payment middleware, behind access tokens, the free tier and
+	// the session middleware that let token holders, free calls and session
+	// requests skip it
+	// Settle-after-response routes hold the response until it is known whether
+	// to settle, so they wrap the payment middleware directly
+	settleAfter := newSettleAfterResponse(facilitator)
+	freeTier := newFreeTier(quotas, routes.FreeTier)
+	payment := freeTier.Middleware(routes, sessions.Middleware(routes, settleAfter.Middleware(routes, routes.Handle)))
+	r.Use(accessTokens.Middleware(routes, payment))
 
 	/**
 	 * Protected endpoint - requires $0.001 USDC payment
@@ -173,11 +300,46 @@ func main() {
 	})
 
 	r.GET("/zkStash", func(c *ginfw.Context) {
+		// Upto payments are settled at the reported cost, not the $0.01 maximum
+		if err := ReportUsage(c, "$0.001"); err != nil {
+			slog.WarnContext(c.Request.Context(), "failed to report usage", "error", err)
+		}
+
 		c.JSON(http.StatusOK, ginfw.H{
 			"timestamp": time.Now().Format(time.RFC3339),
 		})
 	})
 
+	/**
+	 * Payment sessions
+	 *
+	 * POST /session/deposit is paid like any other route and returns a session
+	 * credential. Send it in the PAYMENT-SESSION header to spend the deposit on
+	 * session routes, check the balance with GET /session and close the
+	 * session with POST /session/close to have the rest refunded.
+	 */
+	r.POST("/session/deposit", sessions.Deposit)
+	r.GET("/session", sessions.Status)
+	r.POST("/session/close", sessions.Close)
+
+	/**
+	 * Revenue reporting - requires ADMIN_API_TOKEN as a bearer token
+	 *
+	 * GET /admin/revenue sums receipts by route, day, network or payer
+	 * (groupBy) over an optional from/to period; GET /admin/receipts lists
+	 * them. Add format=csv for a CSV export. Payments the facilitator
+	 * queued for batch settlement are recorded as pending, with their queue
+	 * ID instead of a transaction.
+	 */
+	adminToken := os.Getenv("ADMIN_API_TOKEN")
+	if adminToken == "" {
+		slog.Warn("ADMIN_API_TOKEN not set, the admin API is disabled")
+	}
+	revenue := newRevenueAPI(receipts, adminToken)
+	admin := r.Group("/admin", revenue.Authorize)
+	admin.GET("/revenue", revenue.Revenue)
+	admin.GET("/receipts", revenue.Receipts)
+
 	/**
 	 * Health check endpoint - no payment required
 	 *
@@ -185,15 +347,121 @@ func main() {
 	 */
 	r.GET("/health", func(c *ginfw.Context) {
 		c.JSON(http.StatusOK, ginfw.H{
-			"status":  "ok",
-			"version": "2.0.0",
+			"status":       "ok",
+			"version":      "2.0.0",
+			"degraded":     !facilitatorClient.Ready(),
+			"facilitators": facilitatorRouter.Status(),
 		})
 	})
 
-	fmt.Printf("   Server listening on http://localhost:%s\n\n", DefaultPort)
+	// Every paid handler must have a payment route and every payment route a
+	// handler; anything else is a typo that would serve content for free
+	publicRoutes := []string{"GET /health", "GET /session", "POST /session/close", "GET /admin/revenue", "GET /admin/receipts"}
+	err = routes.SetCheck(func(table *routeTable) error {
+		return table.Validate(r.Routes(), publicRoutes)
+	})
+	if err != nil {
+		logging.Fatal("invalid routes", "error", err)
+	}
+
+	slog.Info("server listening", "url", "http://localhost:"+DefaultPort)
+
+	srv := &http.Server{
+		Addr:    ":" + DefaultPort,
+		Handler: r,
+	}
+
+	background, stopBackground := context.WithCancel(context.Background())
+	reconcileDone := make(chan struct{})
+	go func() {
+		defer close(reconcileDone)
+		sessions.Run(background, reconcileInterval)
+	}()
+	go routes.Watch(background, DefaultConfigPollInterval)
+	go facilitatorClient.Run(background)
+
+	err = shutdown.ServeUntilSignal(srv, inFlight, ShutdownTimeout)
+	// Let a refund in progress record its transaction before exiting
+	stopBackground()
+	<-reconcileDone
+	if err != nil {
+		logging.Fatal("error running server", "error", err)
+	}
+	slog.Info("server stopped")
+}
+
+// priceFuncs are the price functions a route can name with "pricing"
+var priceFuncs = map[string]PriceFunc{
+	"weather": weatherPrice,
+}
+
+// schemeServers creates the server side of the schemes a config can register
+func schemeServers(nativeScheme *NativeScheme) func(scheme string, network x402.Network) (x402.SchemeNetworkServer, error) {
+	return func(scheme string, network x402.Network) (x402.SchemeNetworkServer, error) {
+		isEvm := strings.HasPrefix(string(network), "eip155:")
+		isSvm := strings.HasPrefix(string(network), "solana:")
+		switch {
+		case scheme == "exact" && isEvm:
+			return evm.NewExactEvmScheme(), nil
+		case scheme == "exact" && isSvm:
+			return svm.NewExactSvmScheme(), nil
+		case scheme == SchemeUpto && isEvm:
+			return NewUptoScheme(), nil
+		case scheme == SchemeNative && (isEvm || isSvm):
+			return nativeScheme, nil
+		}
+		return nil, fmt.Errorf("not supported by this server")
+	}
+}
+
+// newFacilitators creates the facilitator router: facilitatorURL (with CDP
+// auth) comes first; FACILITATOR_FALLBACK_URLS (e.g. a self-hosted
+// facilitator, https://x402.org/facilitator) take over per network when it
+// is down or does not support a payment
+func newFacilitators(facilitatorURL string, auth x402http.AuthProvider) *facilitatorRouter {
+	names := []string{facilitatorName(facilitatorURL)}
+	clients := []x402.FacilitatorClient{
+		x402http.NewHTTPFacilitatorClient(&x402http.FacilitatorConfig{
+			URL:          facilitatorURL,
+			HTTPClient:   facilitatorHTTPClient(),
+			AuthProvider: auth,
+			Timeout:      30 * time.Second,
+		}),
+	}
+	for _, fallbackURL := range splitURLs(os.Getenv("FACILITATOR_FALLBACK_URLS")) {
+		names = append(names, facilitatorName(fallbackURL))
+		clients = append(clients, x402http.NewHTTPFacilitatorClient(&x402http.FacilitatorConfig{
+			URL:        fallbackURL,
+			HTTPClient: facilitatorHTTPClient(),
+			Timeout:    30 * time.Second,
+		}))
+	}
+	return newFacilitatorRouter(names, clients)
+}
+
+// facilitatorHTTPClient sends the request ID along, so the facilitator logs
+// a payment under the same ID as the server, and reads the queue ID of
+// payments queued for batch settlement for their receipts
+func facilitatorHTTPClient() *http.Client {
+	return &http.Client{Timeout: 30 * time.Second, Transport: &queuedSettleTransport{next: logging.Transport(nil)}}
+}
+
+// weatherPrice charges more for cities in high demand and at peak hours (UTC)
+func weatherPrice(c *ginfw.Context) (x402.Price, error) {
+	popular := false
+	switch c.DefaultQuery("city", "San Francisco") {
+	case "New York", "London", "Tokyo":
+		popular = true
+	}
+	peak := time.Now().UTC().Hour() >= 12 && time.Now().UTC().Hour() < 18
 
-	if err := r.Run(":" + DefaultPort); err != nil {
-		fmt.Printf("Error starting server: %v\n", err)
-		os.Exit(1)
+	switch {
+	case popular && peak:
+		return "$0.003", nil
+	case popular:
+		return "$0.002", nil
+	case peak:
+		return "$0.0015", nil
 	}
+	return "$0.001", nil
 }
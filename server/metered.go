@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"sync"
+
+	x402 "github.com/coinbase/x402/go"
+	"github.com/coinbase/x402/go/types"
+	ginfw "github.com/gin-gonic/gin"
+)
+
+// SchemeUpto authorizes a maximum price; the route handler reports what the
+// request actually cost and only that is settled
+const SchemeUpto = "upto"
+
+// USDC deployments upto payments and session balances are priced in, with
+// their EIP-712 domains
+var usdcAssets = map[x402.Network]struct {
+	address string
+	name    string
+	version string
+}{
+	"eip155:8453":  {"0x833589fCD6eDb6E08f4c7C32D4f71b54bdA02913", "USD Coin", "2"},
+	"eip155:84532": {"0x036CbD53842c5426634e7929541eC2318f3dCF7e", "USDC", "2"},
+}
+
+// usdcDecimals is the precision of every asset in usdcAssets
+const usdcDecimals = 6
+
+// ============================================================================
+// Upto Scheme
+// ============================================================================
+
+// UptoScheme builds upto payment requirements. The route price is the most a
+// request may cost; the client signs an EIP-2612 or Permit2 permit for it,
+// with the facilitator as spender.
+type UptoScheme struct{}
+
+// NewUptoScheme creates the server side of the upto scheme
+func NewUptoScheme() *UptoScheme {
+	return &UptoScheme{}
+}
+
+func (s *UptoScheme) Scheme() string {
+	return SchemeUpto
+}
+
+// ParsePrice converts the maximum USD price into USDC units
+func (s *UptoScheme) ParsePrice(price x402.Price, network x402.Network) (x402.AssetAmount, error) {
+	if amount, ok := price.(x402.AssetAmount); ok {
+		return amount, nil
+	}
+
+	asset, ok := usdcAssets[network]
+	if !ok {
+		return x402.AssetAmount{}, fmt.Errorf("upto payments are not available on %s", network)
+	}
+	usd, err := parseUSDPrice(price)
+	if err != nil {
+		return x402.AssetAmount{}, err
+	}
+
+	return x402.AssetAmount{
+		Asset:  asset.address,
+		Amount: usdToUnits(usd, usdcDecimals).String(),
+		Extra: map[string]interface{}{
+			"name":     asset.name,
+			"version":  asset.version,
+			"decimals": usdcDecimals,
+		},
+	}, nil
+}
+
+// EnhancePaymentRequirements adds the spender the client's permit must name
+// and the transfer methods the facilitator accepts
+func (s *UptoScheme) EnhancePaymentRequirements(
+	ctx context.Context,
+	requirements types.PaymentRequirements,
+	supportedKind types.SupportedKind,
+	extensions []string,
+) (types.PaymentRequirements, error) {
+	spender, _ := supportedKind.Extra["spender"].(string)
+	if spender == "" {
+		return requirements, fmt.Errorf("facilitator advertises no spender for upto payments on %s", requirements.Network)
+	}
+	if requirements.Extra == nil {
+		requirements.Extra = make(map[string]interface{})
+	}
+	requirements.Extra["spender"] = spender
+	if methods, ok := supportedKind.Extra["assetTransferMethods"]; ok {
+		requirements.Extra["assetTransferMethods"] = methods
+	}
+	return requirements, nil
+}
+
+// ============================================================================
+// Usage Reporting
+// ============================================================================
+
+type usageMeterKey struct{}
+
+// usageMeter carries the usage a handler reports back to settlement
+type usageMeter struct {
+	mu       sync.Mutex
+	usd      *big.Rat
+	reported bool
+}
+
+// MeterUsage is a gin middleware that lets handlers on upto routes report
+// their actual cost with ReportUsage. It must run before the x402 payment
+// middleware so the meter is in the context the settlement is made with.
+func MeterUsage() ginfw.HandlerFunc {
+	return func(c *ginfw.Context) {
+		ctx := context.WithValue(c.Request.Context(), usageMeterKey{}, &usageMeter{})
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// ReportUsage records what the current request cost, in USD ("$0.0004" or a
+// number). Reports accumulate, so a handler may report per unit of work. A
+// request on an upto route that reports nothing is charged its maximum.
+func ReportUsage(c *ginfw.Context, price x402.Price) error {
+	meter, _ := c.Request.Context().Value(usageMeterKey{}).(*usageMeter)
+	if meter == nil {
+		return fmt.Errorf("usage metering is not enabled, add the MeterUsage middleware")
+	}
+
+	usd, err := parseUSDAmount(price)
+	if err != nil {
+		return err
+	}
+
+	meter.mu.Lock()
+	defer meter.mu.Unlock()
+	if meter.usd == nil {
+		meter.usd = new(big.Rat)
+	}
+	meter.usd.Add(meter.usd, usd)
+	meter.reported = true
+	return nil
+}
+
+// reportedUsage returns the USD usage reported for a request, if any
+func reportedUsage(ctx context.Context) (*big.Rat, bool) {
+	meter, _ := ctx.Value(usageMeterKey{}).(*usageMeter)
+	if meter == nil {
+		return nil, false
+	}
+	meter.mu.Lock()
+	defer meter.mu.Unlock()
+	if !meter.reported {
+		return nil, false
+	}
+	return new(big.Rat).Set(meter.usd), true
+}
+
+// ============================================================================
+// Metered Settlement
+// ============================================================================
+
+// meteredFacilitator sits between the payment middleware and the facilitator.
+// For upto payments it replaces the amount in the settlement requirements with
+// the usage the handler reported, capped at the authorized maximum. Other
+// payments pass through untouched.
+type meteredFacilitator struct {
+	x402.FacilitatorClient
+}
+
+// newMeteredFacilitator wraps client with upto usage settlement
+func newMeteredFacilitator(client x402.FacilitatorClient) *meteredFacilitator {
+	return &meteredFacilitator{FacilitatorClient: client}
+}
+
+func (m *meteredFacilitator) Settle(ctx context.Context, payloadBytes []byte, requirementsBytes []byte) (*x402.SettleResponse, error) {
+	usd, reported := reportedUsage(ctx)
+	if !reported {
+		return m.FacilitatorClient.Settle(ctx, payloadBytes, requirementsBytes)
+	}
+
+	var requirements map[string]interface{}
+	if err := json.Unmarshal(requirementsBytes, &requirements); err != nil || requirements["scheme"] != SchemeUpto {
+		return m.FacilitatorClient.Settle(ctx, payloadBytes, requirementsBytes)
+	}
+
+	maxAmount, ok := new(big.Int).SetString(fmt.Sprint(requirements["amount"]), 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid upto amount %v", requirements["amount"])
+	}
+	decimals := usdcDecimals
+	if extra, ok := requirements["extra"].(map[string]interface{}); ok {
+		if value, ok := extra["decimals"].(float64); ok {
+			decimals = int(value)
+		}
+	}
+
+	amount := usdToUnits(usd, decimals)
+	if amount.Cmp(maxAmount) > 0 {
+		slog.WarnContext(ctx, "reported usage exceeds the authorized amount, settling the maximum", "amount", amount.String(), "max", maxAmount.String())
+		amount = maxAmount
+	}
+	requirements["amount"] = amount.String()
+
+	// The facilitator caps EIP-2612 upto permits at the authorized maximum
+	extra, _ := requirements["extra"].(map[string]interface{})
+	if extra == nil {
+		extra = make(map[string]interface{})
+		requirements["extra"] = extra
+	}
+	extra["maxAmount"] = maxAmount.String()
+
+	metered, err := json.Marshal(requirements)
+	if err != nil {
+		return nil, err
+	}
+	slog.InfoContext(ctx, "settling upto payment", "amount", amount.String(), "max", maxAmount.String())
+	return m.FacilitatorClient.Settle(ctx, payloadBytes, metered)
+}
+
+// usdToUnits converts a USD amount into an asset's smallest unit, rounding up
+func usdToUnits(usd *big.Rat, decimals int) *big.Int {
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals)), nil)
+	scaled := new(big.Rat).Mul(usd, new(big.Rat).SetInt(scale))
+	units, remainder := new(big.Int).QuoRem(scaled.Num(), scaled.Denom(), new(big.Int))
+	if remainder.Sign() > 0 {
+		units.Add(units, big.NewInt(1))
+	}
+	return units
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	x402 "github.com/coinbase/x402/go"
+	ginfw "github.com/gin-gonic/gin"
+)
+
+// recordingFacilitator remembers the requirements it was asked to settle
+type recordingFacilitator struct {
+	settled map[string]interface{}
+}
+
+func (f *recordingFacilitator) Verify(ctx context.Context, payload []byte, requirements []byte) (*x402.VerifyResponse, error) {
+	return &x402.VerifyResponse{IsValid: true}, nil
+}
+
+func (f *recordingFacilitator) Settle(ctx context.Context, payload []byte, requirements []byte) (*x402.SettleResponse, error) {
+	f.settled = nil
+	if err := json.Unmarshal(requirements, &f.settled); err != nil {
+		return nil, err
+	}
+	return &x402.SettleResponse{Success: true}, nil
+}
+
+func (f *recordingFacilitator) GetSupported(ctx context.Context) (x402.SupportedResponse, error) {
+	return x402.SupportedResponse{}, nil
+}
+
+// settleAfter runs handler behind MeterUsage and settles requirements through
+// the metered facilitator with the request's context, as the payment
+// middleware would
+func settleAfter(t *testing.T, requirements map[string]interface{}, handler func(c *ginfw.Context)) map[string]interface{} {
+	t.Helper()
+	ginfw.SetMode(ginfw.TestMode)
+
+	recorder := &recordingFacilitator{}
+	metered := newMeteredFacilitator(recorder)
+	raw, _ := json.Marshal(requirements)
+
+	r := ginfw.New()
+	r.Use(MeterUsage())
+	r.Use(func(c *ginfw.Context) {
+		c.Next()
+		if _, err := metered.Settle(c.Request.Context(), []byte(`{}`), raw); err != nil {
+			t.Fatalf("Settle() error = %v", err)
+		}
+	})
+	r.GET("/", handler)
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	return recorder.settled
+}
+
+func TestMeteredSettlement(t *testing.T) {
+	upto := func() map[string]interface{} {
+		return map[string]interface{}{
+			"scheme":  SchemeUpto,
+			"network": "eip155:8453",
+			"amount":  "10000",
+			"extra":   map[string]interface{}{"decimals": 6},
+		}
+	}
+
+	tests := []struct {
+		name         string
+		requirements map[string]interface{}
+		report       []x402.Price
+		want         string
+	}{
+		{"reported usage", upto(), []x402.Price{"$0.001"}, "1000"},
+		{"accumulated usage", upto(), []x402.Price{"$0.001", 0.0005}, "1500"},
+		{"rounded up", upto(), []x402.Price{"$0.0000001"}, "1"},
+		{"zero usage", upto(), []x402.Price{"$0"}, "0"},
+		{"capped at maximum", upto(), []x402.Price{"$1"}, "10000"},
+		{"nothing reported", upto(), nil, "10000"},
+		{
+			"exact payments untouched",
+			map[string]interface{}{"scheme": "exact", "amount": "1000"},
+			[]x402.Price{"$0.0001"},
+			"1000",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settled := settleAfter(t, tt.requirements, func(c *ginfw.Context) {
+				for _, usage := range tt.report {
+					if err := ReportUsage(c, usage); err != nil {
+						t.Fatalf("ReportUsage() error = %v", err)
+					}
+				}
+				c.Status(http.StatusOK)
+			})
+			if settled["amount"] != tt.want {
+				t.Fatalf("settled amount = %v, want %s", settled["amount"], tt.want)
+			}
+			extra, _ := settled["extra"].(map[string]interface{})
+			if tt.requirements["scheme"] == SchemeUpto && len(tt.report) > 0 && extra["maxAmount"] != "10000" {
+				t.Fatalf("settled maxAmount = %v, want the authorized 10000", extra["maxAmount"])
+			}
+		})
+	}
+}
+
+func TestReportUsageRejectsInvalid(t *testing.T) {
+	settleAfter(t, map[string]interface{}{"scheme": SchemeUpto, "amount": "10"}, func(c *ginfw.Context) {
+		for _, bad := range []x402.Price{"-$1", "$-1", "abc", nil} {
+			if err := ReportUsage(c, bad); err == nil {
+				t.Errorf("ReportUsage(%v) succeeded", bad)
+			}
+		}
+	})
+
+	c, _ := ginfw.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+	if err := ReportUsage(c, "$0.001"); err == nil {
+		t.Error("ReportUsage() without MeterUsage succeeded")
+	}
+}
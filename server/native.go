@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	x402 "github.com/coinbase/x402/go"
+	"github.com/coinbase/x402/go/types"
+	ginfw "github.com/gin-gonic/gin"
+)
+
+const (
+	// SchemeNative pays in the network's native asset (ETH, SOL) instead of a token
+	SchemeNative = "native"
+
+	// NativeAssetEvm is the asset sentinel for ETH in native requirements
+	NativeAssetEvm = "0xEeeeeEeeeEeEeeEeEeEeeEEEeeeeEeeeeeeeEEeE"
+
+	// NativeAssetSvm is the asset for SOL in native requirements (the System Program)
+	NativeAssetSvm = "11111111111111111111111111111111"
+
+	// oracleTimeout bounds a price lookup while building requirements
+	oracleTimeout = 10 * time.Second
+
+	// PaymentSignatureHeader carries a v2 payment
+	PaymentSignatureHeader = "PAYMENT-SIGNATURE"
+
+	// defaultQuoteWindow is how long a quoted native price is honoured for
+	// requirements without maxTimeoutSeconds
+	defaultQuoteWindow = 60 * time.Second
+)
+
+// nativeAsset describes the native asset of a network family
+type nativeAsset struct {
+	symbol   string
+	asset    string
+	decimals int
+}
+
+// nativeAssetFor returns the native asset of a CAIP-2 network
+func nativeAssetFor(network x402.Network) (nativeAsset, error) {
+	switch {
+	case strings.HasPrefix(string(network), "eip155:"):
+		return nativeAsset{symbol: "ETH", asset: NativeAssetEvm, decimals: 18}, nil
+	case strings.HasPrefix(string(network), "solana:"):
+		return nativeAsset{symbol: "SOL", asset: NativeAssetSvm, decimals: 9}, nil
+	}
+	return nativeAsset{}, fmt.Errorf("no native asset known for network %s", network)
+}
+
+// NativeScheme builds native scheme payment requirements, converting "$"
+// prices into wei or lamports at the oracle's current price
+type NativeScheme struct {
+	oracle PriceOracle
+}
+
+// NewNativeScheme creates the server side of the native scheme
+//
+// Args:
+//
+//	oracle: USD price source for ETH and SOL
+//
+// Returns:
+//
+//	*NativeScheme
+func NewNativeScheme(oracle PriceOracle) *NativeScheme {
+	return &NativeScheme{oracle: oracle}
+}
+
+func (s *NativeScheme) Scheme() string {
+	return SchemeNative
+}
+
+// ParsePrice converts a route price into an amount of the native asset.
+// Prices are USD ("$0.001", "0.001" or a number); an AssetAmount is used as is.
+// Amounts are rounded up to the next smallest unit. The USD price goes into
+// extra next to the unit price, so the amount can be recomputed at the price
+// a payer was quoted.
+func (s *NativeScheme) ParsePrice(price x402.Price, network x402.Network) (x402.AssetAmount, error) {
+	if amount, ok := price.(x402.AssetAmount); ok {
+		return amount, nil
+	}
+
+	native, err := nativeAssetFor(network)
+	if err != nil {
+		return x402.AssetAmount{}, err
+	}
+	usd, err := parseUSDPrice(price)
+	if err != nil {
+		return x402.AssetAmount{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), oracleTimeout)
+	defer cancel()
+	unitPrice, err := s.oracle.USDPrice(ctx, native.symbol)
+	if err != nil {
+		return x402.AssetAmount{}, fmt.Errorf("failed to get %s price: %w", native.symbol, err)
+	}
+
+	amount := usdToUnits(new(big.Rat).Quo(usd, unitPrice), native.decimals)
+
+	return x402.AssetAmount{
+		Asset:  native.asset,
+		Amount: amount.String(),
+		Extra: map[string]interface{}{
+			"symbol":   native.symbol,
+			"decimals": native.decimals,
+			"usdPrice": unitPrice.FloatString(8),
+			"usd":      formatUSD(usd),
+		},
+	}, nil
+}
+
+// EnhancePaymentRequirements rebuilds the requirements a payment accepted at
+// the price it was quoted, and adds the facilitator's fee payer to Solana
+// requirements; the client has to name it in the transfer it signs
+func (s *NativeScheme) EnhancePaymentRequirements(
+	ctx context.Context,
+	requirements types.PaymentRequirements,
+	supportedKind types.SupportedKind,
+	extensions []string,
+) (types.PaymentRequirements, error) {
+	if accepted, ok := acceptedRequirements(ctx); ok {
+		requirements = s.honourQuote(requirements, accepted)
+	}
+
+	if !strings.HasPrefix(requirements.Network, "solana:") {
+		return requirements, nil
+	}
+
+	feePayer, _ := supportedKind.Extra["feePayer"].(string)
+	if feePayer == "" {
+		return requirements, fmt.Errorf("facilitator advertises no fee payer for native payments on %s", requirements.Network)
+	}
+	if requirements.Extra == nil {
+		requirements.Extra = make(map[string]interface{})
+	}
+	requirements.Extra["feePayer"] = feePayer
+	return requirements, nil
+}
+
+// honourQuote recomputes requirements at the unit price of the accepted
+// requirements of a payment, if the oracle quoted that price within the
+// payment's maxTimeoutSeconds. The price may have moved since the 402 was
+// sent; the payer is still charged what it was quoted. Requirements that
+// don't match the payment's, or a price the oracle didn't quote, are left as
+// they are.
+func (s *NativeScheme) honourQuote(requirements, accepted types.PaymentRequirements) types.PaymentRequirements {
+	oracle, ok := s.oracle.(*cachedOracle)
+	if !ok || accepted.Scheme != SchemeNative || accepted.Network != requirements.Network ||
+		accepted.Asset != requirements.Asset || accepted.PayTo != requirements.PayTo {
+		return requirements
+	}
+
+	quoted, _ := accepted.Extra["usdPrice"].(string)
+	usd, _ := requirements.Extra["usd"].(string)
+	current, _ := requirements.Extra["usdPrice"].(string)
+	if quoted == "" || quoted == current || usd != accepted.Extra["usd"] {
+		return requirements
+	}
+
+	native, err := nativeAssetFor(x402.Network(requirements.Network))
+	if err != nil {
+		return requirements
+	}
+	window := defaultQuoteWindow
+	if requirements.MaxTimeoutSeconds > 0 {
+		window = time.Duration(requirements.MaxTimeoutSeconds) * time.Second
+	}
+	unitPrice, ok := oracle.honoured(native.symbol, quoted, window)
+	if !ok {
+		return requirements
+	}
+	usdAmount, ok := new(big.Rat).SetString(usd)
+	if !ok {
+		return requirements
+	}
+
+	extra := make(map[string]interface{}, len(requirements.Extra))
+	for k, v := range requirements.Extra {
+		extra[k] = v
+	}
+	extra["usdPrice"] = quoted
+	requirements.Extra = extra
+	requirements.Amount = usdToUnits(new(big.Rat).Quo(usdAmount, unitPrice), native.decimals).String()
+	return requirements
+}
+
+type acceptedRequirementsKey struct{}
+
+// RecordAcceptedRequirements decodes the requirements a v2 payment accepted
+// from its PAYMENT-SIGNATURE header, so schemes can rebuild requirements the
+// way they were quoted. Requests without a payment, or with one that can't
+// be decoded, are left to the payment middleware.
+func RecordAcceptedRequirements() ginfw.HandlerFunc {
+	return func(c *ginfw.Context) {
+		header := c.GetHeader(PaymentSignatureHeader)
+		if header == "" {
+			c.Next()
+			return
+		}
+
+		var payment struct {
+			Accepted *types.PaymentRequirements `json:"accepted"`
+		}
+		decoded, err := base64.StdEncoding.DecodeString(header)
+		if err == nil && json.Unmarshal(decoded, &payment) == nil && payment.Accepted != nil {
+			ctx := context.WithValue(c.Request.Context(), acceptedRequirementsKey{}, *payment.Accepted)
+			c.Request = c.Request.WithContext(ctx)
+		}
+		c.Next()
+	}
+}
+
+// acceptedRequirements returns the requirements the request's payment
+// accepted, if it carries one
+func acceptedRequirements(ctx context.Context) (types.PaymentRequirements, bool) {
+	accepted, ok := ctx.Value(acceptedRequirementsKey{}).(types.PaymentRequirements)
+	return accepted, ok
+}
+
+// formatUSD formats a USD amount exactly, without trailing zeros
+func formatUSD(usd *big.Rat) string {
+	value := usd.FloatString(18)
+	return strings.TrimSuffix(strings.TrimRight(value, "0"), ".")
+}
+
+// parseUSDPrice parses a positive USD price given as "$0.01", "0.01" or a number
+func parseUSDPrice(price x402.Price) (*big.Rat, error) {
+	usd, err := parseUSDAmount(price)
+	if err != nil || usd.Sign() == 0 {
+		return nil, fmt.Errorf("invalid USD price %v", price)
+	}
+	return usd, nil
+}
+
+// parseUSDAmount parses a USD amount that may be zero
+func parseUSDAmount(price x402.Price) (*big.Rat, error) {
+	var usd *big.Rat
+	switch v := price.(type) {
+	case string:
+		parsed, ok := new(big.Rat).SetString(strings.TrimPrefix(strings.TrimSpace(v), "$"))
+		if ok {
+			usd = parsed
+		}
+	case float64:
+		// Go through the shortest decimal form so 0.003 is not 0.00299999...
+		parsed, ok := new(big.Rat).SetString(strconv.FormatFloat(v, 'f', -1, 64))
+		if ok {
+			usd = parsed
+		}
+	case int:
+		usd = new(big.Rat).SetInt64(int64(v))
+	case int64:
+		usd = new(big.Rat).SetInt64(v)
+	}
+	if usd == nil || usd.Sign() < 0 {
+		return nil, fmt.Errorf("invalid USD amount %v", price)
+	}
+	return usd, nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	x402 "github.com/coinbase/x402/go"
+	"github.com/coinbase/x402/go/types"
+	ginfw "github.com/gin-gonic/gin"
+)
+
+func TestNativeSchemeParsePrice(t *testing.T) {
+	oracle, err := NewFixedPriceOracle(map[string]string{"ETH": "3000", "SOL": "150"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheme := NewNativeScheme(oracle)
+
+	tests := []struct {
+		name    string
+		price   x402.Price
+		network x402.Network
+		asset   string
+		amount  string
+	}{
+		{"dollar string on base", "$0.001", "eip155:8453", NativeAssetEvm, "333333333334"},
+		{"plain string", "3", "eip155:8453", NativeAssetEvm, "1000000000000000"},
+		{"float", 0.003, "eip155:84532", NativeAssetEvm, "1000000000000"},
+		{"solana", "$0.001", "solana:5eykt4UsFv8P8NJdTREpY1vzqKqZKvdp", NativeAssetSvm, "6667"},
+		{"int", 150, "solana:EtWTRABZaYq6iMfeYKouRu166VU2xqa1", NativeAssetSvm, "1000000000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := scheme.ParsePrice(tt.price, tt.network)
+			if err != nil {
+				t.Fatalf("ParsePrice() error = %v", err)
+			}
+			if got.Asset != tt.asset || got.Amount != tt.amount {
+				t.Fatalf("ParsePrice() = %s %s, want %s %s", got.Amount, got.Asset, tt.amount, tt.asset)
+			}
+		})
+	}
+
+	for _, bad := range []x402.Price{"$0", "-1", "abc", nil} {
+		if _, err := scheme.ParsePrice(bad, "eip155:8453"); err == nil {
+			t.Errorf("ParsePrice(%v) succeeded", bad)
+		}
+	}
+	if _, err := scheme.ParsePrice("$1", "cosmos:hub"); err == nil {
+		t.Error("ParsePrice() on an unknown network succeeded")
+	}
+}
+
+func TestNativeSchemeFeePayer(t *testing.T) {
+	oracle, _ := NewFixedPriceOracle(map[string]string{"SOL": "150"})
+	scheme := NewNativeScheme(oracle)
+	requirements := types.PaymentRequirements{Scheme: SchemeNative, Network: "solana:5eykt4UsFv8P8NJdTREpY1vzqKqZKvdp"}
+
+	if _, err := scheme.EnhancePaymentRequirements(context.Background(), requirements, types.SupportedKind{}, nil); err == nil {
+		t.Fatal("EnhancePaymentRequirements() without a fee payer succeeded")
+	}
+
+	kind := types.SupportedKind{Extra: map[string]interface{}{"feePayer": "FeePayer1111111111111111111111111111111111"}}
+	enhanced, err := scheme.EnhancePaymentRequirements(context.Background(), requirements, kind, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enhanced.Extra["feePayer"] != "FeePayer1111111111111111111111111111111111" {
+		t.Fatalf("feePayer = %v", enhanced.Extra["feePayer"])
+	}
+}
+
+func TestCachedOracleHoldsQuote(t *testing.T) {
+	fixed, _ := NewFixedPriceOracle(map[string]string{"ETH": "3000"})
+	cached := newCachedOracle(fixed, DefaultQuoteTTL)
+
+	first, err := cached.USDPrice(context.Background(), "ETH")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixed.prices["ETH"].SetInt64(4000)
+
+	second, err := cached.USDPrice(context.Background(), "ETH")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Cmp(second) != 0 {
+		t.Fatalf("quote changed within TTL: %s -> %s", first.FloatString(2), second.FloatString(2))
+	}
+}
+
+func TestNativeSchemeHonoursQuotedPrice(t *testing.T) {
+	fixed, _ := NewFixedPriceOracle(map[string]string{"ETH": "3000"})
+	cached := newCachedOracle(fixed, time.Millisecond)
+	scheme := NewNativeScheme(cached)
+
+	quoted, err := scheme.ParsePrice("$0.001", "eip155:8453")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixed.prices["ETH"].SetInt64(4000)
+	time.Sleep(5 * time.Millisecond)
+	current, err := scheme.ParsePrice("$0.001", "eip155:8453")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Amount == quoted.Amount {
+		t.Fatal("price change did not change the amount")
+	}
+
+	requirements := func(amount x402.AssetAmount) types.PaymentRequirements {
+		return types.PaymentRequirements{
+			Scheme:            SchemeNative,
+			Network:           "eip155:8453",
+			Asset:             amount.Asset,
+			Amount:            amount.Amount,
+			PayTo:             "0x209693Bc6afc0C5328bA36FaF03C514EF312287C",
+			MaxTimeoutSeconds: 60,
+			Extra:             amount.Extra,
+		}
+	}
+	enhance := func(accepted types.PaymentRequirements) types.PaymentRequirements {
+		ctx := context.WithValue(context.Background(), acceptedRequirementsKey{}, accepted)
+		enhanced, err := scheme.EnhancePaymentRequirements(ctx, requirements(current), types.SupportedKind{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return enhanced
+	}
+
+	// Paid at the price of the 402: rebuilt at that price
+	if enhanced := enhance(requirements(quoted)); enhanced.Amount != quoted.Amount || enhanced.Extra["usdPrice"] != quoted.Extra["usdPrice"] {
+		t.Errorf("requirements rebuilt at %s (%v), want the quoted %s", enhanced.Amount, enhanced.Extra["usdPrice"], quoted.Amount)
+	}
+
+	// A price the oracle never quoted, or a different USD price, is not honoured
+	forged := requirements(quoted)
+	forged.Extra = map[string]interface{}{"usdPrice": "1000.00000000", "usd": quoted.Extra["usd"]}
+	if enhanced := enhance(forged); enhanced.Amount != current.Amount {
+		t.Errorf("unquoted price honoured: amount %s", enhanced.Amount)
+	}
+	cheaper := requirements(quoted)
+	cheaper.Extra = map[string]interface{}{"usdPrice": quoted.Extra["usdPrice"], "usd": "0.0001"}
+	if enhanced := enhance(cheaper); enhanced.Amount != current.Amount {
+		t.Errorf("other USD price honoured: amount %s", enhanced.Amount)
+	}
+
+	// Outside the payment's window the current price applies
+	if _, ok := cached.honoured("ETH", quoted.Extra["usdPrice"].(string), time.Millisecond); ok {
+		t.Error("quote honoured after its window")
+	}
+}
+
+func TestRecordAcceptedRequirements(t *testing.T) {
+	ginfw.SetMode(ginfw.TestMode)
+
+	var accepted types.PaymentRequirements
+	var found bool
+	r := ginfw.New()
+	r.Use(RecordAcceptedRequirements())
+	r.GET("/", func(c *ginfw.Context) {
+		accepted, found = acceptedRequirements(c.Request.Context())
+	})
+
+	payment := base64.StdEncoding.EncodeToString([]byte(`{"x402Version":2,"accepted":{"scheme":"native","network":"eip155:8453","amount":"42"}}`))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(PaymentSignatureHeader, payment)
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	if !found || accepted.Scheme != SchemeNative || accepted.Amount != "42" {
+		t.Fatalf("accepted = %+v (found %v)", accepted, found)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(PaymentSignatureHeader, "not base64")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	if found {
+		t.Fatal("undecodable payment recorded")
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+const (
+	// DefaultOracleRPC is the chain the Chainlink feeds are read from
+	DefaultOracleRPC = "https://mainnet.base.org"
+
+	// DefaultQuoteTTL is how long a native price quote is held. Requirements
+	// built from the same quote match, so a client paying within this window
+	// is not asked for a new amount.
+	DefaultQuoteTTL = 60 * time.Second
+
+	// DefaultMaxPriceAge rejects Chainlink answers older than this
+	DefaultMaxPriceAge = time.Hour
+)
+
+// Chainlink USD feeds on Base mainnet
+var defaultChainlinkFeeds = map[string]string{
+	"ETH": "0x71041dddad3595F9CEd3DcCFBe3D1F4b0a16Bb70",
+	"SOL": "0x975043adBb80fc32276CbF9Bbcfd4A601a12462D",
+}
+
+// PriceOracle quotes the USD price of one whole unit of a native asset
+type PriceOracle interface {
+	USDPrice(ctx context.Context, symbol string) (*big.Rat, error)
+}
+
+// ============================================================================
+// Fixed Prices
+// ============================================================================
+
+// FixedPriceOracle returns configured prices. It stands in for an on-chain
+// oracle in tests and local runs.
+type FixedPriceOracle struct {
+	prices map[string]*big.Rat
+}
+
+// NewFixedPriceOracle creates an oracle from decimal USD prices by symbol
+//
+// Args:
+//
+//	prices: e.g. {"ETH": "3000", "SOL": "150.25"}
+//
+// Returns:
+//
+//	*FixedPriceOracle or error
+func NewFixedPriceOracle(prices map[string]string) (*FixedPriceOracle, error) {
+	parsed := make(map[string]*big.Rat, len(prices))
+	for symbol, value := range prices {
+		price, ok := new(big.Rat).SetString(value)
+		if !ok || price.Sign() <= 0 {
+			return nil, fmt.Errorf("invalid %s price %q", symbol, value)
+		}
+		parsed[strings.ToUpper(symbol)] = price
+	}
+	return &FixedPriceOracle{prices: parsed}, nil
+}
+
+func (o *FixedPriceOracle) USDPrice(ctx context.Context, symbol string) (*big.Rat, error) {
+	price, ok := o.prices[strings.ToUpper(symbol)]
+	if !ok {
+		return nil, fmt.Errorf("no fixed price for %s", symbol)
+	}
+	return new(big.Rat).Set(price), nil
+}
+
+// ============================================================================
+// Chainlink
+// ============================================================================
+
+const aggregatorV3ABI = `[
+	{"inputs":[],"name":"decimals","outputs":[{"name":"","type":"uint8"}],"stateMutability":"view","type":"function"},
+	{"inputs":[],"name":"latestRoundData","outputs":[{"name":"roundId","type":"uint80"},{"name":"answer","type":"int256"},{"name":"startedAt","type":"uint256"},{"name":"updatedAt","type":"uint256"},{"name":"answeredInRound","type":"uint80"}],"stateMutability":"view","type":"function"}
+]`
+
+var aggregatorV3Parsed = func() abi.ABI {
+	parsed, err := abi.JSON(strings.NewReader(aggregatorV3ABI))
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}()
+
+// ChainlinkOracle reads prices from Chainlink AggregatorV3 USD feeds
+type ChainlinkOracle struct {
+	client *ethclient.Client
+	feeds  map[string]common.Address
+	maxAge time.Duration
+}
+
+// NewChainlinkOracle creates an oracle reading feeds through rpcURL
+//
+// Args:
+//
+//	rpcURL: RPC endpoint of the chain the feeds live on
+//	feeds: feed address by symbol; missing symbols use the Base mainnet feeds
+//	maxAge: answers last updated longer ago are rejected
+//
+// Returns:
+//
+//	*ChainlinkOracle or error
+func NewChainlinkOracle(rpcURL string, feeds map[string]string, maxAge time.Duration) (*ChainlinkOracle, error) {
+	client, err := ethclient.Dial(rpcURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to RPC: %w", err)
+	}
+
+	addresses := make(map[string]common.Address)
+	for symbol, feed := range defaultChainlinkFeeds {
+		addresses[symbol] = common.HexToAddress(feed)
+	}
+	for symbol, feed := range feeds {
+		if feed == "" {
+			continue
+		}
+		if !common.IsHexAddress(feed) {
+			return nil, fmt.Errorf("invalid %s feed address %q", symbol, feed)
+		}
+		addresses[strings.ToUpper(symbol)] = common.HexToAddress(feed)
+	}
+
+	return &ChainlinkOracle{client: client, feeds: addresses, maxAge: maxAge}, nil
+}
+
+func (o *ChainlinkOracle) USDPrice(ctx context.Context, symbol string) (*big.Rat, error) {
+	feed, ok := o.feeds[strings.ToUpper(symbol)]
+	if !ok {
+		return nil, fmt.Errorf("no Chainlink feed for %s", symbol)
+	}
+
+	decimals, err := o.call(ctx, feed, "decimals")
+	if err != nil {
+		return nil, err
+	}
+	round, err := o.call(ctx, feed, "latestRoundData")
+	if err != nil {
+		return nil, err
+	}
+
+	answer := round[1].(*big.Int)
+	updatedAt := round[3].(*big.Int)
+	if answer.Sign() <= 0 {
+		return nil, fmt.Errorf("%s feed returned non-positive answer %s", symbol, answer)
+	}
+	if age := time.Since(time.Unix(updatedAt.Int64(), 0)); o.maxAge > 0 && age > o.maxAge {
+		return nil, fmt.Errorf("%s feed answer is stale (updated %s ago)", symbol, age.Round(time.Second))
+	}
+
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals[0].(uint8))), nil)
+	return new(big.Rat).SetFrac(answer, scale), nil
+}
+
+// call invokes a view method of a feed and unpacks its outputs
+func (o *ChainlinkOracle) call(ctx context.Context, feed common.Address, method string) ([]interface{}, error) {
+	data, err := aggregatorV3Parsed.Pack(method)
+	if err != nil {
+		return nil, err
+	}
+	result, err := o.client.CallContract(ctx, ethereum.CallMsg{To: &feed, Data: data}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call %s on %s: %w", method, feed.Hex(), err)
+	}
+	return aggregatorV3Parsed.Unpack(method, result)
+}
+
+// priceOracleFromEnv builds the oracle selected by PRICE_ORACLE: "chainlink"
+// (default) reads on-chain feeds, "fixed" uses NATIVE_PRICE_<SYMBOL>_USD
+func priceOracleFromEnv() (PriceOracle, error) {
+	ttl := DefaultQuoteTTL
+	if value := os.Getenv("NATIVE_QUOTE_TTL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid NATIVE_QUOTE_TTL: %w", err)
+		}
+		ttl = parsed
+	}
+
+	var oracle PriceOracle
+	switch kind := os.Getenv("PRICE_ORACLE"); kind {
+	case "", "chainlink":
+		rpcURL := os.Getenv("PRICE_ORACLE_RPC_URL")
+		if rpcURL == "" {
+			rpcURL = DefaultOracleRPC
+		}
+		chainlink, err := NewChainlinkOracle(rpcURL, map[string]string{
+			"ETH": os.Getenv("CHAINLINK_ETH_USD_FEED"),
+			"SOL": os.Getenv("CHAINLINK_SOL_USD_FEED"),
+		}, DefaultMaxPriceAge)
+		if err != nil {
+			return nil, err
+		}
+		oracle = chainlink
+	case "fixed":
+		prices := make(map[string]string)
+		for _, symbol := range []string{"ETH", "SOL"} {
+			if value := os.Getenv("NATIVE_PRICE_" + symbol + "_USD"); value != "" {
+				prices[symbol] = value
+			}
+		}
+		fixed, err := NewFixedPriceOracle(prices)
+		if err != nil {
+			return nil, err
+		}
+		oracle = fixed
+	default:
+		return nil, fmt.Errorf("unknown PRICE_ORACLE %q (want chainlink or fixed)", kind)
+	}
+
+	return newCachedOracle(oracle, ttl), nil
+}
+
+// ============================================================================
+// Quote Cache
+// ============================================================================
+
+// cachedOracle holds each price for ttl, so the amounts quoted in 402
+// responses don't move with every oracle update. Prices it handed out are
+// remembered, so the native scheme can rebuild a payment's requirements at
+// the price the payer was quoted until the payment's maxTimeoutSeconds are
+// over, even when a newer price is current by then.
+type cachedOracle struct {
+	oracle PriceOracle
+	ttl    time.Duration
+
+	mu     sync.Mutex
+	quotes map[string]cachedQuote
+	issued map[string][]issuedQuote // by symbol, newest last
+}
+
+type cachedQuote struct {
+	price     *big.Rat
+	expiresAt time.Time
+}
+
+// issuedQuote is a price the cache handed out and when it last did
+type issuedQuote struct {
+	price      *big.Rat
+	lastIssued time.Time
+}
+
+// issuedQuoteRetention bounds how long a price that is no longer handed out
+// can be honoured, whatever a route's maxTimeoutSeconds
+const issuedQuoteRetention = time.Hour
+
+// newCachedOracle wraps oracle with a quote cache of the given lifetime
+func newCachedOracle(oracle PriceOracle, ttl time.Duration) *cachedOracle {
+	return &cachedOracle{
+		oracle: oracle,
+		ttl:    ttl,
+		quotes: make(map[string]cachedQuote),
+		issued: make(map[string][]issuedQuote),
+	}
+}
+
+// USDPrice returns the held price, fetching a new one once it expired. The
+// oracle is queried without holding the lock, so a slow RPC call does not
+// hold up other symbols or requests served from the cache.
+func (o *cachedOracle) USDPrice(ctx context.Context, symbol string) (*big.Rat, error) {
+	o.mu.Lock()
+	quote, ok := o.quotes[symbol]
+	if ok && time.Now().Before(quote.expiresAt) {
+		o.issueLocked(symbol, quote.price)
+		o.mu.Unlock()
+		return new(big.Rat).Set(quote.price), nil
+	}
+	o.mu.Unlock()
+
+	price, err := o.oracle.USDPrice(ctx, symbol)
+	if err != nil {
+		return nil, err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	// Another request may have refreshed the price meanwhile; keep one
+	// price per window so concurrent 402s quote the same amount
+	if quote, ok := o.quotes[symbol]; ok && time.Now().Before(quote.expiresAt) {
+		price = quote.price
+	} else {
+		o.quotes[symbol] = cachedQuote{price: price, expiresAt: time.Now().Add(o.ttl)}
+	}
+	o.issueLocked(symbol, price)
+	return new(big.Rat).Set(price), nil
+}
+
+// issueLocked records that price was handed out for symbol. Must hold o.mu.
+func (o *cachedOracle) issueLocked(symbol string, price *big.Rat) {
+	now := time.Now()
+	var kept []issuedQuote
+	for _, quote := range o.issued[symbol] {
+		if quote.price.Cmp(price) != 0 && now.Sub(quote.lastIssued) <= issuedQuoteRetention {
+			kept = append(kept, quote)
+		}
+	}
+	o.issued[symbol] = append(kept, issuedQuote{price: price, lastIssued: now})
+}
+
+// honoured returns the price handed out for symbol within the last window
+// whose 8-decimal form, as it appears in usdPrice, is quoted
+func (o *cachedOracle) honoured(symbol string, quoted string, window time.Duration) (*big.Rat, bool) {
+	window = min(window, issuedQuoteRetention)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for _, quote := range o.issued[symbol] {
+		if time.Since(quote.lastIssued) <= window && quote.price.FloatString(8) == quoted {
+			return new(big.Rat).Set(quote.price), true
+		}
+	}
+	return nil, false
+}
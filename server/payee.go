@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	svmmech "github.com/coinbase/x402/go/mechanisms/svm"
+	"github.com/ethereum/go-ethereum/common"
+	solana "github.com/gagliardetto/solana-go"
+	"github.com/gagliardetto/solana-go/rpc"
+)
+
+// solanaUSDCMints is USDC on each Solana network
+var solanaUSDCMints = map[string]string{
+	"solana:5eykt4UsFv8P8NJdTREpY1vzqKqZKvdp": solanaUSDCMint,
+	"solana:EtWTRABZaYq6iMfeYKouRu166VU2xqa1": "4zMMC9srt5Ri5X14GAgXhaHii3GnPAEERYPJgZJDncDU",
+}
+
+// checkPayTo checks that address is an address on network's chain, so an
+// EVM payee on a Solana route (or a typo) is caught at startup rather than
+// when a payment to it fails:
+//   - EVM addresses are 20 hex bytes, and mixed-case ones must pass their
+//     EIP-55 checksum. All-lowercase and all-uppercase ones carry no
+//     checksum, so a typo in them goes unnoticed: they are accepted with a
+//     warning naming the checksummed form.
+//   - Solana addresses are base58 ed25519 public keys on the curve, i.e.
+//     wallets; token accounts and program addresses cannot own the token
+//     account a payment is sent to
+func checkPayTo(network string, address string) error {
+	switch {
+	case strings.HasPrefix(network, "eip155:"):
+		if !strings.HasPrefix(address, "0x") || !common.IsHexAddress(address) {
+			if _, err := solana.PublicKeyFromBase58(address); err == nil {
+				return fmt.Errorf("payTo %q is a Solana address, are the EVM and Solana payees swapped?", address)
+			}
+			return fmt.Errorf("payTo %q is not an EVM address", address)
+		}
+		digits := address[2:]
+		checksummed := common.HexToAddress(address).Hex()
+		if checksummed != address {
+			if digits != strings.ToLower(digits) && digits != strings.ToUpper(digits) {
+				return fmt.Errorf("payTo %q fails its EIP-55 checksum, check it for typos", address)
+			}
+			slog.Warn("payTo has no EIP-55 checksum, so a typo in it cannot be detected; use the checksummed address",
+				"network", network, "payTo", address, "checksummed", checksummed)
+		}
+	case strings.HasPrefix(network, "solana:"):
+		if strings.HasPrefix(address, "0x") && common.IsHexAddress(address) {
+			return fmt.Errorf("payTo %q is an EVM address, are the EVM and Solana payees swapped?", address)
+		}
+		key, err := solana.PublicKeyFromBase58(address)
+		if err != nil {
+			return fmt.Errorf("payTo %q is not a Solana address", address)
+		}
+		if !key.IsOnCurve() {
+			return fmt.Errorf("payTo %q is not a wallet address (it is off the ed25519 curve, like token accounts and program addresses)", address)
+		}
+	}
+	return nil
+}
+
+// payeeAccounts checks that Solana payees can be paid in USDC. An SPL
+// transfer goes to the payee's associated token account (ATA) for the mint,
+// and fails if that account does not exist, so every payment to a payee
+// without one would be refused after the client signed it.
+//
+// Accounts found are remembered, so reloads only look up new payees.
+type payeeAccounts struct {
+	// rpcURL returns the RPC endpoint of a Solana network
+	rpcURL func(network string) (string, error)
+
+	mu    sync.Mutex
+	found map[solana.PublicKey]bool
+}
+
+// solanaRPCURLVars names the variable overriding each Solana network's RPC
+// endpoint, so a mainnet endpoint is never used to look up devnet accounts
+var solanaRPCURLVars = map[string]string{
+	"solana:5eykt4UsFv8P8NJdTREpY1vzqKqZKvdp": "SOLANA_MAINNET_RPC_URL",
+	"solana:EtWTRABZaYq6iMfeYKouRu166VU2xqa1": "SOLANA_DEVNET_RPC_URL",
+}
+
+// solanaRPCURL returns the RPC endpoint of a Solana network: the one set in
+// its variable, or the network's default public endpoint
+func solanaRPCURL(network string) (string, error) {
+	if name, ok := solanaRPCURLVars[network]; ok {
+		if rpcURL := os.Getenv(name); rpcURL != "" {
+			return rpcURL, nil
+		}
+	}
+	config, err := svmmech.GetNetworkConfig(network)
+	if err != nil {
+		return "", err
+	}
+	return config.RPCURL, nil
+}
+
+// newPayeeAccounts creates a checker using SOLANA_MAINNET_RPC_URL and
+// SOLANA_DEVNET_RPC_URL, or each network's default public RPC endpoint
+//
+// Returns:
+//
+//	*payeeAccounts
+func newPayeeAccounts() *payeeAccounts {
+	return &payeeAccounts{
+		rpcURL: solanaRPCURL,
+		found:  make(map[solana.PublicKey]bool),
+	}
+}
+
+// Check looks up the USDC token account of every Solana payee paid in USDC.
+// A missing account is a problem; a lookup that fails is only logged, since
+// the RPC endpoint being down says nothing about the config.
+//
+// Args:
+//
+//	ctx: context for the RPC calls
+//	config: payment config
+//
+// Returns:
+//
+//	Problems, sorted; none if every account exists or could not be checked
+func (p *payeeAccounts) Check(ctx context.Context, config *ServerConfig) []string {
+	type account struct {
+		network string
+		owner   solana.PublicKey
+		mint    solana.PublicKey
+	}
+	accounts := make(map[solana.PublicKey]account)
+	for _, route := range config.Routes {
+		for _, option := range route.Accepts {
+			mint, ok := solanaUSDCMints[option.Network]
+			if !ok || option.Scheme == SchemeNative || (option.Asset != "" && option.Asset != mint) {
+				continue
+			}
+			owner, err := solana.PublicKeyFromBase58(config.Payee(option.PayTo))
+			if err != nil {
+				continue // reported by checkPayTo
+			}
+			mintKey := solana.MustPublicKeyFromBase58(mint)
+			ata, _, err := solana.FindAssociatedTokenAddress(owner, mintKey)
+			if err != nil {
+				continue
+			}
+			accounts[ata] = account{network: option.Network, owner: owner, mint: mintKey}
+		}
+	}
+
+	var problems []string
+	for ata, account := range accounts {
+		p.mu.Lock()
+		found := p.found[ata]
+		p.mu.Unlock()
+		if found {
+			continue
+		}
+
+		rpcURL, err := p.rpcURL(account.network)
+		if err != nil {
+			slog.WarnContext(ctx, "cannot check the payee's USDC account", "payee", account.owner.String(), "network", account.network, "error", err)
+			continue
+		}
+		_, err = rpc.New(rpcURL).GetAccountInfo(ctx, ata)
+		switch {
+		case errors.Is(err, rpc.ErrNotFound):
+			problems = append(problems, fmt.Sprintf(
+				"payee %s has no USDC token account on %s (%s), payments to it would fail; create it, e.g. spl-token create-account %s --owner %s",
+				account.owner, account.network, ata, account.mint, account.owner))
+		case err != nil:
+			slog.WarnContext(ctx, "cannot check the payee's USDC account", "payee", account.owner.String(), "network", account.network, "error", err)
+		default:
+			p.mu.Lock()
+			p.found[ata] = true
+			p.mu.Unlock()
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
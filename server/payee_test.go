@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	svmmech "github.com/coinbase/x402/go/mechanisms/svm"
+	solana "github.com/gagliardetto/solana-go"
+)
+
+func TestCheckPayTo(t *testing.T) {
+	wallet := "9WzDXwBbmkg8ZTbNMqUxvQRAyrZzDsGYdLVL9zYtAWWM"
+	ata, _, _ := solana.FindAssociatedTokenAddress(solana.MustPublicKeyFromBase58(wallet), solana.MustPublicKeyFromBase58(solanaUSDCMint))
+
+	for _, test := range []struct {
+		network string
+		address string
+		problem string
+	}{
+		{"eip155:8453", "0x00000000000000000000000000000000000000aa", ""},
+		{"eip155:8453", "0x833589fCD6eDb6E08f4c7C32D4f71b54bdA02913", ""},
+		{"eip155:8453", "0x833589fcD6eDb6E08f4c7C32D4f71b54bdA02913", "EIP-55 checksum"},
+		{"eip155:8453", "0x1", "not an EVM address"},
+		{"eip155:8453", wallet, "swapped"},
+		{"solana:5eykt4UsFv8P8NJdTREpY1vzqKqZKvdp", wallet, ""},
+		{"solana:5eykt4UsFv8P8NJdTREpY1vzqKqZKvdp", "0x00000000000000000000000000000000000000aa", "swapped"},
+		{"solana:5eykt4UsFv8P8NJdTREpY1vzqKqZKvdp", "not-base58-0OIl", "not a Solana address"},
+		{"solana:5eykt4UsFv8P8NJdTREpY1vzqKqZKvdp", ata.String(), "not a wallet address"},
+	} {
+		err := checkPayTo(test.network, test.address)
+		if test.problem == "" && err != nil || test.problem != "" && (err == nil || !strings.Contains(err.Error(), test.problem)) {
+			t.Errorf("checkPayTo(%s, %s) = %v, want %q", test.network, test.address, err, test.problem)
+		}
+	}
+}
+
+func TestCheckPayToWarnsWithoutChecksum(t *testing.T) {
+	var out bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&out, nil)))
+
+	for address, warned := range map[string]bool{
+		"0x833589fcd6edb6e08f4c7c32d4f71b54bda02913": true,
+		"0x833589FCD6EDB6E08F4C7C32D4F71B54BDA02913": true,
+		"0x833589fCD6eDb6E08f4c7C32D4f71b54bdA02913": false,
+	} {
+		out.Reset()
+		if err := checkPayTo("eip155:8453", address); err != nil {
+			t.Errorf("checkPayTo(%s) = %v", address, err)
+		}
+		if got := strings.Contains(out.String(), "0x833589fCD6eDb6E08f4c7C32D4f71b54bdA02913"); got != warned {
+			t.Errorf("checkPayTo(%s) warned with the checksummed address: %v, want %v (log %q)", address, got, warned, out.String())
+		}
+	}
+}
+
+func TestSolanaRPCURL(t *testing.T) {
+	mainnet := "solana:5eykt4UsFv8P8NJdTREpY1vzqKqZKvdp"
+	devnet := "solana:EtWTRABZaYq6iMfeYKouRu166VU2xqa1"
+	t.Setenv("SOLANA_MAINNET_RPC_URL", "https://mainnet.example.com")
+	t.Setenv("SOLANA_DEVNET_RPC_URL", "")
+
+	if got, err := solanaRPCURL(mainnet); err != nil || got != "https://mainnet.example.com" {
+		t.Errorf("solanaRPCURL(mainnet) = %q, %v, want the override", got, err)
+	}
+
+	// The mainnet override is not used for devnet
+	config, err := svmmech.GetNetworkConfig(devnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := solanaRPCURL(devnet); err != nil || got != config.RPCURL {
+		t.Errorf("solanaRPCURL(devnet) = %q, %v, want the default %q", got, err, config.RPCURL)
+	}
+}
+
+func TestPayeeAccountsCheck(t *testing.T) {
+	funded := "9WzDXwBbmkg8ZTbNMqUxvQRAyrZzDsGYdLVL9zYtAWWM"
+	unfunded := solana.NewWallet().PublicKey().String()
+	fundedATA, _, _ := solana.FindAssociatedTokenAddress(solana.MustPublicKeyFromBase58(funded), solana.MustPublicKeyFromBase58(solanaUSDCMint))
+
+	lookups := 0
+	rpcServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			ID     interface{}   `json:"id"`
+			Params []interface{} `json:"params"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		lookups++
+
+		var value interface{}
+		if request.Params[0] == fundedATA.String() {
+			value = map[string]interface{}{
+				"lamports": 2039280, "owner": solana.TokenProgramID.String(), "data": []string{"", "base64"},
+				"executable": false, "rentEpoch": 0,
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"jsonrpc": "2.0", "id": request.ID,
+			"result": map[string]interface{}{"context": map[string]interface{}{"slot": 1}, "value": value},
+		})
+	}))
+	defer rpcServer.Close()
+
+	accounts := newPayeeAccounts()
+	accounts.rpcURL = func(string) (string, error) { return rpcServer.URL, nil }
+	config := &ServerConfig{
+		Payees: map[string]string{"svm": funded, "other": unfunded},
+		Routes: map[string]RouteFileConfig{
+			"GET /a": {Accepts: []PaymentOptionConfig{
+				{Scheme: "exact", Network: "solana:5eykt4UsFv8P8NJdTREpY1vzqKqZKvdp", PayTo: "svm", Price: "$0.001"},
+				// Paid in SOL, no token account needed
+				{Scheme: SchemeNative, Network: "solana:5eykt4UsFv8P8NJdTREpY1vzqKqZKvdp", PayTo: "other", Price: "$0.001"},
+			}},
+		},
+	}
+	if problems := accounts.Check(context.Background(), config); len(problems) != 0 || lookups != 1 {
+		t.Fatalf("Check() = %q after %d lookups", problems, lookups)
+	}
+
+	// Found accounts are not looked up again
+	config.Routes["GET /b"] = RouteFileConfig{Accepts: []PaymentOptionConfig{
+		{Scheme: "exact", Network: "solana:5eykt4UsFv8P8NJdTREpY1vzqKqZKvdp", PayTo: "other", Price: "$0.001"},
+	}}
+	problems := accounts.Check(context.Background(), config)
+	if len(problems) != 1 || !strings.Contains(problems[0], unfunded) || lookups != 2 {
+		t.Errorf("Check() = %q after %d lookups, want the unfunded payee", problems, lookups)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	x402 "github.com/coinbase/x402/go"
+	ginmw "github.com/coinbase/x402/go/http/gin"
+	"github.com/coinbase/x402/go/types"
+	ginfw "github.com/gin-gonic/gin"
+)
+
+// PriceFunc computes a route's price for one request, from its parameters,
+// caller, the time of day or server load. It returns a USD price ("$0.002")
+// that replaces the static price of every payment option of the route.
+type PriceFunc func(c *ginfw.Context) (x402.Price, error)
+
+// PriceQuoteHeader tells the client how long the price it was quoted holds
+const PriceQuoteHeader = "PAYMENT-QUOTE-EXPIRES"
+
+type priceQuoteKey struct{}
+
+// priceQuote is the price computed for a request
+type priceQuote struct {
+	price   x402.Price
+	usd     *big.Rat
+	expires time.Time
+}
+
+// ============================================================================
+// Quotes
+// ============================================================================
+
+// dynamicPricing quotes prices for routes with a PriceFunc. A quote is held
+// for the caller and exact request (method, URL and credentials) for ttl, so
+// the paid retry of a 402 is charged what the 402 said even when the price
+// moves in between. Payment requirements are built from the quote, so a
+// payment made for a cheaper variant of the request does not match them and
+// is rejected.
+type dynamicPricing struct {
+	routes routeMatcher
+	ttl    time.Duration
+
+	mu     sync.Mutex
+	quotes map[string]priceQuote
+}
+
+// newDynamicPricing creates the quoting middleware state for routes
+//
+// Args:
+//
+//	routes: routes whose PriceFunc is called
+//	ttl: how long a quote holds for the same request
+//
+// Returns:
+//
+//	*dynamicPricing
+func newDynamicPricing(routes routeMatcher, ttl time.Duration) *dynamicPricing {
+	return &dynamicPricing{
+		routes: routes,
+		ttl:    ttl,
+		quotes: make(map[string]priceQuote),
+	}
+}
+
+// Middleware quotes the request's price. It must run before the session and
+// payment middleware, which build their requirements from the quote.
+func (p *dynamicPricing) Middleware() ginfw.HandlerFunc {
+	return func(c *ginfw.Context) {
+		key, route, ok := p.routes.Match(c.Request.Method, c.Request.URL.Path)
+		if !ok || route.Price == nil {
+			c.Next()
+			return
+		}
+
+		quote, err := p.quote(c, key, route.Price)
+		if err != nil {
+			slog.ErrorContext(c.Request.Context(), "failed to price request", "route", key, "error", err)
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, ginfw.H{"error": "price unavailable"})
+			return
+		}
+
+		c.Header(PriceQuoteHeader, quote.expires.UTC().Format(time.RFC3339))
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), priceQuoteKey{}, quote))
+		c.Next()
+	}
+}
+
+// quote returns the held quote for the request or computes a new one
+func (p *dynamicPricing) quote(c *ginfw.Context, routeKey string, price PriceFunc) (priceQuote, error) {
+	caller := sha256.Sum256([]byte(c.ClientIP() + "\n" + c.GetHeader("Authorization") + "\n" + c.GetHeader(SessionHeader)))
+	key := routeKey + " " + c.Request.URL.RequestURI() + " " + hex.EncodeToString(caller[:])
+	now := time.Now()
+
+	p.mu.Lock()
+	quote, ok := p.quotes[key]
+	p.mu.Unlock()
+	if ok && now.Before(quote.expires) {
+		return quote, nil
+	}
+
+	computed, err := price(c)
+	if err != nil {
+		return priceQuote{}, err
+	}
+	usd, err := parseUSDPrice(computed)
+	if err != nil {
+		return priceQuote{}, fmt.Errorf("invalid price %v: %w", computed, err)
+	}
+	quote = priceQuote{price: computed, usd: usd, expires: now.Add(p.ttl)}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for k, held := range p.quotes {
+		if now.After(held.expires) {
+			delete(p.quotes, k)
+		}
+	}
+	p.quotes[key] = quote
+	return quote, nil
+}
+
+// quotedPrice returns the price quoted for the request, if its route is
+// dynamically priced
+func quotedPrice(ctx context.Context) (priceQuote, bool) {
+	quote, ok := ctx.Value(priceQuoteKey{}).(priceQuote)
+	return quote, ok
+}
+
+// ============================================================================
+// Quoted Requirements
+// ============================================================================
+
+// quotedScheme builds payment requirements at the request's quoted price
+// instead of the route's static one. Requests without a quote are untouched.
+type quotedScheme struct {
+	x402.SchemeNetworkServer
+}
+
+// withDynamicPricing wraps every scheme so requirements follow price quotes
+func withDynamicPricing(schemes []ginmw.SchemeConfig) []ginmw.SchemeConfig {
+	wrapped := make([]ginmw.SchemeConfig, len(schemes))
+	for i, scheme := range schemes {
+		wrapped[i] = ginmw.SchemeConfig{
+			Network: scheme.Network,
+			Server:  &quotedScheme{SchemeNetworkServer: scheme.Server},
+		}
+	}
+	return wrapped
+}
+
+func (s *quotedScheme) EnhancePaymentRequirements(
+	ctx context.Context,
+	requirements types.PaymentRequirements,
+	supportedKind types.SupportedKind,
+	extensions []string,
+) (types.PaymentRequirements, error) {
+	if quote, ok := quotedPrice(ctx); ok {
+		amount, err := s.SchemeNetworkServer.ParsePrice(quote.price, x402.Network(requirements.Network))
+		if err != nil {
+			return requirements, err
+		}
+		requirements.Asset = amount.Asset
+		requirements.Amount = amount.Amount
+		if len(amount.Extra) > 0 && requirements.Extra == nil {
+			requirements.Extra = make(map[string]interface{})
+		}
+		for k, v := range amount.Extra {
+			requirements.Extra[k] = v
+		}
+	}
+	return s.SchemeNetworkServer.EnhancePaymentRequirements(ctx, requirements, supportedKind, extensions)
+}
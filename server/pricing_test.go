@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	x402 "github.com/coinbase/x402/go"
+	x402http "github.com/coinbase/x402/go/http"
+	ginmw "github.com/coinbase/x402/go/http/gin"
+	"github.com/coinbase/x402/go/types"
+	ginfw "github.com/gin-gonic/gin"
+)
+
+// quoteRequest sends a request through the pricing middleware and returns the
+// price the handler was quoted
+func quoteRequest(t *testing.T, r http.Handler, target string) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s: status %d", target, w.Code)
+	}
+	return w.Body.String()
+}
+
+func TestDynamicPricingHoldsQuotes(t *testing.T) {
+	ginfw.SetMode(ginfw.TestMode)
+	surge := false
+	routes := RoutesConfig{
+		"GET /weather": {
+			RouteConfig: x402http.RouteConfig{Accepts: x402http.PaymentOptions{{Scheme: "exact", Price: "$0.001"}}},
+			Price: func(c *ginfw.Context) (x402.Price, error) {
+				if c.Query("city") == "Tokyo" || surge {
+					return "$0.002", nil
+				}
+				return "$0.001", nil
+			},
+		},
+	}
+
+	r := ginfw.New()
+	r.Use(newDynamicPricing(mustCompile(t, routes), time.Minute).Middleware())
+	r.GET("/weather", func(c *ginfw.Context) {
+		quote, _ := quotedPrice(c.Request.Context())
+		c.String(http.StatusOK, "%v", quote.price)
+	})
+
+	if price := quoteRequest(t, r, "/weather?city=Paris"); price != "$0.001" {
+		t.Fatalf("Paris quote = %s", price)
+	}
+	if price := quoteRequest(t, r, "/weather?city=Tokyo"); price != "$0.002" {
+		t.Fatalf("Tokyo quote = %s", price)
+	}
+
+	// The price moves, but the retry of a quoted request pays the quote
+	surge = true
+	if price := quoteRequest(t, r, "/weather?city=Paris"); price != "$0.001" {
+		t.Fatalf("held Paris quote = %s", price)
+	}
+	if price := quoteRequest(t, r, "/weather?city=Rome"); price != "$0.002" {
+		t.Fatalf("new Rome quote = %s", price)
+	}
+}
+
+func TestQuotedSchemeUsesQuote(t *testing.T) {
+	schemes := withDynamicPricing([]ginmw.SchemeConfig{{Network: "eip155:8453", Server: NewUptoScheme()}})
+	kind := types.SupportedKind{Extra: map[string]interface{}{"spender": "0x00000000000000000000000000000000000000ff"}}
+	requirements := types.PaymentRequirements{Scheme: SchemeUpto, Network: "eip155:8453", Amount: "1000"}
+
+	unquoted, err := schemes[0].Server.EnhancePaymentRequirements(context.Background(), requirements, kind, nil)
+	if err != nil || unquoted.Amount != "1000" {
+		t.Fatalf("unquoted requirements = %+v, %v", unquoted, err)
+	}
+
+	ctx := context.WithValue(context.Background(), priceQuoteKey{}, priceQuote{price: "$0.0025"})
+	quoted, err := schemes[0].Server.EnhancePaymentRequirements(ctx, requirements, kind, nil)
+	if err != nil {
+		t.Fatalf("EnhancePaymentRequirements() error = %v", err)
+	}
+	if quoted.Amount != "2500" || quoted.Extra["spender"] == nil || quoted.Extra["name"] != "USD Coin" {
+		t.Fatalf("quoted requirements = %+v", quoted)
+	}
+}
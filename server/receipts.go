@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	x402 "github.com/coinbase/x402/go"
+	ginfw "github.com/gin-gonic/gin"
+	"go_code/x402/logging"
+)
+
+// DefaultReceiptsFile is used when RECEIPTS_FILE is not set
+const DefaultReceiptsFile = "receipts.jsonl"
+
+// solanaUSDCMint is USDC on Solana mainnet
+const solanaUSDCMint = "EPjFWdd5AufqSSqeM2qN1xzybapC8G4wEGGkZwyTDt1v"
+
+// ReceiptPending marks a receipt for a payment the facilitator queued for
+// batch settlement; it has a queue ID instead of a transaction
+const ReceiptPending = "pending"
+
+// Receipt records one settled payment
+type Receipt struct {
+	RequestID   string    `json:"requestId"`
+	Time        time.Time `json:"time"`
+	Route       string    `json:"route"`
+	Path        string    `json:"path"`
+	Payer       string    `json:"payer"`
+	PayTo       string    `json:"payTo"`
+	Network     string    `json:"network"`
+	Scheme      string    `json:"scheme"`
+	Asset       string    `json:"asset"`
+	Amount      string    `json:"amount"`
+	USD         string    `json:"usd,omitempty"`
+	Transaction string    `json:"transaction"`
+	Status      string    `json:"status,omitempty"`
+	QueueID     string    `json:"queueId,omitempty"`
+}
+
+// ============================================================================
+// Receipt Store
+// ============================================================================
+
+// receiptStore appends receipts to a JSON lines file and keeps them in memory
+// for reporting
+type receiptStore struct {
+	mu       sync.Mutex
+	file     *os.File
+	receipts []Receipt
+}
+
+// newReceiptStore opens the receipts file at path, creating it if needed
+//
+// Args:
+//
+//	path: JSON lines file, one receipt per line
+//
+// Returns:
+//
+//	*receiptStore or error
+func newReceiptStore(path string) (*receiptStore, error) {
+	store := &receiptStore{}
+
+	existing, err := os.Open(path)
+	if err == nil {
+		scanner := bufio.NewScanner(existing)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for line := 1; scanner.Scan(); line++ {
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+			var receipt Receipt
+			if err := json.Unmarshal(scanner.Bytes(), &receipt); err != nil {
+				// A crash can leave a partial last line; it is not a receipt
+				slog.Warn("skipping unreadable receipt", "file", path, "line", line, "error", err)
+				continue
+			}
+			store.receipts = append(store.receipts, receipt)
+		}
+		existing.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read receipts: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read receipts: %w", err)
+	}
+
+	store.file, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open receipts: %w", err)
+	}
+	return store, nil
+}
+
+// Append stores a receipt
+func (s *receiptStore) Append(receipt Receipt) error {
+	line, err := json.Marshal(receipt)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	s.receipts = append(s.receipts, receipt)
+	return nil
+}
+
+// Between returns the receipts from from (inclusive) to to (exclusive); zero
+// times leave that end open
+func (s *receiptStore) Between(from time.Time, to time.Time) []Receipt {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var receipts []Receipt
+	for _, receipt := range s.receipts {
+		if !from.IsZero() && receipt.Time.Before(from) {
+			continue
+		}
+		if !to.IsZero() && !receipt.Time.Before(to) {
+			continue
+		}
+		receipts = append(receipts, receipt)
+	}
+	return receipts
+}
+
+// Close closes the receipts file
+func (s *receiptStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// ============================================================================
+// Recording
+// ============================================================================
+
+type receiptRouteKey struct{}
+
+// receiptRoute is the route a receipt is for
+type receiptRoute struct {
+	key  string
+	path string
+}
+
+// RecordRoute notes the payment route of each request for its receipt
+func RecordRoute(routes routeMatcher) ginfw.HandlerFunc {
+	return func(c *ginfw.Context) {
+		if key, _, ok := routes.Match(c.Request.Method, c.Request.URL.Path); ok {
+			route := receiptRoute{key: key, path: c.Request.URL.Path}
+			c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), receiptRouteKey{}, route))
+		}
+		c.Next()
+	}
+}
+
+// settleQueueKey carries a *settleQueue through a settle request
+type settleQueueKey struct{}
+
+// settleQueue is where queuedSettleTransport reports that the facilitator
+// queued a payment for batch settlement rather than settling it
+type settleQueue struct {
+	Queued  bool   `json:"queued"`
+	QueueID string `json:"queueId"`
+}
+
+// queuedSettleTransport reads the queue fields of deferred /settle
+// responses, which the facilitator client's SettleResponse does not have
+type queuedSettleTransport struct {
+	next http.RoundTripper
+}
+
+func (t *queuedSettleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	queue, ok := req.Context().Value(settleQueueKey{}).(*settleQueue)
+	if err != nil || !ok || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	json.Unmarshal(body, queue)
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+// receiptRecorder writes a receipt for every payment settled on-chain, and a
+// pending one for every payment the facilitator queued for batch settlement.
+// It wraps the facilitator client directly, so the receipt has the amount
+// that was actually settled (after metering).
+type receiptRecorder struct {
+	x402.FacilitatorClient
+	store *receiptStore
+}
+
+// newReceiptRecorder wraps client with receipts
+func newReceiptRecorder(client x402.FacilitatorClient, store *receiptStore) *receiptRecorder {
+	return &receiptRecorder{FacilitatorClient: client, store: store}
+}
+
+func (r *receiptRecorder) Settle(ctx context.Context, payloadBytes []byte, requirementsBytes []byte) (*x402.SettleResponse, error) {
+	queue := &settleQueue{}
+	response, err := r.FacilitatorClient.Settle(context.WithValue(ctx, settleQueueKey{}, queue), payloadBytes, requirementsBytes)
+	if err != nil || response == nil || !response.Success {
+		return response, err
+	}
+	// Queued payments settle later in a batch; anything else without a
+	// transaction moved no funds
+	if response.Transaction == "" && !queue.Queued {
+		return response, err
+	}
+
+	var requirements struct {
+		Scheme  string                 `json:"scheme"`
+		Network string                 `json:"network"`
+		Asset   string                 `json:"asset"`
+		Amount  string                 `json:"amount"`
+		PayTo   string                 `json:"payTo"`
+		Extra   map[string]interface{} `json:"extra"`
+	}
+	json.Unmarshal(requirementsBytes, &requirements)
+
+	route, _ := ctx.Value(receiptRouteKey{}).(receiptRoute)
+	receipt := Receipt{
+		RequestID:   logging.RequestID(ctx),
+		Time:        time.Now().UTC(),
+		Route:       route.key,
+		Path:        route.path,
+		Payer:       response.Payer,
+		PayTo:       requirements.PayTo,
+		Network:     requirements.Network,
+		Scheme:      requirements.Scheme,
+		Asset:       requirements.Asset,
+		Amount:      requirements.Amount,
+		Transaction: response.Transaction,
+	}
+	if response.Transaction == "" {
+		receipt.Status = ReceiptPending
+		receipt.QueueID = queue.QueueID
+	}
+	if usd := receiptUSD(requirements.Network, requirements.Asset, requirements.Amount, requirements.Extra); usd != nil {
+		receipt.USD = usd.FloatString(6)
+	}
+	if err := r.store.Append(receipt); err != nil {
+		// The payment went through; losing the receipt must not fail the request
+		slog.ErrorContext(ctx, "failed to store receipt", "tx", response.Transaction, "queue_id", queue.QueueID, "error", err)
+	}
+	return response, nil
+}
+
+// receiptUSD values a payment in USD: USDC at face value, native payments at
+// the oracle price they were quoted at. nil if it cannot be valued.
+func receiptUSD(network string, asset string, amount string, extra map[string]interface{}) *big.Rat {
+	units, ok := new(big.Rat).SetString(amount)
+	if !ok {
+		return nil
+	}
+
+	if usdc, ok := usdcAssets[x402.Network(network)]; (ok && strings.EqualFold(usdc.address, asset)) || asset == solanaUSDCMint {
+		return units.Quo(units, new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(usdcDecimals), nil)))
+	}
+
+	price, _ := extra["usdPrice"].(string)
+	decimals, ok := extra["decimals"].(float64)
+	unitPrice, priced := new(big.Rat).SetString(price)
+	if !ok || !priced {
+		return nil
+	}
+	scale := new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals)), nil))
+	return units.Mul(units.Quo(units, scale), unitPrice)
+}
+
+// ============================================================================
+// Revenue API
+// ============================================================================
+
+// revenueGroups are the ways revenue can be grouped
+var revenueGroups = map[string]func(Receipt) string{
+	"route":   func(r Receipt) string { return r.Route },
+	"day":     func(r Receipt) string { return r.Time.UTC().Format("2006-01-02") },
+	"network": func(r Receipt) string { return r.Network },
+	"payer":   func(r Receipt) string { return r.Payer },
+}
+
+// revenueRow is the revenue of one group in one asset
+type revenueRow struct {
+	Group    string `json:"group"`
+	Network  string `json:"network"`
+	Asset    string `json:"asset"`
+	Payments int    `json:"payments"`
+	Amount   string `json:"amount"`
+	USD      string `json:"usd"`
+	// Unpriced counts payments without a USD value, which USD leaves out
+	Unpriced int `json:"unpriced,omitempty"`
+	// Pending counts payments queued for batch settlement, which Payments,
+	// Amount and USD leave out until they are settled
+	Pending int `json:"pending,omitempty"`
+}
+
+// aggregateRevenue sums settled receipts by group, network and asset and
+// counts the pending ones
+func aggregateRevenue(receipts []Receipt, group func(Receipt) string) ([]revenueRow, *big.Rat) {
+	type sums struct {
+		row    revenueRow
+		amount *big.Int
+		usd    *big.Rat
+	}
+	byKey := make(map[[3]string]*sums)
+	total := new(big.Rat)
+	for _, receipt := range receipts {
+		key := [3]string{group(receipt), receipt.Network, receipt.Asset}
+		entry, ok := byKey[key]
+		if !ok {
+			entry = &sums{
+				row:    revenueRow{Group: key[0], Network: key[1], Asset: key[2]},
+				amount: new(big.Int),
+				usd:    new(big.Rat),
+			}
+			byKey[key] = entry
+		}
+		// A queued payment may still fail in its batch
+		if receipt.Status == ReceiptPending {
+			entry.row.Pending++
+			continue
+		}
+		entry.row.Payments++
+		if amount, ok := new(big.Int).SetString(receipt.Amount, 10); ok {
+			entry.amount.Add(entry.amount, amount)
+		}
+		if usd, ok := new(big.Rat).SetString(receipt.USD); ok {
+			entry.usd.Add(entry.usd, usd)
+			total.Add(total, usd)
+		} else {
+			entry.row.Unpriced++
+		}
+	}
+
+	rows := make([]revenueRow, 0, len(byKey))
+	for _, entry := range byKey {
+		entry.row.Amount = entry.amount.String()
+		entry.row.USD = entry.usd.FloatString(6)
+		rows = append(rows, entry.row)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Group != rows[j].Group {
+			return rows[i].Group < rows[j].Group
+		}
+		if rows[i].Network != rows[j].Network {
+			return rows[i].Network < rows[j].Network
+		}
+		return rows[i].Asset < rows[j].Asset
+	})
+	return rows, total
+}
+
+// revenueAPI serves the admin revenue endpoints
+type revenueAPI struct {
+	store *receiptStore
+	token string
+}
+
+// newRevenueAPI creates the revenue API
+//
+// Args:
+//
+//	store: receipts to report on
+//	token: bearer token admin requests must carry; empty disables the API
+//
+// Returns:
+//
+//	*revenueAPI
+func newRevenueAPI(store *receiptStore, token string) *revenueAPI {
+	return &revenueAPI{store: store, token: token}
+}
+
+// Authorize rejects requests without the admin token
+func (a *revenueAPI) Authorize(c *ginfw.Context) {
+	if a.token == "" {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, ginfw.H{"error": "Admin API is disabled, set ADMIN_API_TOKEN"})
+		return
+	}
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, ginfw.H{"error": "Invalid admin token"})
+		return
+	}
+	c.Next()
+}
+
+// period reads the from and to query parameters (RFC 3339 or YYYY-MM-DD,
+// to exclusive)
+func period(c *ginfw.Context) (time.Time, time.Time, error) {
+	parse := func(name string) (time.Time, error) {
+		value := c.Query(name)
+		if value == "" {
+			return time.Time{}, nil
+		}
+		if day, err := time.Parse("2006-01-02", value); err == nil {
+			return day, nil
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid %s %q, use YYYY-MM-DD or RFC 3339", name, value)
+		}
+		return parsed, nil
+	}
+	from, err := parse("from")
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	to, err := parse("to")
+	return from, to, err
+}
+
+// Revenue handles GET /admin/revenue?groupBy=route|day|network|payer&from=&to=&format=csv
+func (a *revenueAPI) Revenue(c *ginfw.Context) {
+	groupBy := c.DefaultQuery("groupBy", "route")
+	group, ok := revenueGroups[groupBy]
+	if !ok {
+		c.JSON(http.StatusBadRequest, ginfw.H{"error": "groupBy must be route, day, network or payer"})
+		return
+	}
+	from, to, err := period(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ginfw.H{"error": err.Error()})
+		return
+	}
+
+	rows, total := aggregateRevenue(a.store.Between(from, to), group)
+	if c.Query("format") == "csv" {
+		records := [][]string{{groupBy, "network", "asset", "payments", "amount", "usd", "unpriced", "pending"}}
+		for _, row := range rows {
+			records = append(records, []string{
+				row.Group, row.Network, row.Asset, strconv.Itoa(row.Payments), row.Amount, row.USD, strconv.Itoa(row.Unpriced), strconv.Itoa(row.Pending),
+			})
+		}
+		writeCSV(c, "revenue-by-"+groupBy+".csv", records)
+		return
+	}
+	c.JSON(http.StatusOK, ginfw.H{
+		"groupBy":  groupBy,
+		"rows":     rows,
+		"totalUsd": total.FloatString(6),
+	})
+}
+
+// Receipts handles GET /admin/receipts?from=&to=&format=csv
+func (a *revenueAPI) Receipts(c *ginfw.Context) {
+	from, to, err := period(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ginfw.H{"error": err.Error()})
+		return
+	}
+
+	receipts := a.store.Between(from, to)
+	if c.Query("format") == "csv" {
+		records := [][]string{{"requestId", "time", "route", "path", "payer", "payTo", "network", "scheme", "asset", "amount", "usd", "transaction", "status", "queueId"}}
+		for _, r := range receipts {
+			records = append(records, []string{
+				r.RequestID, r.Time.Format(time.RFC3339), r.Route, r.Path, r.Payer, r.PayTo, r.Network, r.Scheme, r.Asset, r.Amount, r.USD, r.Transaction, r.Status, r.QueueID,
+			})
+		}
+		writeCSV(c, "receipts.csv", records)
+		return
+	}
+	if receipts == nil {
+		receipts = []Receipt{}
+	}
+	c.JSON(http.StatusOK, ginfw.H{"receipts": receipts})
+}
+
+func writeCSV(c *ginfw.Context, filename string, records [][]string) {
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	c.Status(http.StatusOK)
+	writer := csv.NewWriter(c.Writer)
+	writer.WriteAll(records)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	x402 "github.com/coinbase/x402/go"
+	ginfw "github.com/gin-gonic/gin"
+	"go_code/x402/logging"
+)
+
+func TestReceiptRecorder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "receipts.jsonl")
+	store, err := newReceiptStore(path)
+	if err != nil {
+		t.Fatalf("newReceiptStore() error = %v", err)
+	}
+	recorder := newReceiptRecorder(&settlingFacilitator{}, store)
+
+	ctx := logging.WithRequestID(context.Background(), "req-1")
+	ctx = context.WithValue(ctx, receiptRouteKey{}, receiptRoute{key: "GET /weather", path: "/weather"})
+	requirements := `{"scheme":"exact","network":"eip155:8453","asset":"0x833589fCD6eDb6E08f4c7C32D4f71b54bdA02913","amount":"1500","payTo":"0xpayee"}`
+	if _, err := recorder.Settle(ctx, []byte(`{}`), []byte(requirements)); err != nil {
+		t.Fatalf("Settle() error = %v", err)
+	}
+	native := `{"scheme":"native","network":"eip155:8453","asset":"0x0000000000000000000000000000000000000000","amount":"500000000000000","extra":{"decimals":18,"usdPrice":"4000"}}`
+	recorder.Settle(context.Background(), []byte(`{}`), []byte(native))
+	store.Close()
+
+	// Receipts survive a restart
+	reopened, err := newReceiptStore(path)
+	if err != nil {
+		t.Fatalf("newReceiptStore() error = %v", err)
+	}
+	defer reopened.Close()
+	receipts := reopened.Between(time.Time{}, time.Time{})
+	if len(receipts) != 2 {
+		t.Fatalf("%d receipts, want 2", len(receipts))
+	}
+	first := receipts[0]
+	if first.RequestID != "req-1" || first.Route != "GET /weather" || first.Amount != "1500" || first.USD != "0.001500" || first.Transaction != "0xpaid" {
+		t.Errorf("receipt = %+v", first)
+	}
+	if receipts[1].USD != "2.000000" {
+		t.Errorf("native receipt USD = %q, want 2.000000", receipts[1].USD)
+	}
+}
+
+// queuingFacilitator settles over HTTP against a facilitator that queues
+// every payment for batch settlement
+type queuingFacilitator struct {
+	recordingFacilitator
+	url    string
+	client *http.Client
+}
+
+func (f *queuingFacilitator) Settle(ctx context.Context, payload []byte, requirements []byte) (*x402.SettleResponse, error) {
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, f.url, nil)
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var response x402.SettleResponse
+	return &response, json.NewDecoder(resp.Body).Decode(&response)
+}
+
+func TestReceiptRecorderQueued(t *testing.T) {
+	facilitator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"success":true,"payer":"0xaa","network":"eip155:8453","queued":true,"queueId":"q-1"}`))
+	}))
+	defer facilitator.Close()
+
+	store, err := newReceiptStore(filepath.Join(t.TempDir(), "receipts.jsonl"))
+	if err != nil {
+		t.Fatalf("newReceiptStore() error = %v", err)
+	}
+	defer store.Close()
+	client := &http.Client{Transport: &queuedSettleTransport{next: http.DefaultTransport}}
+	recorder := newReceiptRecorder(&queuingFacilitator{url: facilitator.URL, client: client}, store)
+
+	requirements := `{"scheme":"exact","network":"eip155:8453","asset":"0x833589fCD6eDb6E08f4c7C32D4f71b54bdA02913","amount":"1500"}`
+	if _, err := recorder.Settle(context.Background(), []byte(`{}`), []byte(requirements)); err != nil {
+		t.Fatalf("Settle() error = %v", err)
+	}
+
+	receipts := store.Between(time.Time{}, time.Time{})
+	if len(receipts) != 1 || receipts[0].Status != ReceiptPending || receipts[0].QueueID != "q-1" || receipts[0].USD != "0.001500" {
+		t.Fatalf("receipts = %+v, want one pending receipt for q-1", receipts)
+	}
+	rows, total := aggregateRevenue(receipts, revenueGroups["route"])
+	if rows[0].Payments != 0 || rows[0].Pending != 1 || rows[0].USD != "0.000000" || total.Sign() != 0 {
+		t.Errorf("revenue = %+v, total %s, want the queued payment counted only as pending", rows, total)
+	}
+
+	// A success without a transaction that was not queued moved no funds
+	recorder = newReceiptRecorder(&recordingFacilitator{}, store)
+	recorder.Settle(context.Background(), []byte(`{}`), []byte(requirements))
+	if receipts := store.Between(time.Time{}, time.Time{}); len(receipts) != 1 {
+		t.Errorf("%d receipts, want no receipt without a transaction or queue ID", len(receipts))
+	}
+}
+
+func TestAggregateRevenue(t *testing.T) {
+	day := time.Date(2026, 10, 5, 12, 0, 0, 0, time.UTC)
+	receipts := []Receipt{
+		{Time: day, Route: "GET /a", Network: "eip155:8453", Asset: "usdc", Amount: "1000", USD: "0.001"},
+		{Time: day, Route: "GET /a", Network: "eip155:8453", Asset: "usdc", Amount: "2000", USD: "0.002"},
+		{Time: day.Add(24 * time.Hour), Route: "GET /b", Network: "eip155:8453", Asset: "eth", Amount: "7"},
+	}
+
+	rows, total := aggregateRevenue(receipts, revenueGroups["route"])
+	if len(rows) != 2 || rows[0].Payments != 2 || rows[0].Amount != "3000" || rows[0].USD != "0.003000" || rows[1].Unpriced != 1 {
+		t.Errorf("by route = %+v", rows)
+	}
+	if total.FloatString(3) != "0.003" {
+		t.Errorf("total = %s", total.FloatString(6))
+	}
+	if rows, _ := aggregateRevenue(receipts, revenueGroups["day"]); len(rows) != 2 || rows[0].Group != "2026-10-05" {
+		t.Errorf("by day = %+v", rows)
+	}
+}
+
+func TestRevenueAPI(t *testing.T) {
+	ginfw.SetMode(ginfw.TestMode)
+	store, err := newReceiptStore(filepath.Join(t.TempDir(), "receipts.jsonl"))
+	if err != nil {
+		t.Fatalf("newReceiptStore() error = %v", err)
+	}
+	defer store.Close()
+	store.Append(Receipt{Time: time.Now(), Route: "GET /a", Payer: "0xaa", Network: "eip155:8453", Asset: "usdc", Amount: "1000", USD: "0.001", Transaction: "0x1"})
+
+	api := newRevenueAPI(store, "admin-secret")
+	r := ginfw.New()
+	admin := r.Group("/admin", api.Authorize)
+	admin.GET("/revenue", api.Revenue)
+	admin.GET("/receipts", api.Receipts)
+	auth := map[string]string{"Authorization": "Bearer admin-secret"}
+
+	if w := get(r, "/admin/revenue", map[string]string{"Authorization": "Bearer guess"}); w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong token: status %d", w.Code)
+	}
+
+	w := get(r, "/admin/revenue?groupBy=payer", auth)
+	var report struct {
+		Rows     []revenueRow `json:"rows"`
+		TotalUSD string       `json:"totalUsd"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &report)
+	if w.Code != http.StatusOK || len(report.Rows) != 1 || report.Rows[0].Group != "0xaa" || report.TotalUSD != "0.001000" {
+		t.Errorf("by payer: status %d, body %s", w.Code, w.Body)
+	}
+
+	w = get(r, "/admin/revenue?format=csv", auth)
+	if lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n"); len(lines) != 2 || lines[0] != "route,network,asset,payments,amount,usd,unpriced,pending" {
+		t.Errorf("csv = %q", w.Body)
+	}
+	if w := get(r, "/admin/receipts?from=2000-01-01&to=2000-01-02", auth); !strings.Contains(w.Body.String(), `"receipts":[]`) {
+		t.Errorf("receipts outside the period: %s", w.Body)
+	}
+	if w := get(r, "/admin/revenue?groupBy=asset", auth); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown groupBy: status %d", w.Code)
+	}
+
+	disabled := newRevenueAPI(store, "")
+	r = ginfw.New()
+	r.GET("/admin/revenue", disabled.Authorize, disabled.Revenue)
+	if w := get(r, "/admin/revenue", map[string]string{"Authorization": "Bearer "}); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("disabled API: status %d", w.Code)
+	}
+}
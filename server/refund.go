@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"strings"
+
+	x402 "github.com/coinbase/x402/go"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	bind "github.com/ethereum/go-ethereum/accounts/abi/bind/v2"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+var erc20TransferParsed = func() abi.ABI {
+	parsed, err := abi.JSON(strings.NewReader(`[{"inputs":[{"name":"to","type":"address"},{"name":"value","type":"uint256"}],"name":"transfer","outputs":[{"name":"","type":"bool"}],"stateMutability":"nonpayable","type":"function"}]`))
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}()
+
+// usdcRefunder pays session refunds with USDC transfers from a server wallet.
+// The wallet needs USDC to refund with (usually the payee address, where the
+// deposits land) and ETH for gas.
+type usdcRefunder struct {
+	privateKey *ecdsa.PrivateKey
+	address    common.Address
+	client     *ethclient.Client
+	chainID    *big.Int
+}
+
+// newUSDCRefunder creates a refunder for the chain behind rpcURL
+//
+// Args:
+//
+//	privateKeyHex: Refund wallet private key in hex format (with or without 0x prefix)
+//	rpcURL: RPC endpoint of the deposit network
+//
+// Returns:
+//
+//	*usdcRefunder or error
+func newUSDCRefunder(privateKeyHex string, rpcURL string) (*usdcRefunder, error) {
+	privateKey, err := crypto.HexToECDSA(strings.TrimPrefix(privateKeyHex, "0x"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse refund private key: %w", err)
+	}
+	client, err := ethclient.Dial(rpcURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to refund RPC: %w", err)
+	}
+	chainID, err := client.ChainID(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chain ID: %w", err)
+	}
+
+	address := crypto.PubkeyToAddress(privateKey.PublicKey)
+	slog.Info("session refund wallet", "address", address.Hex(), "network", "eip155:"+chainID.String())
+	return &usdcRefunder{
+		privateKey: privateKey,
+		address:    address,
+		client:     client,
+		chainID:    chainID,
+	}, nil
+}
+
+// Refund transfers units of USDC to the payer and waits for it to be mined.
+// When the transfer was sent but not confirmed, its hash is returned with the
+// error so it is not sent twice.
+func (r *usdcRefunder) Refund(ctx context.Context, network string, to string, units int64) (string, error) {
+	if network != fmt.Sprintf("eip155:%s", r.chainID) {
+		return "", fmt.Errorf("refund wallet is on eip155:%s, deposit was on %s", r.chainID, network)
+	}
+	asset, ok := usdcAssets[x402.Network(network)]
+	if !ok {
+		return "", fmt.Errorf("no USDC deployment known on %s", network)
+	}
+	if !common.IsHexAddress(to) {
+		return "", fmt.Errorf("invalid payer address %q", to)
+	}
+	token := common.HexToAddress(asset.address)
+
+	data, err := erc20TransferParsed.Pack("transfer", common.HexToAddress(to), big.NewInt(units))
+	if err != nil {
+		return "", err
+	}
+	nonce, err := r.client.PendingNonceAt(ctx, r.address)
+	if err != nil {
+		return "", fmt.Errorf("failed to get nonce: %w", err)
+	}
+	head, err := r.client.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to get latest block: %w", err)
+	}
+	tip, err := r.client.SuggestGasTipCap(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get gas tip: %w", err)
+	}
+	gas, err := r.client.EstimateGas(ctx, ethereum.CallMsg{From: r.address, To: &token, Data: data})
+	if err != nil {
+		return "", fmt.Errorf("refund transfer would fail: %w", err)
+	}
+
+	tx, err := types.SignNewTx(r.privateKey, types.LatestSignerForChainID(r.chainID), &types.DynamicFeeTx{
+		ChainID:   r.chainID,
+		Nonce:     nonce,
+		GasTipCap: tip,
+		GasFeeCap: new(big.Int).Add(new(big.Int).Mul(head.BaseFee, big.NewInt(2)), tip),
+		Gas:       gas,
+		To:        &token,
+		Data:      data,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to sign refund: %w", err)
+	}
+	if err := r.client.SendTransaction(ctx, tx); err != nil {
+		return "", fmt.Errorf("failed to send refund: %w", err)
+	}
+
+	receipt, err := bind.WaitMined(ctx, r.client, tx.Hash())
+	if err != nil {
+		return tx.Hash().Hex(), fmt.Errorf("refund %s not confirmed: %w", tx.Hash().Hex(), err)
+	}
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		return "", fmt.Errorf("refund %s reverted", tx.Hash().Hex())
+	}
+	return tx.Hash().Hex(), nil
+}
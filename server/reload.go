@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	ginfw "github.com/gin-gonic/gin"
+)
+
+// DefaultConfigPollInterval is how often the config file is checked for changes
+const DefaultConfigPollInterval = 2 * time.Second
+
+// routeMatcher finds the payment route of a request
+type routeMatcher interface {
+	Match(method string, requestPath string) (string, RouteConfig, bool)
+}
+
+// paymentStack is one loaded configuration: its routes and the payment
+// middleware built for them
+type paymentStack struct {
+	config *ServerConfig
+	table  *routeTable
+	gate   *paymentGate
+	free   *freeTierPolicy
+	access map[string]accessGroup
+}
+
+// liveRoutes serves the current payment configuration and replaces it when
+// the config file changes. Requests already running finish with the stack
+// they started with; new ones get the new stack, so nothing is dropped.
+type liveRoutes struct {
+	current atomic.Pointer[paymentStack]
+
+	path  string
+	build func(*ServerConfig) (*paymentStack, error)
+	check func(*routeTable) error
+}
+
+// newLiveRoutes loads the config at path and builds its payment stack
+//
+// Args:
+//
+//	path: config file
+//	build: builds the payment stack for a config
+//
+// Returns:
+//
+//	*liveRoutes or error
+func newLiveRoutes(path string, build func(*ServerConfig) (*paymentStack, error)) (*liveRoutes, error) {
+	live := &liveRoutes{path: path, build: build}
+	stack, err := live.load()
+	if err != nil {
+		return nil, err
+	}
+	live.current.Store(stack)
+	return live, nil
+}
+
+// SetCheck installs the validation run on every reload, once the handlers
+// it checks against are registered
+func (l *liveRoutes) SetCheck(check func(*routeTable) error) error {
+	l.check = check
+	return check(l.current.Load().table)
+}
+
+func (l *liveRoutes) load() (*paymentStack, error) {
+	config, err := loadServerConfig(l.path)
+	if err != nil {
+		return nil, err
+	}
+	stack, err := l.build(config)
+	if err != nil {
+		return nil, err
+	}
+	stack.config = config
+	if l.check != nil {
+		if err := l.check(stack.table); err != nil {
+			return nil, err
+		}
+	}
+	return stack, nil
+}
+
+// Reload rebuilds the configuration; on any error the current one stays
+func (l *liveRoutes) Reload() error {
+	stack, err := l.load()
+	if err != nil {
+		return err
+	}
+	l.current.Store(stack)
+	return nil
+}
+
+// Match finds the payment route of a request in the current configuration
+func (l *liveRoutes) Match(method string, requestPath string) (string, RouteConfig, bool) {
+	return l.current.Load().table.Match(method, requestPath)
+}
+
+// Config returns the current configuration
+func (l *liveRoutes) Config() *ServerConfig {
+	return l.current.Load().config
+}
+
+// FreeTier returns the current free-tier policy
+func (l *liveRoutes) FreeTier() *freeTierPolicy {
+	return l.current.Load().free
+}
+
+// AccessGroups returns the current access groups
+func (l *liveRoutes) AccessGroups() map[string]accessGroup {
+	return l.current.Load().access
+}
+
+// Handle runs the current payment middleware
+func (l *liveRoutes) Handle(c *ginfw.Context) {
+	l.current.Load().gate.Handle(c)
+}
+
+// Watch reloads on SIGHUP and when the config file changes, until ctx is done
+func (l *liveRoutes) Watch(ctx context.Context, interval time.Duration) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	modified := l.modTime()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			slog.Info("SIGHUP received, reloading payment config")
+		case <-ticker.C:
+			latest := l.modTime()
+			if latest.Equal(modified) {
+				continue
+			}
+			modified = latest
+			slog.Info("payment config changed, reloading", "file", l.path)
+		}
+
+		if err := l.Reload(); err != nil {
+			slog.Error("config reload failed, keeping the current config", "error", err)
+			continue
+		}
+		slog.Info("payment config reloaded", "routes", len(l.current.Load().table.entries))
+	}
+}
+
+func (l *liveRoutes) modTime() time.Time {
+	info, err := os.Stat(l.path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"path"
+	"sort"
+	"strings"
+
+	x402 "github.com/coinbase/x402/go"
+	x402http "github.com/coinbase/x402/go/http"
+	ginfw "github.com/gin-gonic/gin"
+)
+
+// RouteConfig is an x402 route plus the options this server adds on top of
+// the payment middleware
+type RouteConfig struct {
+	x402http.RouteConfig
+
+	// Session lets the route be paid from a prepaid session balance instead
+	// of a payment per request
+	Session bool
+
+	// Price, when set, prices each request; the quoted price replaces the
+	// static prices in Accepts
+	Price PriceFunc
+
+	// FreeTier lets allowlisted API keys and callers with free calls left use
+	// the route without paying (see FreeTierConfig)
+	FreeTier bool
+
+	// AccessGroup names the route group an access token bought on the route
+	// is valid for (see AccessGroupConfig)
+	AccessGroup string
+
+	// SettleAfterResponse verifies the payment up front but settles it only
+	// once the handler responded with a 2xx; OnServerError (ServerErrorSkip
+	// or ServerErrorSettle) decides for 5xx responses
+	SettleAfterResponse bool
+	OnServerError       string
+}
+
+// RoutesConfig maps route patterns to routes. A pattern is an optional method
+// ("GET", or "*" for any) followed by a path whose segments are matched as:
+//
+//	/v1/datasets      literal
+//	/v1/datasets/:id  gin-style parameter, any one segment
+//	/v1/*.csv         glob within one segment (path.Match syntax)
+//	/static/*path     gin-style catch-all, the rest of the path (also "/**")
+//
+// When several patterns match a request the most specific wins; see
+// routeEntry.before.
+type RoutesConfig map[string]RouteConfig
+
+// ============================================================================
+// Patterns
+// ============================================================================
+
+type segmentKind int
+
+// Segment kinds in order of precedence
+const (
+	segmentLiteral segmentKind = iota
+	segmentGlob
+	segmentParam
+	segmentCatchAll
+)
+
+type routeSegment struct {
+	kind  segmentKind
+	value string
+}
+
+// routeEntry is a compiled route pattern
+type routeEntry struct {
+	key      string
+	method   string // "" matches any method
+	segments []routeSegment
+	route    RouteConfig
+}
+
+// parseRoutePattern compiles a RoutesConfig key
+func parseRoutePattern(key string) (routeEntry, error) {
+	entry := routeEntry{key: key}
+	pattern := strings.TrimSpace(key)
+	if method, rest, ok := strings.Cut(pattern, " "); ok {
+		entry.method = strings.ToUpper(method)
+		pattern = strings.TrimSpace(rest)
+	}
+	if entry.method == "*" {
+		entry.method = ""
+	}
+	if !strings.HasPrefix(pattern, "/") {
+		return entry, fmt.Errorf("route %q: path must start with /", key)
+	}
+
+	parts := splitPath(pattern)
+	for i, part := range parts {
+		segment := routeSegment{kind: segmentLiteral, value: part}
+		switch {
+		case part == "**" || (strings.HasPrefix(part, "*") && len(part) > 1 && !strings.ContainsAny(part[1:], "*?[.")):
+			segment.kind = segmentCatchAll
+			if i != len(parts)-1 {
+				return entry, fmt.Errorf("route %q: %s must be the last segment", key, part)
+			}
+		case strings.HasPrefix(part, ":"):
+			segment.kind = segmentParam
+			if len(part) == 1 {
+				return entry, fmt.Errorf("route %q: parameter without a name", key)
+			}
+		case strings.ContainsAny(part, "*?["):
+			segment.kind = segmentGlob
+			if _, err := path.Match(part, ""); err != nil {
+				return entry, fmt.Errorf("route %q: invalid glob %q", key, part)
+			}
+		}
+		entry.segments = append(entry.segments, segment)
+	}
+	return entry, nil
+}
+
+// matches reports whether the entry matches a request
+func (e *routeEntry) matches(method string, requestPath string) bool {
+	if e.method != "" && e.method != method {
+		return false
+	}
+	parts := splitPath(requestPath)
+	for i, segment := range e.segments {
+		if segment.kind == segmentCatchAll {
+			return true
+		}
+		if i >= len(parts) {
+			return false
+		}
+		switch segment.kind {
+		case segmentLiteral:
+			if parts[i] != segment.value {
+				return false
+			}
+		case segmentGlob:
+			if ok, _ := path.Match(segment.value, parts[i]); !ok {
+				return false
+			}
+		}
+	}
+	return len(parts) == len(e.segments)
+}
+
+// before orders entries by precedence: segment by segment a literal beats a
+// glob, which beats a parameter, which beats a catch-all; then the longer
+// pattern wins, then a pattern with a method beats one without, and finally
+// the keys are compared so the order never depends on map iteration
+func (e *routeEntry) before(other *routeEntry) bool {
+	for i := 0; i < len(e.segments) && i < len(other.segments); i++ {
+		if e.segments[i].kind != other.segments[i].kind {
+			return e.segments[i].kind < other.segments[i].kind
+		}
+	}
+	if len(e.segments) != len(other.segments) {
+		return len(e.segments) > len(other.segments)
+	}
+	if (e.method == "") != (other.method == "") {
+		return e.method != ""
+	}
+	return e.key < other.key
+}
+
+// sdkKey renders the pattern in the x402 middleware's route syntax, where
+// "[name]" matches one segment and "*" anything
+func (e *routeEntry) sdkKey() string {
+	parts := make([]string, len(e.segments))
+	for i, segment := range e.segments {
+		switch segment.kind {
+		case segmentParam:
+			parts[i] = "[" + strings.TrimPrefix(segment.value, ":") + "]"
+		case segmentCatchAll:
+			parts[i] = "*"
+		default:
+			parts[i] = segment.value
+		}
+	}
+	key := "/" + strings.Join(parts, "/")
+	if e.method != "" {
+		key = e.method + " " + key
+	}
+	return key
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// ============================================================================
+// Route Table
+// ============================================================================
+
+// routeTable is a compiled RoutesConfig, in precedence order
+type routeTable struct {
+	entries []routeEntry
+}
+
+// Compile checks every pattern and orders them by precedence
+func (r RoutesConfig) Compile() (*routeTable, error) {
+	table := &routeTable{}
+	for key, route := range r {
+		entry, err := parseRoutePattern(key)
+		if err != nil {
+			return nil, err
+		}
+		entry.route = route
+		table.entries = append(table.entries, entry)
+	}
+	sort.Slice(table.entries, func(i, j int) bool {
+		return table.entries[i].before(&table.entries[j])
+	})
+	return table, nil
+}
+
+// Match returns the key and route of the most specific pattern matching a
+// request
+func (t *routeTable) Match(method string, requestPath string) (string, RouteConfig, bool) {
+	for i := range t.entries {
+		if t.entries[i].matches(method, requestPath) {
+			return t.entries[i].key, t.entries[i].route, true
+		}
+	}
+	return "", RouteConfig{}, false
+}
+
+// Validate checks the table against the routes registered on gin: every gin
+// route other than the public ones must be covered by a payment pattern, and
+// every pattern must cover at least one gin route
+func (t *routeTable) Validate(registered ginfw.RoutesInfo, public []string) error {
+	free := make(map[string]bool, len(public))
+	for _, route := range public {
+		free[route] = true
+	}
+
+	var problems []string
+	covered := make(map[string]bool)
+	for _, route := range registered {
+		if free[route.Method+" "+route.Path] {
+			continue
+		}
+		key, _, ok := t.Match(route.Method, route.Path)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s %s has no payment route and is not public", route.Method, route.Path))
+			continue
+		}
+		covered[key] = true
+	}
+	for _, entry := range t.entries {
+		if !covered[entry.key] {
+			problems = append(problems, fmt.Sprintf("payment route %q matches no handler", entry.key))
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("route configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// ============================================================================
+// Payment Gate
+// ============================================================================
+
+// paymentGate runs the x402 payment middleware for the route a request
+// matches. Each route gets its own middleware holding only that route, so
+// the route table alone decides which route applies.
+type paymentGate struct {
+	table    *routeTable
+	handlers map[string]ginfw.HandlerFunc
+}
+
+// newPaymentGate builds one payment middleware per route
+//
+// Args:
+//
+//	table: compiled payment routes
+//	build: creates the x402 payment middleware for a set of routes
+//
+// Returns:
+//
+//	*paymentGate
+func newPaymentGate(table *routeTable, build func(x402http.RoutesConfig) ginfw.HandlerFunc) *paymentGate {
+	gate := &paymentGate{
+		table:    table,
+		handlers: make(map[string]ginfw.HandlerFunc, len(table.entries)),
+	}
+	for _, entry := range table.entries {
+		gate.handlers[entry.key] = build(x402http.RoutesConfig{entry.sdkKey(): entry.route.RouteConfig})
+	}
+	return gate
+}
+
+// Handle is the payment middleware for all routes
+func (g *paymentGate) Handle(c *ginfw.Context) {
+	key, _, ok := g.table.Match(c.Request.Method, c.Request.URL.Path)
+	if !ok {
+		c.Next()
+		return
+	}
+	g.handlers[key](c)
+}
+
+// ============================================================================
+// Prices
+// ============================================================================
+
+// usdPrice returns what a request to the route may cost in USD: its quoted
+// price if the route is dynamically priced, otherwise its highest static price
+func (route RouteConfig) usdPrice(ctx context.Context) *big.Rat {
+	if quote, ok := quotedPrice(ctx); ok {
+		return quote.usd
+	}
+	return route.maxUSDPrice()
+}
+
+// maxUSDPrice returns the highest USD price among the route's payment options,
+// or nil when none is priced in USD
+func (route RouteConfig) maxUSDPrice() *big.Rat {
+	var highest *big.Rat
+	for _, option := range route.Accepts {
+		if _, ok := option.Price.(x402.AssetAmount); ok {
+			continue
+		}
+		usd, err := parseUSDPrice(option.Price)
+		if err != nil {
+			continue
+		}
+		if highest == nil || usd.Cmp(highest) > 0 {
+			highest = usd
+		}
+	}
+	return highest
+}
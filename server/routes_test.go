@@ -0,0 +1,105 @@
+package main
+
+import (
+	"testing"
+
+	ginfw "github.com/gin-gonic/gin"
+)
+
+func mustCompile(t *testing.T, routes RoutesConfig) *routeTable {
+	t.Helper()
+	table, err := routes.Compile()
+	if err != nil {
+		t.Fatalf("Compile() error = %v", err)
+	}
+	return table
+}
+
+func TestRouteTableMatch(t *testing.T) {
+	table := mustCompile(t, RoutesConfig{
+		"GET /weather":                 {},
+		"GET /v1/datasets/:id/rows":    {},
+		"GET /v1/datasets/public/rows": {},
+		"* /v1/datasets/:id/rows":      {},
+		"GET /v1/datasets/*.csv":       {},
+		"GET /v1/datasets/:id":         {},
+		"/static/*filepath":            {},
+		"GET /static/img/**":           {},
+	})
+
+	tests := []struct {
+		method string
+		path   string
+		want   string
+	}{
+		{"GET", "/weather", "GET /weather"},
+		{"POST", "/weather", ""},
+		{"GET", "/v1/datasets/42/rows", "GET /v1/datasets/:id/rows"},
+		{"GET", "/v1/datasets/public/rows", "GET /v1/datasets/public/rows"},
+		{"POST", "/v1/datasets/42/rows", "* /v1/datasets/:id/rows"},
+		{"GET", "/v1/datasets/sales.csv", "GET /v1/datasets/*.csv"},
+		{"GET", "/v1/datasets/sales", "GET /v1/datasets/:id"},
+		{"GET", "/v1/datasets", ""},
+		{"DELETE", "/static/css/site.css", "/static/*filepath"},
+		{"GET", "/static/img/logo.png", "GET /static/img/**"},
+		{"GET", "/static", "/static/*filepath"},
+	}
+	for _, tt := range tests {
+		key, _, ok := table.Match(tt.method, tt.path)
+		if tt.want == "" && ok {
+			t.Errorf("%s %s matched %q, want no match", tt.method, tt.path, key)
+		}
+		if tt.want != "" && key != tt.want {
+			t.Errorf("%s %s matched %q, want %q", tt.method, tt.path, key, tt.want)
+		}
+	}
+}
+
+func TestRoutePatternErrors(t *testing.T) {
+	for _, key := range []string{"GET weather", "GET /files/**/meta", "GET /a/:", "GET /a/[b"} {
+		if _, err := (RoutesConfig{key: {}}).Compile(); err == nil {
+			t.Errorf("Compile(%q) succeeded", key)
+		}
+	}
+}
+
+func TestRouteTableSDKKey(t *testing.T) {
+	for key, want := range map[string]string{
+		"GET /v1/datasets/:id/rows": "GET /v1/datasets/[id]/rows",
+		"* /static/*filepath":       "/static/*",
+		"POST /v1/*.csv":            "POST /v1/*.csv",
+	} {
+		entry, err := parseRoutePattern(key)
+		if err != nil {
+			t.Fatalf("parseRoutePattern(%q) error = %v", key, err)
+		}
+		if got := entry.sdkKey(); got != want {
+			t.Errorf("sdkKey(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestRouteTableValidate(t *testing.T) {
+	ginfw.SetMode(ginfw.TestMode)
+	handler := func(c *ginfw.Context) {}
+	r := ginfw.New()
+	r.GET("/health", handler)
+	r.GET("/v1/datasets/:id/rows", handler)
+	r.GET("/weather", handler)
+
+	table := mustCompile(t, RoutesConfig{"GET /v1/datasets/:id/rows": {}, "GET /weather": {}})
+	if err := table.Validate(r.Routes(), []string{"GET /health"}); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+
+	r.POST("/v1/datasets/:id/rows", handler)
+	table = mustCompile(t, RoutesConfig{"GET /v1/datasets/:id/rows": {}, "GET /wheather": {}})
+	err := table.Validate(r.Routes(), []string{"GET /health"})
+	want := "route configuration:\n" +
+		"  GET /weather has no payment route and is not public\n" +
+		"  POST /v1/datasets/:id/rows has no payment route and is not public\n" +
+		"  payment route \"GET /wheather\" matches no handler"
+	if err == nil || err.Error() != want {
+		t.Fatalf("Validate() error = %v, want %s", err, want)
+	}
+}
@@ -0,0 +1,827 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	x402 "github.com/coinbase/x402/go"
+	x402http "github.com/coinbase/x402/go/http"
+	ginfw "github.com/gin-gonic/gin"
+)
+
+const (
+	// SessionHeader carries the session credential on session-eligible requests
+	SessionHeader = "PAYMENT-SESSION"
+	// SessionBalanceHeader reports the balance left after a session debit
+	SessionBalanceHeader = "PAYMENT-SESSION-BALANCE"
+	// SessionStatusHeader explains why a session could not pay for a request,
+	// which is then paid per request as usual
+	SessionStatusHeader = "PAYMENT-SESSION-STATUS"
+
+	DefaultSessionStoreFile  = "sessions.json"
+	DefaultSessionDeposit    = "$1.00"
+	DefaultSessionTTL        = 24 * time.Hour
+	DefaultReconcileInterval = time.Minute
+
+	// sessionFlushInterval is how often balance changes are written to disk
+	sessionFlushInterval = 5 * time.Second
+
+	// sessionDepositNetwork is where deposits are taken and refunds are paid
+	sessionDepositNetwork = x402.Network("eip155:8453")
+	// pendingSessionTimeout drops sessions whose deposit never settled
+	pendingSessionTimeout = 10 * time.Minute
+	// sessionDepositKey is the gin context key the deposit handler leaves the
+	// new session ID under, for activation once the deposit settles
+	sessionDepositKey = "x402.sessionDeposit"
+)
+
+var (
+	errSessionNotFound     = errors.New("session_not_found")
+	errSessionInactive     = errors.New("session_inactive")
+	errSessionExpired      = errors.New("session_expired")
+	errInsufficientBalance = errors.New("insufficient_balance")
+	errInvalidCredential   = errors.New("invalid_credential")
+)
+
+// ============================================================================
+// Session Store
+// ============================================================================
+
+type sessionStatus string
+
+const (
+	sessionPending sessionStatus = "pending" // deposit not settled yet
+	sessionActive  sessionStatus = "active"  // balance can be spent
+	sessionClosed  sessionStatus = "closed"  // waiting for its refund
+	sessionSettled sessionStatus = "settled" // refunded, nothing owed
+)
+
+// session is a prepaid balance. Amounts are USDC units (6 decimals).
+type session struct {
+	ID        string        `json:"id"`
+	Status    sessionStatus `json:"status"`
+	Payer     string        `json:"payer,omitempty"`
+	Network   string        `json:"network,omitempty"`
+	DepositTx string        `json:"depositTx,omitempty"`
+	Deposit   int64         `json:"deposit"`
+	Balance   int64         `json:"balance"`
+	Reserved  int64         `json:"reserved"`
+	Refunded  int64         `json:"refunded"`
+	RefundTx  string        `json:"refundTx,omitempty"`
+	CreatedAt time.Time     `json:"createdAt"`
+	ExpiresAt time.Time     `json:"expiresAt"`
+}
+
+// sessionStore holds session balances in memory and persists them to a JSON
+// file, so a restart neither forgets a deposit nor refunds spent funds.
+// Lifecycle changes (deposits, closes, refunds) are written right away.
+// Debits happen on every request and are only marked dirty, then written by
+// Flush; a crash loses at most sessionFlushInterval of debits, which are
+// then refunded to the payer.
+type sessionStore struct {
+	mu       sync.Mutex
+	path     string
+	sessions map[string]*session
+	dirty    bool
+}
+
+// newSessionStore loads the sessions persisted at path, if any
+//
+// Args:
+//
+//	path: JSON file used for persistence (created on first write)
+//
+// Returns:
+//
+//	*sessionStore or error
+func newSessionStore(path string) (*sessionStore, error) {
+	store := &sessionStore{
+		path:     path,
+		sessions: make(map[string]*session),
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sessions: %w", err)
+	}
+	if len(data) == 0 {
+		return store, nil
+	}
+
+	var entries []*session
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse sessions: %w", err)
+	}
+	for _, entry := range entries {
+		// Requests in flight when the server stopped never finished; their
+		// reservations are released
+		entry.Balance += entry.Reserved
+		entry.Reserved = 0
+		store.sessions[entry.ID] = entry
+	}
+
+	return store, nil
+}
+
+// Create opens a pending session for a deposit of units
+func (s *sessionStore) Create(units int64, ttl time.Duration) (session, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return session{}, err
+	}
+	now := time.Now()
+	entry := &session{
+		ID:        hex.EncodeToString(id),
+		Status:    sessionPending,
+		Deposit:   units,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[entry.ID] = entry
+	s.persist()
+	return *entry, nil
+}
+
+// Activate credits a pending session once its deposit has settled
+func (s *sessionStore) Activate(id string, payer string, network string, tx string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.sessions[id]
+	if !ok {
+		return errSessionNotFound
+	}
+	if entry.Status != sessionPending {
+		return errSessionInactive
+	}
+	entry.Status = sessionActive
+	entry.Payer = payer
+	entry.Network = network
+	entry.DepositTx = tx
+	entry.Balance = entry.Deposit
+	s.persist()
+	return nil
+}
+
+// Remove forgets a session whose deposit did not settle
+func (s *sessionStore) Remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+	s.persist()
+}
+
+// Get returns a copy of a session
+func (s *sessionStore) Get(id string) (session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.sessions[id]
+	if !ok {
+		return session{}, errSessionNotFound
+	}
+	return *entry, nil
+}
+
+// Reserve sets units aside for a request about to run
+func (s *sessionStore) Reserve(id string, units int64) (session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.sessions[id]
+	if !ok {
+		return session{}, errSessionNotFound
+	}
+	if entry.Status != sessionActive {
+		return *entry, errSessionInactive
+	}
+	if time.Now().After(entry.ExpiresAt) {
+		return *entry, errSessionExpired
+	}
+	if entry.Balance < units {
+		return *entry, errInsufficientBalance
+	}
+	entry.Balance -= units
+	entry.Reserved += units
+	s.dirty = true
+	return *entry, nil
+}
+
+// Commit releases a reservation, keeping charged of it
+func (s *sessionStore) Commit(id string, reserved int64, charged int64) (session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.sessions[id]
+	if !ok {
+		return session{}, errSessionNotFound
+	}
+	entry.Reserved -= reserved
+	entry.Balance += reserved - charged
+	s.dirty = true
+	return *entry, nil
+}
+
+// Close stops a session from being spent; its balance is refunded by the
+// next reconciliation
+func (s *sessionStore) Close(id string) (session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.sessions[id]
+	if !ok {
+		return session{}, errSessionNotFound
+	}
+	if entry.Status != sessionActive {
+		return *entry, errSessionInactive
+	}
+	entry.Status = sessionClosed
+	s.persist()
+	return *entry, nil
+}
+
+// MarkRefunded settles a closed session after its balance was paid back
+func (s *sessionStore) MarkRefunded(id string, units int64, tx string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.sessions[id]
+	if !ok {
+		return
+	}
+	entry.Balance -= units
+	entry.Refunded += units
+	entry.RefundTx = tx
+	entry.Status = sessionSettled
+	s.persist()
+}
+
+// RefundSent records a refund transaction whose outcome is unknown, so the
+// balance is not refunded twice
+func (s *sessionStore) RefundSent(id string, tx string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry, ok := s.sessions[id]; ok {
+		entry.RefundTx = tx
+		s.persist()
+	}
+}
+
+// expire closes sessions past their expiry and drops deposits that never
+// settled
+func (s *sessionStore) expire(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changed := false
+	for id, entry := range s.sessions {
+		switch {
+		case entry.Status == sessionPending && now.Sub(entry.CreatedAt) > pendingSessionTimeout:
+			delete(s.sessions, id)
+			changed = true
+		case entry.Status == sessionActive && now.After(entry.ExpiresAt):
+			entry.Status = sessionClosed
+			changed = true
+		}
+	}
+	if changed {
+		s.persist()
+	}
+}
+
+// snapshot returns copies of all sessions, oldest first
+func (s *sessionStore) snapshot() []session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := make([]session, 0, len(s.sessions))
+	for _, entry := range s.sessions {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].CreatedAt.Before(entries[j].CreatedAt)
+	})
+	return entries
+}
+
+// Flush writes balance changes made since the last write to disk
+func (s *sessionStore) Flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.dirty {
+		s.persist()
+	}
+}
+
+// persist writes the store to disk. Callers must hold s.mu.
+func (s *sessionStore) persist() {
+	entries := make([]*session, 0, len(s.sessions))
+	for _, entry := range s.sessions {
+		entries = append(entries, entry)
+	}
+	if err := writeJSONFile(s.path, entries); err != nil {
+		slog.Warn("failed to persist sessions", "error", err)
+		return
+	}
+	s.dirty = false
+}
+
+// ============================================================================
+// Session Credentials
+// ============================================================================
+
+// sessionCredentials issues and checks the bearer credential a client shows
+// to spend a session: base64url(JSON claims) "." base64url(HMAC-SHA256)
+type sessionCredentials struct {
+	secret []byte
+}
+
+type sessionClaims struct {
+	SessionID string `json:"sid"`
+	Expires   int64  `json:"exp"`
+}
+
+// Issue signs a credential for a session
+func (s *sessionCredentials) Issue(entry session) string {
+	claims, _ := json.Marshal(sessionClaims{SessionID: entry.ID, Expires: entry.ExpiresAt.Unix()})
+	payload := base64.RawURLEncoding.EncodeToString(claims)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(s.sign(payload))
+}
+
+// Verify returns the session ID a credential was issued for
+func (s *sessionCredentials) Verify(credential string) (string, error) {
+	payload, signature, ok := strings.Cut(credential, ".")
+	if !ok {
+		return "", errInvalidCredential
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, s.sign(payload)) {
+		return "", errInvalidCredential
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", errInvalidCredential
+	}
+	var claims sessionClaims
+	if err := json.Unmarshal(raw, &claims); err != nil || claims.SessionID == "" {
+		return "", errInvalidCredential
+	}
+	if time.Now().Unix() > claims.Expires {
+		return "", errSessionExpired
+	}
+	return claims.SessionID, nil
+}
+
+func (s *sessionCredentials) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// ============================================================================
+// Session Manager
+// ============================================================================
+
+// sessionRefunder pays unspent session balances back to the payer. A refund
+// that was sent but not confirmed returns its transaction with the error.
+type sessionRefunder interface {
+	Refund(ctx context.Context, network string, to string, units int64) (string, error)
+}
+
+// sessionManager runs prepaid sessions. A client pays a deposit once through
+// the normal x402 flow and gets a session credential back; requests to
+// session-eligible routes that carry it are debited from the balance held
+// here instead of settling on-chain. Reconciliation refunds what is left when
+// the session is closed or expires.
+type sessionManager struct {
+	store       *sessionStore
+	credentials *sessionCredentials
+	deposit     *big.Rat
+	ttl         time.Duration
+	refunder    sessionRefunder
+	wake        chan struct{}
+}
+
+// newSessionManager creates a session manager
+//
+// Args:
+//
+//	store: session balances
+//	secret: HMAC key for session credentials
+//	deposit: USD amount a session is opened with
+//	ttl: how long a session may be spent before it is refunded
+//	refunder: pays back unspent balances (nil records them as owed)
+//
+// Returns:
+//
+//	*sessionManager
+func newSessionManager(store *sessionStore, secret []byte, deposit *big.Rat, ttl time.Duration, refunder sessionRefunder) *sessionManager {
+	return &sessionManager{
+		store:       store,
+		credentials: &sessionCredentials{secret: secret},
+		deposit:     deposit,
+		ttl:         ttl,
+		refunder:    refunder,
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// sessionManagerFromEnv builds the session manager from SESSION_* variables
+func sessionManagerFromEnv() (*sessionManager, error) {
+	path := os.Getenv("SESSION_STORE_FILE")
+	if path == "" {
+		path = DefaultSessionStoreFile
+	}
+	store, err := newSessionStore(path)
+	if err != nil {
+		return nil, err
+	}
+
+	secret := []byte(os.Getenv("SESSION_SECRET"))
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		slog.Warn("SESSION_SECRET not set, session credentials will not survive a restart")
+	}
+
+	depositPrice := os.Getenv("SESSION_DEPOSIT_USD")
+	if depositPrice == "" {
+		depositPrice = DefaultSessionDeposit
+	}
+	deposit, err := parseUSDPrice(depositPrice)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SESSION_DEPOSIT_USD: %w", err)
+	}
+
+	ttl := DefaultSessionTTL
+	if value := os.Getenv("SESSION_TTL"); value != "" {
+		if ttl, err = time.ParseDuration(value); err != nil {
+			return nil, fmt.Errorf("invalid SESSION_TTL: %w", err)
+		}
+	}
+
+	var refunder sessionRefunder
+	if key := os.Getenv("SESSION_REFUND_PRIVATE_KEY"); key != "" {
+		rpcURL := os.Getenv("SESSION_REFUND_RPC_URL")
+		if rpcURL == "" {
+			rpcURL = DefaultOracleRPC
+		}
+		if refunder, err = newUSDCRefunder(key, rpcURL); err != nil {
+			return nil, err
+		}
+	} else {
+		slog.Warn("SESSION_REFUND_PRIVATE_KEY not set, unspent session balances are recorded as owed")
+	}
+
+	return newSessionManager(store, secret, deposit, ttl, refunder), nil
+}
+
+// DepositRoute is the route a session deposit is paid on, in USDC on Base
+func (m *sessionManager) DepositRoute(payTo string) RouteConfig {
+	return RouteConfig{
+		RouteConfig: x402http.RouteConfig{
+			Accepts: x402http.PaymentOptions{
+				{
+					Scheme:  "exact",
+					Price:   "$" + m.deposit.FloatString(usdcDecimals),
+					Network: sessionDepositNetwork,
+					PayTo:   payTo,
+				},
+			},
+			Description: "Open a prepaid payment session",
+			MimeType:    "application/json",
+		},
+	}
+}
+
+// Middleware wraps the x402 payment middleware. Requests to session routes
+// with a usable credential are debited from the session and skip payment;
+// anything else, including a session that cannot cover the request, goes
+// through payment as usual. It must run after MeterUsage so metered routes
+// are debited what they report.
+func (m *sessionManager) Middleware(routes routeMatcher, payment ginfw.HandlerFunc) ginfw.HandlerFunc {
+	return func(c *ginfw.Context) {
+		_, route, ok := routes.Match(c.Request.Method, c.Request.URL.Path)
+		if credential := c.GetHeader(SessionHeader); ok && route.Session && credential != "" {
+			if m.serve(c, route, credential) {
+				return
+			}
+		}
+
+		record := recordSettlement(c)
+		payment(c)
+
+		if id := c.GetString(sessionDepositKey); id != "" {
+			m.activate(c.Request.Context(), id, record.get())
+		}
+	}
+}
+
+// serve runs a request against a session balance. It returns false, without
+// running the handler, when the session cannot pay for it.
+func (m *sessionManager) serve(c *ginfw.Context, route RouteConfig, credential string) bool {
+	price := route.usdPrice(c.Request.Context())
+	if price == nil {
+		return false
+	}
+	id, err := m.credentials.Verify(credential)
+	if err != nil {
+		c.Header(SessionStatusHeader, err.Error())
+		return false
+	}
+
+	reserve := usdToUnits(price, usdcDecimals).Int64()
+	entry, err := m.store.Reserve(id, reserve)
+	if err != nil {
+		c.Header(SessionStatusHeader, err.Error())
+		return false
+	}
+	c.Header(SessionBalanceHeader, formatUSDC(entry.Balance))
+
+	c.Next()
+
+	charged := reserve
+	if usd, ok := reportedUsage(c.Request.Context()); ok {
+		if units := usdToUnits(usd, usdcDecimals).Int64(); units < charged {
+			charged = units
+		}
+	}
+	if c.Writer.Status() >= http.StatusBadRequest {
+		charged = 0
+	}
+	if _, err := m.store.Commit(id, reserve, charged); err != nil {
+		slog.WarnContext(c.Request.Context(), "failed to debit session", "session", id, "error", err)
+	}
+	return true
+}
+
+// activate credits a deposit session once the payment middleware settled it
+func (m *sessionManager) activate(ctx context.Context, id string, settled *x402.SettleResponse) {
+	// A free call settles without a transaction and deposits nothing
+	if settled == nil || !settled.Success || settled.Transaction == "" {
+		m.store.Remove(id)
+		return
+	}
+	if err := m.store.Activate(id, settled.Payer, string(settled.Network), settled.Transaction); err != nil {
+		slog.WarnContext(ctx, "failed to activate session", "session", id, "error", err)
+		return
+	}
+	slog.InfoContext(ctx, "session opened", "session", id, "payer", settled.Payer, "deposit_usdc", m.deposit.FloatString(usdcDecimals), "tx", settled.Transaction)
+}
+
+// Deposit handles the paid deposit route and returns the session credential.
+// The session can be spent once the deposit has settled.
+func (m *sessionManager) Deposit(c *ginfw.Context) {
+	entry, err := m.store.Create(usdToUnits(m.deposit, usdcDecimals).Int64(), m.ttl)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ginfw.H{"error": err.Error()})
+		return
+	}
+	c.Set(sessionDepositKey, entry.ID)
+
+	c.JSON(http.StatusOK, ginfw.H{
+		"session":   m.credentials.Issue(entry),
+		"id":        entry.ID,
+		"deposit":   formatUSDC(entry.Deposit),
+		"expiresAt": entry.ExpiresAt.Format(time.RFC3339),
+	})
+}
+
+// Status reports the balance of the session in the request's credential
+func (m *sessionManager) Status(c *ginfw.Context) {
+	entry, ok := m.sessionFromRequest(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, sessionView(entry))
+}
+
+// Close ends the session in the request's credential and schedules the
+// refund of its balance
+func (m *sessionManager) Close(c *ginfw.Context) {
+	entry, ok := m.sessionFromRequest(c)
+	if !ok {
+		return
+	}
+	entry, err := m.store.Close(entry.ID)
+	if err != nil {
+		c.JSON(http.StatusConflict, ginfw.H{"error": err.Error(), "status": entry.Status})
+		return
+	}
+
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+	c.JSON(http.StatusOK, sessionView(entry))
+}
+
+func (m *sessionManager) sessionFromRequest(c *ginfw.Context) (session, bool) {
+	id, err := m.credentials.Verify(c.GetHeader(SessionHeader))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, ginfw.H{"error": err.Error()})
+		return session{}, false
+	}
+	entry, err := m.store.Get(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, ginfw.H{"error": err.Error()})
+		return session{}, false
+	}
+	return entry, true
+}
+
+func sessionView(entry session) ginfw.H {
+	return ginfw.H{
+		"id":        entry.ID,
+		"status":    entry.Status,
+		"deposit":   formatUSDC(entry.Deposit),
+		"balance":   formatUSDC(entry.Balance + entry.Reserved),
+		"refunded":  formatUSDC(entry.Refunded),
+		"refundTx":  entry.RefundTx,
+		"expiresAt": entry.ExpiresAt.Format(time.RFC3339),
+	}
+}
+
+// ============================================================================
+// Reconciliation
+// ============================================================================
+
+// Run reconciles sessions every interval, and right away when one is closed,
+// and writes balance changes to disk every sessionFlushInterval until ctx is
+// done, when it writes them a last time
+func (m *sessionManager) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	flush := time.NewTicker(sessionFlushInterval)
+	defer flush.Stop()
+	defer m.store.Flush()
+
+	m.Reconcile(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flush.C:
+			m.store.Flush()
+		case <-ticker.C:
+			m.Reconcile(ctx)
+		case <-m.wake:
+			m.Reconcile(ctx)
+		}
+	}
+}
+
+// Reconcile closes expired sessions, refunds closed ones and logs what the
+// server is holding
+func (m *sessionManager) Reconcile(ctx context.Context) {
+	m.store.expire(time.Now())
+
+	var active, owed int
+	var held, owedUnits int64
+	for _, entry := range m.store.snapshot() {
+		switch entry.Status {
+		case sessionActive:
+			active++
+			held += entry.Balance + entry.Reserved
+		case sessionClosed:
+			// Wait for requests still running against the session
+			if entry.Reserved > 0 {
+				continue
+			}
+			if entry.RefundTx != "" {
+				// Sent before but never confirmed; needs checking by hand
+				owed++
+				owedUnits += entry.Balance
+				continue
+			}
+			if entry.Balance == 0 {
+				m.store.MarkRefunded(entry.ID, 0, "")
+				continue
+			}
+			if err := m.refund(ctx, entry); err != nil {
+				owed++
+				owedUnits += entry.Balance
+				slog.WarnContext(ctx, "session refund failed, balance owed", "session", entry.ID, "owed_usdc", formatUSDC(entry.Balance), "payer", entry.Payer, "error", err)
+			}
+		}
+	}
+
+	if active > 0 || owed > 0 {
+		slog.Info("sessions reconciled", "active", active, "held_usdc", formatUSDC(held), "owing", owed, "owed_usdc", formatUSDC(owedUnits))
+	}
+}
+
+func (m *sessionManager) refund(ctx context.Context, entry session) error {
+	if m.refunder == nil {
+		return fmt.Errorf("no refund wallet configured")
+	}
+	tx, err := m.refunder.Refund(ctx, entry.Network, entry.Payer, entry.Balance)
+	if err != nil {
+		if tx != "" {
+			m.store.RefundSent(entry.ID, tx)
+		}
+		return err
+	}
+	m.store.MarkRefunded(entry.ID, entry.Balance, tx)
+	slog.InfoContext(ctx, "session refunded", "session", entry.ID, "refund_usdc", formatUSDC(entry.Balance), "payer", entry.Payer, "tx", tx)
+	return nil
+}
+
+// ============================================================================
+// Settlement Record
+// ============================================================================
+
+type settlementRecordKey struct{}
+
+// settlementRecord keeps the settlement the payment middleware made for a
+// request, so handlers wrapped around it can act on the result
+type settlementRecord struct {
+	mu       sync.Mutex
+	response *x402.SettleResponse
+	hooks    []func(*x402.SettleResponse)
+}
+
+// recordSettlement returns the settlement record of the request, installing
+// one if no middleware has yet
+func recordSettlement(c *ginfw.Context) *settlementRecord {
+	if record, _ := c.Request.Context().Value(settlementRecordKey{}).(*settlementRecord); record != nil {
+		return record
+	}
+	record := &settlementRecord{}
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), settlementRecordKey{}, record))
+	return record
+}
+
+// onSettle runs hook with the settlement as soon as it is made, while the
+// payment middleware can still send headers set by it
+func (r *settlementRecord) onSettle(hook func(*x402.SettleResponse)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hooks = append(r.hooks, hook)
+}
+
+func (r *settlementRecord) set(response *x402.SettleResponse) {
+	r.mu.Lock()
+	r.response = response
+	hooks := r.hooks
+	r.mu.Unlock()
+
+	for _, hook := range hooks {
+		hook(response)
+	}
+}
+
+func (r *settlementRecord) get() *x402.SettleResponse {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.response
+}
+
+// settlementRecorder stores each settlement in the request's record
+type settlementRecorder struct {
+	x402.FacilitatorClient
+}
+
+// newSettlementRecorder wraps client so the session middleware sees the
+// settlement of deposits
+func newSettlementRecorder(client x402.FacilitatorClient) *settlementRecorder {
+	return &settlementRecorder{FacilitatorClient: client}
+}
+
+func (r *settlementRecorder) Settle(ctx context.Context, payloadBytes []byte, requirementsBytes []byte) (*x402.SettleResponse, error) {
+	response, err := r.FacilitatorClient.Settle(ctx, payloadBytes, requirementsBytes)
+	if record, _ := ctx.Value(settlementRecordKey{}).(*settlementRecord); record != nil && err == nil {
+		record.set(response)
+	}
+	return response, err
+}
+
+// formatUSDC renders USDC units as a decimal amount
+func formatUSDC(units int64) string {
+	value := new(big.Rat).SetFrac64(units, 1_000_000).FloatString(usdcDecimals)
+	return strings.TrimSuffix(strings.TrimRight(value, "0"), ".")
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	x402 "github.com/coinbase/x402/go"
+	x402http "github.com/coinbase/x402/go/http"
+	ginfw "github.com/gin-gonic/gin"
+)
+
+// fakeRefunder records refunds instead of sending them
+type fakeRefunder struct {
+	refunds map[string]int64
+	err     error
+}
+
+func (f *fakeRefunder) Refund(ctx context.Context, network string, to string, units int64) (string, error) {
+	if f.err != nil {
+		return "", f.err
+	}
+	f.refunds[to] += units
+	return fmt.Sprintf("0xrefund%d", len(f.refunds)), nil
+}
+
+// newTestSessions returns a session manager with a $1 deposit and a router
+// whose payment middleware settles every paid request through the session
+// recorder, counting how many requests it saw
+func newTestSessions(t *testing.T, refunder sessionRefunder) (*sessionManager, *ginfw.Engine, *int) {
+	t.Helper()
+	ginfw.SetMode(ginfw.TestMode)
+
+	store, err := newSessionStore(filepath.Join(t.TempDir(), "sessions.json"))
+	if err != nil {
+		t.Fatalf("newSessionStore() error = %v", err)
+	}
+	sessions := newSessionManager(store, []byte("secret"), big.NewRat(1, 1), time.Hour, refunder)
+
+	routes := RoutesConfig{
+		"GET /metered": {RouteConfig: x402http.RouteConfig{
+			Accepts: x402http.PaymentOptions{{Scheme: "exact", Price: "$0.01"}},
+		}, Session: true},
+		"GET /failing": {RouteConfig: x402http.RouteConfig{
+			Accepts: x402http.PaymentOptions{{Scheme: "exact", Price: "$0.01"}},
+		}, Session: true},
+		"POST /session/deposit": sessions.DepositRoute("0x0000000000000000000000000000000000000001"),
+	}
+
+	payments := 0
+	recorder := newSettlementRecorder(&recordingFacilitator{})
+	payment := func(c *ginfw.Context) {
+		payments++
+		c.Next()
+		settled, _ := recorder.Settle(c.Request.Context(), []byte(`{}`), []byte(`{}`))
+		settled.Payer = "0x00000000000000000000000000000000000000aa"
+		settled.Network = sessionDepositNetwork
+		settled.Transaction = "0xdeposit"
+	}
+
+	r := ginfw.New()
+	r.Use(MeterUsage())
+	r.Use(sessions.Middleware(mustCompile(t, routes), payment))
+	r.GET("/metered", func(c *ginfw.Context) {
+		ReportUsage(c, "$0.002")
+		c.Status(http.StatusOK)
+	})
+	r.GET("/failing", func(c *ginfw.Context) {
+		c.Status(http.StatusInternalServerError)
+	})
+	r.POST("/session/deposit", sessions.Deposit)
+	r.POST("/session/close", sessions.Close)
+	return sessions, r, &payments
+}
+
+func sessionRequest(r http.Handler, method string, path string, credential string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if credential != "" {
+		req.Header.Set(SessionHeader, credential)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// openSession pays a deposit and returns the credential and session ID
+func openSession(t *testing.T, r http.Handler) (string, string) {
+	t.Helper()
+	w := sessionRequest(r, http.MethodPost, "/session/deposit", "")
+	var body struct {
+		Session string `json:"session"`
+		ID      string `json:"id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Session == "" {
+		t.Fatalf("deposit response = %s", w.Body.String())
+	}
+	return body.Session, body.ID
+}
+
+func TestSessionCredentials(t *testing.T) {
+	credentials := &sessionCredentials{secret: []byte("secret")}
+	credential := credentials.Issue(session{ID: "abc", ExpiresAt: time.Now().Add(time.Hour)})
+
+	if id, err := credentials.Verify(credential); err != nil || id != "abc" {
+		t.Fatalf("Verify() = %q, %v", id, err)
+	}
+	if _, err := credentials.Verify(credential + "x"); err != errInvalidCredential {
+		t.Errorf("tampered credential: error = %v", err)
+	}
+	other := &sessionCredentials{secret: []byte("other")}
+	if _, err := other.Verify(credential); err != errInvalidCredential {
+		t.Errorf("foreign credential: error = %v", err)
+	}
+	expired := credentials.Issue(session{ID: "abc", ExpiresAt: time.Now().Add(-time.Minute)})
+	if _, err := credentials.Verify(expired); err != errSessionExpired {
+		t.Errorf("expired credential: error = %v", err)
+	}
+}
+
+func TestSessionDebits(t *testing.T) {
+	sessions, r, payments := newTestSessions(t, nil)
+	credential, id := openSession(t, r)
+	if entry, _ := sessions.store.Get(id); entry.Status != sessionActive || entry.Balance != 1_000_000 {
+		t.Fatalf("session after deposit = %+v", entry)
+	}
+	*payments = 0
+
+	// Metered route: $0.01 is reserved, the reported $0.002 is kept
+	w := sessionRequest(r, http.MethodGet, "/metered", credential)
+	if w.Code != http.StatusOK || *payments != 0 {
+		t.Fatalf("session request: status %d, %d payments", w.Code, *payments)
+	}
+	if entry, _ := sessions.store.Get(id); entry.Balance != 998_000 || entry.Reserved != 0 {
+		t.Fatalf("balance after metered request = %d (reserved %d)", entry.Balance, entry.Reserved)
+	}
+
+	// Failed requests are not charged
+	sessionRequest(r, http.MethodGet, "/failing", credential)
+	if entry, _ := sessions.store.Get(id); entry.Balance != 998_000 {
+		t.Fatalf("balance after failed request = %d", entry.Balance)
+	}
+
+	// Without enough balance the request is paid per request
+	sessions.store.Commit(id, 0, 995_000)
+	w = sessionRequest(r, http.MethodGet, "/metered", credential)
+	if *payments != 1 || w.Header().Get(SessionStatusHeader) != errInsufficientBalance.Error() {
+		t.Fatalf("insufficient balance: %d payments, status %q", *payments, w.Header().Get(SessionStatusHeader))
+	}
+
+	// Forged credentials are ignored the same way
+	sessionRequest(r, http.MethodGet, "/metered", credential[:len(credential)-2])
+	if *payments != 2 {
+		t.Fatalf("forged credential: %d payments", *payments)
+	}
+}
+
+func TestSessionReconcileRefunds(t *testing.T) {
+	refunder := &fakeRefunder{refunds: make(map[string]int64)}
+	sessions, r, _ := newTestSessions(t, refunder)
+	credential, id := openSession(t, r)
+	sessionRequest(r, http.MethodGet, "/metered", credential)
+
+	if w := sessionRequest(r, http.MethodPost, "/session/close", credential); w.Code != http.StatusOK {
+		t.Fatalf("close: status %d, %s", w.Code, w.Body.String())
+	}
+	if w := sessionRequest(r, http.MethodGet, "/metered", credential); w.Header().Get(SessionStatusHeader) != errSessionInactive.Error() {
+		t.Fatalf("closed session still spendable")
+	}
+
+	sessions.Reconcile(context.Background())
+	entry, _ := sessions.store.Get(id)
+	if entry.Status != sessionSettled || entry.Refunded != 998_000 || entry.Balance != 0 {
+		t.Fatalf("session after reconcile = %+v", entry)
+	}
+	if refunder.refunds["0x00000000000000000000000000000000000000aa"] != 998_000 {
+		t.Fatalf("refunds = %v", refunder.refunds)
+	}
+
+	// Nothing is refunded twice
+	sessions.Reconcile(context.Background())
+	if refunder.refunds["0x00000000000000000000000000000000000000aa"] != 998_000 {
+		t.Fatalf("refunds after second reconcile = %v", refunder.refunds)
+	}
+}
+
+func TestSessionStoreSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	store, _ := newSessionStore(path)
+	entry, _ := store.Create(500, time.Hour)
+	store.Activate(entry.ID, "0xpayer", string(sessionDepositNetwork), "0xtx")
+	store.Reserve(entry.ID, 200)
+
+	reloaded, err := newSessionStore(path)
+	if err != nil {
+		t.Fatalf("newSessionStore() error = %v", err)
+	}
+	got, _ := reloaded.Get(entry.ID)
+	if got.Status != sessionActive || got.Balance != 500 || got.Reserved != 0 {
+		t.Fatalf("reloaded session = %+v", got)
+	}
+}
+
+func TestSessionStoreFlushesDebits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	store, _ := newSessionStore(path)
+	entry, _ := store.Create(500, time.Hour)
+	store.Activate(entry.ID, "0xpayer", string(sessionDepositNetwork), "0xtx")
+	store.Reserve(entry.ID, 200)
+	store.Commit(entry.ID, 200, 150)
+
+	// Debits stay in memory until flushed
+	reloaded, _ := newSessionStore(path)
+	if got, _ := reloaded.Get(entry.ID); got.Balance != 500 {
+		t.Fatalf("balance on disk before flush = %d, want 500", got.Balance)
+	}
+
+	store.Flush()
+	reloaded, _ = newSessionStore(path)
+	if got, _ := reloaded.Get(entry.ID); got.Balance != 350 {
+		t.Fatalf("balance on disk after flush = %d, want 350", got.Balance)
+	}
+}
+
+func TestSessionDepositWithoutTransaction(t *testing.T) {
+	sessions, _, _ := newTestSessions(t, nil)
+	entry, _ := sessions.store.Create(1_000_000, time.Hour)
+
+	// A free call settles successfully without a transaction
+	sessions.activate(context.Background(), entry.ID, &x402.SettleResponse{Success: true, Payer: "0xpayer"})
+	if _, err := sessions.store.Get(entry.ID); err != errSessionNotFound {
+		t.Fatalf("session without a deposit transaction: error = %v, want removed", err)
+	}
+}
+
+func TestFormatUSDC(t *testing.T) {
+	for units, want := range map[int64]string{0: "0", 1: "0.000001", 998_000: "0.998", 1_000_000: "1", 12_345_678: "12.345678"} {
+		if got := formatUSDC(units); got != want {
+			t.Errorf("formatUSDC(%d) = %q, want %q", units, got, want)
+		}
+	}
+}
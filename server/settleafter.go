@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	x402 "github.com/coinbase/x402/go"
+	ginfw "github.com/gin-gonic/gin"
+)
+
+// PaymentResponseHeader carries the settlement result to the client
+const PaymentResponseHeader = "PAYMENT-RESPONSE"
+
+// What to do with a payment when a settle-after-response route fails with a
+// 5xx. Other non-2xx responses are never settled.
+const (
+	// ServerErrorSkip leaves the payment unsettled: the payer keeps the money
+	ServerErrorSkip = "skip"
+	// ServerErrorSettle settles anyway, for routes whose cost is incurred
+	// before they can fail
+	ServerErrorSettle = "settle"
+)
+
+type deferredSettlementKey struct{}
+
+// deferredSettlement holds a verified payment until the handler's response
+// shows whether it should be settled
+type deferredSettlement struct {
+	mu           sync.Mutex
+	verified     bool
+	payload      []byte
+	requirements []byte
+	payer        string
+}
+
+// deferringFacilitator postpones the settlements of settle-after-response
+// routes. It keeps each verified payment, and the payment middleware gets a
+// provisional success when it settles; the real settlement is made by
+// settleAfterResponse once the handler has run. Keeping the payment from
+// Verify means it can be settled even if the payment middleware itself
+// skips settlement for error responses.
+type deferringFacilitator struct {
+	x402.FacilitatorClient
+}
+
+// newDeferringFacilitator wraps client; it has to be the outermost wrapper
+// so the ones below it only see real settlements
+func newDeferringFacilitator(client x402.FacilitatorClient) *deferringFacilitator {
+	return &deferringFacilitator{FacilitatorClient: client}
+}
+
+func (d *deferringFacilitator) Verify(ctx context.Context, payloadBytes []byte, requirementsBytes []byte) (*x402.VerifyResponse, error) {
+	response, err := d.FacilitatorClient.Verify(ctx, payloadBytes, requirementsBytes)
+	if deferred, _ := ctx.Value(deferredSettlementKey{}).(*deferredSettlement); deferred != nil && err == nil && response.IsValid {
+		deferred.mu.Lock()
+		deferred.verified = true
+		deferred.payload = payloadBytes
+		deferred.requirements = requirementsBytes
+		deferred.payer = response.Payer
+		deferred.mu.Unlock()
+	}
+	return response, err
+}
+
+func (d *deferringFacilitator) Settle(ctx context.Context, payloadBytes []byte, requirementsBytes []byte) (*x402.SettleResponse, error) {
+	deferred, _ := ctx.Value(deferredSettlementKey{}).(*deferredSettlement)
+	if deferred == nil {
+		return d.FacilitatorClient.Settle(ctx, payloadBytes, requirementsBytes)
+	}
+
+	deferred.mu.Lock()
+	defer deferred.mu.Unlock()
+	if !deferred.verified {
+		return d.FacilitatorClient.Settle(ctx, payloadBytes, requirementsBytes)
+	}
+	return &x402.SettleResponse{Success: true, Payer: deferred.payer, Network: requirementsNetwork(requirementsBytes)}, nil
+}
+
+// settle makes the deferred settlement
+func (d *deferringFacilitator) settle(ctx context.Context, deferred *deferredSettlement) (*x402.SettleResponse, error) {
+	deferred.mu.Lock()
+	payload, requirements := deferred.payload, deferred.requirements
+	deferred.mu.Unlock()
+	return d.FacilitatorClient.Settle(ctx, payload, requirements)
+}
+
+// requirementsNetwork reads the network of encoded payment requirements
+func requirementsNetwork(requirementsBytes []byte) x402.Network {
+	var requirements struct {
+		Network x402.Network `json:"network"`
+	}
+	json.Unmarshal(requirementsBytes, &requirements)
+	return requirements.Network
+}
+
+// settleAfterResponse runs settle-after-response routes: the payment is
+// verified up front as usual, but only settled once the handler responded
+// with a 2xx (or a 5xx, if the route's policy says so). The response is held
+// back until then, so PAYMENT-RESPONSE can say whether settlement happened
+// and a failed settlement still ends in a 402 instead of free content.
+type settleAfterResponse struct {
+	facilitator *deferringFacilitator
+}
+
+// newSettleAfterResponse creates the settle-after-response middleware
+//
+// Args:
+//
+//	facilitator: the facilitator given to the payment middleware
+//
+// Returns:
+//
+//	*settleAfterResponse
+func newSettleAfterResponse(facilitator *deferringFacilitator) *settleAfterResponse {
+	return &settleAfterResponse{facilitator: facilitator}
+}
+
+// Middleware wraps the payment middleware in next
+func (s *settleAfterResponse) Middleware(routes routeMatcher, next ginfw.HandlerFunc) ginfw.HandlerFunc {
+	return func(c *ginfw.Context) {
+		_, route, ok := routes.Match(c.Request.Method, c.Request.URL.Path)
+		if !ok || !route.SettleAfterResponse {
+			next(c)
+			return
+		}
+
+		deferred := &deferredSettlement{}
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), deferredSettlementKey{}, deferred))
+		writer := &heldResponseWriter{ResponseWriter: c.Writer, status: http.StatusOK}
+		c.Writer = writer
+		defer func() {
+			c.Writer = writer.ResponseWriter
+			writer.release()
+		}()
+
+		next(c)
+
+		deferred.mu.Lock()
+		verified, payer := deferred.verified, deferred.payer
+		network := requirementsNetwork(deferred.requirements)
+		deferred.mu.Unlock()
+		if !verified {
+			// Not paid: a 402 or an invalid payment
+			return
+		}
+
+		status := writer.Status()
+		settle := status >= 200 && status < 300
+		if status >= 500 && route.OnServerError == ServerErrorSettle {
+			settle = true
+		}
+		if !settle {
+			slog.InfoContext(c.Request.Context(), "not settling payment", "payer", payer, "method", c.Request.Method, "path", c.Request.URL.Path, "status", status)
+			setPaymentResponse(writer.Header(), &x402.SettleResponse{
+				Success:     false,
+				ErrorReason: fmt.Sprintf("not settled: handler returned %d", status),
+				Payer:       payer,
+				Network:     network,
+			})
+			return
+		}
+
+		settled, err := s.facilitator.settle(c.Request.Context(), deferred)
+		if err == nil && !settled.Success {
+			err = fmt.Errorf("%s", settled.ErrorReason)
+		}
+		if err != nil {
+			slog.ErrorContext(c.Request.Context(), "settlement after response failed", "error", err)
+			if settled == nil {
+				settled = &x402.SettleResponse{ErrorReason: err.Error(), Payer: payer, Network: network}
+			}
+			writer.replace(http.StatusPaymentRequired, ginfw.H{"error": "Settlement failed", "details": err.Error()})
+		}
+		setPaymentResponse(writer.Header(), settled)
+	}
+}
+
+// setPaymentResponse replaces the PAYMENT-RESPONSE header (and its v1 name,
+// if the payment middleware set that instead)
+func setPaymentResponse(header http.Header, settled *x402.SettleResponse) {
+	encoded, err := json.Marshal(settled)
+	if err != nil {
+		return
+	}
+	value := base64.StdEncoding.EncodeToString(encoded)
+	header.Set(PaymentResponseHeader, value)
+	if header.Get("X-"+PaymentResponseHeader) != "" {
+		header.Set("X-"+PaymentResponseHeader, value)
+	}
+}
+
+// heldResponseWriter keeps the response in memory until release
+type heldResponseWriter struct {
+	ginfw.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *heldResponseWriter) WriteHeader(code int) {
+	if code > 0 {
+		w.status = code
+	}
+}
+
+func (w *heldResponseWriter) WriteHeaderNow() {}
+
+func (w *heldResponseWriter) Write(data []byte) (int, error) {
+	return w.body.Write(data)
+}
+
+func (w *heldResponseWriter) WriteString(s string) (int, error) {
+	return w.body.WriteString(s)
+}
+
+func (w *heldResponseWriter) Status() int { return w.status }
+
+func (w *heldResponseWriter) Size() int { return w.body.Len() }
+
+func (w *heldResponseWriter) Written() bool { return false }
+
+func (w *heldResponseWriter) Flush() {}
+
+// replace discards the held response for a JSON one
+func (w *heldResponseWriter) replace(status int, body interface{}) {
+	encoded, _ := json.Marshal(body)
+	w.status = status
+	w.body.Reset()
+	w.body.Write(encoded)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Del("Content-Length")
+}
+
+// release sends the held response
+func (w *heldResponseWriter) release() {
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(w.body.Bytes())
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	x402 "github.com/coinbase/x402/go"
+	x402http "github.com/coinbase/x402/go/http"
+	ginfw "github.com/gin-gonic/gin"
+)
+
+// countingFacilitator settles with a transaction, or fails when failing is
+// set, and counts settlements
+type countingFacilitator struct {
+	recordingFacilitator
+	settles int
+	failing bool
+}
+
+func (f *countingFacilitator) Verify(ctx context.Context, payload []byte, requirements []byte) (*x402.VerifyResponse, error) {
+	return &x402.VerifyResponse{IsValid: true, Payer: "0x00000000000000000000000000000000000000aa"}, nil
+}
+
+func (f *countingFacilitator) Settle(ctx context.Context, payload []byte, requirements []byte) (*x402.SettleResponse, error) {
+	f.settles++
+	if f.failing {
+		return &x402.SettleResponse{Success: false, ErrorReason: "insufficient_funds"}, nil
+	}
+	return &x402.SettleResponse{Success: true, Transaction: "0xsettled"}, nil
+}
+
+// newTestSettleAfter serves settle-after-response routes GET /ok, GET /down
+// (503, skipped) and GET /spent (500, settled anyway) behind a payment
+// middleware that verifies, settles before the handler and sets
+// PAYMENT-RESPONSE, as the SDK would
+func newTestSettleAfter(t *testing.T) (*ginfw.Engine, *countingFacilitator) {
+	t.Helper()
+	ginfw.SetMode(ginfw.TestMode)
+
+	inner := &countingFacilitator{}
+	facilitator := newDeferringFacilitator(inner)
+
+	option := x402http.PaymentOptions{{Scheme: "exact", Price: "$0.01"}}
+	routes := mustCompile(t, RoutesConfig{
+		"GET /ok":    {RouteConfig: x402http.RouteConfig{Accepts: option}, SettleAfterResponse: true},
+		"GET /down":  {RouteConfig: x402http.RouteConfig{Accepts: option}, SettleAfterResponse: true, OnServerError: ServerErrorSkip},
+		"GET /spent": {RouteConfig: x402http.RouteConfig{Accepts: option}, SettleAfterResponse: true, OnServerError: ServerErrorSettle},
+	})
+	payment := func(c *ginfw.Context) {
+		ctx := c.Request.Context()
+		requirements := []byte(`{"network":"eip155:8453"}`)
+		facilitator.Verify(ctx, []byte(`{}`), requirements)
+		settled, _ := facilitator.Settle(ctx, []byte(`{}`), requirements)
+		setPaymentResponse(c.Writer.Header(), settled)
+		c.Next()
+	}
+
+	r := ginfw.New()
+	r.Use(newSettleAfterResponse(facilitator).Middleware(routes, payment))
+	r.GET("/ok", func(c *ginfw.Context) { c.JSON(http.StatusOK, ginfw.H{"data": "content"}) })
+	r.GET("/down", func(c *ginfw.Context) { c.JSON(http.StatusServiceUnavailable, ginfw.H{"error": "upstream"}) })
+	r.GET("/spent", func(c *ginfw.Context) { c.Status(http.StatusInternalServerError) })
+	return r, inner
+}
+
+func paymentResponse(t *testing.T, header http.Header) x402.SettleResponse {
+	t.Helper()
+	decoded, err := base64.StdEncoding.DecodeString(header.Get(PaymentResponseHeader))
+	if err != nil {
+		t.Fatalf("PAYMENT-RESPONSE: %v", err)
+	}
+	var settled x402.SettleResponse
+	if err := json.Unmarshal(decoded, &settled); err != nil {
+		t.Fatalf("PAYMENT-RESPONSE: %v", err)
+	}
+	return settled
+}
+
+func TestSettleAfterResponse(t *testing.T) {
+	r, inner := newTestSettleAfter(t)
+
+	w := get(r, "/ok", nil)
+	if settled := paymentResponse(t, w.Header()); w.Code != http.StatusOK || !settled.Success || settled.Transaction != "0xsettled" || inner.settles != 1 {
+		t.Errorf("2xx: status %d, settlement %+v, settles %d", w.Code, settled, inner.settles)
+	}
+
+	w = get(r, "/down", nil)
+	if settled := paymentResponse(t, w.Header()); w.Code != http.StatusServiceUnavailable || settled.Success || inner.settles != 1 {
+		t.Errorf("5xx skipped: status %d, settlement %+v, settles %d", w.Code, settled, inner.settles)
+	}
+
+	w = get(r, "/spent", nil)
+	if settled := paymentResponse(t, w.Header()); w.Code != http.StatusInternalServerError || !settled.Success || inner.settles != 2 {
+		t.Errorf("5xx settled: status %d, settlement %+v, settles %d", w.Code, settled, inner.settles)
+	}
+}
+
+func TestSettleAfterResponseFailedSettlement(t *testing.T) {
+	r, inner := newTestSettleAfter(t)
+	inner.failing = true
+
+	w := get(r, "/ok", nil)
+	settled := paymentResponse(t, w.Header())
+	if w.Code != http.StatusPaymentRequired || settled.Success || settled.ErrorReason != "insufficient_funds" {
+		t.Errorf("status %d, settlement %+v", w.Code, settled)
+	}
+	if body := w.Body.String(); !json.Valid([]byte(body)) || strings.Contains(body, "content") {
+		t.Errorf("content served without settlement: %s", body)
+	}
+}
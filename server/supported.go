@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	x402 "github.com/coinbase/x402/go"
+	ginfw "github.com/gin-gonic/gin"
+)
+
+// DefaultSupportedTTL is how long a /supported response is used before it is
+// fetched again
+const DefaultSupportedTTL = 5 * time.Minute
+
+// supportedCache caches the facilitators' /supported response. It is
+// refreshed in the background, and a stale response is kept when a refresh
+// fails. Until one has been fetched the server is degraded: paid routes
+// answer 503 instead of payment requirements nobody can pay.
+type supportedCache struct {
+	x402.FacilitatorClient
+	ttl time.Duration
+
+	mu        sync.Mutex
+	supported *x402.SupportedResponse
+	fetched   time.Time
+	onChange  []func(x402.SupportedResponse)
+}
+
+// newSupportedCache wraps client with a /supported cache
+//
+// Args:
+//
+//	client: facilitator client
+//	ttl: how long a response is fresh
+//
+// Returns:
+//
+//	*supportedCache
+func newSupportedCache(client x402.FacilitatorClient, ttl time.Duration) *supportedCache {
+	return &supportedCache{FacilitatorClient: client, ttl: ttl}
+}
+
+// OnChange registers a function called with every response that differs
+// from the previous one (including the first)
+func (s *supportedCache) OnChange(fn func(x402.SupportedResponse)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onChange = append(s.onChange, fn)
+}
+
+// GetSupported returns the cached response, fetching it when it is older
+// than the TTL
+func (s *supportedCache) GetSupported(ctx context.Context) (x402.SupportedResponse, error) {
+	s.mu.Lock()
+	cached, fresh := s.supported, time.Since(s.fetched) < s.ttl
+	s.mu.Unlock()
+	if cached != nil && fresh {
+		return *cached, nil
+	}
+
+	if err := s.Refresh(ctx); err != nil {
+		if cached != nil {
+			return *cached, nil
+		}
+		return x402.SupportedResponse{}, err
+	}
+	return s.Current()
+}
+
+// Current returns the cached response without fetching
+func (s *supportedCache) Current() (x402.SupportedResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.supported == nil {
+		return x402.SupportedResponse{}, fmt.Errorf("supported payment kinds not known yet")
+	}
+	return *s.supported, nil
+}
+
+// Ready reports whether a response has been fetched
+func (s *supportedCache) Ready() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.supported != nil
+}
+
+// Refresh fetches /supported, logging what changed
+func (s *supportedCache) Refresh(ctx context.Context) error {
+	supported, err := s.FacilitatorClient.GetSupported(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to fetch supported payment kinds: %w", err)
+	}
+
+	s.mu.Lock()
+	previous := s.supported
+	s.supported = &supported
+	s.fetched = time.Now()
+	hooks := s.onChange
+	s.mu.Unlock()
+
+	var before []x402.SupportedKind
+	if previous != nil {
+		before = previous.Kinds
+	}
+	added, removed := diffKinds(before, supported.Kinds)
+	if previous != nil && len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
+
+	if previous == nil {
+		slog.Info("facilitators support payment kinds", "count", len(added), "kinds", strings.Join(added, ","))
+	} else {
+		if len(added) > 0 {
+			slog.Info("facilitators support new payment kinds", "kinds", strings.Join(added, ","))
+		}
+		if len(removed) > 0 {
+			slog.Warn("facilitators no longer support payment kinds", "kinds", strings.Join(removed, ","))
+		}
+	}
+	for _, hook := range hooks {
+		hook(supported)
+	}
+	return nil
+}
+
+// Run refreshes the cache every TTL until ctx is done
+func (s *supportedCache) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.ttl)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		refreshCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		if err := s.Refresh(refreshCtx); err != nil {
+			if s.Ready() {
+				slog.Warn("keeping the cached payment kinds", "error", err)
+			} else {
+				slog.Warn("still degraded", "error", err)
+			}
+		}
+		cancel()
+	}
+}
+
+// Middleware answers 503 on paid routes until the supported kinds are known
+func (s *supportedCache) Middleware(routes routeMatcher) ginfw.HandlerFunc {
+	return func(c *ginfw.Context) {
+		if _, _, ok := routes.Match(c.Request.Method, c.Request.URL.Path); ok && !s.Ready() {
+			c.Header("Retry-After", "30")
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, ginfw.H{
+				"error": "Payments are temporarily unavailable: no facilitator reachable",
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// diffKinds lists the scheme@network kinds in after but not before, and the
+// other way round
+func diffKinds(before []x402.SupportedKind, after []x402.SupportedKind) ([]string, []string) {
+	set := func(kinds []x402.SupportedKind) map[string]bool {
+		names := make(map[string]bool, len(kinds))
+		for _, kind := range kinds {
+			names[kind.Scheme+"@"+kind.Network] = true
+		}
+		return names
+	}
+	old, current := set(before), set(after)
+
+	var added, removed []string
+	for name := range current {
+		if !old[name] {
+			added = append(added, name)
+		}
+	}
+	for name := range old {
+		if !current[name] {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
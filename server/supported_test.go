@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	x402 "github.com/coinbase/x402/go"
+	x402http "github.com/coinbase/x402/go/http"
+	ginfw "github.com/gin-gonic/gin"
+)
+
+func TestSupportedCache(t *testing.T) {
+	ginfw.SetMode(ginfw.TestMode)
+	facilitator := &fakeFacilitator{down: true, kinds: []x402.SupportedKind{{Scheme: "exact", Network: "eip155:8453"}}}
+	cache := newSupportedCache(facilitator, time.Hour)
+
+	changes := 0
+	cache.OnChange(func(x402.SupportedResponse) { changes++ })
+
+	routes := mustCompile(t, RoutesConfig{
+		"GET /paid": {RouteConfig: x402http.RouteConfig{Accepts: x402http.PaymentOptions{{Scheme: "exact", Price: "$0.01"}}}},
+	})
+	r := ginfw.New()
+	r.Use(cache.Middleware(routes))
+	r.GET("/paid", func(c *ginfw.Context) { c.Status(http.StatusOK) })
+	r.GET("/health", func(c *ginfw.Context) { c.Status(http.StatusOK) })
+
+	// Degraded while no facilitator answers
+	if err := cache.Refresh(context.Background()); err == nil || cache.Ready() {
+		t.Fatalf("Refresh() = %v with the facilitator down", err)
+	}
+	if w := get(r, "/paid", nil); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("degraded paid route: status %d", w.Code)
+	}
+	if w := get(r, "/health", nil); w.Code != http.StatusOK {
+		t.Errorf("degraded public route: status %d", w.Code)
+	}
+
+	facilitator.down = false
+	if err := cache.Refresh(context.Background()); err != nil || changes != 1 {
+		t.Fatalf("Refresh() = %v, changes %d", err, changes)
+	}
+	if w := get(r, "/paid", nil); w.Code != http.StatusOK {
+		t.Errorf("paid route once ready: status %d", w.Code)
+	}
+
+	// Unchanged kinds are not a change; a failed refresh keeps them
+	cache.Refresh(context.Background())
+	facilitator.down = true
+	cache.fetched = time.Time{}
+	if supported, err := cache.GetSupported(context.Background()); err != nil || len(supported.Kinds) != 1 || changes != 1 {
+		t.Errorf("stale GetSupported() = %+v, %v, changes %d", supported, err, changes)
+	}
+
+	facilitator.down = false
+	facilitator.kinds = append(facilitator.kinds, x402.SupportedKind{Scheme: "exact", Network: "eip155:84532"})
+	cache.Refresh(context.Background())
+	if changes != 2 {
+		t.Errorf("changes = %d after a new kind, want 2", changes)
+	}
+}
+
+func TestDiffKinds(t *testing.T) {
+	before := []x402.SupportedKind{{Scheme: "exact", Network: "eip155:8453"}, {Scheme: "exact", Network: "eip155:84532"}}
+	after := []x402.SupportedKind{{Scheme: "exact", Network: "eip155:8453"}, {Scheme: "upto", Network: "eip155:8453"}}
+	added, removed := diffKinds(before, after)
+	if len(added) != 1 || added[0] != "upto@eip155:8453" || len(removed) != 1 || removed[0] != "exact@eip155:84532" {
+		t.Errorf("diffKinds() = %v, %v", added, removed)
+	}
+}
+
+func TestUnsupportedSchemes(t *testing.T) {
+	config := &ServerConfig{
+		Schemes: []SchemeRegistration{{Network: "eip155:8453", Scheme: "exact"}, {Network: "eip155:84532", Scheme: "exact"}},
+		Routes: map[string]RouteFileConfig{
+			"GET /weather": {Accepts: []PaymentOptionConfig{{Scheme: "exact", Network: "eip155:84532"}}},
+		},
+	}
+	problems := config.UnsupportedSchemes(x402.SupportedResponse{Kinds: []x402.SupportedKind{{Scheme: "exact", Network: "eip155:8453"}}})
+	if len(problems) != 2 {
+		t.Errorf("UnsupportedSchemes() = %q", problems)
+	}
+}
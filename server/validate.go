@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	x402 "github.com/coinbase/x402/go"
+	x402http "github.com/coinbase/x402/go/http"
+)
+
+// validateConfig runs every check a payment config has to pass before it is
+// served: routes, prices and payees (see RoutesConfig), that this server
+// implements the registered schemes, the free-tier and access-group
+// sections, and, when supported is known, that a facilitator supports every
+// scheme and route option. Every problem found is reported.
+//
+// Args:
+//
+//	config: payment config
+//	priceFuncs: price functions routes may name in pricing
+//	servers: creates the server side of a scheme for a network
+//	supported: the facilitators' supported kinds, nil when unknown
+//
+// Returns:
+//
+//	Problems, sorted; none if the config is valid
+func validateConfig(config *ServerConfig, priceFuncs map[string]PriceFunc, servers func(scheme string, network x402.Network) (x402.SchemeNetworkServer, error), supported *x402.SupportedResponse) []string {
+	_, problems := config.routes(priceFuncs)
+
+	for _, registration := range config.Schemes {
+		if _, err := servers(registration.Scheme, x402.Network(registration.Network)); err != nil {
+			problems = append(problems, fmt.Sprintf("scheme %s on %s: %v", registration.Scheme, registration.Network, err))
+		}
+	}
+	if _, err := config.FreeTierPolicy(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := config.AccessGroupPolicies(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	// Session deposits are always paid to the EVM payee
+	if address := config.Payees["evm"]; address == "" {
+		problems = append(problems, `payee "evm" is required to take session deposits`)
+	} else if err := checkPayTo(string(sessionDepositNetwork), address); err != nil {
+		problems = append(problems, fmt.Sprintf(`payee "evm": %v`, err))
+	}
+	if supported != nil {
+		problems = append(problems, config.UnsupportedSchemes(*supported)...)
+	}
+
+	sort.Strings(problems)
+	return problems
+}
+
+// runValidate implements "server validate [config]": it checks a payment
+// config as the server does at startup, without starting it. Supported
+// kinds are fetched from the facilitators when FACILITATOR_URL is set, and
+// Solana payees' USDC accounts are looked up.
+//
+// Args:
+//
+//	args: command-line arguments after "validate"
+//
+// Returns:
+//
+//	Exit code: 0 if the config is valid, 1 otherwise
+func runValidate(args []string) int {
+	configPath := os.Getenv("ROUTES_CONFIG")
+	if len(args) > 0 {
+		configPath = args[0]
+	}
+	if configPath == "" {
+		configPath = DefaultRoutesConfigFile
+	}
+	fmt.Printf("Validating %s\n", configPath)
+
+	config, err := loadServerConfig(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	priceOracle, err := priceOracleFromEnv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to create price oracle: %v\n", err)
+		return 1
+	}
+
+	var supported *x402.SupportedResponse
+	if facilitatorURL := os.Getenv("FACILITATOR_URL"); facilitatorURL == "" {
+		fmt.Println("Warning: FACILITATOR_URL not set, supported payment kinds are not checked")
+	} else {
+		var auth x402http.AuthProvider
+		if keyID, keySecret := os.Getenv("CDP_API_KEY_ID"), os.Getenv("CDP_API_KEY_SECRET"); keyID != "" || keySecret != "" {
+			cdpAuth, err := NewCDPAuthProvider(keyID, keySecret, facilitatorURL)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				return 1
+			}
+			auth = cdpAuth
+		}
+		facilitators := newFacilitators(facilitatorURL, auth)
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		fetched, err := facilitators.GetSupported(ctx)
+		cancel()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to fetch supported payment kinds: %v\n", err)
+			return 1
+		}
+		supported = &fetched
+	}
+
+	problems := validateConfig(config, priceFuncs, schemeServers(NewNativeScheme(priceOracle)), supported)
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	problems = append(problems, newPayeeAccounts().Check(ctx, config)...)
+	cancel()
+	if len(problems) > 0 {
+		fmt.Printf("%s has %d problems:\n", configPath, len(problems))
+		for _, problem := range problems {
+			fmt.Printf("  - %s\n", problem)
+		}
+		return 1
+	}
+	fmt.Printf("%s is valid\n", configPath)
+	return 0
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	x402 "github.com/coinbase/x402/go"
+)
+
+func TestValidateConfig(t *testing.T) {
+	t.Setenv("EVM_PAYEE_ADDRESS", "0x00000000000000000000000000000000000000aa")
+	t.Setenv("SVM_PAYEE_ADDRESS", "9WzDXwBbmkg8ZTbNMqUxvQRAyrZzDsGYdLVL9zYtAWWM")
+	servers := schemeServers(NewNativeScheme(nil))
+
+	config, err := loadServerConfig("routes.yaml")
+	if err != nil {
+		t.Fatalf("loadServerConfig() error = %v", err)
+	}
+	supported := x402.SupportedResponse{}
+	for _, scheme := range config.Schemes {
+		supported.Kinds = append(supported.Kinds, x402.SupportedKind{Scheme: scheme.Scheme, Network: scheme.Network})
+	}
+	if problems := validateConfig(config, priceFuncs, servers, &supported); len(problems) > 0 {
+		t.Errorf("shipped config: %q", problems)
+	}
+
+	// The testnet mismatch: a route on networks no scheme is registered on
+	// and no facilitator supports, with the payees swapped
+	config.Routes["GET /weather"] = RouteFileConfig{Accepts: []PaymentOptionConfig{
+		{Scheme: "exact", Network: "eip155:84532", PayTo: "svm", Price: "$0.001"},
+		{Scheme: "exact", Network: "solana:EtWTRABZaYq6iMfeYKouRu166VU2xqa1", PayTo: "evm", Price: "$0.001"},
+	}}
+	config.Schemes = append(config.Schemes, SchemeRegistration{Network: "solana:5eykt4UsFv8P8NJdTREpY1vzqKqZKvdp", Scheme: SchemeUpto})
+	config.Payees["evm"] = ""
+
+	problems := strings.Join(validateConfig(config, priceFuncs, servers, &supported), "\n")
+	for _, want := range []string{
+		`route "GET /weather" option 1: scheme exact is not registered on eip155:84532`,
+		`route "GET /weather" option 1: payTo "9WzDXwBbmkg8ZTbNMqUxvQRAyrZzDsGYdLVL9zYtAWWM" is a Solana address, are the EVM and Solana payees swapped?`,
+		`route "GET /weather" option 2: payTo is empty`,
+		`route "GET /weather" option 1: no facilitator supports exact on eip155:84532`,
+		`scheme upto on solana:5eykt4UsFv8P8NJdTREpY1vzqKqZKvdp: not supported by this server`,
+		`payee "evm" is required to take session deposits`,
+	} {
+		if !strings.Contains(problems, want) {
+			t.Errorf("problems do not mention %q:\n%s", want, problems)
+		}
+	}
+
+	// Without supported kinds the facilitator check is skipped
+	if problems := validateConfig(config, priceFuncs, servers, nil); strings.Contains(strings.Join(problems, "\n"), "no facilitator") {
+		t.Errorf("facilitator problems without supported kinds: %q", problems)
+	}
+}
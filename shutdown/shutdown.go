@@ -0,0 +1,84 @@
+// Package shutdown runs the HTTP servers of the binaries until they are
+// asked to stop, then lets the requests in flight finish.
+package shutdown
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// InFlightTracker counts requests that are currently being handled
+type InFlightTracker struct {
+	count atomic.Int64
+}
+
+// Middleware returns a gin middleware that keeps the in-flight count up to date
+func (t *InFlightTracker) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		t.count.Add(1)
+		defer t.count.Add(-1)
+		c.Next()
+	}
+}
+
+// Count returns the number of requests currently being handled
+func (t *InFlightTracker) Count() int64 {
+	return t.count.Load()
+}
+
+// ServeUntilSignal runs srv until SIGINT or SIGTERM is received, then stops
+// accepting new requests and waits up to timeout for in-flight ones to finish.
+// A second signal during the drain terminates the process immediately.
+//
+// Args:
+//
+//	srv: HTTP server to run
+//	tracker: in-flight request tracker used for progress reporting (may be nil)
+//	timeout: maximum time to wait for in-flight requests
+//
+// Returns:
+//
+//	error if the server failed to start or did not drain in time
+func ServeUntilSignal(srv *http.Server, tracker *InFlightTracker, timeout time.Duration) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			serveErr <- err
+		}
+		close(serveErr)
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-serveErr:
+		stop()
+		return err
+	case <-ctx.Done():
+	}
+	// Restore default signal handling so a second Ctrl+C kills the process
+	stop()
+
+	if tracker != nil {
+		slog.Info("shutting down, draining in-flight requests", "in_flight", tracker.Count())
+	} else {
+		slog.Info("shutting down, draining in-flight requests")
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("failed to drain in-flight requests: %w", err)
+	}
+	return nil
+}
@@ -5,11 +5,17 @@ import (
 	"fmt"
 	"log"
 	"os"
+
+	"github.com/joho/godotenv"
 )
 
 func main() {
-	// 直接从 .env 文件读取
-	keySecret := "c4KyNT9OwYiMOXxYzEy/lekTj8+QJv7dDeO1psK6rctkk4NUC4JgNs8L1K7xoO7TJhI/7HTwPREkxGT+0IFbg=="
+	// Read from the environment (or .env); never paste a key secret here
+	godotenv.Load("server/.env")
+	keySecret := os.Getenv("CDP_API_KEY_SECRET")
+	if keySecret == "" {
+		log.Fatal("CDP_API_KEY_SECRET environment variable is required")
+	}
 
 	// Decode base64 key
 	decoded, err := base64.StdEncoding.DecodeString(keySecret)
@@ -2,27 +2,40 @@ package main
 
 import (
 	"fmt"
+	"log/slog"
 	"os"
 
 	x402 "github.com/coinbase/x402/go"
 	"github.com/joho/godotenv"
+	"go_code/x402/logging"
 )
 
 func main() { // Load .env file if it exists
-	if err := godotenv.Load(); err != nil {
-		fmt.Println("No .env file found, using environment variables")
+	envErr := godotenv.Load()
+	// Redact secrets from everything printed from here on
+	installErr := logging.Install()
+	defer logging.Close()
+	if _, err := logging.Setup("zkstash"); err != nil {
+		fmt.Println(err)
+		logging.Exit(1)
+	}
+	if installErr != nil {
+		slog.Warn("output is not redacted", "error", installErr)
+	}
+	logging.WarnSecretsInSource()
+	if envErr != nil {
+		slog.Info("no .env file found, using environment variables")
 	}
 	pattern := "mechanism-helper-registration"
 	if len(os.Args) > 1 {
 		pattern = os.Args[1]
 	}
-	fmt.Printf("\nRunning example: %s\n\n", pattern)
+	slog.Info("running example", "pattern", pattern)
 
 	// Get configuration
 	evmPrivateKey := os.Getenv("EVM_PRIVATE_KEY")
 	if evmPrivateKey == "" {
-		fmt.Println("❌ EVM_PRIVATE_KEY environment variable is required")
-		os.Exit(1)
+		logging.Fatal("EVM_PRIVATE_KEY environment variable is required")
 	}
 	svmPrivateKey := os.Getenv("SVM_PRIVATE_KEY")
 
@@ -41,20 +54,17 @@ func main() { // Load .env file if it exists
 	case "mechanism-helper-registration":
 		client, err = createMechanismHelperRegistrationClient(evmPrivateKey, svmPrivateKey)
 	default:
-		fmt.Printf("❌ Unknown pattern: %s\n", pattern)
-		fmt.Println("Available patterns: builder-pattern, mechanism-helper-registration")
-		os.Exit(1)
+		logging.Fatal("unknown pattern", "pattern", pattern,
+			"available", "builder-pattern, mechanism-helper-registration")
 	}
 
 	if err != nil {
-		fmt.Printf("❌ Failed to create client: %v\n", err)
-		os.Exit(1)
+		logging.Fatal("failed to create client", "error", err)
 	}
 
 	ZkStashClientWithPayment, err := NewZkStashClientWithPayment(evmPrivateKey, url, client)
 	if err != nil {
-		fmt.Printf("❌ Failed to create ZkStashClientWithPayment: %v\n", err)
-		os.Exit(1)
+		logging.Fatal("failed to create ZkStashClientWithPayment", "error", err)
 	}
 	// Make the request
 
@@ -73,8 +83,7 @@ func main() { // Load .env file if it exists
 			},
 		})
 	if err != nil {
-		fmt.Printf("%v\n", err)
-		os.Exit(1)
+		logging.Fatal("failed to create memories", "error", err)
 	}
-	fmt.Printf("✅ Response: %+v\n", resp)
+	slog.Info("memories created", "response", resp)
 }
@@ -6,6 +6,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net/http"
 
 	x402 "github.com/coinbase/x402/go"
@@ -49,6 +50,20 @@ func extractPaymentResponse(headers http.Header) (*x402.SettleResponse, error) {
 	return &settleResp, nil
 }
 
+// logPaymentResponse logs the settlement the server reported in the
+// PAYMENT-RESPONSE (v2) or X-PAYMENT-RESPONSE (v1) header, if any
+func logPaymentResponse(headers http.Header) {
+	settleResp, err := extractPaymentResponse(headers)
+	if err != nil {
+		slog.Warn("unreadable payment response header", "error", err)
+		return
+	}
+	if settleResp == nil {
+		return
+	}
+	slog.Info("payment settled", "tx", settleResp.Transaction, "network", settleResp.Network, "payer", settleResp.Payer)
+}
+
 // hashBody 对请求体进行SHA256哈希
 func hashBody(body interface{}) (string, error) {
 	var bodyString string
@@ -64,11 +79,3 @@ func hashBody(body interface{}) (string, error) {
 	hash := sha256.Sum256([]byte(bodyString))
 	return hex.EncodeToString(hash[:]), nil
 }
-
-// min 返回两个整数中的较小值
-func min(a, b int) int {
-	if a < b {
-		return a
-	}
-	return b
-}
@@ -8,6 +8,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"strconv"
 	"strings"
@@ -126,7 +127,7 @@ func (c *ZkStashClientWithPayment) CreateMemories(req *CreateMemoriesRequest) (*
 func (c *ZkStashClientWithPayment) makeRequestWithResponse(method, path, body string) ([]byte, error) {
 	httpClient := wrapHTTPClient(c.httpClient)
 
-	fmt.Printf("Making request to: %s\n\n", c.rpcURL+path)
+	slog.Info("making request", "method", method, "url", c.rpcURL+path)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
@@ -155,60 +156,20 @@ func (c *ZkStashClientWithPayment) makeRequestWithResponse(method, path, body st
 		return nil, fmt.Errorf("failed to read response body: %w", err)
 	}
 
-	fmt.Printf("Response Status: %d %s\n", resp.StatusCode, resp.Status)
-	fmt.Printf("Response Body Length: %d bytes\n", len(bodyBytes))
+	slog.Info("response", "status", resp.StatusCode, "bytes", len(bodyBytes))
 
-	// Check if response body is empty
-	if len(bodyBytes) == 0 {
-		fmt.Println("⚠️  Response body is empty")
-		// Extract payment response from headers if present
-		paymentHeader := resp.Header.Get("PAYMENT-RESPONSE")
-		if paymentHeader == "" {
-			paymentHeader = resp.Header.Get("X-PAYMENT-RESPONSE")
-		}
+	logPaymentResponse(resp.Header)
 
-		if paymentHeader != "" {
-			fmt.Println("\n💰 Payment Details:")
-			settleResp, err := extractPaymentResponse(resp.Header)
-			if err == nil {
-				fmt.Printf("  Transaction: %s\n", settleResp.Transaction)
-				fmt.Printf("  Network: %s\n", settleResp.Network)
-				fmt.Printf("  Payer: %s\n", settleResp.Payer)
-			} else {
-				fmt.Printf("  Payment Header: %s\n", paymentHeader[:min(100, len(paymentHeader))])
-			}
-		}
+	if len(bodyBytes) == 0 {
+		slog.Warn("response body is empty")
 		return bodyBytes, nil
 	}
 
-	// Try to decode response body as JSON
-	var responseData interface{}
-	if err := json.Unmarshal(bodyBytes, &responseData); err != nil {
-		// If JSON decoding fails, print raw response
-		fmt.Printf("⚠️  Failed to decode as JSON, showing raw response:\n")
-		fmt.Printf("  %s\n", string(bodyBytes))
-		return bodyBytes, fmt.Errorf("failed to decode response as JSON: %w", err)
-	}
-
-	fmt.Println("✅ Response body:")
-	prettyJSON, _ := json.MarshalIndent(responseData, "  ", "  ")
-	fmt.Printf("  %s\n", string(prettyJSON))
-
-	// Extract payment response from headers if present
-	paymentHeader := resp.Header.Get("PAYMENT-RESPONSE")
-	if paymentHeader == "" {
-		paymentHeader = resp.Header.Get("X-PAYMENT-RESPONSE")
-	}
-
-	if paymentHeader != "" {
-		fmt.Println("\n💰 Payment Details:")
-		settleResp, err := extractPaymentResponse(resp.Header)
-		if err == nil {
-			fmt.Printf("  Transaction: %s\n", settleResp.Transaction)
-			fmt.Printf("  Network: %s\n", settleResp.Network)
-			fmt.Printf("  Payer: %s\n", settleResp.Payer)
-		}
+	if !json.Valid(bodyBytes) {
+		slog.Warn("response is not JSON", "body", string(bodyBytes))
+		return bodyBytes, fmt.Errorf("failed to decode response as JSON")
 	}
+	slog.Info("response body", "body", string(bodyBytes))
 
 	return bodyBytes, nil
 }
@@ -331,7 +292,7 @@ func (c *ZkStashClientWithPayment) signSolanaMessages(message string) (signature
 func (c *ZkStashClientWithPayment) makeRequest(client *x402.X402Client, path, method, body string) error {
 	httpClient := wrapHTTPClient(client)
 
-	fmt.Printf("Making request to: %s\n\n", c.rpcURL+path)
+	slog.Info("making request", "method", method, "url", c.rpcURL+path)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
@@ -359,60 +320,20 @@ func (c *ZkStashClientWithPayment) makeRequest(client *x402.X402Client, path, me
 		return fmt.Errorf("failed to read response body: %w", err)
 	}
 
-	fmt.Printf("Response Status: %d %s\n", resp.StatusCode, resp.Status)
-	fmt.Printf("Response Body Length: %d bytes\n", len(bodyBytes))
+	slog.Info("response", "status", resp.StatusCode, "bytes", len(bodyBytes))
 
-	// Check if response body is empty
-	if len(bodyBytes) == 0 {
-		fmt.Println("⚠️  Response body is empty")
-		// Extract payment response from headers if present
-		paymentHeader := resp.Header.Get("PAYMENT-RESPONSE")
-		if paymentHeader == "" {
-			paymentHeader = resp.Header.Get("X-PAYMENT-RESPONSE")
-		}
+	logPaymentResponse(resp.Header)
 
-		if paymentHeader != "" {
-			fmt.Println("\n💰 Payment Details:")
-			settleResp, err := extractPaymentResponse(resp.Header)
-			if err == nil {
-				fmt.Printf("  Transaction: %s\n", settleResp.Transaction)
-				fmt.Printf("  Network: %s\n", settleResp.Network)
-				fmt.Printf("  Payer: %s\n", settleResp.Payer)
-			} else {
-				fmt.Printf("  Payment Header: %s\n", paymentHeader[:min(100, len(paymentHeader))])
-			}
-		}
+	if len(bodyBytes) == 0 {
+		slog.Warn("response body is empty")
 		return nil
 	}
 
-	// Try to decode response body as JSON
-	var responseData interface{}
-	if err := json.Unmarshal(bodyBytes, &responseData); err != nil {
-		// If JSON decoding fails, print raw response
-		fmt.Printf("⚠️  Failed to decode as JSON, showing raw response:\n")
-		fmt.Printf("  %s\n", string(bodyBytes))
-		return fmt.Errorf("failed to decode response as JSON: %w", err)
-	}
-
-	fmt.Println("✅ Response body:")
-	prettyJSON, _ := json.MarshalIndent(responseData, "  ", "  ")
-	fmt.Printf("  %s\n", string(prettyJSON))
-
-	// Extract payment response from headers if present
-	paymentHeader := resp.Header.Get("PAYMENT-RESPONSE")
-	if paymentHeader == "" {
-		paymentHeader = resp.Header.Get("X-PAYMENT-RESPONSE")
-	}
-
-	if paymentHeader != "" {
-		fmt.Println("\n💰 Payment Details:")
-		settleResp, err := extractPaymentResponse(resp.Header)
-		if err == nil {
-			fmt.Printf("  Transaction: %s\n", settleResp.Transaction)
-			fmt.Printf("  Network: %s\n", settleResp.Network)
-			fmt.Printf("  Payer: %s\n", settleResp.Payer)
-		}
+	if !json.Valid(bodyBytes) {
+		slog.Warn("response is not JSON", "body", string(bodyBytes))
+		return fmt.Errorf("failed to decode response as JSON")
 	}
+	slog.Info("response body", "body", string(bodyBytes))
 
 	return nil
 }